@@ -22,6 +22,7 @@ import (
 	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/spf13/cast"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/sync/syncmap"
@@ -29,6 +30,7 @@ import (
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
 	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
 	flag "github.com/eekwong/go-common-flags"
 )
 
@@ -49,42 +51,31 @@ e = some(where (p.eft == allow))
 [matchers]
 m = g(r.sub, "admin") || g(r.sub, p.sub) && globMatch(r.obj, p.obj) && r.act == p.act
 `
-)
-
-var newPolicies = [][]string{
-	{"user", "/api/v1/repos", "POST"},
-	{"user", "/api/v1/repos/*", "POST"},
-	{"user", "/api/v1/columns", "GET"},
-	{"user", "/api/v1/owners", "GET"},
-	{"user", "/api/v1/userview", "GET"},
-	{"user", "/api/v1/userview", "PUT"},
-	{"user", "/ws", "GET"},
-	{"owneradmin", "/api/v1/repos/action/repo-owner", "POST"},
-	{"owneradmin", "/api/v1/repos/action/delete-owner/*", "POST"},
-	{"owneradmin", "/api/v1/owners", "POST"},
-	{"owneradmin", "/api/v1/owner/*", "DELETE"},
-	{"owneradmin", "/api/v1/owner/*", "PUT"},
-}
 
-var rolesDefined = map[string]struct{}{
-	"admin":      {},
-	"user":       {},
-	"owneradmin": {},
-}
+	// policyReloadInterval is how often the policies changed by the other replicas are loaded
+	policyReloadInterval = 10 * time.Second
+)
 
 type api struct {
 	ctx                    context.Context
 	db                     *mongo.Database
 	dbw                    db.Database
 	g                      gh.GitHub
-	key                    []byte
+	key                    *security.Keyring
 	clients                syncmap.Map
 	store                  *session.Store
+	sessions               *db.SessionStorage
 	oktaOpts               *flag.OktaOpts
-	enforcer               *casbin.Enforcer
+	groupsClaim            string
+	enforcer               *casbin.SyncedEnforcer
 	loggedCache            *expirable.LRU[string, time.Time]
+	localAuthCache         *expirable.LRU[string, struct{}]
 	mu                     sync.Mutex
 	getUsernameFromSession func(c *fiber.Ctx) (string, error)
+	hooks                  HookTester
+	images                 ImageChecker
+	// executors are the executors the hooks can choose from
+	executors []string
 }
 
 func NewFiberApp(
@@ -92,10 +83,14 @@ func NewFiberApp(
 	db *mongo.Database,
 	dbw db.Database,
 	g gh.GitHub,
-	key []byte,
+	key *security.Keyring,
+	sessions *db.SessionStorage,
 	adminUsernames []string,
-	adminPasswords []string,
 	oktaOpts *flag.OktaOpts,
+	groupsClaim string,
+	hooks HookTester,
+	images ImageChecker,
+	executors []string,
 ) *fiber.App {
 	app := fiber.New()
 	app.Use(compress.New())
@@ -106,19 +101,29 @@ func NewFiberApp(
 		Expiration:   time.Hour,
 		KeyLookup:    "cookie:session_id",
 		KeyGenerator: utils.UUID,
+		Storage:      sessions,
 	})
 
 	a := api{
-		ctx:         ctx,
-		db:          db,
-		dbw:         dbw,
-		g:           g,
-		key:         key,
-		clients:     syncmap.Map{},
-		store:       store,
-		oktaOpts:    oktaOpts,
-		loggedCache: expirable.NewLRU[string, time.Time](1000, nil, time.Hour),
+		ctx:            ctx,
+		db:             db,
+		dbw:            dbw,
+		g:              g,
+		key:            key,
+		clients:        syncmap.Map{},
+		store:          store,
+		sessions:       sessions,
+		oktaOpts:       oktaOpts,
+		groupsClaim:    groupsClaim,
+		hooks:          hooks,
+		images:         images,
+		executors:      executors,
+		loggedCache:    expirable.NewLRU[string, time.Time](1000, nil, time.Hour),
+		localAuthCache: expirable.NewLRU[string, struct{}](1000, nil, localAuthCacheTTL),
 		getUsernameFromSession: func(c *fiber.Ctx) (string, error) {
+			if token := getTokenFromLocals(c); token != nil {
+				return token.Username, nil
+			}
 			sess, err := store.Get(c)
 			if err != nil || sess.Get("username") == nil || cast.ToString(sess.Get("username")) == "" {
 				return "", c.SendStatus(fiber.StatusForbidden)
@@ -137,6 +142,10 @@ func NewFiberApp(
 
 	// casbin
 	a.settingUpCasbinEnforcer()
+	go a.runPolicyReload()
+
+	// api tokens
+	app.Use(a.tokenAuthenticator())
 
 	if oktaOpts.IsEnabled() {
 		app.Get("/login", a.oktaLogin)
@@ -145,63 +154,52 @@ func NewFiberApp(
 		app.Use(a.oktaAuthenticator())
 
 		app.Static("/", filesDir)
-
-		for _, username := range adminUsernames {
-			slog.Info("adding admin", slog.String("username", username))
-			if _, err := a.enforcer.AddRoleForUser(username, "admin"); err != nil {
-				slog.Error("error in adding admins", slog.String("err", err.Error()))
-				panic(err)
-			}
-		}
-		a.enforcer.SavePolicy()
-
-		app.Use(func(c *fiber.Ctx) error {
-			sess, err := store.Get(c)
-			if err != nil || sess.Get("username") == nil || cast.ToString(sess.Get("username")) == "" {
-				return c.SendStatus(fiber.StatusForbidden)
-			}
-			r, err := a.enforcer.Enforce(
-				cast.ToString(sess.Get("username")),
-				string(c.Request().URI().Path()),
-				string(c.Request().Header.Method()),
-			)
-			if err != nil {
-				return c.SendStatus(fiber.StatusInternalServerError)
-			}
-			if !r {
-				return c.SendStatus(fiber.StatusForbidden)
-			}
-			return c.Next()
-		})
 	} else {
-		// check both slice length is the same
-		if len(adminUsernames) != len(adminPasswords) {
-			panic("admin usernames and passwords should have the same size")
-		}
-
-		users := make(map[string]string)
-		for idx, username := range adminUsernames {
-			users[username] = adminPasswords[idx]
-		}
+		// the users are in the local user store, seeded from the admin flags by SeedLocalUsers
 		app.Use(basicauth.New(basicauth.Config{
-			Users: users,
+			Next: func(c *fiber.Ctx) bool {
+				return getTokenFromLocals(c) != nil
+			},
+			Authorizer: a.localUserAuthorizer,
 		}))
 		app.Use(func(c *fiber.Ctx) error {
+			if getTokenFromLocals(c) != nil {
+				return c.Next()
+			}
 			sess, err := store.Get(c)
 			if err != nil {
 				return c.SendStatus(fiber.StatusForbidden)
 			}
-			sess.Set("username", c.Locals("username"))
-			sess.Save()
+			// only persist the session on login, it's shared across the replicas
+			username := cast.ToString(c.Locals("username"))
+			if cast.ToString(sess.Get("username")) != username {
+				sess.Set("username", username)
+				if err := sess.Save(); err != nil {
+					return err
+				}
+				if err := sessions.SetUsername(sess.ID(), username); err != nil {
+					slog.Error("error in setting the session username", slog.String("error", err.Error()))
+				}
+			}
 			return c.Next()
 		})
 
 		app.Static("/", filesDir)
 	}
 
+	for _, username := range adminUsernames {
+		slog.Info("adding admin", slog.String("username", username))
+		if _, err := a.enforcer.AddRoleForUser(username, "admin"); err != nil {
+			slog.Error("error in adding admins", slog.String("err", err.Error()))
+			panic(err)
+		}
+	}
+
+	app.Use(a.authorizer())
+
 	app.Get("/ws", websocket.New(func(c *websocket.Conn) {
 		slog.Info("WebSocket connection established")
-		a.clients.Store(c, true)
+		a.clients.Store(c, c.Locals(scopeLocalsKey))
 		defer func() {
 			a.clients.Delete(c)
 			c.Close()
@@ -226,24 +224,52 @@ func NewFiberApp(
 	v1.Delete("/automation/:id", a.DeleteAutomation)
 	v1.Delete("/column/:id", a.DeleteColumn)
 	v1.Delete("/custom/:id", a.DeleteCustom)
+	v1.Delete("/custom/:id/cache", a.InvalidateCustomCache)
 	v1.Delete("/owner/:id", a.DeleteOwner)
+	v1.Delete("/roledefinition/:name", a.DeleteRoleDefinition)
+	v1.Delete("/rolemapping/:id", a.DeleteRoleMapping)
+	v1.Delete("/rolescope/:id", a.DeleteRoleScope)
+	v1.Delete("/session/:id", a.DeleteSession)
+	v1.Delete("/token/:id", a.DeleteToken)
+	v1.Delete("/user/:name/sessions", a.DeleteUserSessions)
 	v1.Get("/automations", a.GetAutomations)
 	v1.Get("/columns", a.GetColumns)
 	v1.Get("/customs", a.GetCustoms)
 	v1.Get("/globalsettings", a.GetGlobalSettings)
+	v1.Get("/hookrun/:id", a.GetHookRun)
+	v1.Get("/hookruns", a.GetHookRuns)
+	v1.Get("/hookschedules", a.GetHookSchedules)
 	v1.Get("/logged", a.GetLoggeds)
 	v1.Get("/owners", a.GetOwners)
+	v1.Get("/permissions", a.GetPermissions)
+	v1.Get("/roledefinitions", a.GetRoleDefinitions)
+	v1.Get("/rolemappings", a.GetRoleMappings)
 	v1.Get("/roles", a.GetRoles)
+	v1.Get("/rolescopes", a.GetRoleScopes)
+	v1.Get("/sessions", a.GetSessions)
+	v1.Get("/tokens", a.GetTokens)
 	v1.Get("/users", a.GetUsers)
 	v1.Get("/userview", a.GetUserView)
+	v1.Post("/auditlog", a.GetAuditLog)
 	v1.Post("/automations", a.CreateAutomation)
+	v1.Post("/automations/preview", a.PreviewAutomation)
+	v1.Post("/automations/test", a.TestAutomation)
+	v1.Post("/automation/:id/reveal", a.RevealAutomationEnvs)
+	v1.Post("/automation/:id/run", a.RunAutomation)
 	v1.Post("/changelog", a.GetChangelog)
 	v1.Post("/changelog/:groupBy", a.GetChangelogGroupBy)
 	v1.Post("/columns", a.CreateColumn)
 	v1.Post("/customs", a.CreateCustom)
+	v1.Post("/customs/preview", a.PreviewCustom)
+	v1.Post("/customs/test", a.TestCustom)
+	v1.Post("/custom/:id/reveal", a.RevealCustomEnvs)
+	v1.Post("/custom/:id/run", a.RunCustom)
 	v1.Post("/columns/order", a.ChangeColumnsOrder)
 	v1.Post("/owners", a.CreateOwner)
 	v1.Post("/repos", a.GetRepositories)
+	v1.Post("/roledefinitions", a.CreateRoleDefinition)
+	v1.Post("/rolemappings", a.CreateRoleMapping)
+	v1.Post("/tokens", a.CreateToken)
 	v1.Post("/repos/:groupBy", a.GetRepositoriesGroupBy)
 	v1.Post("/repos/action/add-branch-protection-rule", a.AddBranchProtectionRule)
 	v1.Post("/repos/action/admin-enforced", a.IsAdminEnforced)
@@ -266,45 +292,187 @@ func NewFiberApp(
 	v1.Put("/custom/:id", a.UpdateCustom)
 	v1.Put("/globalsettings", a.UpdateGlobalSettings)
 	v1.Put("/owner/:id", a.UpdateOwner)
+	v1.Put("/roledefinition/:name", a.UpdateRoleDefinition)
+	v1.Put("/rolemapping/:id", a.UpdateRoleMapping)
+	v1.Put("/rolescope", a.UpdateRoleScope)
 	v1.Put("/user/:name", a.UpdateUserRoles)
 	v1.Put("/userview", a.UpdateUserView)
 
 	return app
 }
 
-func (a *api) settingUpCasbinEnforcer() {
-	// clear all policies
-	// RemovePolicies doesn't work with wildcard, we saw left over rules
-	if _, err := a.db.Collection("casbin_rule").DeleteMany(a.ctx, bson.D{{Key: "ptype", Value: "p"}}); err != nil {
-		slog.Error("error in deleting the policies", slog.String("error", err.Error()))
-		panic(err)
-	}
-
-	adapter, err := mongodbadapter.NewAdapterByDB(a.db.Client(), &mongodbadapter.AdapterConfig{
-		DatabaseName:   a.db.Name(),
+// newEnforcer returns a synced enforcer as the roles and their mappings change it at runtime.
+// The enforcer saves each rule it changes, the other replicas load them every
+// policyReloadInterval.
+func newEnforcer(db *mongo.Database) (*casbin.SyncedEnforcer, error) {
+	adapter, err := mongodbadapter.NewAdapterByDB(db.Client(), &mongodbadapter.AdapterConfig{
+		DatabaseName:   db.Name(),
 		CollectionName: "casbin_rule",
 	})
 	if err != nil {
 		slog.Error("error in creating mongodb casbin adapter", slog.String("err", err.Error()))
-		panic(err)
+		return nil, err
 	}
 	m, err := model.NewModelFromString(modelConf)
 	if err != nil {
 		slog.Error("error in creating casbin model from string", slog.String("err", err.Error()))
-		panic(err)
+		return nil, err
 	}
-	a.enforcer, err = casbin.NewEnforcer(m, adapter)
+	enforcer, err := casbin.NewSyncedEnforcer(m, adapter)
 	if err != nil {
 		slog.Error("error in creating Enforcer", slog.String("err", err.Error()))
+		return nil, err
+	}
+	return enforcer, nil
+}
+
+func (a *api) settingUpCasbinEnforcer() {
+	var err error
+	a.enforcer, err = newEnforcer(a.db)
+	if err != nil {
 		panic(err)
 	}
-	a.enforcer.LoadPolicy()
-	if _, err := a.enforcer.AddPolicies(newPolicies); err != nil {
-		slog.Error("error in adding policies", slog.String("err", err.Error()))
+	if err := a.resetPolicies(); err != nil {
+		slog.Error("error in resetting the policies", slog.String("err", err.Error()))
 		panic(err)
 	}
 }
 
+// resetPolicies recreates all the policies from the built-in and custom roles
+func (a *api) resetPolicies() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	policies, err := a.allPolicies()
+	if err != nil {
+		return err
+	}
+	return a.replacePolicies(bson.D{}, policies)
+}
+
+// replacePolicies replaces the policies matching the filter by the ones given and loads them.
+// The rules are changed in place so that the replicas loading the policies meanwhile never
+// miss the ones kept, and the rules added at once by another replica are skipped by the
+// unique index of the rules.
+func (a *api) replacePolicies(filter bson.D, policies [][]string) error {
+	// RemovePolicies doesn't work with wildcard, the rules are changed in the collection
+	cursor, err := a.db.Collection("casbin_rule").Find(a.ctx, append(bson.D{{Key: "ptype", Value: "p"}}, filter...))
+	if err != nil {
+		return err
+	}
+	var rules []struct {
+		ID                        primitive.ObjectID `bson:"_id"`
+		mongodbadapter.CasbinRule `bson:",inline"`
+	}
+	if err := cursor.All(a.ctx, &rules); err != nil {
+		return err
+	}
+
+	wanted := make(map[mongodbadapter.CasbinRule]bool, len(policies))
+	for _, policy := range policies {
+		wanted[policyRule(policy)] = true
+	}
+	stale := make([]primitive.ObjectID, 0)
+	for _, rule := range rules {
+		if wanted[rule.CasbinRule] {
+			delete(wanted, rule.CasbinRule)
+		} else {
+			stale = append(stale, rule.ID)
+		}
+	}
+	if len(stale) > 0 {
+		if _, err := a.db.Collection("casbin_rule").DeleteMany(
+			a.ctx,
+			bson.D{{Key: "_id", Value: bson.M{"$in": stale}}},
+		); err != nil {
+			return err
+		}
+	}
+	if len(wanted) > 0 {
+		missing := make([]interface{}, 0, len(wanted))
+		for rule := range wanted {
+			missing = append(missing, rule)
+		}
+		if _, err := a.db.Collection("casbin_rule").InsertMany(
+			a.ctx,
+			missing,
+			options.InsertMany().SetOrdered(false),
+		); err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return a.enforcer.LoadPolicy()
+}
+
+// policyRule is the stored rule of the policy, as the casbin adapter saves it
+func policyRule(policy []string) mongodbadapter.CasbinRule {
+	rule := mongodbadapter.CasbinRule{PType: "p"}
+	for idx, v := range policy {
+		switch idx {
+		case 0:
+			rule.V0 = v
+		case 1:
+			rule.V1 = v
+		case 2:
+			rule.V2 = v
+		case 3:
+			rule.V3 = v
+		case 4:
+			rule.V4 = v
+		case 5:
+			rule.V5 = v
+		}
+	}
+	return rule
+}
+
+// reloadPolicies loads the policies changed by another replica or the CLI, not in the middle
+// of a change of the policies of this replica
+func (a *api) reloadPolicies() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.enforcer.LoadPolicy()
+}
+
+// runPolicyReload reloads the policies until the server stops, the roles and permissions
+// changed by the other replicas apply here at most policyReloadInterval later
+func (a *api) runPolicyReload() {
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(policyReloadInterval):
+			if err := a.reloadPolicies(); err != nil {
+				slog.Error("error in reloading the policies", slog.String("err", err.Error()))
+			}
+		}
+	}
+}
+
+func (a *api) authorizer() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		username, err := a.getUsernameFromSession(c)
+		if err != nil {
+			return err
+		}
+		r, err := a.enforce(c, username)
+		if err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if !r {
+			return c.SendStatus(fiber.StatusForbidden)
+		}
+		scope, err := a.getRepoScope(c, username)
+		if err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if scope != nil {
+			c.Locals(scopeLocalsKey, scope)
+		}
+		return c.Next()
+	}
+}
+
 func (a *api) broadcastMessage(repo gh.Repository) {
 	// Convert the repo object to a JSON string
 	repoJson, err := json.Marshal(repo)
@@ -320,6 +488,9 @@ func (a *api) broadcastMessage(repo gh.Repository) {
 	// Broadcast the JSON string to all connected WebSocket clients
 	a.clients.Range(func(k, v interface{}) bool {
 		if client, ok := k.(*websocket.Conn); ok {
+			if scope, ok := v.(*repoScope); ok && scope != nil && !scope.match(&repo) {
+				return true
+			}
 			if err := client.WriteMessage(websocket.TextMessage, repoJson); err != nil {
 				slog.Error(
 					"error in socket WriteMessage",
@@ -348,8 +519,20 @@ func (a *api) loggedTime(c *fiber.Ctx) error {
 	a.loggedCache.Add(username, time.Now())
 	a.mu.Unlock()
 
+	// tokens don't have a session
+	sessionID := ""
+	if getTokenFromLocals(c) == nil {
+		sessionID = utils.CopyString(c.Cookies("session_id"))
+	}
+
 	// try updating the database in a background go routine
-	go func(username string) {
+	go func(username, sessionID string) {
+		if sessionID != "" {
+			if err := a.sessions.Touch(sessionID); err != nil {
+				slog.Error("error in updating the session activity", slog.String("err", err.Error()))
+			}
+		}
+
 		now := time.Now()
 		filter := bson.D{
 			{Key: "username", Value: username},
@@ -391,7 +574,7 @@ func (a *api) loggedTime(c *fiber.Ctx) error {
 			slog.Error("error in updating the logged entry", slog.String("err", err.Error()))
 			return
 		}
-	}(username)
+	}(username, sessionID)
 
 	return c.Next()
 }
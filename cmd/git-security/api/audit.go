@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/cast"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+)
+
+const (
+	redactedValue        = "[REDACTED]"
+	redactedChangedValue = "[REDACTED] (changed)"
+)
+
+func (a *api) GetAuditLog(c *fiber.Ctx) error {
+	q := struct {
+		CSV bool `query:"csv"`
+	}{}
+	if err := c.QueryParser(&q); err != nil {
+		return err
+	}
+
+	b := struct {
+		Filters   []Filter `json:"filters"`
+		StartDate int64    `json:"start_date"`
+		EndDate   int64    `json:"end_date"`
+	}{}
+	if err := c.BodyParser(&b); err != nil {
+		return err
+	}
+
+	start := time.Now().AddDate(0, 0, -30)
+	if b.StartDate > 0 {
+		start = time.Unix(b.StartDate, 0)
+	}
+	end := time.Now()
+	if b.EndDate > 0 {
+		end = time.Unix(b.EndDate, 0)
+	}
+
+	filters := bson.D{bson.E{Key: "created_at", Value: bson.M{"$gte": start, "$lte": end}}}
+	for _, filter := range b.Filters {
+		if !config.ValidFilterField(filter.Field) {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("invalid filter field %q", filter.Field))
+		}
+		if filter.Negate {
+			filters = append(filters, bson.E{Key: filter.Field, Value: bson.M{"$nin": filter.Values}})
+		} else {
+			filters = append(filters, bson.E{Key: filter.Field, Value: bson.M{"$in": filter.Values}})
+		}
+	}
+	auditLog, err := a.dbw.ReadAuditLog(filters)
+	if err != nil {
+		return err
+	}
+
+	if q.CSV {
+		records := [][]string{{
+			"Actor", "Entity Type", "Entity ID", "Action",
+			"Path", "From", "To", "Created At",
+		}}
+		for _, l := range auditLog {
+			if len(l.Changes) == 0 {
+				records = append(records, []string{
+					l.Actor, l.EntityType, l.EntityID, l.Action,
+					"", "", "", l.CreatedAt.String(),
+				})
+			}
+			for _, change := range l.Changes {
+				records = append(records, []string{
+					l.Actor, l.EntityType, l.EntityID, l.Action,
+					change.Path, cast.ToString(change.From), cast.ToString(change.To), l.CreatedAt.String(),
+				})
+			}
+		}
+		buf := new(bytes.Buffer)
+		csvWriter := csv.NewWriter(buf)
+		if err := csvWriter.WriteAll(records); err != nil {
+			return err
+		}
+		c.Set("Content-Type", "text/csv")
+		c.Set("Content-Disposition", "attachment; filename=audit_log.csv")
+		return c.SendStream(buf)
+	}
+
+	return c.JSON(auditLog)
+}
+
+// audit records the configuration change made by the current user, a nil before (after)
+// means the entity is created (deleted). The error is only logged, the change is already done.
+func (a *api) audit(c *fiber.Ctx, entityType, entityID string, before, after interface{}) {
+	actor, err := a.getUsernameFromSession(c)
+	if err != nil {
+		actor = ""
+	}
+	if err := a.dbw.CreateAuditLog(actor, entityType, entityID, before, after); err != nil {
+		slog.Error(
+			"error in creating the audit log",
+			slog.String("error", err.Error()),
+			slog.String("entity_type", entityType),
+			slog.String("entity_id", entityID),
+		)
+	}
+}
+
+// findByID decodes the entity before the change, v is left untouched if it doesn't exist
+func (a *api) findByID(collection string, id primitive.ObjectID, v interface{}) error {
+	if err := a.db.Collection(collection).FindOne(
+		a.ctx,
+		bson.D{{Key: "_id", Value: id}},
+	).Decode(v); err != nil {
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+)
+
+func TestAuditLog(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	a := api{
+		ctx: context.Background(),
+		db:  mdb,
+		dbw: dbw,
+		key: testKeyring(t),
+		getUsernameFromSession: func(c *fiber.Ctx) (string, error) {
+			return "foo@bar.com", nil
+		},
+	}
+
+	app := fiber.New()
+	app.Post("/api/v1/auditlog", a.GetAuditLog)
+	app.Post("/api/v1/customs", a.CreateCustom)
+	app.Put("/api/v1/custom/:id", a.UpdateCustom)
+	app.Delete("/api/v1/custom/:id", a.DeleteCustom)
+
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		b, err := json.Marshal(body)
+		require.Nil(t, err)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		rec := httptest.NewRecorder()
+		io.Copy(rec, resp.Body)
+		return rec
+	}
+	readAuditLog := func(filters []Filter) []db.AuditLog {
+		rec := send("POST", "/api/v1/auditlog", map[string]interface{}{"filters": filters})
+		log := []db.AuditLog{}
+		require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &log))
+		return log
+	}
+
+	send("POST", "/api/v1/customs", nil)
+	var custom config.Custom
+	require.Nil(t, mdb.Collection("customs").FindOne(a.ctx, bson.D{}).Decode(&custom))
+	id := custom.ID.Hex()
+
+	custom.Field = "foo"
+	custom.Envs = []config.EnvKeyValue{{Key: "TOKEN", Value: "secret1"}, {Key: "HOST", Value: "github.com"}}
+	send("PUT", "/api/v1/custom/"+id, custom)
+	// the secrets given without a value are kept
+	custom.Envs = []config.EnvKeyValue{{Key: "TOKEN", Value: "secret2"}, {Key: "HOST"}}
+	send("PUT", "/api/v1/custom/"+id, custom)
+	// no change, no entry
+	custom.Envs = []config.EnvKeyValue{{Key: "TOKEN"}, {Key: "HOST"}}
+	send("PUT", "/api/v1/custom/"+id, custom)
+	send("DELETE", "/api/v1/custom/"+id, nil)
+
+	log := readAuditLog([]Filter{{Field: "entity_id", Values: []interface{}{id}}})
+	require.Equal(t, 4, len(log))
+	// sorted by latest first
+	assert.Equal(t, db.AuditActionDelete, log[0].Action)
+	assert.Equal(t, db.AuditActionUpdate, log[1].Action)
+	assert.Equal(t, db.AuditActionUpdate, log[2].Action)
+	assert.Equal(t, db.AuditActionCreate, log[3].Action)
+	for _, l := range log {
+		assert.Equal(t, "foo@bar.com", l.Actor)
+		assert.Equal(t, "custom", l.EntityType)
+	}
+
+	// only the changed secret is flagged, the values never reach the log
+	assert.Equal(t, []db.AuditChange{
+		{Path: "envs.0.value", From: redactedValue, To: redactedChangedValue},
+	}, log[1].Changes)
+	b, err := json.Marshal(log)
+	require.Nil(t, err)
+	assert.False(t, strings.Contains(string(b), "secret1"))
+	assert.False(t, strings.Contains(string(b), "secret2"))
+
+	log = readAuditLog([]Filter{{Field: "action", Values: []interface{}{"create"}}})
+	assert.Equal(t, 1, len(log))
+
+	// the fields aren't operators
+	for _, field := range []string{"$where", "$or", "changes.$ne", ""} {
+		b, err := json.Marshal(map[string]interface{}{"filters": []Filter{{Field: field, Values: []interface{}{"x"}}}})
+		require.Nil(t, err)
+		req := httptest.NewRequest("POST", "/api/v1/auditlog", bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		assert.Equal(t, 400, resp.StatusCode, field)
+	}
+}
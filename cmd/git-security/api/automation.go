@@ -1,6 +1,7 @@
 package api
 
 import (
+	"fmt"
 	"log/slog"
 	"slices"
 
@@ -9,7 +10,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
-	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
 )
 
 func (a *api) GetAutomations(c *fiber.Ctx) error {
@@ -24,12 +25,7 @@ func (a *api) GetAutomations(c *fiber.Ctx) error {
 	}
 
 	for idx := range automations {
-		for idy := range automations[idx].Envs {
-			automations[idx].Envs[idy].Value, err = security.Decrypt(automations[idx].Envs[idy].Value, a.key)
-			if err != nil {
-				return err
-			}
-		}
+		maskEnvs(automations[idx].Envs)
 	}
 
 	slices.Reverse(automations)
@@ -37,13 +33,14 @@ func (a *api) GetAutomations(c *fiber.Ctx) error {
 }
 
 func (a *api) CreateAutomation(c *fiber.Ctx) error {
-	if _, err := a.db.Collection("automations").InsertOne(
-		a.ctx,
-		config.Automation{},
-	); err != nil {
+	automation := config.Automation{}
+	result, err := a.db.Collection("automations").InsertOne(a.ctx, automation)
+	if err != nil {
 		slog.Error("error in inserting a automation", slog.String("error", err.Error()))
 		return err
 	}
+	automation.ID, _ = result.InsertedID.(primitive.ObjectID)
+	a.audit(c, "automation", automation.ID.Hex(), nil, automation)
 	return c.SendStatus(200)
 }
 
@@ -57,25 +54,59 @@ func (a *api) UpdateAutomation(c *fiber.Ctx) error {
 		return err
 	}
 
+	var old config.Automation
+	if err := a.findByID("automations", id, &old); err != nil {
+		return err
+	}
+
 	var automation config.Automation
 	if err := c.BodyParser(&automation); err != nil {
 		return err
 	}
+	if automation.Executor != "" && !slices.Contains(a.executors, automation.Executor) {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("the executor %s is not available", automation.Executor))
+	}
+	if _, err := config.ParseSchedule(automation.Schedule); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := automation.HookLimits.Validate(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := config.ValidateSecretRefs(automation.Envs); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if _, err := config.HookFilters(nil, automation.Filters); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := automation.ValidateEvents(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := automation.ValidateWebhook(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := automation.ValidatePermissions(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := a.checkHookImage(automation.Image, &automation.HookImage, old.Image, old.HookImage); err != nil {
+		return err
+	}
 
-	// encrypt
-	for idx := range automation.Envs {
-		automation.Envs[idx].Value, err = security.Encrypt(automation.Envs[idx].Value, a.key)
-		if err != nil {
-			return err
-		}
+	if err := a.updateEnvs(old.Envs, automation.Envs); err != nil {
+		return err
 	}
 
+	// redact the secrets for the audit log
+	auditBefore, auditAfter := old, automation
+	auditBefore.Envs, auditAfter.Envs = redactEnvs(old.Envs, automation.Envs)
+	auditAfter.ID = id
+
 	filter := bson.D{{Key: "_id", Value: id}}
 	update := bson.D{{Key: "$set", Value: automation}}
 	if _, err := a.db.Collection("automations").UpdateOne(a.ctx, filter, update); err != nil {
 		slog.Error("error in updating the automation", slog.String("error", err.Error()))
 		return err
 	}
+	a.audit(c, "automation", id.Hex(), auditBefore, auditAfter)
 
 	return c.SendStatus(200)
 }
@@ -90,11 +121,23 @@ func (a *api) DeleteAutomation(c *fiber.Ctx) error {
 		return err
 	}
 
+	var old config.Automation
+	if err := a.findByID("automations", id, &old); err != nil {
+		return err
+	}
+
 	filter := bson.D{{Key: "_id", Value: id}}
 	if _, err := a.db.Collection("automations").DeleteOne(a.ctx, filter); err != nil {
 		slog.Error("error in deleting the automation", slog.String("error", err.Error()))
 		return err
 	}
+	old.Envs, _ = redactEnvs(old.Envs, nil)
+	a.audit(c, "automation", id.Hex(), old, nil)
+
+	if err := a.dbw.DeleteHookSchedule(db.HookTypeAutomation, id); err != nil {
+		slog.Error("error in deleting the automation schedule", slog.String("error", err.Error()))
+		return err
+	}
 
 	return c.SendStatus(200)
 }
@@ -45,7 +45,7 @@ func (a *api) GetChangelog(c *fiber.Ctx) error {
 			filters = append(filters, bson.E{Key: filter.Field, Value: bson.M{"$in": filter.Values}})
 		}
 	}
-	changelog, err := a.dbw.ReadChangelog(filters)
+	changelog, err := a.dbw.ReadChangelog(withScope(c, filters))
 	if err != nil {
 		return err
 	}
@@ -54,13 +54,13 @@ func (a *api) GetChangelog(c *fiber.Ctx) error {
 		records := [][]string{{
 			"Repo Name", "Organization",
 			"Repo Owner", "Repo Owner Contact",
-			"Field", "From", "To", "Created At",
+			"Field", "Operation", "From", "To", "Changed By", "Created At",
 		}}
 		for _, c := range changelog {
 			records = append(records, []string{
 				c.Name, c.Owner.Login,
 				c.RepoOwner, c.RepoOwnerContact,
-				c.Field, c.From, c.To, c.CreatedAt.String(),
+				c.Field, c.Op, c.From, c.To, c.Actor, c.CreatedAt.String(),
 			})
 		}
 		buf := new(bytes.Buffer)
@@ -109,7 +109,7 @@ func (a *api) GetChangelogGroupBy(c *fiber.Ctx) error {
 		}
 	}
 
-	matchStage := bson.D{{Key: "$match", Value: filters}}
+	matchStage := bson.D{{Key: "$match", Value: withScope(c, filters)}}
 	sortGroupByStage := bson.D{{Key: "$sort", Value: bson.D{{Key: groupBy, Value: 1}}}}
 	groupStage := bson.D{
 		{
@@ -42,17 +42,18 @@ func (a *api) CreateColumn(c *fiber.Ctx) error {
 		}
 	}
 	r, _ := lexorank.Rank("", col.Order)
-	if _, err := a.db.Collection("columns").InsertOne(
-		a.ctx,
-		config.Column{
-			Type:  "string",
-			Width: 100,
-			Order: r,
-		},
-	); err != nil {
+	newCol := config.Column{
+		Type:  "string",
+		Width: 100,
+		Order: r,
+	}
+	result, err := a.db.Collection("columns").InsertOne(a.ctx, newCol)
+	if err != nil {
 		slog.Error("error in inserting a column", slog.String("error", err.Error()))
 		return err
 	}
+	newCol.ID, _ = result.InsertedID.(primitive.ObjectID)
+	a.audit(c, "column", newCol.ID.Hex(), nil, newCol)
 	return c.SendStatus(200)
 }
 
@@ -70,12 +71,19 @@ func (a *api) ChangeColumnsOrder(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
+	var old config.Column
+	if err := a.findByID("columns", id, &old); err != nil {
+		return err
+	}
 	filter := bson.D{{Key: "_id", Value: id}}
 	update := bson.D{{Key: "$set", Value: bson.M{"order": r}}}
 	if _, err := a.db.Collection("columns").UpdateOne(a.ctx, filter, update); err != nil {
 		slog.Error("error in updating the column order", slog.String("newR", r))
 		return err
 	}
+	column := old
+	column.Order = r
+	a.audit(c, "column", id.Hex(), old, column)
 	return c.SendStatus(200)
 }
 
@@ -88,6 +96,10 @@ func (a *api) UpdateColumn(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
+	var old config.Column
+	if err := a.findByID("columns", id, &old); err != nil {
+		return err
+	}
 	var column config.Column
 	if err := c.BodyParser(&column); err != nil {
 		return err
@@ -98,6 +110,8 @@ func (a *api) UpdateColumn(c *fiber.Ctx) error {
 		slog.Error("error in updating the column", slog.String("error", err.Error()))
 		return err
 	}
+	column.ID = id
+	a.audit(c, "column", id.Hex(), old, column)
 	return c.SendStatus(200)
 }
 
@@ -110,10 +124,15 @@ func (a *api) DeleteColumn(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
+	var old config.Column
+	if err := a.findByID("columns", id, &old); err != nil {
+		return err
+	}
 	filter := bson.D{{Key: "_id", Value: id}}
 	if _, err := a.db.Collection("columns").DeleteOne(a.ctx, filter); err != nil {
 		slog.Error("error in deleting the column", slog.String("error", err.Error()))
 		return err
 	}
+	a.audit(c, "column", id.Hex(), old, nil)
 	return c.SendStatus(200)
 }
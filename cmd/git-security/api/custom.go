@@ -6,12 +6,14 @@ import (
 	"slices"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/xissy/lexorank"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
-	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
 )
 
 func (a *api) GetCustoms(c *fiber.Ctx) error {
@@ -26,12 +28,7 @@ func (a *api) GetCustoms(c *fiber.Ctx) error {
 	}
 
 	for idx := range customs {
-		for idy := range customs[idx].Envs {
-			customs[idx].Envs[idy].Value, err = security.Decrypt(customs[idx].Envs[idy].Value, a.key)
-			if err != nil {
-				return err
-			}
-		}
+		maskEnvs(customs[idx].Envs)
 	}
 
 	slices.Reverse(customs)
@@ -39,17 +36,18 @@ func (a *api) GetCustoms(c *fiber.Ctx) error {
 }
 
 func (a *api) CreateCustom(c *fiber.Ctx) error {
-	if _, err := a.db.Collection("customs").InsertOne(
-		a.ctx,
-		config.Custom{
-			ValueType:    "string",
-			DefaultValue: "",
-			ErrorValue:   "",
-		},
-	); err != nil {
+	custom := config.Custom{
+		ValueType:    "string",
+		DefaultValue: "",
+		ErrorValue:   "",
+	}
+	result, err := a.db.Collection("customs").InsertOne(a.ctx, custom)
+	if err != nil {
 		slog.Error("error in inserting a custom", slog.String("error", err.Error()))
 		return err
 	}
+	custom.ID, _ = result.InsertedID.(primitive.ObjectID)
+	a.audit(c, "custom", custom.ID.Hex(), nil, custom)
 	return c.SendStatus(200)
 }
 
@@ -72,60 +70,77 @@ func (a *api) UpdateCustom(c *fiber.Ctx) error {
 			return err
 		}
 	}
-	oldField := old.Field
 
 	var custom config.Custom
 	if err := c.BodyParser(&custom); err != nil {
 		return err
 	}
+	if custom.Executor != "" && !slices.Contains(a.executors, custom.Executor) {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("the executor %s is not available", custom.Executor))
+	}
+	if _, err := config.ParseSchedule(custom.Schedule); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := custom.HookLimits.Validate(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := config.ValidateSecretRefs(custom.Envs); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if _, err := config.HookFilters(nil, custom.Filters); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := custom.ValidateOutputs(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	cursor, err := a.db.Collection("customs").Find(a.ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	var customs []config.Custom
+	if err := cursor.All(a.ctx, &customs); err != nil {
+		return err
+	}
+	if err := custom.ValidateCache(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := a.checkHookImage(custom.Image, &custom.HookImage, old.Image, old.HookImage); err != nil {
+		return err
+	}
+	updated := custom
+	updated.ID = id
+	if err := updated.ValidateDependencies(customs); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
 
-	// encrypt
-	for idx := range custom.Envs {
-		custom.Envs[idx].Value, err = security.Encrypt(custom.Envs[idx].Value, a.key)
-		if err != nil {
-			return err
-		}
+	if err := a.updateEnvs(old.Envs, custom.Envs); err != nil {
+		return err
 	}
 
+	// redact the secrets for the audit log
+	auditBefore, auditAfter := old, custom
+	auditBefore.Envs, auditAfter.Envs = redactEnvs(old.Envs, custom.Envs)
+	auditAfter.ID = id
+
 	// create new data for default
-	if oldField != custom.Field {
-		// update all the null customs first
-		if _, err := a.db.Collection("repositories").UpdateMany(
-			a.ctx,
-			bson.D{
-				{Key: "customs", Value: nil},
-			},
-			bson.D{
-				{
-					Key:   "$set",
-					Value: bson.D{{Key: "customs", Value: make(map[string]interface{})}},
-				},
-			},
-		); err != nil {
-			slog.Error(
-				"error in adding empty customs for repos",
-				slog.String("error", err.Error()),
-			)
-			return err
+	oldFields := make(map[string]bool)
+	for _, o := range old.Fields() {
+		oldFields[o.Field] = true
+	}
+	newFields := make(map[string]bool)
+	for _, o := range custom.Fields() {
+		newFields[o.Field] = true
+		if oldFields[o.Field] {
+			continue
 		}
-
-		if _, err := a.db.Collection("repositories").UpdateMany(
-			a.ctx,
-			bson.D{},
-			bson.D{
-				{
-					Key:   "$set",
-					Value: bson.D{{Key: fmt.Sprintf("customs.%s", custom.Field), Value: custom.DefaultValue}},
-				},
-			},
-		); err != nil {
-			slog.Error(
-				"error in adding new field for repos",
-				slog.String("error", err.Error()),
-				slog.String("field", custom.Field),
-			)
+		if err := a.addCustomField(o); err != nil {
 			return err
 		}
+		if custom.Structured() {
+			if err := a.addCustomColumn(c, o); err != nil {
+				return err
+			}
+		}
 	}
 
 	filter := bson.D{{Key: "_id", Value: id}}
@@ -135,19 +150,19 @@ func (a *api) UpdateCustom(c *fiber.Ctx) error {
 		return err
 	}
 
-	if oldField != custom.Field && oldField != "" {
-		// delete the old data
-		if _, err := a.db.Collection("repositories").UpdateMany(
-			a.ctx,
-			bson.D{},
-			bson.D{{Key: "$unset", Value: bson.D{{Key: fmt.Sprintf("customs.%s", oldField), Value: ""}}}},
-		); err != nil {
-			slog.Error(
-				"error in removing field from repos",
-				slog.String("error", err.Error()),
-				slog.String("field", oldField),
-			)
-			return err
+	a.audit(c, "custom", id.Hex(), auditBefore, auditAfter)
+
+	// the cached runs may not match the changed hook
+	if err := a.dbw.DeleteHookCache(id, nil); err != nil {
+		return err
+	}
+
+	// delete the old data
+	for field := range oldFields {
+		if !newFields[field] {
+			if err := a.removeCustomField(field); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -179,22 +194,128 @@ func (a *api) DeleteCustom(c *fiber.Ctx) error {
 		slog.Error("error in deleting the custom", slog.String("error", err.Error()))
 		return err
 	}
+	old.Envs, _ = redactEnvs(old.Envs, nil)
+	a.audit(c, "custom", id.Hex(), old, nil)
+
+	if err := a.dbw.DeleteHookSchedule(db.HookTypeCustom, id); err != nil {
+		slog.Error("error in deleting the custom schedule", slog.String("error", err.Error()))
+		return err
+	}
+	if err := a.dbw.DeleteHookCache(id, nil); err != nil {
+		return err
+	}
 
 	// delete the old data
-	if old.Field != "" {
-		if _, err := a.db.Collection("repositories").UpdateMany(
-			a.ctx,
-			bson.D{},
-			bson.D{{Key: "$unset", Value: bson.D{{Key: fmt.Sprintf("customs.%s", old.Field), Value: ""}}}},
-		); err != nil {
-			slog.Error(
-				"error in removing field from customs",
-				slog.String("error", err.Error()),
-				slog.String("field", old.Field),
-			)
+	for _, o := range old.Fields() {
+		if err := a.removeCustomField(o.Field); err != nil {
 			return err
 		}
 	}
 
 	return c.SendStatus(200)
 }
+
+// addCustomField sets the default value of a new custom field on all the repos
+func (a *api) addCustomField(output config.CustomOutput) error {
+	// update all the null customs first
+	if _, err := a.db.Collection("repositories").UpdateMany(
+		a.ctx,
+		bson.D{
+			{Key: "customs", Value: nil},
+		},
+		bson.D{
+			{
+				Key:   "$set",
+				Value: bson.D{{Key: "customs", Value: make(map[string]interface{})}},
+			},
+		},
+	); err != nil {
+		slog.Error(
+			"error in adding empty customs for repos",
+			slog.String("error", err.Error()),
+		)
+		return err
+	}
+
+	if _, err := a.db.Collection("repositories").UpdateMany(
+		a.ctx,
+		bson.D{},
+		bson.D{
+			{
+				Key:   "$set",
+				Value: bson.D{{Key: fmt.Sprintf("customs.%s", output.Field), Value: output.DefaultValue}},
+			},
+		},
+	); err != nil {
+		slog.Error(
+			"error in adding new field for repos",
+			slog.String("error", err.Error()),
+			slog.String("field", output.Field),
+		)
+		return err
+	}
+	return nil
+}
+
+// removeCustomField removes the custom field from all the repos
+func (a *api) removeCustomField(field string) error {
+	if field == "" {
+		return nil
+	}
+	if _, err := a.db.Collection("repositories").UpdateMany(
+		a.ctx,
+		bson.D{},
+		bson.D{{Key: "$unset", Value: bson.D{{Key: fmt.Sprintf("customs.%s", field), Value: ""}}}},
+	); err != nil {
+		slog.Error(
+			"error in removing field from repos",
+			slog.String("error", err.Error()),
+			slog.String("field", field),
+		)
+		return err
+	}
+	return nil
+}
+
+// addCustomColumn creates the column of an output field of a structured custom hook first
+// in the order, unless a column already shows the field
+func (a *api) addCustomColumn(c *fiber.Ctx, output config.CustomOutput) error {
+	key := fmt.Sprintf("customs.%s", output.Field)
+	count, err := a.db.Collection("columns").CountDocuments(a.ctx, bson.D{{Key: "key", Value: key}})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	var col config.Column
+	if err := a.db.Collection("columns").FindOne(
+		a.ctx,
+		bson.D{},
+		options.FindOne().SetSort(bson.D{{Key: "order", Value: 1}}),
+	).Decode(&col); err != nil {
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+	r, _ := lexorank.Rank("", col.Order)
+	newCol := config.Column{
+		Type:   output.ValueType,
+		Title:  output.Field,
+		Key:    key,
+		Width:  100,
+		Show:   true,
+		Filter: true,
+		CSV:    true,
+		Order:  r,
+	}
+	result, err := a.db.Collection("columns").InsertOne(a.ctx, newCol)
+	if err != nil {
+		slog.Error("error in inserting a column", slog.String("error", err.Error()))
+		return err
+	}
+	newCol.ID, _ = result.InsertedID.(primitive.ObjectID)
+	a.audit(c, "column", newCol.ID.Hex(), nil, newCol)
+	return nil
+}
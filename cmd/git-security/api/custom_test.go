@@ -0,0 +1,69 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/executor"
+)
+
+func TestUpdateHookExecutor(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	a := api{
+		ctx:       context.Background(),
+		db:        mdb,
+		dbw:       dbw,
+		key:       testKeyring(t),
+		executors: []string{executor.Docker},
+		getUsernameFromSession: func(c *fiber.Ctx) (string, error) {
+			return "foo@bar.com", nil
+		},
+	}
+	app := fiber.New()
+	app.Put("/api/v1/custom/:id", a.UpdateCustom)
+	app.Put("/api/v1/automation/:id", a.UpdateAutomation)
+
+	send := func(path string, body interface{}) int {
+		b, err := json.Marshal(body)
+		require.Nil(t, err)
+		req := httptest.NewRequest("PUT", path, bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		return resp.StatusCode
+	}
+
+	// the subprocess executor isn't registered
+	id := primitive.NewObjectID().Hex()
+	custom := config.Custom{Field: "foo", ValueType: "string", Executor: executor.Subprocess}
+	assert.Equal(t, 400, send("/api/v1/custom/"+id, custom))
+	assert.Equal(t, 400, send("/api/v1/automation/"+id, config.Automation{Executor: executor.Subprocess}))
+	custom.Executor = executor.Docker
+	assert.Equal(t, 200, send("/api/v1/custom/"+id, custom))
+
+	// the hooks can't join the network of the host or of another container
+	for _, mode := range []string{"host", "container:git-security"} {
+		custom.NetworkMode = mode
+		assert.Equal(t, 400, send("/api/v1/custom/"+id, custom))
+	}
+	custom.NetworkMode = "none"
+	assert.Equal(t, 200, send("/api/v1/custom/"+id, custom))
+
+	// the webhooks need a URL
+	webhook := config.Automation{Kind: config.AutomationKindWebhook}
+	assert.Equal(t, 400, send("/api/v1/automation/"+id, webhook))
+	webhook.Webhook.URL = "https://hooks.example.com/repo"
+	assert.Equal(t, 200, send("/api/v1/automation/"+id, webhook))
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+)
+
+// RevealedEnv is the decrypted value of a secret env
+type RevealedEnv struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// RevealCustomEnvs returns the secret values of the custom hook, for break-glass use
+func (a *api) RevealCustomEnvs(c *fiber.Ctx) error {
+	return a.revealEnvs(c, "customs", "custom")
+}
+
+// RevealAutomationEnvs returns the secret values of the automation, for break-glass use
+func (a *api) RevealAutomationEnvs(c *fiber.Ctx) error {
+	return a.revealEnvs(c, "automations", "automation")
+}
+
+// revealEnvs decrypts the set values of the envs with the keys of the body, all of them if no
+// key is given. Every reveal is audited with the keys of the revealed envs.
+func (a *api) revealEnvs(c *fiber.Ctx, collection, entityType string) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	b := struct {
+		Keys []string `json:"keys"`
+	}{}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&b); err != nil {
+			return err
+		}
+	}
+
+	hook := struct {
+		Envs []config.EnvKeyValue `bson:"envs"`
+	}{}
+	if err := a.readHookForTest(collection, id.Hex(), &hook); err != nil {
+		return err
+	}
+
+	revealed := make([]RevealedEnv, 0)
+	changes := make([]db.AuditChange, 0)
+	for _, env := range hook.Envs {
+		if env.Ref != "" || env.Value == "" || (len(b.Keys) > 0 && !slices.Contains(b.Keys, env.Key)) {
+			continue
+		}
+		value, err := a.key.Decrypt(env.Value)
+		if err != nil {
+			return err
+		}
+		revealed = append(revealed, RevealedEnv{Key: env.Key, Value: value})
+		changes = append(changes, db.AuditChange{Path: "envs." + env.Key})
+	}
+	if len(revealed) == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "no secret to reveal")
+	}
+
+	actor, err := a.getUsernameFromSession(c)
+	if err != nil {
+		actor = ""
+	}
+	// the secrets aren't returned if the reveal can't be audited
+	if err := a.dbw.CreateAuditLogAction(actor, entityType, id.Hex(), db.AuditActionReveal, changes); err != nil {
+		slog.Error("error in auditing the reveal of the secrets", slog.String("error", err.Error()))
+		return err
+	}
+	return c.JSON(revealed)
+}
+
+// maskEnvs hides the values of the envs in place, set tells if the env has a value
+func maskEnvs(envs []config.EnvKeyValue) {
+	for idx := range envs {
+		envs[idx].Set = envs[idx].Ref == "" && envs[idx].Value != ""
+		envs[idx].Value = ""
+	}
+}
+
+// updateEnvs encrypts the new values of the envs in place, the envs given without a value
+// keep their stored value so that the secrets are only replaced by a new one. The update
+// time tells when the value or the secret reference of an env last changed.
+func (a *api) updateEnvs(stored, envs []config.EnvKeyValue) error {
+	now := time.Now()
+	previous := make(map[string]config.EnvKeyValue)
+	for _, env := range stored {
+		previous[env.Key] = env
+	}
+	for idx := range envs {
+		env, prev := &envs[idx], previous[envs[idx].Key]
+		env.Set = false
+		switch {
+		case env.Ref != "":
+			env.Value, env.UpdatedAt = "", &now
+			if prev.Ref == env.Ref {
+				env.UpdatedAt = prev.UpdatedAt
+			}
+		case env.Value == "":
+			env.UpdatedAt = nil
+			if prev.Ref == "" {
+				env.Value, env.UpdatedAt = prev.Value, prev.UpdatedAt
+			}
+		default:
+			encrypted, err := a.key.Encrypt(env.Value)
+			if err != nil {
+				return err
+			}
+			env.Value, env.UpdatedAt = encrypted, &now
+		}
+	}
+	return nil
+}
+
+// fillEnvsForTest fills the envs given without a value with the stored secrets of the saved
+// hook, as the hooks in the body only have the masked values of the API. The stored secrets
+// are only given to the saved command, a changed hook needs the values of its secrets.
+func (a *api) fillEnvsForTest(stored, envs []config.EnvKeyValue, unchanged bool) error {
+	if !unchanged {
+		previous := make(map[string]config.EnvKeyValue)
+		for _, env := range stored {
+			previous[env.Key] = env
+		}
+		for _, env := range envs {
+			prev := previous[env.Key]
+			if env.Ref == "" && env.Value == "" && prev.Ref == "" && prev.Value != "" {
+				return fiber.NewError(
+					fiber.StatusBadRequest,
+					fmt.Sprintf("the hook is changed, the value of the env %s is required", env.Key),
+				)
+			}
+		}
+		return nil
+	}
+	if err := a.updateEnvs(stored, envs); err != nil {
+		return err
+	}
+	return a.decryptEnvs(envs)
+}
+
+// decryptEnvs decrypts the values of the envs in place, the secret references are only
+// resolved by the runs
+func (a *api) decryptEnvs(envs []config.EnvKeyValue) error {
+	var err error
+	for idx := range envs {
+		if envs[idx].Ref != "" || envs[idx].Value == "" {
+			continue
+		}
+		if envs[idx].Value, err = a.key.Decrypt(envs[idx].Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redactEnvs returns copies of the stored envs for the audit log, with the values redacted
+// and the replaced ones flagged. The secret references aren't secrets, they are kept.
+func redactEnvs(before, after []config.EnvKeyValue) ([]config.EnvKeyValue, []config.EnvKeyValue) {
+	redact := func(env config.EnvKeyValue) config.EnvKeyValue {
+		redacted := config.EnvKeyValue{Key: env.Key, Ref: env.Ref}
+		if env.Ref == "" && env.Value != "" {
+			redacted.Value = redactedValue
+		}
+		return redacted
+	}
+
+	values := make(map[string]string)
+	redactedBefore := make([]config.EnvKeyValue, 0, len(before))
+	for _, env := range before {
+		values[env.Key] = env.Value
+		redactedBefore = append(redactedBefore, redact(env))
+	}
+	redactedAfter := make([]config.EnvKeyValue, 0, len(after))
+	for _, env := range after {
+		redacted := redact(env)
+		if value, ok := values[env.Key]; ok && value != "" && redacted.Value != "" && value != env.Value {
+			redacted.Value = redactedChangedValue
+		}
+		redactedAfter = append(redactedAfter, redacted)
+	}
+	return redactedBefore, redactedAfter
+}
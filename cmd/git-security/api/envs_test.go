@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
+)
+
+func testKeyring(t *testing.T) *security.Keyring {
+	keyring, err := security.NewKeyring(security.Key{ID: "test", Secret: []byte("0123456789abcdef0123456789abcdef")})
+	require.Nil(t, err)
+	return keyring
+}
+
+func TestSecretRefEnvs(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	a := api{
+		ctx: context.Background(),
+		db:  mdb,
+		dbw: dbw,
+		key: testKeyring(t),
+		getUsernameFromSession: func(c *fiber.Ctx) (string, error) {
+			return "foo@bar.com", nil
+		},
+	}
+	app := fiber.New()
+	app.Get("/api/v1/customs", a.GetCustoms)
+	app.Put("/api/v1/custom/:id", a.UpdateCustom)
+	app.Post("/api/v1/custom/:id/reveal", a.RevealCustomEnvs)
+
+	id := primitive.NewObjectID()
+	_, err := mdb.Collection("customs").InsertOne(a.ctx, config.Custom{ID: id})
+	require.Nil(t, err)
+	update := func(envs []config.EnvKeyValue) int {
+		b, err := json.Marshal(config.Custom{Field: "foo", ValueType: "string", Envs: envs})
+		require.Nil(t, err)
+		req := httptest.NewRequest("PUT", "/api/v1/custom/"+id.Hex(), bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		return resp.StatusCode
+	}
+	readStored := func() config.Custom {
+		var stored config.Custom
+		require.Nil(t, mdb.Collection("customs").FindOne(a.ctx, bson.D{{Key: "_id", Value: id}}).Decode(&stored))
+		return stored
+	}
+
+	require.Equal(t, 200, update([]config.EnvKeyValue{
+		{Key: "TOKEN", Value: "plain"},
+		{Key: "VAULT", Value: "not stored", Ref: "vault:secret/data/hooks#token"},
+		{Key: "EMPTY"},
+	}))
+	stored := readStored()
+	assert.NotEqual(t, "plain", stored.Envs[0].Value)
+	assert.NotNil(t, stored.Envs[0].UpdatedAt)
+	assert.Equal(t, "", stored.Envs[1].Value)
+	assert.Equal(t, "vault:secret/data/hooks#token", stored.Envs[1].Ref)
+
+	// the values are masked, the references are returned, never their secrets
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/customs", nil), -1)
+	require.Nil(t, err)
+	customs := []config.Custom{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&customs))
+	require.Equal(t, 1, len(customs))
+	require.Equal(t, 3, len(customs[0].Envs))
+	assert.Equal(t, "", customs[0].Envs[0].Value)
+	assert.True(t, customs[0].Envs[0].Set)
+	assert.NotNil(t, customs[0].Envs[0].UpdatedAt)
+	assert.Equal(t, "vault:secret/data/hooks#token", customs[0].Envs[1].Ref)
+	assert.False(t, customs[0].Envs[1].Set)
+	assert.False(t, customs[0].Envs[2].Set)
+
+	// the masked values sent back keep the secrets
+	require.Equal(t, 200, update(customs[0].Envs))
+	assert.Equal(t, stored.Envs[0].Value, readStored().Envs[0].Value)
+
+	// the reveal is audited
+	reveal := func(body string) ([]RevealedEnv, int) {
+		req := httptest.NewRequest("POST", "/api/v1/custom/"+id.Hex()+"/reveal", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		revealed := []RevealedEnv{}
+		if resp.StatusCode == 200 {
+			require.Nil(t, json.NewDecoder(resp.Body).Decode(&revealed))
+		}
+		return revealed, resp.StatusCode
+	}
+	revealed, status := reveal(`{"keys": ["TOKEN"]}`)
+	require.Equal(t, 200, status)
+	assert.Equal(t, []RevealedEnv{{Key: "TOKEN", Value: "plain"}}, revealed)
+	_, status = reveal(`{"keys": ["VAULT"]}`)
+	assert.Equal(t, 404, status)
+	log, err := dbw.ReadAuditLog(bson.D{{Key: "action", Value: db.AuditActionReveal}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(log))
+	assert.Equal(t, "foo@bar.com", log[0].Actor)
+	assert.Equal(t, []db.AuditChange{{Path: "envs.TOKEN"}}, log[0].Changes)
+
+	assert.Equal(t, 400, update([]config.EnvKeyValue{{Key: "VAULT", Ref: "vault:secret/data/hooks"}}))
+	assert.Equal(t, 400, update([]config.EnvKeyValue{{Key: "FILE", Ref: "file:relative/path"}}))
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultHookRunsLimit = 100
+	maxHookRunsLimit     = 1000
+)
+
+// GetHookRuns lists the runs of a hook and/or a repo, the latest first and without the logs.
+// The scoped requests only see the runs of the repos in their scope.
+func (a *api) GetHookRuns(c *fiber.Ctx) error {
+	q := struct {
+		HookType string `query:"hook_type"`
+		HookID   string `query:"hook_id"`
+		Repo     string `query:"repo"`
+		Limit    int64  `query:"limit"`
+	}{}
+	if err := c.QueryParser(&q); err != nil {
+		return err
+	}
+
+	filters := bson.D{}
+	if q.HookType != "" {
+		filters = append(filters, bson.E{Key: "hook_type", Value: q.HookType})
+	}
+	if q.HookID != "" {
+		hookID, err := primitive.ObjectIDFromHex(q.HookID)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		filters = append(filters, bson.E{Key: "hook_id", Value: hookID})
+	}
+	if getScopeFromLocals(c) != nil {
+		// the batch runs aren't of a repo, they are hidden from the scoped requests
+		var names []string
+		if q.Repo != "" {
+			names = []string{q.Repo}
+		}
+		repos, err := a.scopedRepoNames(c, names)
+		if err != nil {
+			return err
+		}
+		filters = append(filters, bson.E{Key: "repo", Value: bson.M{"$in": repos}})
+	} else if q.Repo != "" {
+		filters = append(filters, bson.E{Key: "repo", Value: q.Repo})
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultHookRunsLimit
+	}
+	q.Limit = min(q.Limit, maxHookRunsLimit)
+
+	runs, err := a.dbw.ReadHookRuns(filters, q.Limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(runs)
+}
+
+// GetHookRun returns the run with its logs, the secrets are redacted when the run is recorded
+func (a *api) GetHookRun(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	run, err := a.dbw.ReadHookRun(id)
+	if err != nil {
+		return err
+	}
+	if run == nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if getScopeFromLocals(c) != nil {
+		if run.Repo == "" {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		repos, err := a.scopedRepoNames(c, []string{run.Repo})
+		if err != nil {
+			return err
+		}
+		if len(repos) == 0 {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+	}
+	return c.JSON(run)
+}
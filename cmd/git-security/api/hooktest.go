@@ -0,0 +1,206 @@
+package api
+
+import (
+	"slices"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+// HookTester runs a custom hook or an automation for a repo and returns what the run would
+// write, without recording the run nor updating the repo. The envs of the hooks are given
+// decrypted, and their secret references are resolved by the runs. The webhooks are only
+// sent if send is set, otherwise their request is returned.
+type HookTester interface {
+	TestCustom(custom config.Custom, repo *gh.Repository) (*HookTestResult, error)
+	TestAutomation(automation config.Automation, repo *gh.Repository, send bool) (*HookTestResult, error)
+}
+
+// HookTestResult is the run of a hook for a repo with its full logs, the values the custom
+// hook would write and the actions the automation printed. Targeted tells if the scheduled
+// runs of the hook target the repo.
+type HookTestResult struct {
+	db.HookRun
+	Targeted bool                   `json:"targeted"`
+	Result   string                 `json:"result,omitempty"`
+	Values   map[string]interface{} `json:"values,omitempty"`
+	Changed  []string               `json:"changed,omitempty"`
+	Actions  []HookTestAction       `json:"actions,omitempty"`
+	Errors   []string               `json:"errors,omitempty"`
+	Request  *HookTestRequest       `json:"request,omitempty"`
+}
+
+// HookTestRequest is the request a webhook would send, with the secrets redacted
+type HookTestRequest struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Payload string            `json:"payload"`
+}
+
+// HookTestAction is an action printed by an automation and if its permissions allow it
+type HookTestAction struct {
+	config.AutomationAction
+	Permitted bool `json:"permitted"`
+}
+
+// TestCustom runs the saved custom hook with the id, or the one in the body, for the repo
+func (a *api) TestCustom(c *fiber.Ctx) error {
+	b := struct {
+		ID     string        `json:"id"`
+		Custom config.Custom `json:"custom"`
+		Repo   string        `json:"repo"`
+	}{}
+	if err := c.BodyParser(&b); err != nil {
+		return err
+	}
+	custom := b.Custom
+	if b.ID != "" {
+		if err := a.readHookForTest("customs", b.ID, &custom); err != nil {
+			return err
+		}
+		if err := a.decryptEnvs(custom.Envs); err != nil {
+			return err
+		}
+	} else if !custom.ID.IsZero() {
+		var saved config.Custom
+		if err := a.findByID("customs", custom.ID, &saved); err != nil {
+			return err
+		}
+		unchanged := saved.Command == custom.Command &&
+			saved.Executor == custom.Executor &&
+			saved.Image == custom.Image &&
+			saved.PinnedDigest() == custom.PinnedDigest()
+		if err := a.fillEnvsForTest(saved.Envs, custom.Envs, unchanged); err != nil {
+			return err
+		}
+	}
+
+	if len(custom.Command) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "the custom hook has no command")
+	}
+	if err := custom.ValidateOutputs(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := custom.HookLimits.Validate(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	repo, err := a.readRepoForTest(c, b.Repo)
+	if err != nil {
+		return err
+	}
+
+	result, err := a.hooks.TestCustom(custom, repo)
+	if err != nil {
+		return err
+	}
+	return c.JSON(result)
+}
+
+// TestAutomation runs the saved automation with the id, or the one in the body, for the repo.
+// The webhooks are only sent with send.
+func (a *api) TestAutomation(c *fiber.Ctx) error {
+	b := struct {
+		ID         string            `json:"id"`
+		Automation config.Automation `json:"automation"`
+		Repo       string            `json:"repo"`
+		Send       bool              `json:"send"`
+	}{}
+	if err := c.BodyParser(&b); err != nil {
+		return err
+	}
+	automation := b.Automation
+	if b.ID != "" {
+		if err := a.readHookForTest("automations", b.ID, &automation); err != nil {
+			return err
+		}
+		if err := a.decryptEnvs(automation.Envs); err != nil {
+			return err
+		}
+	} else if !automation.ID.IsZero() {
+		var saved config.Automation
+		if err := a.findByID("automations", automation.ID, &saved); err != nil {
+			return err
+		}
+		unchanged := saved.Kind == automation.Kind &&
+			saved.Command == automation.Command &&
+			saved.Executor == automation.Executor &&
+			saved.Image == automation.Image &&
+			saved.PinnedDigest() == automation.PinnedDigest() &&
+			sameWebhook(saved.Webhook, automation.Webhook)
+		if err := a.fillEnvsForTest(saved.Envs, automation.Envs, unchanged); err != nil {
+			return err
+		}
+	}
+
+	if !automation.IsWebhook() && len(automation.Command) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "the automation has no command")
+	}
+	if err := automation.HookLimits.Validate(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := automation.ValidateWebhook(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := automation.ValidatePermissions(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	repo, err := a.readRepoForTest(c, b.Repo)
+	if err != nil {
+		return err
+	}
+
+	result, err := a.hooks.TestAutomation(automation, repo, b.Send)
+	if err != nil {
+		return err
+	}
+	return c.JSON(result)
+}
+
+// sameWebhook tells if the webhooks send the same request, their templates can use the envs
+func sameWebhook(webhook, other config.AutomationWebhook) bool {
+	return webhook.URL == other.URL &&
+		webhook.Payload == other.Payload &&
+		webhook.HMACEnv == other.HMACEnv &&
+		webhook.HMACHeader == other.HMACHeader &&
+		slices.EqualFunc(webhook.Headers, other.Headers, func(h, o config.EnvKeyValue) bool {
+			return h.Key == o.Key && h.Value == o.Value
+		})
+}
+
+func (a *api) readHookForTest(collection, _id string, hook interface{}) error {
+	id, err := primitive.ObjectIDFromHex(_id)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := a.db.Collection(collection).FindOne(
+		a.ctx,
+		bson.D{{Key: "_id", Value: id}},
+	).Decode(hook); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fiber.NewError(fiber.StatusNotFound, "hook not found")
+		}
+		return err
+	}
+	return nil
+}
+
+// readRepoForTest returns the repo with the name, within the scope of the user
+func (a *api) readRepoForTest(c *fiber.Ctx, name string) (*gh.Repository, error) {
+	if name == "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "the repo is required")
+	}
+	repos, err := a.dbw.ReadRepositories(withScope(c, bson.D{{Key: "full_name", Value: name}}))
+	if err != nil {
+		return nil, err
+	}
+	if len(repos) == 0 {
+		return nil, fiber.NewError(fiber.StatusNotFound, "repo not found")
+	}
+	return repos[0], nil
+}
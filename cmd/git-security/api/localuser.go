@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
+)
+
+const (
+	localUsersCollection = "localusers"
+	localAuthCacheTTL    = time.Minute
+)
+
+// localUserAuthorizer checks the basic auth credentials against the local user store,
+// successful logins are cached for a minute to avoid running bcrypt on every request
+func (a *api) localUserAuthorizer(username, password string) bool {
+	cacheKey := security.HashToken(username + ":" + password)
+	if _, ok := a.localAuthCache.Get(cacheKey); ok {
+		return true
+	}
+
+	var user config.LocalUser
+	if err := a.db.Collection(localUsersCollection).FindOne(
+		a.ctx,
+		bson.D{{Key: "username", Value: username}},
+	).Decode(&user); err != nil {
+		if err != mongo.ErrNoDocuments {
+			slog.Error("error in finding the local user", slog.String("error", err.Error()))
+		}
+		return false
+	}
+	if !security.CheckPassword(user.PasswordHash, password) {
+		return false
+	}
+	a.localAuthCache.Add(cacheKey, struct{}{})
+
+	// the roles could have been assigned by the CLI while the server was running
+	roles, err := a.enforcer.GetRolesForUser(username)
+	if err == nil && len(roles) == 0 {
+		if err := a.reloadPolicies(); err != nil {
+			slog.Error("error in reloading the policies", slog.String("error", err.Error()))
+		}
+	}
+	return true
+}
+
+// SeedLocalUsers creates the local users from the admin flags if they don't exist yet,
+// the passwords can be given in plaintext or as bcrypt hashes. Existing users are left
+// untouched so a password reset from the CLI is not overridden at the next start.
+// It refuses to go on if any of the admins still has the default password, unless debug is set.
+func SeedLocalUsers(ctx context.Context, db *mongo.Database, usernames, passwords []string, debug bool) error {
+	if len(usernames) != len(passwords) {
+		return fmt.Errorf("admin usernames and passwords should have the same size")
+	}
+	for idx, username := range usernames {
+		var user config.LocalUser
+		err := db.Collection(localUsersCollection).FindOne(
+			ctx,
+			bson.D{{Key: "username", Value: username}},
+		).Decode(&user)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		if err == mongo.ErrNoDocuments {
+			slog.Info("creating local user", slog.String("username", username))
+			if user, err = createLocalUser(ctx, db, username, passwords[idx]); err != nil {
+				return err
+			}
+		}
+		if security.CheckPassword(user.PasswordHash, security.DefaultPassword) {
+			if !debug {
+				return fmt.Errorf("user %s has the default password, change it or start with --debug", username)
+			}
+			slog.Warn("user has the default password", slog.String("username", username))
+		}
+	}
+	return nil
+}
+
+// CreateLocalUser creates a local user and assigns the roles through the casbin enforcer
+func CreateLocalUser(ctx context.Context, db *mongo.Database, username, password string, roles []string) error {
+	enforcer, err := newEnforcer(db)
+	if err != nil {
+		return err
+	}
+	a := api{ctx: ctx, db: db, enforcer: enforcer}
+	return a.createLocalUserWithRoles(username, password, roles)
+}
+
+func (a *api) createLocalUserWithRoles(username, password string, roles []string) error {
+	if username == "" || password == "" {
+		return fmt.Errorf("username and password are required")
+	}
+	rolesDefined, err := a.getRolesDefined()
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if _, ok := rolesDefined[role]; !ok {
+			return fmt.Errorf("role %s is not defined", role)
+		}
+	}
+
+	if _, err := createLocalUser(a.ctx, a.db, username, password); err != nil {
+		return err
+	}
+
+	if len(roles) == 0 {
+		return nil
+	}
+	_, err = a.enforcer.AddRolesForUser(username, roles)
+	return err
+}
+
+// ResetLocalUserPassword replaces the password hash of an existing local user
+func ResetLocalUserPassword(ctx context.Context, db *mongo.Database, username, password string) error {
+	if username == "" || password == "" {
+		return fmt.Errorf("username and password are required")
+	}
+	hash, err := hashPasswordIfNeeded(password)
+	if err != nil {
+		return err
+	}
+	result, err := db.Collection(localUsersCollection).UpdateOne(
+		ctx,
+		bson.D{{Key: "username", Value: username}},
+		bson.D{{Key: "$set", Value: bson.M{
+			"password_hash": hash,
+			"updated_at":    time.Now(),
+		}}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("user %s doesn't exist", username)
+	}
+	return nil
+}
+
+func createLocalUser(ctx context.Context, db *mongo.Database, username, password string) (config.LocalUser, error) {
+	hash, err := hashPasswordIfNeeded(password)
+	if err != nil {
+		return config.LocalUser{}, err
+	}
+	count, err := db.Collection(localUsersCollection).CountDocuments(
+		ctx, bson.D{{Key: "username", Value: username}})
+	if err != nil {
+		return config.LocalUser{}, err
+	}
+	if count > 0 {
+		return config.LocalUser{}, fmt.Errorf("user %s already exists", username)
+	}
+	now := time.Now()
+	user := config.LocalUser{
+		Username:     username,
+		PasswordHash: hash,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if _, err := db.Collection(localUsersCollection).InsertOne(ctx, user); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+func hashPasswordIfNeeded(password string) (string, error) {
+	if security.IsPasswordHash(password) {
+		return password, nil
+	}
+	return security.HashPassword(password)
+}
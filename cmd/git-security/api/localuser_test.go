@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
+)
+
+func TestLocalUsers(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	ctx := context.Background()
+	a := api{
+		ctx:            ctx,
+		db:             mdb,
+		dbw:            dbw,
+		localAuthCache: expirable.NewLRU[string, struct{}](10, nil, time.Minute),
+	}
+	a.settingUpCasbinEnforcer()
+
+	// the default password is refused unless debug is set
+	assert.NotNil(t, SeedLocalUsers(ctx, mdb, []string{"admin"}, []string{"changeme"}, false))
+	require.Nil(t, SeedLocalUsers(ctx, mdb, []string{"admin"}, []string{"changeme"}, true))
+	assert.NotNil(t, SeedLocalUsers(ctx, mdb, []string{"admin"}, []string{"changeme", "other"}, true))
+
+	// the password is stored hashed
+	var user config.LocalUser
+	require.Nil(t, mdb.Collection(localUsersCollection).FindOne(
+		ctx, bson.D{{Key: "username", Value: "admin"}}).Decode(&user))
+	assert.NotEqual(t, "changeme", user.PasswordHash)
+	assert.True(t, a.localUserAuthorizer("admin", "changeme"))
+	assert.False(t, a.localUserAuthorizer("admin", "wrong"))
+
+	// a reset password is not overridden by the flags at the next start
+	require.Nil(t, ResetLocalUserPassword(ctx, mdb, "admin", "s3cret"))
+	require.Nil(t, SeedLocalUsers(ctx, mdb, []string{"admin"}, []string{"changeme"}, false))
+	a.localAuthCache.Purge()
+	assert.False(t, a.localUserAuthorizer("admin", "changeme"))
+	assert.True(t, a.localUserAuthorizer("admin", "s3cret"))
+	assert.NotNil(t, ResetLocalUserPassword(ctx, mdb, "missing", "s3cret"))
+
+	// hashed passwords are accepted as is
+	hash, err := security.HashPassword("hashed")
+	require.Nil(t, err)
+	require.Nil(t, SeedLocalUsers(ctx, mdb, []string{"ops"}, []string{hash}, false))
+	assert.True(t, a.localUserAuthorizer("ops", "hashed"))
+
+	// roles are assigned through the enforcer, only defined roles are accepted
+	assert.NotNil(t, a.createLocalUserWithRoles("alice", "password", []string{"superuser"}))
+	require.Nil(t, a.createLocalUserWithRoles("alice", "password", []string{"user"}))
+	assert.NotNil(t, a.createLocalUserWithRoles("alice", "password", []string{"user"}))
+	assert.True(t, a.localUserAuthorizer("alice", "password"))
+	roles, err := a.enforcer.GetRolesForUser("alice")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"user"}, roles)
+}
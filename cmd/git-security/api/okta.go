@@ -16,11 +16,6 @@ import (
 	"github.com/spf13/cast"
 )
 
-var (
-	state = generateState()
-	nonce = "NonceNotSetYet"
-)
-
 func generateState() string {
 	// Generate a random byte array for state paramter
 	b := make([]byte, 16)
@@ -46,13 +41,28 @@ type Exchange struct {
 
 // https://developer.okta.com/docs/guides/sign-into-web-app/go/redirect-to-sign-in/
 func (api *api) oktaLogin(c *fiber.Ctx) error {
-	nonce = generateNonce()
+	// the state and nonce are kept in the session so the callback can land on any replica
+	state := generateState()
+	nonce := generateNonce()
+	sess, err := api.store.Get(c)
+	if err != nil {
+		return err
+	}
+	sess.Set("state", state)
+	sess.Set("nonce", nonce)
+	if err := sess.Save(); err != nil {
+		return err
+	}
 
 	q := make(url.Values)
 	q.Add("client_id", api.oktaOpts.OktaClientID)
 	q.Add("response_type", "code")
 	q.Add("response_mode", "query")
-	q.Add("scope", "openid profile email")
+	scope := "openid profile email"
+	if api.groupsClaim != "" {
+		scope += " groups"
+	}
+	q.Add("scope", scope)
 	q.Add("redirect_uri", api.oktaOpts.OktaRedirectURL)
 	q.Add("state", state)
 	q.Add("nonce", nonce)
@@ -68,10 +78,7 @@ func (api *api) oktaLogout(c *fiber.Ctx) error {
 		return err
 	}
 	idToken := cast.ToString(sess.Get("id_token"))
-	sess.Delete("id_token")
-	sess.Delete("access_token")
-	sess.Delete("username")
-	if err := sess.Save(); err != nil {
+	if err := sess.Destroy(); err != nil {
 		return err
 	}
 
@@ -86,8 +93,13 @@ func (api *api) oktaLogout(c *fiber.Ctx) error {
 
 // https://developer.okta.com/docs/guides/sign-into-web-app/go/define-callback/
 func (api *api) oktaCallback(c *fiber.Ctx) error {
+	sess, err := api.store.Get(c)
+	if err != nil {
+		return err
+	}
 	// Check the state that was returned in the query string is the same as the above state
-	if c.Query("state") != state {
+	state := cast.ToString(sess.Get("state"))
+	if state == "" || c.Query("state") != state {
 		return fiber.NewError(fiber.StatusInternalServerError, "The state was not as expected")
 	}
 	// Make sure the code was provided
@@ -103,7 +115,7 @@ func (api *api) oktaCallback(c *fiber.Ctx) error {
 		return err
 	}
 
-	_, verificationError := api.verifyToken(exchange.IdToken)
+	jwt, verificationError := api.verifyToken(exchange.IdToken, cast.ToString(sess.Get("nonce")))
 	if verificationError == nil {
 		// fetch profile
 		client := resty.New().
@@ -128,16 +140,29 @@ func (api *api) oktaCallback(c *fiber.Ctx) error {
 			return err
 		}
 
-		sess, err := api.store.Get(c)
-		if err != nil {
-			return err
+		// sync the roles from the IdP groups
+		if api.groupsClaim != "" {
+			groups := getGroupsFromClaims(m, api.groupsClaim)
+			if len(groups) == 0 {
+				groups = getGroupsFromClaims(jwt.Claims, api.groupsClaim)
+			}
+			if err := api.syncGroupRoles(cast.ToString(m["email"]), groups); err != nil {
+				slog.Error("error in syncGroupRoles", slog.String("error", err.Error()))
+				return err
+			}
 		}
+
+		sess.Delete("state")
+		sess.Delete("nonce")
 		sess.Set("id_token", exchange.IdToken)
 		sess.Set("access_token", exchange.AccessToken)
 		sess.Set("username", m["email"])
 		if err := sess.Save(); err != nil {
 			return err
 		}
+		if err := api.sessions.SetUsername(sess.ID(), cast.ToString(m["email"])); err != nil {
+			slog.Error("error in setting the session username", slog.String("error", err.Error()))
+		}
 	} else {
 		slog.Error("error in verifyToken", slog.String("error", verificationError.Error()))
 	}
@@ -183,7 +208,7 @@ func (api *api) exchangeCode(code string) (Exchange, error) {
 	return exchange, nil
 }
 
-func (api *api) verifyToken(t string) (*verifier.Jwt, error) {
+func (api *api) verifyToken(t, nonce string) (*verifier.Jwt, error) {
 	tv := map[string]string{}
 	tv["nonce"] = nonce
 	tv["aud"] = api.oktaOpts.OktaClientID
@@ -207,6 +232,10 @@ func (api *api) verifyToken(t string) (*verifier.Jwt, error) {
 
 func (api *api) oktaAuthenticator() fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		if getTokenFromLocals(c) != nil {
+			return c.Next()
+		}
+
 		sess, err := api.store.Get(c)
 		if err != nil {
 			return err
@@ -216,6 +245,11 @@ func (api *api) oktaAuthenticator() fiber.Handler {
 			return c.Redirect("/login", fiber.StatusMovedPermanently)
 		}
 
+		// roles are managed by the IdP groups, users without any role are not allowed
+		if api.groupsClaim != "" {
+			return c.Next()
+		}
+
 		// check if the user has any role, if not, by default assign them to "user"
 		email := cast.ToString(sess.Get("username"))
 		roles, err := api.enforcer.GetRolesForUser(email)
@@ -226,7 +260,6 @@ func (api *api) oktaAuthenticator() fiber.Handler {
 			if _, err := api.enforcer.AddRoleForUser(email, "user"); err != nil {
 				return err
 			}
-			api.enforcer.SavePolicy()
 		}
 
 		return c.Next()
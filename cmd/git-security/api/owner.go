@@ -2,6 +2,7 @@ package api
 
 import (
 	"log/slog"
+	"slices"
 	"strconv"
 	"time"
 
@@ -31,15 +32,16 @@ func (a *api) GetOwners(c *fiber.Ctx) error {
 }
 
 func (a *api) CreateOwner(c *fiber.Ctx) error {
-	if _, err := a.db.Collection("owners").InsertOne(
-		a.ctx,
-		config.Owner{
-			Name: strconv.FormatInt(time.Now().UnixMilli(), 10),
-		},
-	); err != nil {
+	owner := config.Owner{
+		Name: strconv.FormatInt(time.Now().UnixMilli(), 10),
+	}
+	result, err := a.db.Collection("owners").InsertOne(a.ctx, owner)
+	if err != nil {
 		slog.Error("error in inserting an owner", slog.String("error", err.Error()))
 		return err
 	}
+	owner.ID, _ = result.InsertedID.(primitive.ObjectID)
+	a.audit(c, "owner", owner.ID.Hex(), nil, owner)
 	return c.SendStatus(200)
 }
 
@@ -52,19 +54,28 @@ func (a *api) UpdateOwner(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
+	var old config.Owner
+	if err := a.findByID("owners", id, &old); err != nil {
+		return err
+	}
 	var owner config.Owner
 	if err := c.BodyParser(&owner); err != nil {
 		return err
 	}
+	if !ownerInScope(c, old.Name) || !ownerInScope(c, owner.Name) {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
 	filter := bson.D{{Key: "_id", Value: id}}
 	update := bson.D{{Key: "$set", Value: owner}}
 	if _, err := a.db.Collection("owners").UpdateOne(a.ctx, filter, update); err != nil {
 		slog.Error("error in updating the owner", slog.String("error", err.Error()))
 		return err
 	}
+	owner.ID = id
+	a.audit(c, "owner", id.Hex(), old, owner)
 
 	// update all the repos with the corresponding owner
-	filter = bson.D{{Key: "repo_owner_id", Value: id}}
+	filter = withScope(c, bson.D{{Key: "repo_owner_id", Value: id}})
 	update = bson.D{{Key: "$set", Value: bson.D{
 		{Key: "repo_owner", Value: owner.Name},
 		{Key: "repo_owner_contact", Value: owner.Contact},
@@ -90,14 +101,22 @@ func (a *api) DeleteOwner(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
+	var old config.Owner
+	if err := a.findByID("owners", id, &old); err != nil {
+		return err
+	}
+	if !ownerInScope(c, old.Name) {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
 	filter := bson.D{{Key: "_id", Value: id}}
 	if _, err := a.db.Collection("owners").DeleteOne(a.ctx, filter); err != nil {
 		slog.Error("error in deleting the owner", slog.String("error", err.Error()))
 		return err
 	}
+	a.audit(c, "owner", id.Hex(), old, nil)
 
 	// unset all the repos with the deleted owner
-	filter = bson.D{{Key: "repo_owner_id", Value: id}}
+	filter = withScope(c, bson.D{{Key: "repo_owner_id", Value: id}})
 	update := bson.D{{Key: "$unset", Value: bson.D{
 		{Key: "repo_owner_id", Value: ""},
 		{Key: "repo_owner", Value: ""},
@@ -114,3 +133,12 @@ func (a *api) DeleteOwner(c *fiber.Ctx) error {
 
 	return c.SendStatus(200)
 }
+
+// ownerInScope tells if a scoped request can manage the owner, the owner has to be one of the
+// repo owners of the scope as renaming or deleting it changes all of its repos
+func ownerInScope(c *fiber.Ctx, name string) bool {
+	if scope := getScopeFromLocals(c); scope != nil {
+		return slices.Contains(scope.RepoOwners, name)
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+// HookPreview is the repos a custom hook or an automation runs for
+type HookPreview struct {
+	Count int      `json:"count"`
+	Repos []string `json:"repos"`
+}
+
+// PreviewCustom returns the repos matched by the custom hook in the body, saved or not
+func (a *api) PreviewCustom(c *fiber.Ctx) error {
+	var custom config.Custom
+	if err := c.BodyParser(&custom); err != nil {
+		return err
+	}
+	return a.previewHook(c, custom.Filters, func(repo *gh.Repository) bool {
+		return custom.HasTarget() && custom.MatchPattern(repo.NameWithOwner)
+	})
+}
+
+// PreviewAutomation returns the repos matched by the automation in the body, saved or not
+func (a *api) PreviewAutomation(c *fiber.Ctx) error {
+	var automation config.Automation
+	if err := c.BodyParser(&automation); err != nil {
+		return err
+	}
+	return a.previewHook(c, automation.Filters, func(repo *gh.Repository) bool {
+		return automation.MatchRepo(repo.NameWithOwner, repo.RepoOwner)
+	})
+}
+
+func (a *api) previewHook(c *fiber.Ctx, repoFilters []config.Filter, match func(repo *gh.Repository) bool) error {
+	filters, err := config.HookFilters(nil, repoFilters)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	repos, err := a.dbw.ReadRepositories(withScope(c, filters))
+	if err != nil {
+		return err
+	}
+
+	preview := HookPreview{Repos: []string{}}
+	for _, repo := range repos {
+		if match(repo) {
+			preview.Repos = append(preview.Repos, repo.NameWithOwner)
+		}
+	}
+	sort.Strings(preview.Repos)
+	preview.Count = len(preview.Repos)
+	return c.JSON(preview)
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+func TestPreviewHooks(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	for i, language := range []string{"Go", "Go", "Python", "Go"} {
+		repo := gh.Repository{
+			GqlRepository: &gh.GqlRepository{
+				ID:            fmt.Sprintf("repo%d", i),
+				NameWithOwner: fmt.Sprintf("org/repo%d", i),
+				IsArchived:    i == 3,
+			},
+			RepoOwner: "team-a",
+		}
+		repo.PrimaryLanguage.Name = language
+		_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+		require.Nil(t, err)
+	}
+
+	a := api{
+		ctx: context.Background(),
+		db:  mdb,
+		dbw: dbw,
+	}
+	app := fiber.New()
+	app.Post("/customs/preview", a.PreviewCustom)
+	app.Post("/automations/preview", a.PreviewAutomation)
+
+	preview := func(path string, body interface{}) (int, HookPreview) {
+		b, err := json.Marshal(body)
+		require.Nil(t, err)
+		req := httptest.NewRequest("POST", path, bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		var p HookPreview
+		json.NewDecoder(resp.Body).Decode(&p)
+		return resp.StatusCode, p
+	}
+	goFilter := config.Filter{Field: "primary_language.name", Values: []interface{}{"Go"}}
+
+	// the filters alone target the unarchived repos
+	status, p := preview("/customs/preview", config.Custom{Filters: []config.Filter{goFilter}})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, HookPreview{Count: 2, Repos: []string{"org/repo0", "org/repo1"}}, p)
+
+	// the filters and the patterns both apply
+	_, p = preview("/customs/preview", config.Custom{Pattern: "org/repo1", Filters: []config.Filter{goFilter}})
+	assert.Equal(t, HookPreview{Count: 1, Repos: []string{"org/repo1"}}, p)
+
+	// no target
+	_, p = preview("/customs/preview", config.Custom{})
+	assert.Equal(t, HookPreview{Count: 0, Repos: []string{}}, p)
+
+	// a filter can select the archived repos
+	_, p = preview("/automations/preview", config.Automation{
+		Owner:   "team-*",
+		Exclude: "org/repo0",
+		Filters: []config.Filter{goFilter, {Field: "is_archived", Values: []interface{}{true, false}}},
+	})
+	assert.Equal(t, HookPreview{Count: 2, Repos: []string{"org/repo1", "org/repo3"}}, p)
+
+	status, _ = preview("/automations/preview", config.Automation{
+		Filters: []config.Filter{{Type: "date", Field: "fetched_at"}},
+	})
+	assert.Equal(t, 400, status)
+
+	// the fields can't be operators
+	for _, field := range []string{"$where", "customs.$where", "$or", ""} {
+		status, _ = preview("/customs/preview", config.Custom{
+			Filters: []config.Filter{{Field: field, Values: []interface{}{"x"}}},
+		})
+		assert.Equal(t, 400, status, field)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -17,16 +18,11 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
 	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
 )
 
-type Filter struct {
-	Type            string        `json:"type"`
-	Field           string        `json:"field"`
-	Values          []interface{} `json:"values"`
-	Negate          bool          `json:"negate"`
-	IncludeZeroTime bool          `json:"include_zero_time"`
-}
+type Filter = config.Filter
 
 type NameCount struct {
 	Name  interface{} `bson:"_id" json:"name"`
@@ -35,12 +31,17 @@ type NameCount struct {
 
 func (a *api) GetRepositories(c *fiber.Ctx) error {
 	q := struct {
-		CSV      bool `query:"csv"`
-		Archived bool `query:"archived"`
+		CSV      bool   `query:"csv"`
+		Archived bool   `query:"archived"`
+		AsOf     string `query:"as_of"`
 	}{}
 	if err := c.QueryParser(&q); err != nil {
 		return err
 	}
+	asOf, err := parseAsOf(q.AsOf)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
 
 	b := struct {
 		Filters []Filter `json:"filters"`
@@ -53,52 +54,35 @@ func (a *api) GetRepositories(c *fiber.Ctx) error {
 	if !q.Archived {
 		filters = append(filters, bson.E{Key: "is_archived", Value: false})
 	}
-	for _, filter := range b.Filters {
-		if filter.Type == "array" {
-			values := bson.A{}
-			for _, v := range filter.Values {
-				values = append(values, bson.M{filter.Field: v})
-			}
-			if filter.Negate {
-				filters = append(filters, bson.E{Key: "$nor", Value: values})
-			} else {
-				filters = append(filters, bson.E{Key: "$or", Value: values})
-			}
-		} else if filter.Type == "date" {
-			if len(filter.Values) != 2 {
-				slog.Error("error in GetRepositories: datefilter value size has to be 2")
-				return c.SendStatus(fiber.StatusBadRequest)
-			}
-			start := time.Now().AddDate(0, 0, cast.ToInt(filter.Values[0]))
-			end := time.Now().AddDate(0, 0, cast.ToInt(filter.Values[1]))
-
-			if filter.IncludeZeroTime {
-				filters = append(filters, bson.E{Key: "$or", Value: []bson.D{
-					{
-						{
-							Key:   filter.Field,
-							Value: bson.M{"$gte": start, "$lte": end},
-						},
-					},
-					{
-						{
-							Key:   filter.Field,
-							Value: bson.M{"$eq": time.Time{}},
-						},
-					},
-				}})
-			} else {
-				filters = append(filters, bson.E{Key: filter.Field, Value: bson.M{"$gte": start, "$lte": end}})
-			}
-		} else {
-			if filter.Negate {
-				filters = append(filters, bson.E{Key: filter.Field, Value: bson.M{"$nin": filter.Values}})
+	var repos []*gh.Repository
+	if asOf.IsZero() {
+		filters, err = config.AppendFilters(filters, b.Filters)
+		if err != nil {
+			slog.Error("error in GetRepositories", slog.String("error", err.Error()))
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		repos, err = a.dbw.ReadRepositories(withScope(c, filters))
+	} else {
+		// the filters on the fields kept along the snapshots are matched before reading them
+		var snapshotFilters, repoFilters []Filter
+		for _, f := range b.Filters {
+			if db.IsRepoSnapshotField(f.Field) {
+				snapshotFilters = append(snapshotFilters, f)
 			} else {
-				filters = append(filters, bson.E{Key: filter.Field, Value: bson.M{"$in": filter.Values}})
+				repoFilters = append(repoFilters, f)
 			}
 		}
+		var others bson.D
+		filters, err = config.AppendFilters(filters, snapshotFilters)
+		if err == nil {
+			others, err = config.AppendFilters(bson.D{}, repoFilters)
+		}
+		if err != nil {
+			slog.Error("error in GetRepositories", slog.String("error", err.Error()))
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		repos, err = a.dbw.ReadRepositoriesAsOf(asOf, withScope(c, filters), others)
 	}
-	repos, err := a.dbw.ReadRepositories(filters)
 	if err != nil {
 		return err
 	}
@@ -166,6 +150,24 @@ func (a *api) GetRepositories(c *fiber.Ctx) error {
 	return c.JSON(repos)
 }
 
+// parseAsOf parses the time of the point-in-time queries, a unix timestamp, an RFC 3339 time
+// or a date for the end of the day in UTC. The zero time is the current state.
+func parseAsOf(asOf string) (time.Time, error) {
+	if asOf == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(asOf, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, asOf); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, asOf); err == nil {
+		return t.Add(24*time.Hour - time.Nanosecond), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid as_of %q, expected a unix timestamp, an RFC 3339 time or a date", asOf)
+}
+
 func (a *api) GetRepositoriesGroupBy(c *fiber.Ctx) error {
 	q := struct {
 		Archived bool `query:"archived"`
@@ -191,53 +193,13 @@ func (a *api) GetRepositoriesGroupBy(c *fiber.Ctx) error {
 	if !q.Archived {
 		filters = append(filters, bson.E{Key: "is_archived", Value: false})
 	}
-	for _, filter := range b.Filters {
-		if filter.Type == "array" {
-			values := bson.A{}
-			for _, v := range filter.Values {
-				values = append(values, bson.M{filter.Field: v})
-			}
-			if filter.Negate {
-				filters = append(filters, bson.E{Key: "$nor", Value: values})
-			} else {
-				filters = append(filters, bson.E{Key: "$or", Value: values})
-			}
-		} else if filter.Type == "date" {
-			if len(filter.Values) != 2 {
-				slog.Error("error in GetRepositories: datefilter value size has to be 2")
-				return c.SendStatus(fiber.StatusBadRequest)
-			}
-			start := time.Now().AddDate(0, 0, cast.ToInt(filter.Values[0]))
-			end := time.Now().AddDate(0, 0, cast.ToInt(filter.Values[1]))
-
-			if filter.IncludeZeroTime {
-				filters = append(filters, bson.E{Key: "$or", Value: []bson.D{
-					{
-						{
-							Key:   filter.Field,
-							Value: bson.M{"$gte": start, "$lte": end},
-						},
-					},
-					{
-						{
-							Key:   filter.Field,
-							Value: bson.M{"$eq": time.Time{}},
-						},
-					},
-				}})
-			} else {
-				filters = append(filters, bson.E{Key: filter.Field, Value: bson.M{"$gte": start, "$lte": end}})
-			}
-		} else {
-			if filter.Negate {
-				filters = append(filters, bson.E{Key: filter.Field, Value: bson.M{"$nin": filter.Values}})
-			} else {
-				filters = append(filters, bson.E{Key: filter.Field, Value: bson.M{"$in": filter.Values}})
-			}
-		}
+	filters, err := config.AppendFilters(filters, b.Filters)
+	if err != nil {
+		slog.Error("error in GetRepositories", slog.String("error", err.Error()))
+		return c.SendStatus(fiber.StatusBadRequest)
 	}
 
-	matchStage := bson.D{{Key: "$match", Value: filters}}
+	matchStage := bson.D{{Key: "$match", Value: withScope(c, filters)}}
 	sortGroupByStage := bson.D{{Key: "$sort", Value: bson.D{{Key: groupBy, Value: 1}}}}
 	groupStage := bson.D{
 		{
@@ -300,12 +262,12 @@ func (a *api) AddBranchProtectionRule(c *fiber.Ctx) error {
 		return err
 	}
 
-	repos, err := a.dbw.ReadRepositories(bson.D{
+	repos, err := a.dbw.ReadRepositories(withScope(c, bson.D{
 		bson.E{
 			Key:   "id",
 			Value: bson.M{"$in": b.IDs},
 		},
-	})
+	}))
 	if err != nil {
 		return err
 	}
@@ -353,12 +315,12 @@ func (a *api) updateBranchProtectionRule(c *fiber.Ctx, updateField string) error
 		b.UpdateValue = int(v)
 	}
 
-	repos, err := a.dbw.ReadRepositories(bson.D{
+	repos, err := a.dbw.ReadRepositories(withScope(c, bson.D{
 		bson.E{
 			Key:   "id",
 			Value: bson.M{"$in": b.IDs},
 		},
-	})
+	}))
 	if err != nil {
 		return err
 	}
@@ -491,7 +453,11 @@ func (a *api) AddRepoOwner(c *fiber.Ctx) error {
 		"repo_owner_contact": owner.Contact,
 	}}
 
-	repos, err := a.dbw.UpdateRepositoriesByIDs(b.IDs, update)
+	ids, err := a.scopedRepoIDs(c, b.IDs)
+	if err != nil {
+		return err
+	}
+	repos, err := a.dbw.UpdateRepositoriesByIDs(ids, update)
 	if err != nil {
 		return err
 	}
@@ -508,6 +474,10 @@ func (a *api) DeleteRepoOwner(c *fiber.Ctx) error {
 	if err := c.BodyParser(&ids); err != nil {
 		return err
 	}
+	ids, err := a.scopedRepoIDs(c, ids)
+	if err != nil {
+		return err
+	}
 
 	// Update the repositories
 	update := bson.M{"$unset": bson.M{
@@ -537,12 +507,12 @@ func (a *api) ArchiveRepo(c *fiber.Ctx) error {
 		return err
 	}
 
-	repos, err := a.dbw.ReadRepositories(bson.D{
+	repos, err := a.dbw.ReadRepositories(withScope(c, bson.D{
 		bson.E{
 			Key:   "id",
 			Value: bson.M{"$in": b.IDs},
 		},
-	})
+	}))
 	if err != nil {
 		return err
 	}
@@ -580,12 +550,12 @@ func (a *api) PreReceiveHook(c *fiber.Ctx) error {
 		return err
 	}
 
-	repos, err := a.dbw.ReadRepositories(bson.D{
+	repos, err := a.dbw.ReadRepositories(withScope(c, bson.D{
 		bson.E{
 			Key:   "id",
 			Value: bson.M{"$in": b.IDs},
 		},
-	})
+	}))
 	if err != nil {
 		return err
 	}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
@@ -245,3 +246,25 @@ func TestGetRepositoriesCSVs(t *testing.T) {
 	expectedData := []string{"repo1", "repo1", "owner1/repo1"}
 	assert.Equal(t, expectedData, records[1])
 }
+
+func TestParseAsOf(t *testing.T) {
+	asOf, err := parseAsOf("")
+	require.Nil(t, err)
+	assert.True(t, asOf.IsZero())
+
+	asOf, err = parseAsOf("1709251200")
+	require.Nil(t, err)
+	assert.Equal(t, int64(1709251200), asOf.Unix())
+
+	asOf, err = parseAsOf("2024-03-01T12:00:00Z")
+	require.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), asOf.UTC())
+
+	// a date is the state at the end of the day
+	asOf, err = parseAsOf("2024-03-01")
+	require.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 3, 1, 23, 59, 59, 999999999, time.UTC), asOf)
+
+	_, err = parseAsOf("March 1st")
+	assert.NotNil(t, err)
+}
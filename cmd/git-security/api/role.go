@@ -0,0 +1,395 @@
+package api
+
+import (
+	"log/slog"
+	"regexp"
+	"slices"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+)
+
+type Permission struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Routes      [][2]string `json:"routes"`
+}
+
+// permissionCatalogue is the list of named permissions the roles are built from,
+// each permission maps to the routes (path glob + method) it grants
+var permissionCatalogue = []Permission{
+	{
+		Name:        "repos.read",
+		Description: "View the repositories, columns, owners and own user view",
+		Routes: [][2]string{
+			{"/api/v1/repos", "POST"},
+			{"/api/v1/repos/*", "POST"},
+			{"/api/v1/columns", "GET"},
+			{"/api/v1/owners", "GET"},
+			{"/api/v1/userview", "GET"},
+			{"/api/v1/userview", "PUT"},
+			{"/ws", "GET"},
+		},
+	},
+	{
+		Name:        "tokens.manage",
+		Description: "Create, list and revoke own API tokens",
+		Routes: [][2]string{
+			{"/api/v1/tokens", "GET"},
+			{"/api/v1/tokens", "POST"},
+			{"/api/v1/token/*", "DELETE"},
+		},
+	},
+	{
+		Name:        "changelog.read",
+		Description: "View and export (CSV) the repositories changelog",
+		Routes: [][2]string{
+			{"/api/v1/changelog", "POST"},
+			{"/api/v1/changelog/*", "POST"},
+		},
+	},
+	{
+		Name:        "owners.assign",
+		Description: "Assign and remove the repo owners",
+		Routes: [][2]string{
+			{"/api/v1/repos/action/repo-owner", "POST"},
+			{"/api/v1/repos/action/delete-owner", "POST"},
+			{"/api/v1/repos/action/delete-owner/*", "POST"},
+		},
+	},
+	{
+		Name:        "owners.manage",
+		Description: "Create, update and delete the owners",
+		Routes: [][2]string{
+			{"/api/v1/owners", "POST"},
+			{"/api/v1/owner/*", "DELETE"},
+			{"/api/v1/owner/*", "PUT"},
+		},
+	},
+	{
+		Name:        "branchprotection.manage",
+		Description: "Create and update the branch protection rules",
+		Routes: [][2]string{
+			{"/api/v1/repos/action/add-branch-protection-rule", "POST"},
+			{"/api/v1/repos/action/admin-enforced", "POST"},
+			{"/api/v1/repos/action/allows-deletions", "POST"},
+			{"/api/v1/repos/action/allows-force-pushes", "POST"},
+			{"/api/v1/repos/action/dismisses-stale-reviews", "POST"},
+			{"/api/v1/repos/action/required-approving-review-count", "POST"},
+			{"/api/v1/repos/action/requires-code-owner-reviews", "POST"},
+			{"/api/v1/repos/action/requires-commit-signatures", "POST"},
+			{"/api/v1/repos/action/requires-conversation-resolution", "POST"},
+			{"/api/v1/repos/action/requires-status-checks", "POST"},
+			{"/api/v1/repos/action/requires-strict-status-checks", "POST"},
+			{"/api/v1/repos/action/requires-pr", "POST"},
+		},
+	},
+	{
+		Name:        "repos.archive",
+		Description: "Archive and unarchive the repositories",
+		Routes: [][2]string{
+			{"/api/v1/repos/action/archive-repo", "POST"},
+		},
+	},
+	{
+		Name:        "prereceivehooks.manage",
+		Description: "Enable and disable the pre-receive hooks",
+		Routes: [][2]string{
+			{"/api/v1/repos/action/pre-receive-hook", "POST"},
+		},
+	},
+	{
+		Name:        "users.read",
+		Description: "View the users, roles and logged time",
+		Routes: [][2]string{
+			{"/api/v1/users", "GET"},
+			{"/api/v1/roles", "GET"},
+			{"/api/v1/logged", "GET"},
+		},
+	},
+	{
+		Name:        "audit.read",
+		Description: "View and export (CSV) the configuration audit log",
+		Routes: [][2]string{
+			{"/api/v1/auditlog", "POST"},
+		},
+	},
+	{
+		Name:        "sessions.manage",
+		Description: "View and revoke the active sessions of the users",
+		Routes: [][2]string{
+			{"/api/v1/sessions", "GET"},
+			{"/api/v1/session/*", "DELETE"},
+			{"/api/v1/user/*/sessions", "DELETE"},
+		},
+	},
+	{
+		Name:        "hooks.run",
+		Description: "View the schedules, trigger the runs of the custom hooks and automations and invalidate their cached results",
+		Routes: [][2]string{
+			{"/api/v1/hookschedules", "GET"},
+			{"/api/v1/custom/*/run", "POST"},
+			{"/api/v1/custom/*/cache", "DELETE"},
+			{"/api/v1/automation/*/run", "POST"},
+		},
+	},
+	{
+		Name:        "secrets.reveal",
+		Description: "Reveal the secret env values of the custom hooks and automations, each reveal is audited",
+		Routes: [][2]string{
+			{"/api/v1/custom/*/reveal", "POST"},
+			{"/api/v1/automation/*/reveal", "POST"},
+		},
+	},
+	{
+		Name:        "hooks.history",
+		Description: "View the runs and logs of the custom hooks and automations",
+		Routes: [][2]string{
+			{"/api/v1/hookruns", "GET"},
+			{"/api/v1/hookrun/*", "GET"},
+		},
+	},
+}
+
+// builtInRoles can't be edited or deleted, admin is granted everything by the casbin model
+var builtInRoles = []config.Role{
+	{
+		Name:        "admin",
+		Description: "Full access",
+		Permissions: []string{},
+	},
+	{
+		Name:        "user",
+		Description: "Read-only access to the repositories",
+		Permissions: []string{"repos.read", "tokens.manage"},
+	},
+	{
+		Name:        "owneradmin",
+		Description: "Manage and assign the repo owners",
+		Permissions: []string{"owners.assign", "owners.manage"},
+	},
+}
+
+var roleNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+func isBuiltInRole(name string) bool {
+	return slices.ContainsFunc(builtInRoles, func(r config.Role) bool { return r.Name == name })
+}
+
+// rolePolicies returns the casbin policies of the role from its permissions
+func rolePolicies(role string, permissions []string) [][]string {
+	policies := make([][]string, 0)
+	for _, p := range permissionCatalogue {
+		if !slices.Contains(permissions, p.Name) {
+			continue
+		}
+		for _, route := range p.Routes {
+			policies = append(policies, []string{role, route[0], route[1]})
+		}
+	}
+	return policies
+}
+
+func validPermissions(permissions []string) bool {
+	for _, name := range permissions {
+		if !slices.ContainsFunc(permissionCatalogue, func(p Permission) bool { return p.Name == name }) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *api) getCustomRoles() ([]config.Role, error) {
+	cursor, err := a.db.Collection("roles").Find(
+		a.ctx,
+		bson.D{},
+		options.Find().SetSort(bson.D{{Key: "name", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(a.ctx)
+	roles := []config.Role{}
+	if err := cursor.All(a.ctx, &roles); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// getRolesDefined returns the names of the built-in and custom roles
+func (a *api) getRolesDefined() (map[string]struct{}, error) {
+	roles, err := a.getCustomRoles()
+	if err != nil {
+		return nil, err
+	}
+	defined := make(map[string]struct{})
+	for _, r := range append(builtInRoles, roles...) {
+		defined[r.Name] = struct{}{}
+	}
+	return defined, nil
+}
+
+// allPolicies returns the casbin policies of the built-in and custom roles
+func (a *api) allPolicies() ([][]string, error) {
+	roles, err := a.getCustomRoles()
+	if err != nil {
+		return nil, err
+	}
+	policies := make([][]string, 0)
+	for _, r := range append(builtInRoles, roles...) {
+		policies = append(policies, rolePolicies(r.Name, r.Permissions)...)
+	}
+	return policies, nil
+}
+
+// replaceRolePolicies replaces the casbin policies of the role
+func (a *api) replaceRolePolicies(role string, permissions []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.replacePolicies(bson.D{{Key: "v0", Value: role}}, rolePolicies(role, permissions))
+}
+
+func (a *api) GetPermissions(c *fiber.Ctx) error {
+	return c.JSON(permissionCatalogue)
+}
+
+func (a *api) GetRoleDefinitions(c *fiber.Ctx) error {
+	roles, err := a.getCustomRoles()
+	if err != nil {
+		return err
+	}
+	definitions := make([]config.Role, 0)
+	for _, r := range builtInRoles {
+		r.BuiltIn = true
+		definitions = append(definitions, r)
+	}
+	return c.JSON(append(definitions, roles...))
+}
+
+func (a *api) CreateRoleDefinition(c *fiber.Ctx) error {
+	var role config.Role
+	if err := c.BodyParser(&role); err != nil {
+		return err
+	}
+	if !roleNameRegex.MatchString(role.Name) || isBuiltInRole(role.Name) || !validPermissions(role.Permissions) {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+
+	if err := a.db.Collection("roles").FindOne(
+		a.ctx,
+		bson.D{{Key: "name", Value: role.Name}},
+	).Err(); err != mongo.ErrNoDocuments {
+		if err != nil {
+			return err
+		}
+		return c.SendStatus(fiber.StatusConflict)
+	}
+
+	if _, err := a.db.Collection("roles").InsertOne(a.ctx, role); err != nil {
+		slog.Error("error in inserting a role", slog.String("error", err.Error()))
+		return err
+	}
+	if err := a.replaceRolePolicies(role.Name, role.Permissions); err != nil {
+		slog.Error("error in adding the role policies", slog.String("error", err.Error()))
+		return err
+	}
+	a.audit(c, "role", role.Name, nil, role)
+	return c.SendStatus(200)
+}
+
+func (a *api) UpdateRoleDefinition(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if name == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if isBuiltInRole(name) {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+
+	var role config.Role
+	if err := c.BodyParser(&role); err != nil {
+		return err
+	}
+	if !validPermissions(role.Permissions) {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+
+	filter := bson.D{{Key: "name", Value: name}}
+	var old config.Role
+	if err := a.db.Collection("roles").FindOne(a.ctx, filter).Decode(&old); err != nil {
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	update := bson.D{{Key: "$set", Value: bson.M{
+		"description": role.Description,
+		"permissions": role.Permissions,
+	}}}
+	if _, err := a.db.Collection("roles").UpdateOne(a.ctx, filter, update); err != nil {
+		slog.Error("error in updating the role", slog.String("error", err.Error()))
+		return err
+	}
+	if err := a.replaceRolePolicies(name, role.Permissions); err != nil {
+		slog.Error("error in replacing the role policies", slog.String("error", err.Error()))
+		return err
+	}
+	updated := old
+	updated.Description = role.Description
+	updated.Permissions = role.Permissions
+	a.audit(c, "role", name, old, updated)
+	return c.SendStatus(200)
+}
+
+func (a *api) DeleteRoleDefinition(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if name == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if isBuiltInRole(name) {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+
+	filter := bson.D{{Key: "name", Value: name}}
+	var old config.Role
+	if err := a.db.Collection("roles").FindOneAndDelete(a.ctx, filter).Decode(&old); err != nil {
+		if err != mongo.ErrNoDocuments {
+			slog.Error("error in deleting the role", slog.String("error", err.Error()))
+			return err
+		}
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	a.audit(c, "role", name, old, nil)
+
+	// remove the policies, the assignments and everything referring to the role
+	if err := a.replaceRolePolicies(name, nil); err != nil {
+		return err
+	}
+	if _, err := a.enforcer.DeleteRole(name); err != nil {
+		return err
+	}
+	if _, err := a.db.Collection("rolescopes").DeleteMany(a.ctx, bson.D{{Key: "role", Value: name}}); err != nil {
+		return err
+	}
+	for _, collection := range []string{"rolemappings", "grouproles"} {
+		if _, err := a.db.Collection(collection).UpdateMany(
+			a.ctx,
+			bson.D{{Key: "roles", Value: name}},
+			bson.D{{Key: "$pull", Value: bson.M{"roles": name}}},
+		); err != nil {
+			return err
+		}
+	}
+	return c.SendStatus(200)
+}
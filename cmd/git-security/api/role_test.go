@@ -0,0 +1,135 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+)
+
+func TestCustomRoles(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	a := api{
+		ctx: context.Background(),
+		db:  mdb,
+		dbw: dbw,
+		getUsernameFromSession: func(c *fiber.Ctx) (string, error) {
+			return "admin", nil
+		},
+	}
+	a.settingUpCasbinEnforcer()
+
+	app := fiber.New()
+	app.Post("/roledefinitions", a.CreateRoleDefinition)
+	app.Put("/roledefinition/:name", a.UpdateRoleDefinition)
+	app.Delete("/roledefinition/:name", a.DeleteRoleDefinition)
+
+	send := func(method, path string, role config.Role) int {
+		b, err := json.Marshal(role)
+		require.Nil(t, err)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		return resp.StatusCode
+	}
+
+	auditor := config.Role{
+		Name:        "security-auditor",
+		Permissions: []string{"repos.read", "changelog.read"},
+	}
+	assert.Equal(t, 200, send("POST", "/roledefinitions", auditor))
+	assert.Equal(t, 409, send("POST", "/roledefinitions", auditor))
+	assert.Equal(t, 400, send("POST", "/roledefinitions", config.Role{Name: "admin"}))
+	assert.Equal(t, 400, send("POST", "/roledefinitions", config.Role{Name: "foo", Permissions: []string{"unknown"}}))
+	assert.Equal(t, 403, send("PUT", "/roledefinition/user", config.Role{Permissions: []string{"changelog.read"}}))
+
+	_, err := a.enforcer.AddRoleForUser("foo@bar.com", "security-auditor")
+	require.Nil(t, err)
+	r, err := a.enforcer.Enforce("foo@bar.com", "/api/v1/changelog", "POST")
+	require.Nil(t, err)
+	assert.True(t, r)
+
+	// survives a restart
+	require.Nil(t, a.resetPolicies())
+	r, err = a.enforcer.Enforce("foo@bar.com", "/api/v1/changelog", "POST")
+	require.Nil(t, err)
+	assert.True(t, r)
+	r, err = a.enforcer.Enforce("foo@bar.com", "/api/v1/repos/action/requires-pr", "POST")
+	require.Nil(t, err)
+	assert.False(t, r)
+
+	// narrowed down
+	assert.Equal(t, 200, send("PUT", "/roledefinition/security-auditor", config.Role{Permissions: []string{"repos.read"}}))
+	r, err = a.enforcer.Enforce("foo@bar.com", "/api/v1/changelog", "POST")
+	require.Nil(t, err)
+	assert.False(t, r)
+	r, err = a.enforcer.Enforce("foo@bar.com", "/api/v1/repos", "POST")
+	require.Nil(t, err)
+	assert.True(t, r)
+
+	// deleted along with the assignments
+	assert.Equal(t, 200, send("DELETE", "/roledefinition/security-auditor", config.Role{}))
+	roles, err := a.enforcer.GetRolesForUser("foo@bar.com")
+	require.Nil(t, err)
+	assert.Empty(t, roles)
+	assert.Equal(t, 403, send("DELETE", "/roledefinition/admin", config.Role{}))
+}
+
+func TestReplicaPolicies(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	_, err := mdb.Collection("roles").InsertOne(context.Background(), config.Role{
+		Name:        "auditor",
+		Permissions: []string{"audit.read"},
+	})
+	require.Nil(t, err)
+	a := api{ctx: context.Background(), db: mdb, dbw: dbw}
+	a.settingUpCasbinEnforcer()
+	replica := api{ctx: context.Background(), db: mdb, dbw: dbw}
+	replica.settingUpCasbinEnforcer()
+
+	// the replicas resetting the policies at once keep a single copy of each rule
+	var wg sync.WaitGroup
+	for _, r := range []*api{&a, &replica} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, r.resetPolicies())
+		}()
+	}
+	wg.Wait()
+	policies, err := a.allPolicies()
+	require.Nil(t, err)
+	count, err := mdb.Collection("casbin_rule").CountDocuments(a.ctx, bson.D{{Key: "ptype", Value: "p"}})
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(policies)), count)
+
+	// the changes of a replica apply to the others once they reload the policies
+	_, err = a.enforcer.AddRoleForUser("foo@bar.com", "auditor")
+	require.Nil(t, err)
+	require.Nil(t, a.replaceRolePolicies("auditor", []string{"users.read"}))
+	allowed, err := replica.enforcer.Enforce("foo@bar.com", "/api/v1/users", "GET")
+	require.Nil(t, err)
+	assert.False(t, allowed)
+	require.Nil(t, replica.reloadPolicies())
+	allowed, err = replica.enforcer.Enforce("foo@bar.com", "/api/v1/users", "GET")
+	require.Nil(t, err)
+	assert.True(t, allowed)
+	allowed, err = replica.enforcer.Enforce("foo@bar.com", "/api/v1/auditlog", "POST")
+	require.Nil(t, err)
+	assert.False(t, allowed)
+}
@@ -0,0 +1,236 @@
+package api
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/cast"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+)
+
+func (a *api) GetRoleMappings(c *fiber.Ctx) error {
+	cursor, err := a.db.Collection("rolemappings").Find(
+		a.ctx,
+		bson.D{},
+		options.Find().SetSort(bson.D{{Key: "group", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(a.ctx)
+	mappings := []config.RoleMapping{}
+	if err := cursor.All(a.ctx, &mappings); err != nil {
+		return err
+	}
+	return c.JSON(mappings)
+}
+
+func (a *api) CreateRoleMapping(c *fiber.Ctx) error {
+	mapping := config.RoleMapping{
+		Roles: []string{},
+	}
+	result, err := a.db.Collection("rolemappings").InsertOne(a.ctx, mapping)
+	if err != nil {
+		slog.Error("error in inserting a role mapping", slog.String("error", err.Error()))
+		return err
+	}
+	mapping.ID, _ = result.InsertedID.(primitive.ObjectID)
+	a.audit(c, "rolemapping", mapping.ID.Hex(), nil, mapping)
+	return c.SendStatus(200)
+}
+
+func (a *api) UpdateRoleMapping(c *fiber.Ctx) error {
+	_id := c.Params("id")
+	if _id == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	id, err := primitive.ObjectIDFromHex(_id)
+	if err != nil {
+		return err
+	}
+	var mapping config.RoleMapping
+	if err := c.BodyParser(&mapping); err != nil {
+		return err
+	}
+	rolesDefined, err := a.getRolesDefined()
+	if err != nil {
+		return err
+	}
+	for _, role := range mapping.Roles {
+		if _, ok := rolesDefined[role]; !ok {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+	}
+	var old config.RoleMapping
+	if err := a.findByID("rolemappings", id, &old); err != nil {
+		return err
+	}
+	filter := bson.D{{Key: "_id", Value: id}}
+	update := bson.D{{Key: "$set", Value: mapping}}
+	if _, err := a.db.Collection("rolemappings").UpdateOne(a.ctx, filter, update); err != nil {
+		slog.Error("error in updating the role mapping", slog.String("error", err.Error()))
+		return err
+	}
+	mapping.ID = id
+	a.audit(c, "rolemapping", id.Hex(), old, mapping)
+	return c.SendStatus(200)
+}
+
+func (a *api) DeleteRoleMapping(c *fiber.Ctx) error {
+	_id := c.Params("id")
+	if _id == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	id, err := primitive.ObjectIDFromHex(_id)
+	if err != nil {
+		return err
+	}
+	var old config.RoleMapping
+	if err := a.findByID("rolemappings", id, &old); err != nil {
+		return err
+	}
+	filter := bson.D{{Key: "_id", Value: id}}
+	if _, err := a.db.Collection("rolemappings").DeleteOne(a.ctx, filter); err != nil {
+		slog.Error("error in deleting the role mapping", slog.String("error", err.Error()))
+		return err
+	}
+	a.audit(c, "rolemapping", id.Hex(), old, nil)
+	return c.SendStatus(200)
+}
+
+// getGroupsFromClaims extracts the group names from the userinfo / id token claims
+func getGroupsFromClaims(claims map[string]interface{}, claim string) []string {
+	v, ok := claims[claim]
+	if !ok || v == nil {
+		return []string{}
+	}
+	switch groups := v.(type) {
+	case string:
+		return []string{groups}
+	default:
+		return cast.ToStringSlice(groups)
+	}
+}
+
+// mapGroupsToRoles returns the deduplicated and sorted roles granted by the groups
+func mapGroupsToRoles(groups []string, mappings []config.RoleMapping, rolesDefined map[string]struct{}) []string {
+	dedup := make(map[string]struct{})
+	for _, mapping := range mappings {
+		if !slices.Contains(groups, mapping.Group) {
+			continue
+		}
+		for _, role := range mapping.Roles {
+			if _, ok := rolesDefined[role]; ok {
+				dedup[role] = struct{}{}
+			}
+		}
+	}
+	roles := make([]string, 0, len(dedup))
+	for role := range dedup {
+		roles = append(roles, role)
+	}
+	slices.Sort(roles)
+	return roles
+}
+
+// syncGroupRoles aligns the casbin roles of the user with the roles granted by the IdP groups.
+// Roles that were assigned manually are left untouched; roles previously granted by a group
+// the user is no longer part of are removed.
+func (a *api) syncGroupRoles(username string, groups []string) error {
+	cursor, err := a.db.Collection("rolemappings").Find(a.ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(a.ctx)
+	var mappings []config.RoleMapping
+	if err := cursor.All(a.ctx, &mappings); err != nil {
+		return err
+	}
+
+	var gr config.GroupRoles
+	if err := a.db.Collection("grouproles").FindOne(
+		a.ctx,
+		bson.D{{Key: "username", Value: username}},
+	).Decode(&gr); err != nil {
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+
+	// the roles may have been changed by another replica, the roles added and deleted below
+	// are saved one by one so that the changes of the others are kept
+	if err := a.reloadPolicies(); err != nil {
+		return err
+	}
+	currentRoles, err := a.enforcer.GetRolesForUser(username)
+	if err != nil {
+		return err
+	}
+
+	rolesDefined, err := a.getRolesDefined()
+	if err != nil {
+		return err
+	}
+	mapped := mapGroupsToRoles(groups, mappings, rolesDefined)
+	owned := make([]string, 0)
+	for _, role := range gr.Roles {
+		if slices.Contains(mapped, role) {
+			owned = append(owned, role)
+		} else if slices.Contains(currentRoles, role) {
+			slog.Info("removing group role", slog.String("username", username), slog.String("role", role))
+			if _, err := a.enforcer.DeleteRoleForUser(username, role); err != nil {
+				return err
+			}
+		}
+	}
+	for _, role := range mapped {
+		if slices.Contains(currentRoles, role) {
+			continue
+		}
+		slog.Info("adding group role", slog.String("username", username), slog.String("role", role))
+		if _, err := a.enforcer.AddRoleForUser(username, role); err != nil {
+			return err
+		}
+		if !slices.Contains(owned, role) {
+			owned = append(owned, role)
+		}
+	}
+	filter := bson.D{{Key: "username", Value: username}}
+	update := bson.D{{Key: "$set", Value: config.GroupRoles{
+		Username: username,
+		Groups:   groups,
+		Roles:    owned,
+		SyncedAt: time.Now(),
+	}}}
+	if _, err := a.db.Collection("grouproles").UpdateOne(
+		a.ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+		slog.Error("error in updating the group roles", slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// getGroupRolesMap returns the group granted roles by username
+func (a *api) getGroupRolesMap() (map[string][]string, error) {
+	cursor, err := a.db.Collection("grouproles").Find(a.ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(a.ctx)
+	var grs []config.GroupRoles
+	if err := cursor.All(a.ctx, &grs); err != nil {
+		return nil, err
+	}
+	m := make(map[string][]string)
+	for _, gr := range grs {
+		m[gr.Username] = gr.Roles
+	}
+	return m, nil
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+)
+
+func TestMapGroupsToRoles(t *testing.T) {
+	mappings := []config.RoleMapping{
+		{Group: "security", Roles: []string{"admin", "user"}},
+		{Group: "eng", Roles: []string{"user"}},
+		{Group: "typo", Roles: []string{"superuser"}},
+	}
+	rolesDefined := map[string]struct{}{"admin": {}, "user": {}, "owneradmin": {}}
+	assert.Equal(t, []string{"admin", "user"}, mapGroupsToRoles([]string{"eng", "security"}, mappings, rolesDefined))
+	assert.Equal(t, []string{"user"}, mapGroupsToRoles([]string{"eng"}, mappings, rolesDefined))
+	assert.Equal(t, []string{}, mapGroupsToRoles([]string{"typo", "other"}, mappings, rolesDefined))
+}
+
+func TestGetGroupsFromClaims(t *testing.T) {
+	claims := map[string]interface{}{
+		"groups": []interface{}{"a", "b"},
+		"single": "c",
+	}
+	assert.Equal(t, []string{"a", "b"}, getGroupsFromClaims(claims, "groups"))
+	assert.Equal(t, []string{"c"}, getGroupsFromClaims(claims, "single"))
+	assert.Equal(t, []string{}, getGroupsFromClaims(claims, "missing"))
+}
+
+func TestSyncGroupRoles(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	a := api{
+		ctx: context.Background(),
+		db:  mdb,
+		dbw: dbw,
+	}
+	a.settingUpCasbinEnforcer()
+
+	_, err := mdb.Collection("rolemappings").InsertOne(a.ctx, config.RoleMapping{
+		Group: "security",
+		Roles: []string{"admin"},
+	})
+	require.Nil(t, err)
+
+	// manually assigned role
+	_, err = a.enforcer.AddRoleForUser("foo@bar.com", "owneradmin")
+	require.Nil(t, err)
+
+	require.Nil(t, a.syncGroupRoles("foo@bar.com", []string{"security"}))
+	roles, err := a.enforcer.GetRolesForUser("foo@bar.com")
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{"admin", "owneradmin"}, roles)
+
+	groupRoles, err := a.getGroupRolesMap()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"admin"}, groupRoles["foo@bar.com"])
+
+	// left the group
+	require.Nil(t, a.syncGroupRoles("foo@bar.com", []string{}))
+	roles, err = a.enforcer.GetRolesForUser("foo@bar.com")
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{"owneradmin"}, roles)
+
+	// the sync on a replica with stale policies keeps the changes of the others
+	replica := api{ctx: context.Background(), db: mdb, dbw: dbw}
+	replica.enforcer, err = newEnforcer(mdb)
+	require.Nil(t, err)
+	_, err = a.enforcer.DeleteRoleForUser("foo@bar.com", "owneradmin")
+	require.Nil(t, err)
+	require.Nil(t, replica.syncGroupRoles("foo@bar.com", []string{"security"}))
+	require.Nil(t, a.reloadPolicies())
+	roles, err = a.enforcer.GetRolesForUser("foo@bar.com")
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{"admin"}, roles)
+}
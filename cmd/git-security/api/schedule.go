@@ -0,0 +1,120 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+)
+
+func (a *api) GetHookSchedules(c *fiber.Ctx) error {
+	schedules, err := a.dbw.ReadHookSchedules(bson.D{})
+	if err != nil {
+		return err
+	}
+	return c.JSON(schedules)
+}
+
+func (a *api) RunCustom(c *fiber.Ctx) error {
+	return a.triggerHook(c, db.HookTypeCustom, "customs")
+}
+
+func (a *api) RunAutomation(c *fiber.Ctx) error {
+	return a.triggerHook(c, db.HookTypeAutomation, "automations")
+}
+
+// triggerHook requests a run of the enabled hook for all the repos or the ones in the body,
+// the scheduler picks it up at its next tick
+func (a *api) triggerHook(c *fiber.Ctx, hookType, collection string) error {
+	_id := c.Params("id")
+	if _id == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	id, err := primitive.ObjectIDFromHex(_id)
+	if err != nil {
+		return err
+	}
+
+	b := struct {
+		Repos []string `json:"repos"`
+	}{}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&b); err != nil {
+			return err
+		}
+	}
+
+	var hook struct {
+		Enabled bool          `bson:"enabled"`
+		Events  []interface{} `bson:"events"`
+	}
+	if err := a.db.Collection(collection).FindOne(
+		a.ctx,
+		bson.D{{Key: "_id", Value: id}},
+	).Decode(&hook); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return err
+	}
+	if !hook.Enabled {
+		return fiber.NewError(fiber.StatusBadRequest, "the hook is disabled")
+	}
+	if len(hook.Events) > 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "the hook runs on the repo changes")
+	}
+
+	repos, err := a.scopedRepoNames(c, b.Repos)
+	if err != nil {
+		return err
+	}
+	if getScopeFromLocals(c) != nil && len(repos) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "none of the repos is in scope")
+	}
+
+	username, err := a.getUsernameFromSession(c)
+	if err != nil {
+		return err
+	}
+	if err := a.dbw.TriggerHook(hookType, id, repos, username); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+// InvalidateCustomCache drops the cached runs of the custom hook for all the repos or the
+// ones in the body, their next run refreshes them
+func (a *api) InvalidateCustomCache(c *fiber.Ctx) error {
+	_id := c.Params("id")
+	if _id == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	id, err := primitive.ObjectIDFromHex(_id)
+	if err != nil {
+		return err
+	}
+
+	b := struct {
+		Repos []string `json:"repos"`
+	}{}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&b); err != nil {
+			return err
+		}
+	}
+
+	repos, err := a.scopedRepoNames(c, b.Repos)
+	if err != nil {
+		return err
+	}
+	if getScopeFromLocals(c) != nil && len(repos) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "none of the repos is in scope")
+	}
+
+	if err := a.dbw.DeleteHookCache(id, repos); err != nil {
+		return err
+	}
+	return c.SendStatus(200)
+}
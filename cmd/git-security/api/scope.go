@@ -0,0 +1,284 @@
+package api
+
+import (
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/IGLOU-EU/go-wildcard/v2"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+const (
+	scopeLocalsKey = "scope"
+)
+
+// repoScope is the union of the role scopes granting the current request,
+// a nil scope means the request is not restricted
+type repoScope struct {
+	Orgs       []string
+	RepoOwners []string
+	Patterns   []string
+}
+
+// filter returns the mongo filter matching the repositories (or changelog entries) in scope
+func (rs *repoScope) filter() bson.E {
+	or := bson.A{}
+	if len(rs.Orgs) > 0 {
+		or = append(or, bson.M{"owner.login": bson.M{"$in": rs.Orgs}})
+	}
+	if len(rs.RepoOwners) > 0 {
+		or = append(or, bson.M{"repo_owner": bson.M{"$in": rs.RepoOwners}})
+	}
+	for _, p := range rs.Patterns {
+		or = append(or, bson.M{"full_name": bson.M{"$regex": wildcardToRegex(p)}})
+	}
+	if len(or) == 0 {
+		// scoped to nothing
+		return bson.E{Key: "id", Value: bson.M{"$in": bson.A{}}}
+	}
+	// wrapped in $and so it doesn't collide with the $or of the other filters
+	return bson.E{Key: "$and", Value: bson.A{bson.M{"$or": or}}}
+}
+
+func (rs *repoScope) match(repo *gh.Repository) bool {
+	if slices.Contains(rs.Orgs, repo.Owner.Login) || slices.Contains(rs.RepoOwners, repo.RepoOwner) {
+		return true
+	}
+	for _, p := range rs.Patterns {
+		if wildcard.Match(p, repo.NameWithOwner) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardToRegex converts the go-wildcard pattern to an anchored regex
+func wildcardToRegex(pattern string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".?")
+		case '.':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+// getRepoScope resolves the scope of the request from the scoped roles granting it
+func (a *api) getRepoScope(c *fiber.Ctx, username string) (*repoScope, error) {
+	path := string(c.Request().URI().Path())
+	method := string(c.Request().Header.Method())
+
+	roles, err := a.enforcer.GetRolesForUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if token := getTokenFromLocals(c); token != nil && len(token.Roles) > 0 {
+		roles = slices.DeleteFunc(roles, func(role string) bool {
+			return !slices.Contains(token.Roles, role)
+		})
+	}
+	if slices.Contains(roles, "admin") {
+		return nil, nil
+	}
+
+	cursor, err := a.db.Collection("rolescopes").Find(a.ctx, bson.D{{Key: "username", Value: username}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(a.ctx)
+	var roleScopes []config.RoleScope
+	if err := cursor.All(a.ctx, &roleScopes); err != nil {
+		return nil, err
+	}
+	scopes := make(map[string]config.RoleScope)
+	for _, rs := range roleScopes {
+		scopes[rs.Role] = rs
+	}
+
+	scope := &repoScope{}
+	for _, role := range roles {
+		r, err := a.enforcer.Enforce(role, path, method)
+		if err != nil {
+			return nil, err
+		}
+		if !r {
+			continue
+		}
+		rs, ok := scopes[role]
+		if !ok || rs.IsEmpty() {
+			// one of the granting roles is not scoped
+			return nil, nil
+		}
+		scope.Orgs = append(scope.Orgs, rs.Orgs...)
+		scope.RepoOwners = append(scope.RepoOwners, rs.RepoOwners...)
+		scope.Patterns = append(scope.Patterns, rs.Patterns...)
+	}
+	return scope, nil
+}
+
+func getScopeFromLocals(c *fiber.Ctx) *repoScope {
+	if scope, ok := c.Locals(scopeLocalsKey).(*repoScope); ok {
+		return scope
+	}
+	return nil
+}
+
+// withScope appends the scope of the request to the filters
+func withScope(c *fiber.Ctx, filters bson.D) bson.D {
+	if scope := getScopeFromLocals(c); scope != nil {
+		return append(filters, scope.filter())
+	}
+	return filters
+}
+
+// scopedRepoIDs drops the repo IDs that are out of the scope of the request
+func (a *api) scopedRepoIDs(c *fiber.Ctx, ids []string) ([]string, error) {
+	if getScopeFromLocals(c) == nil {
+		return ids, nil
+	}
+	repos, err := a.dbw.ReadRepositories(withScope(c, bson.D{
+		bson.E{
+			Key:   "id",
+			Value: bson.M{"$in": ids},
+		},
+	}))
+	if err != nil {
+		return nil, err
+	}
+	scoped := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		scoped = append(scoped, repo.ID)
+	}
+	return scoped, nil
+}
+
+// scopedRepoNames drops the repo names that are out of the scope of the request, no names
+// means all the repos and is replaced by the ones in scope
+func (a *api) scopedRepoNames(c *fiber.Ctx, names []string) ([]string, error) {
+	if getScopeFromLocals(c) == nil {
+		return names, nil
+	}
+	filters := bson.D{}
+	if len(names) > 0 {
+		filters = append(filters, bson.E{Key: "full_name", Value: bson.M{"$in": names}})
+	}
+	repos, err := a.dbw.ReadRepositories(withScope(c, filters))
+	if err != nil {
+		return nil, err
+	}
+	scoped := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		scoped = append(scoped, repo.NameWithOwner)
+	}
+	return scoped, nil
+}
+
+func (a *api) GetRoleScopes(c *fiber.Ctx) error {
+	cursor, err := a.db.Collection("rolescopes").Find(
+		a.ctx,
+		bson.D{},
+		options.Find().SetSort(bson.D{{Key: "username", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(a.ctx)
+	roleScopes := []config.RoleScope{}
+	if err := cursor.All(a.ctx, &roleScopes); err != nil {
+		return err
+	}
+	return c.JSON(roleScopes)
+}
+
+func (a *api) UpdateRoleScope(c *fiber.Ctx) error {
+	var rs config.RoleScope
+	if err := c.BodyParser(&rs); err != nil {
+		return err
+	}
+	if rs.Username == "" || rs.Role == "admin" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	rolesDefined, err := a.getRolesDefined()
+	if err != nil {
+		return err
+	}
+	if _, ok := rolesDefined[rs.Role]; !ok {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	rs.ID = primitive.NilObjectID
+
+	filter := bson.D{
+		{Key: "username", Value: rs.Username},
+		{Key: "role", Value: rs.Role},
+	}
+	entityID := rs.Username + "/" + rs.Role
+	var old config.RoleScope
+	if err := a.db.Collection("rolescopes").FindOne(a.ctx, filter).Decode(&old); err != nil {
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+	var before interface{}
+	if !old.ID.IsZero() {
+		before = old
+	}
+	if rs.IsEmpty() {
+		if _, err := a.db.Collection("rolescopes").DeleteOne(a.ctx, filter); err != nil {
+			slog.Error("error in deleting the role scope", slog.String("error", err.Error()))
+			return err
+		}
+		if before != nil {
+			a.audit(c, "rolescope", entityID, before, nil)
+		}
+		return c.SendStatus(200)
+	}
+	update := bson.D{{Key: "$set", Value: rs}}
+	if _, err := a.db.Collection("rolescopes").UpdateOne(
+		a.ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+		slog.Error("error in updating the role scope", slog.String("error", err.Error()))
+		return err
+	}
+	rs.ID = old.ID
+	a.audit(c, "rolescope", entityID, before, rs)
+	return c.SendStatus(200)
+}
+
+func (a *api) DeleteRoleScope(c *fiber.Ctx) error {
+	_id := c.Params("id")
+	if _id == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	id, err := primitive.ObjectIDFromHex(_id)
+	if err != nil {
+		return err
+	}
+	var old config.RoleScope
+	if err := a.findByID("rolescopes", id, &old); err != nil {
+		return err
+	}
+	filter := bson.D{{Key: "_id", Value: id}}
+	if _, err := a.db.Collection("rolescopes").DeleteOne(a.ctx, filter); err != nil {
+		slog.Error("error in deleting the role scope", slog.String("error", err.Error()))
+		return err
+	}
+	a.audit(c, "rolescope", old.Username+"/"+old.Role, old, nil)
+	return c.SendStatus(200)
+}
@@ -0,0 +1,348 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+func TestWildcardToRegex(t *testing.T) {
+	assert.Regexp(t, regexp.MustCompile(wildcardToRegex("org/repo*")), "org/repo123")
+	assert.NotRegexp(t, regexp.MustCompile(wildcardToRegex("org/repo*")), "other/org/repo123")
+	assert.Regexp(t, regexp.MustCompile(wildcardToRegex("org/a+b")), "org/a+b")
+	assert.NotRegexp(t, regexp.MustCompile(wildcardToRegex("org/a+b")), "org/aab")
+}
+
+func TestScopedRepositories(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	for _, r := range []struct{ id, org, owner string }{
+		{"1", "payments", ""},
+		{"2", "payments", "team-a"},
+		{"3", "infra", "team-a"},
+		{"4", "infra", ""},
+	} {
+		repo := gh.Repository{
+			GqlRepository: &gh.GqlRepository{
+				ID:            r.id,
+				Name:          "repo" + r.id,
+				NameWithOwner: r.org + "/repo" + r.id,
+			},
+			RepoOwner: r.owner,
+		}
+		repo.Owner.Login = r.org
+		_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+		require.Nil(t, err)
+	}
+
+	a := api{
+		ctx: context.Background(),
+		db:  mdb,
+		dbw: dbw,
+		getUsernameFromSession: func(c *fiber.Ctx) (string, error) {
+			return "foo@bar.com", nil
+		},
+	}
+	a.settingUpCasbinEnforcer()
+	_, err := a.enforcer.AddRoleForUser("foo@bar.com", "user")
+	require.Nil(t, err)
+
+	app := fiber.New()
+	app.Use(a.authorizer())
+	app.Post("/api/v1/repos", a.GetRepositories)
+
+	getRepoIDs := func() []string {
+		req := httptest.NewRequest("POST", "/api/v1/repos", bytes.NewBufferString("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		var repos []gh.Repository
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&repos))
+		ids := make([]string, 0)
+		for _, repo := range repos {
+			ids = append(ids, repo.ID)
+		}
+		return ids
+	}
+
+	// not scoped
+	assert.ElementsMatch(t, []string{"1", "2", "3", "4"}, getRepoIDs())
+
+	// scoped to an org and a repo owner
+	_, err = mdb.Collection("rolescopes").InsertOne(a.ctx, config.RoleScope{
+		Username:   "foo@bar.com",
+		Role:       "user",
+		Orgs:       []string{"payments"},
+		RepoOwners: []string{"team-a"},
+	})
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{"1", "2", "3"}, getRepoIDs())
+
+	// scoped to a pattern
+	_, err = mdb.Collection("rolescopes").UpdateOne(
+		a.ctx,
+		bson.D{{Key: "username", Value: "foo@bar.com"}},
+		bson.D{{Key: "$set", Value: bson.M{"orgs": []string{}, "repo_owners": []string{}, "patterns": []string{"infra/*4"}}}},
+	)
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{"4"}, getRepoIDs())
+}
+
+func TestScopedOwners(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	a := api{
+		ctx: context.Background(),
+		db:  mdb,
+		dbw: dbw,
+		getUsernameFromSession: func(c *fiber.Ctx) (string, error) {
+			return "foo@bar.com", nil
+		},
+	}
+	a.settingUpCasbinEnforcer()
+	_, err := a.enforcer.AddRoleForUser("foo@bar.com", "owneradmin")
+	require.Nil(t, err)
+	_, err = mdb.Collection("rolescopes").InsertOne(a.ctx, config.RoleScope{
+		Username:   "foo@bar.com",
+		Role:       "owneradmin",
+		RepoOwners: []string{"team-a"},
+	})
+	require.Nil(t, err)
+
+	owners := map[string]config.Owner{}
+	for _, name := range []string{"team-a", "team-b"} {
+		res, err := mdb.Collection("owners").InsertOne(a.ctx, config.Owner{Name: name})
+		require.Nil(t, err)
+		owner := config.Owner{Name: name}
+		owner.ID = res.InsertedID.(primitive.ObjectID)
+		owners[name] = owner
+
+		repo := gh.Repository{
+			GqlRepository: &gh.GqlRepository{ID: name, NameWithOwner: "org/" + name},
+			RepoOwnerID:   owner.ID,
+			RepoOwner:     name,
+		}
+		_, err = dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+		require.Nil(t, err)
+	}
+
+	app := fiber.New()
+	app.Use(a.authorizer())
+	app.Put("/api/v1/owner/:id", a.UpdateOwner)
+	app.Delete("/api/v1/owner/:id", a.DeleteOwner)
+
+	send := func(method, name string, owner config.Owner) int {
+		body, err := json.Marshal(owner)
+		require.Nil(t, err)
+		req := httptest.NewRequest(method, "/api/v1/owner/"+owners[name].ID.Hex(), bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		return resp.StatusCode
+	}
+
+	// the owners out of the scope can't be changed, nor can the owner take another name
+	assert.Equal(t, 403, send("PUT", "team-b", config.Owner{Name: "team-b", Contact: "x"}))
+	assert.Equal(t, 403, send("DELETE", "team-b", config.Owner{}))
+	assert.Equal(t, 403, send("PUT", "team-a", config.Owner{Name: "team-b"}))
+	assert.Equal(t, 200, send("PUT", "team-a", config.Owner{Name: "team-a", Contact: "a@bar.com"}))
+
+	repos, err := dbw.ReadRepositories(bson.D{})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(repos))
+	for _, repo := range repos {
+		if repo.ID == "team-a" {
+			assert.Equal(t, "a@bar.com", repo.RepoOwnerContact)
+		} else {
+			assert.Equal(t, "team-b", repo.RepoOwner)
+		}
+	}
+
+	assert.Equal(t, 200, send("DELETE", "team-a", config.Owner{}))
+	count, err := mdb.Collection("owners").CountDocuments(a.ctx, bson.D{})
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestScopedTrigger(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	for _, name := range []string{"payments/api", "infra/tools"} {
+		repo := gh.Repository{GqlRepository: &gh.GqlRepository{ID: name, NameWithOwner: name}}
+		repo.Owner.Login = strings.Split(name, "/")[0]
+		_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+		require.Nil(t, err)
+	}
+	res, err := mdb.Collection("customs").InsertOne(context.Background(), config.Custom{Enabled: true})
+	require.Nil(t, err)
+	id := res.InsertedID.(primitive.ObjectID)
+
+	a := api{
+		ctx: context.Background(),
+		db:  mdb,
+		dbw: dbw,
+		getUsernameFromSession: func(c *fiber.Ctx) (string, error) {
+			return "foo@bar.com", nil
+		},
+	}
+	a.settingUpCasbinEnforcer()
+	_, err = a.enforcer.AddPolicies(rolePolicies("runner", []string{"hooks.run"}))
+	require.Nil(t, err)
+	_, err = a.enforcer.AddRoleForUser("foo@bar.com", "runner")
+	require.Nil(t, err)
+	_, err = mdb.Collection("rolescopes").InsertOne(a.ctx, config.RoleScope{
+		Username: "foo@bar.com",
+		Role:     "runner",
+		Orgs:     []string{"payments"},
+	})
+	require.Nil(t, err)
+
+	app := fiber.New()
+	app.Use(a.authorizer())
+	app.Post("/api/v1/custom/:id/run", a.RunCustom)
+	app.Delete("/api/v1/custom/:id/cache", a.InvalidateCustomCache)
+
+	run := func(repos []string) int {
+		body, err := json.Marshal(bson.M{"repos": repos})
+		require.Nil(t, err)
+		req := httptest.NewRequest("POST", "/api/v1/custom/"+id.Hex()+"/run", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		return resp.StatusCode
+	}
+	triggered := func() []string {
+		trigger, err := dbw.TakeHookTrigger(db.HookTypeCustom, id)
+		require.Nil(t, err)
+		require.NotNil(t, trigger)
+		return trigger.Repos
+	}
+
+	// the repos out of the scope are dropped, and all the repos are the ones in scope
+	assert.Equal(t, 202, run([]string{"payments/api", "infra/tools"}))
+	assert.Equal(t, []string{"payments/api"}, triggered())
+	assert.Equal(t, 202, run(nil))
+	assert.Equal(t, []string{"payments/api"}, triggered())
+	assert.Equal(t, 400, run([]string{"infra/tools"}))
+
+	// the cache is only invalidated for the repos in scope
+	invalidate := func(repos []string) int {
+		body, err := json.Marshal(bson.M{"repos": repos})
+		require.Nil(t, err)
+		req := httptest.NewRequest("DELETE", "/api/v1/custom/"+id.Hex()+"/cache", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		return resp.StatusCode
+	}
+	cached := func() []string {
+		cache, err := dbw.ReadHookCache(id)
+		require.Nil(t, err)
+		repos := make([]string, 0, len(cache))
+		for repo := range cache {
+			repos = append(repos, repo)
+		}
+		return repos
+	}
+	for _, name := range []string{"payments/api", "infra/tools"} {
+		require.Nil(t, dbw.UpdateHookCache(&db.HookCacheEntry{HookID: id, Repo: name, RanAt: time.Now()}))
+	}
+	assert.Equal(t, 400, invalidate([]string{"infra/tools"}))
+	assert.Equal(t, 200, invalidate(nil))
+	assert.Equal(t, []string{"infra/tools"}, cached())
+}
+
+func TestScopedHookRuns(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	for _, name := range []string{"payments/api", "infra/tools"} {
+		repo := gh.Repository{GqlRepository: &gh.GqlRepository{ID: name, NameWithOwner: name}}
+		repo.Owner.Login = strings.Split(name, "/")[0]
+		_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+		require.Nil(t, err)
+	}
+	hookID := primitive.NewObjectID()
+	runIDs := map[string]primitive.ObjectID{}
+	for _, repo := range []string{"payments/api", "infra/tools", ""} {
+		run := &db.HookRun{ID: primitive.NewObjectID(), HookType: db.HookTypeCustom, HookID: hookID, Repo: repo, StartedAt: time.Now()}
+		require.Nil(t, dbw.CreateHookRun(run))
+		runIDs[repo] = run.ID
+	}
+
+	a := api{
+		ctx: context.Background(),
+		db:  mdb,
+		dbw: dbw,
+		getUsernameFromSession: func(c *fiber.Ctx) (string, error) {
+			return "foo@bar.com", nil
+		},
+	}
+	a.settingUpCasbinEnforcer()
+	_, err := a.enforcer.AddPolicies(rolePolicies("historian", []string{"hooks.history"}))
+	require.Nil(t, err)
+	_, err = a.enforcer.AddRoleForUser("foo@bar.com", "historian")
+	require.Nil(t, err)
+	_, err = mdb.Collection("rolescopes").InsertOne(a.ctx, config.RoleScope{
+		Username: "foo@bar.com",
+		Role:     "historian",
+		Orgs:     []string{"payments"},
+	})
+	require.Nil(t, err)
+
+	app := fiber.New()
+	app.Use(a.authorizer())
+	app.Get("/api/v1/hookruns", a.GetHookRuns)
+	app.Get("/api/v1/hookrun/:id", a.GetHookRun)
+
+	get := func(path string) (int, []byte) {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil), -1)
+		require.Nil(t, err)
+		body := new(bytes.Buffer)
+		_, err = body.ReadFrom(resp.Body)
+		require.Nil(t, err)
+		return resp.StatusCode, body.Bytes()
+	}
+	listed := func(query string) []string {
+		status, body := get("/api/v1/hookruns?" + query)
+		require.Equal(t, 200, status)
+		runs := []db.HookRun{}
+		require.Nil(t, json.Unmarshal(body, &runs))
+		repos := make([]string, 0, len(runs))
+		for _, run := range runs {
+			repos = append(repos, run.Repo)
+		}
+		return repos
+	}
+
+	// the runs of the repos out of the scope and the batch runs are hidden
+	assert.Equal(t, []string{"payments/api"}, listed("hook_id="+hookID.Hex()))
+	assert.Empty(t, listed("repo=infra/tools"))
+	assert.Equal(t, []string{"payments/api"}, listed("repo=payments/api"))
+
+	status, _ := get("/api/v1/hookrun/" + runIDs["payments/api"].Hex())
+	assert.Equal(t, 200, status)
+	status, _ = get("/api/v1/hookrun/" + runIDs["infra/tools"].Hex())
+	assert.Equal(t, 404, status)
+	status, _ = get("/api/v1/hookrun/" + runIDs[""].Hex())
+	assert.Equal(t, 404, status)
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/emirpasic/gods/maps/treemap"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+)
+
+// GetSessions returns the active sessions grouped by user, along with the last activity
+// recorded in the logged entries
+func (a *api) GetSessions(c *fiber.Ctx) error {
+	type UserSessions struct {
+		Username       string        `json:"username"`
+		LastActivityAt time.Time     `json:"last_activity_at"`
+		Sessions       []*db.Session `json:"sessions"`
+	}
+	sessions, err := a.sessions.ReadSessions(bson.D{
+		{Key: "username", Value: bson.M{"$exists": true, "$ne": ""}},
+	})
+	if err != nil {
+		slog.Error("error in reading the sessions", slog.String("error", err.Error()))
+		return err
+	}
+	dedup := treemap.NewWithStringComparator()
+	for _, sess := range sessions {
+		if userSessions, ok := dedup.Get(sess.Username); ok {
+			if userSessions, ok := userSessions.(*UserSessions); ok {
+				userSessions.Sessions = append(userSessions.Sessions, sess)
+			}
+		} else {
+			lastActivityAt, err := a.getLastActivity(sess.Username)
+			if err != nil {
+				return err
+			}
+			dedup.Put(sess.Username, &UserSessions{
+				Username:       sess.Username,
+				LastActivityAt: lastActivityAt,
+				Sessions:       []*db.Session{sess},
+			})
+		}
+	}
+	return c.JSON(dedup.Values())
+}
+
+// DeleteSession revokes a single session, the id is the hashed session ID returned by GetSessions
+func (a *api) DeleteSession(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if id == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if _, err := a.sessions.RevokeSessions(bson.D{{Key: "_id", Value: id}}); err != nil {
+		slog.Error("error in revoking the session", slog.String("error", err.Error()))
+		return err
+	}
+	return c.SendStatus(200)
+}
+
+// DeleteUserSessions revokes all the sessions of the user
+func (a *api) DeleteUserSessions(c *fiber.Ctx) error {
+	username := c.Params("name")
+	if username == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	count, err := a.sessions.RevokeSessions(bson.D{{Key: "username", Value: username}})
+	if err != nil {
+		slog.Error("error in revoking the sessions", slog.String("error", err.Error()))
+		return err
+	}
+	slog.Info("revoked sessions", slog.String("username", username), slog.Int64("count", count))
+	return c.SendStatus(200)
+}
+
+// getLastActivity returns the end of the latest logged entry of the user
+func (a *api) getLastActivity(username string) (time.Time, error) {
+	var logged config.Logged
+	if err := a.db.Collection("logged").FindOne(
+		a.ctx,
+		bson.D{{Key: "username", Value: username}},
+		options.FindOne().SetSort(bson.D{{Key: "end", Value: -1}}),
+	).Decode(&logged); err != nil {
+		if err != mongo.ErrNoDocuments {
+			return time.Time{}, err
+		}
+		return time.Time{}, nil
+	}
+	return logged.End, nil
+}
@@ -28,6 +28,15 @@ func (a *api) GetGlobalSettings(c *fiber.Ctx) error {
 }
 
 func (a *api) UpdateGlobalSettings(c *fiber.Ctx) error {
+	var old config.GlobalSettings
+	if err := a.db.Collection("globalSettings").FindOne(
+		a.ctx,
+		bson.D{},
+	).Decode(&old); err != nil {
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
 	var gs config.GlobalSettings
 	if err := c.BodyParser(&gs); err != nil {
 		return err
@@ -38,5 +47,7 @@ func (a *api) UpdateGlobalSettings(c *fiber.Ctx) error {
 		slog.Error("error in updating the global settings", slog.String("error", err.Error()))
 		return err
 	}
+	gs.ID = old.ID
+	a.audit(c, "globalsettings", "", old, gs)
 	return c.SendStatus(200)
 }
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
+)
+
+const (
+	defaultTokenExpirationDays = 30
+	maxTokenExpirationDays     = 365
+	tokenLocalsKey             = "token"
+)
+
+// tokenAuthenticator authenticates the requests with the "Authorization: Bearer" header,
+// the token and its owner are stored in the locals for the following handlers
+func (a *api) tokenAuthenticator() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		auth := c.Get(fiber.HeaderAuthorization)
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return c.Next()
+		}
+
+		var token config.APIToken
+		if err := a.db.Collection("tokens").FindOne(
+			a.ctx,
+			bson.D{{Key: "hash", Value: security.HashToken(strings.TrimPrefix(auth, "Bearer "))}},
+		).Decode(&token); err != nil {
+			if err != mongo.ErrNoDocuments {
+				return err
+			}
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		if time.Now().After(token.ExpiresAt) {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		// update the last used time in a background go routine
+		go func(id primitive.ObjectID) {
+			update := bson.D{{Key: "$set", Value: bson.M{"last_used_at": time.Now()}}}
+			if _, err := a.db.Collection("tokens").UpdateByID(a.ctx, id, update); err != nil {
+				slog.Error("error in updating the token last used time", slog.String("error", err.Error()))
+			}
+		}(token.ID)
+
+		c.Locals("username", token.Username)
+		c.Locals(tokenLocalsKey, &token)
+		return c.Next()
+	}
+}
+
+func getTokenFromLocals(c *fiber.Ctx) *config.APIToken {
+	if token, ok := c.Locals(tokenLocalsKey).(*config.APIToken); ok {
+		return token
+	}
+	return nil
+}
+
+// enforce checks the casbin policies for the user, a token with roles is limited to
+// the roles the user still has
+func (a *api) enforce(c *fiber.Ctx, username string) (bool, error) {
+	path := string(c.Request().URI().Path())
+	method := string(c.Request().Header.Method())
+
+	token := getTokenFromLocals(c)
+	if token == nil || len(token.Roles) == 0 {
+		return a.enforcer.Enforce(username, path, method)
+	}
+
+	roles, err := a.enforcer.GetRolesForUser(username)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range token.Roles {
+		if !slices.Contains(roles, role) {
+			continue
+		}
+		r, err := a.enforcer.Enforce(role, path, method)
+		if err != nil {
+			return false, err
+		}
+		if r {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (a *api) GetTokens(c *fiber.Ctx) error {
+	username, err := a.getUsernameFromSession(c)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := a.db.Collection("tokens").Find(
+		a.ctx,
+		bson.D{{Key: "username", Value: username}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(a.ctx)
+	tokens := []config.APIToken{}
+	if err := cursor.All(a.ctx, &tokens); err != nil {
+		return err
+	}
+	return c.JSON(tokens)
+}
+
+func (a *api) CreateToken(c *fiber.Ctx) error {
+	// tokens can't be used for minting new tokens
+	if getTokenFromLocals(c) != nil {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+
+	username, err := a.getUsernameFromSession(c)
+	if err != nil {
+		return err
+	}
+
+	b := struct {
+		Name          string   `json:"name"`
+		ExpiresInDays int      `json:"expires_in_days"`
+		Roles         []string `json:"roles"`
+	}{}
+	if err := c.BodyParser(&b); err != nil {
+		return err
+	}
+	if strings.TrimSpace(b.Name) == "" || b.ExpiresInDays < 0 || b.ExpiresInDays > maxTokenExpirationDays {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if b.ExpiresInDays == 0 {
+		b.ExpiresInDays = defaultTokenExpirationDays
+	}
+
+	// the scope can only narrow down the roles of the user
+	if len(b.Roles) > 0 {
+		roles, err := a.enforcer.GetRolesForUser(username)
+		if err != nil {
+			return err
+		}
+		for _, role := range b.Roles {
+			if !slices.Contains(roles, role) {
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+		}
+	}
+
+	t, err := security.GenerateToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	token := config.APIToken{
+		Username:  username,
+		Name:      strings.TrimSpace(b.Name),
+		Hash:      security.HashToken(t),
+		Prefix:    t[:len(security.TokenPrefix)+4],
+		Roles:     b.Roles,
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, b.ExpiresInDays),
+	}
+	if token.Roles == nil {
+		token.Roles = []string{}
+	}
+	result, err := a.db.Collection("tokens").InsertOne(a.ctx, token)
+	if err != nil {
+		slog.Error("error in inserting a token", slog.String("error", err.Error()))
+		return err
+	}
+	token.ID = result.InsertedID.(primitive.ObjectID)
+
+	// the plain token is returned only once
+	return c.JSON(struct {
+		config.APIToken
+		Token string `json:"token"`
+	}{
+		APIToken: token,
+		Token:    t,
+	})
+}
+
+func (a *api) DeleteToken(c *fiber.Ctx) error {
+	username, err := a.getUsernameFromSession(c)
+	if err != nil {
+		return err
+	}
+
+	_id := c.Params("id")
+	if _id == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	id, err := primitive.ObjectIDFromHex(_id)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "username", Value: username},
+	}
+	result, err := a.db.Collection("tokens").DeleteOne(a.ctx, filter)
+	if err != nil {
+		slog.Error("error in deleting the token", slog.String("error", err.Error()))
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	return c.SendStatus(200)
+}
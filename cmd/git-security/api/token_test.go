@@ -0,0 +1,90 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+)
+
+func TestAPIToken(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	a := api{
+		ctx: context.Background(),
+		db:  mdb,
+		dbw: dbw,
+	}
+	a.getUsernameFromSession = func(c *fiber.Ctx) (string, error) {
+		if token := getTokenFromLocals(c); token != nil {
+			return token.Username, nil
+		}
+		return "foo@bar.com", nil
+	}
+	a.settingUpCasbinEnforcer()
+	_, err := a.enforcer.AddRoleForUser("foo@bar.com", "user")
+	require.Nil(t, err)
+	_, err = a.enforcer.AddRoleForUser("foo@bar.com", "owneradmin")
+	require.Nil(t, err)
+
+	app := fiber.New()
+	app.Use(a.tokenAuthenticator())
+	app.Use(a.authorizer())
+	app.Post("/api/v1/tokens", a.CreateToken)
+	app.Get("/api/v1/columns", func(c *fiber.Ctx) error { return c.SendStatus(200) })
+	app.Post("/api/v1/owners", func(c *fiber.Ctx) error { return c.SendStatus(200) })
+
+	createToken := func(roles []string) (config.APIToken, string) {
+		b, err := json.Marshal(map[string]interface{}{"name": "ci", "roles": roles})
+		require.Nil(t, err)
+		req := httptest.NewRequest("POST", "/api/v1/tokens", bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		token := struct {
+			config.APIToken
+			Token string `json:"token"`
+		}{}
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&token))
+		return token.APIToken, token.Token
+	}
+	call := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req, -1)
+		require.Nil(t, err)
+		return resp.StatusCode
+	}
+
+	// inherits all the roles
+	full, fullToken := createToken(nil)
+	assert.Equal(t, 200, call("GET", "/api/v1/columns", fullToken))
+	assert.Equal(t, 200, call("POST", "/api/v1/owners", fullToken))
+	assert.Equal(t, 401, call("GET", "/api/v1/columns", "gs_invalid"))
+
+	// narrowed down to the user role
+	_, narrowToken := createToken([]string{"user"})
+	assert.Equal(t, 200, call("GET", "/api/v1/columns", narrowToken))
+	assert.Equal(t, 403, call("POST", "/api/v1/owners", narrowToken))
+
+	// tokens can't mint new tokens
+	assert.Equal(t, 403, call("POST", "/api/v1/tokens", fullToken))
+
+	// expired
+	_, err = mdb.Collection("tokens").UpdateByID(
+		a.ctx, full.ID, bson.D{{Key: "$set", Value: bson.M{"expires_at": time.Now().Add(-time.Minute)}}})
+	require.Nil(t, err)
+	assert.Equal(t, 401, call("GET", "/api/v1/columns", fullToken))
+}
@@ -1,14 +1,27 @@
 package api
 
 import (
+	"slices"
+
 	"github.com/emirpasic/gods/maps/treemap"
 	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	roleSourceGroup  = "group"
+	roleSourceManual = "manual"
 )
 
 func (a *api) GetUsers(c *fiber.Ctx) error {
 	type UserRoles struct {
-		Name  string   `json:"name"`
-		Roles []string `json:"roles"`
+		Name    string            `json:"name"`
+		Roles   []string          `json:"roles"`
+		Sources map[string]string `json:"sources"`
+	}
+	groupRoles, err := a.getGroupRolesMap()
+	if err != nil {
+		return err
 	}
 	dedup := treemap.NewWithStringComparator()
 	entries, err := a.enforcer.GetGroupingPolicy()
@@ -18,14 +31,20 @@ func (a *api) GetUsers(c *fiber.Ctx) error {
 	for _, entry := range entries {
 		username := entry[0]
 		role := entry[1]
+		source := roleSourceManual
+		if slices.Contains(groupRoles[username], role) {
+			source = roleSourceGroup
+		}
 		if userRoles, ok := dedup.Get(username); ok {
 			if userRoles, ok := userRoles.(*UserRoles); ok {
 				userRoles.Roles = append(userRoles.Roles, role)
+				userRoles.Sources[role] = source
 			}
 		} else {
 			dedup.Put(username, &UserRoles{
-				Name:  username,
-				Roles: []string{role},
+				Name:    username,
+				Roles:   []string{role},
+				Sources: map[string]string{role: source},
 			})
 		}
 	}
@@ -33,10 +52,15 @@ func (a *api) GetUsers(c *fiber.Ctx) error {
 }
 
 func (a *api) GetRoles(c *fiber.Ctx) error {
+	rolesDefined, err := a.getRolesDefined()
+	if err != nil {
+		return err
+	}
 	roles := make([]string, 0)
 	for r := range rolesDefined {
 		roles = append(roles, r)
 	}
+	slices.Sort(roles)
 	return c.JSON(roles)
 }
 
@@ -57,13 +81,22 @@ func (a *api) UpdateUserRoles(c *fiber.Ctx) error {
 	if len(b.Roles) == 0 {
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
+	rolesDefined, err := a.getRolesDefined()
+	if err != nil {
+		return err
+	}
 	for _, role := range b.Roles {
 		if _, ok := rolesDefined[role]; !ok {
 			return c.SendStatus(fiber.StatusBadRequest)
 		}
 	}
 
-	// check if the user exists, assuming every user has at least one role
+	// check if the user exists, assuming every user has at least one role. The roles may
+	// have been changed by another replica, the roles added and deleted below are saved one
+	// by one so that the changes of the others are kept.
+	if err := a.reloadPolicies(); err != nil {
+		return err
+	}
 	currentRoles, err := a.enforcer.GetRolesForUser(username)
 	if err != nil {
 		return err
@@ -77,11 +110,13 @@ func (a *api) UpdateUserRoles(c *fiber.Ctx) error {
 		updatedRoles[role] = struct{}{}
 	}
 
+	removedRoles := make([]string, 0)
 	for _, role := range currentRoles {
 		if _, ok := updatedRoles[role]; !ok {
 			if _, err := a.enforcer.DeleteRoleForUser(username, role); err != nil {
 				return err
 			}
+			removedRoles = append(removedRoles, role)
 		} else {
 			delete(updatedRoles, role)
 		}
@@ -91,7 +126,34 @@ func (a *api) UpdateUserRoles(c *fiber.Ctx) error {
 			return err
 		}
 	}
-	a.enforcer.SavePolicy()
+
+	before := slices.Clone(currentRoles)
+	after := slices.Clone(b.Roles)
+	slices.Sort(before)
+	slices.Sort(after)
+	a.audit(c, "user", username, bson.M{"roles": before}, bson.M{"roles": slices.Compact(after)})
+
+	if len(removedRoles) > 0 {
+		// drop the scopes of the removed roles
+		if _, err := a.db.Collection("rolescopes").DeleteMany(
+			a.ctx,
+			bson.D{
+				{Key: "username", Value: username},
+				{Key: "role", Value: bson.M{"$in": removedRoles}},
+			},
+		); err != nil {
+			return err
+		}
+
+		// a group role removed manually is no longer owned by the group sync
+		if _, err := a.db.Collection("grouproles").UpdateOne(
+			a.ctx,
+			bson.D{{Key: "username", Value: username}},
+			bson.D{{Key: "$pull", Value: bson.M{"roles": bson.M{"$in": removedRoles}}}},
+		); err != nil {
+			return err
+		}
+	}
 
 	return c.SendStatus(200)
 }
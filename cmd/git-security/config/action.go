@@ -0,0 +1,85 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/IGLOU-EU/go-wildcard/v2"
+)
+
+const (
+	// AutomationActionPrefix starts the stdout lines of an automation holding an action, the
+	// rest of the line is the action in JSON
+	AutomationActionPrefix = "::git-security::"
+
+	ActionSetCustom         = "set_custom"
+	ActionAssignOwner       = "assign_owner"
+	ActionAddNote           = "add_note"
+	ActionRequestProtection = "request_protection"
+)
+
+// AutomationActions are the actions an automation can be permitted to apply
+var AutomationActions = []string{
+	ActionSetCustom,
+	ActionAssignOwner,
+	ActionAddNote,
+	ActionRequestProtection,
+}
+
+// AutomationAction is printed on stdout by an automation to update the repo it runs for. The
+// field and value are the custom field or the branch protection field to change.
+type AutomationAction struct {
+	Action string      `json:"action"`
+	Field  string      `json:"field,omitempty"`
+	Value  interface{} `json:"value,omitempty"`
+	Owner  string      `json:"owner,omitempty"`
+	Note   string      `json:"note,omitempty"`
+}
+
+// AutomationPermission allows an automation to apply an action, the fields are wildcard
+// patterns of the custom fields or the branch protection fields the action can change
+type AutomationPermission struct {
+	Action string   `bson:"action" json:"action"`
+	Fields []string `bson:"fields" json:"fields"`
+}
+
+// hasFields tells if the action changes a field that the permissions have to allow
+func hasFields(action string) bool {
+	return action == ActionSetCustom || action == ActionRequestProtection
+}
+
+func (a *Automation) ValidatePermissions() error {
+	for _, p := range a.Permissions {
+		if !slices.Contains(AutomationActions, p.Action) {
+			return fmt.Errorf("invalid automation action %q", p.Action)
+		}
+		if hasFields(p.Action) && len(p.Fields) == 0 {
+			return fmt.Errorf("the %s permission needs the fields", p.Action)
+		}
+		for _, f := range p.Fields {
+			if f == "" {
+				return errors.New("the permission fields can't be empty")
+			}
+		}
+	}
+	return nil
+}
+
+// Allows tells if the permissions of the automation allow the action
+func (a *Automation) Allows(action AutomationAction) bool {
+	for _, p := range a.Permissions {
+		if p.Action != action.Action {
+			continue
+		}
+		if !hasFields(p.Action) {
+			return true
+		}
+		for _, f := range p.Fields {
+			if wildcard.Match(f, action.Field) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,14 +1,186 @@
 package config
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/IGLOU-EU/go-wildcard/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	AutomationKindContainer = "container"
+	AutomationKindWebhook   = "webhook"
+
+	// DefaultWebhookPayload is the payload of the webhooks without a template
+	DefaultWebhookPayload = `{"repo": {{ json .Repo }}, "change": {{ json .Change }}, "score": {{ json .Score }}}`
+	// DefaultWebhookHMACHeader is the header of the HMAC-SHA256 signature of the payload
+	DefaultWebhookHMACHeader = "X-Hub-Signature-256"
+	// MaxWebhookRetries caps the retries of a webhook
+	MaxWebhookRetries = 10
+)
+
+// WebhookTemplateFuncs are the functions of the webhook templates
+var WebhookTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
 
 type Automation struct {
-	ID      primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	Pattern string             `bson:"pattern" json:"pattern"`
-	Owner   string             `bson:"owner" json:"owner"`
-	Exclude string             `bson:"exclude" json:"exclude"`
-	Image   string             `bson:"image" json:"image"`
-	Command string             `bson:"command" json:"command"`
-	Envs    []EnvKeyValue      `bson:"envs" json:"envs"`
-	Enabled bool               `bson:"enabled" json:"enabled"`
+	ID          primitive.ObjectID     `bson:"_id,omitempty" json:"id,omitempty"`
+	Pattern     string                 `bson:"pattern" json:"pattern"`
+	Owner       string                 `bson:"owner" json:"owner"`
+	Exclude     string                 `bson:"exclude" json:"exclude"`
+	Image       string                 `bson:"image" json:"image"`
+	Command     string                 `bson:"command" json:"command"`
+	Envs        []EnvKeyValue          `bson:"envs" json:"envs"`
+	Enabled     bool                   `bson:"enabled" json:"enabled"`
+	Executor    string                 `bson:"executor" json:"executor"`
+	Schedule    string                 `bson:"schedule" json:"schedule"`
+	Events      []AutomationEvent      `bson:"events" json:"events"`
+	Filters     []Filter               `bson:"filters" json:"filters"`
+	Kind        string                 `bson:"kind" json:"kind"`
+	Webhook     AutomationWebhook      `bson:"webhook" json:"webhook"`
+	Permissions []AutomationPermission `bson:"permissions" json:"permissions"`
+	HookLimits  `bson:",inline"`
+	HookImage   `bson:",inline"`
+}
+
+// AutomationWebhook POSTs the payload template to the URL, the header values are templates
+// too. The HMAC secret and the secrets used by the templates are the envs of the automation.
+type AutomationWebhook struct {
+	URL        string        `bson:"url" json:"url"`
+	Payload    string        `bson:"payload" json:"payload"`
+	Headers    []EnvKeyValue `bson:"headers" json:"headers"`
+	HMACEnv    string        `bson:"hmac_env" json:"hmac_env"`
+	HMACHeader string        `bson:"hmac_header" json:"hmac_header"`
+	Retries    int           `bson:"retries" json:"retries"`
+}
+
+// AutomationEvent selects the changelog entries an automation runs for, the field, from and
+// to are wildcard patterns and the empty from and to match any value. The repo creations
+// and deletions are the "New Repo" and "Delete Repo" fields.
+type AutomationEvent struct {
+	Field string `bson:"field" json:"field"`
+	Op    string `bson:"op,omitempty" json:"op,omitempty"`
+	From  string `bson:"from" json:"from"`
+	To    string `bson:"to" json:"to"`
+}
+
+// IsWebhook tells if the automation is a webhook run by the app instead of an executor
+func (a *Automation) IsWebhook() bool {
+	return a.Kind == AutomationKindWebhook
+}
+
+func (a *Automation) ValidateWebhook() error {
+	if a.Kind != "" && a.Kind != AutomationKindContainer && a.Kind != AutomationKindWebhook {
+		return fmt.Errorf("invalid automation kind %q", a.Kind)
+	}
+	if !a.IsWebhook() {
+		return nil
+	}
+	if a.Webhook.URL == "" {
+		return errors.New("the webhook has no URL")
+	}
+	u, err := url.Parse(a.Webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("the webhook URL must be an http or https URL")
+	}
+	if a.Webhook.Retries < 0 || a.Webhook.Retries > MaxWebhookRetries {
+		return fmt.Errorf("the webhook retries must be between 0 and %d", MaxWebhookRetries)
+	}
+	if _, err := template.New("payload").Funcs(WebhookTemplateFuncs).Parse(a.Webhook.Payload); err != nil {
+		return err
+	}
+	for _, h := range a.Webhook.Headers {
+		if h.Key == "" {
+			return errors.New("the webhook headers need a name")
+		}
+		if _, err := template.New(h.Key).Funcs(WebhookTemplateFuncs).Parse(h.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EventDriven tells if the automation runs on the repo changes instead of its schedule
+func (a *Automation) EventDriven() bool {
+	return len(a.Events) > 0
+}
+
+// MatchEvent tells if a change recorded in the changelog matches one of the events, the
+// events without an operation match all of them
+func (a *Automation) MatchEvent(field, op, from, to string) bool {
+	for _, e := range a.Events {
+		if wildcard.Match(e.Field, field) &&
+			(e.Op == "" || e.Op == op) &&
+			(e.From == "" || wildcard.Match(e.From, from)) &&
+			(e.To == "" || wildcard.Match(e.To, to)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Automation) ValidateEvents() error {
+	for _, e := range a.Events {
+		if e.Field == "" {
+			return errors.New("the events need a field")
+		}
+		if !slices.Contains([]string{"", "create", "update", "delete"}, e.Op) {
+			return fmt.Errorf("invalid event operation %q, expected create, update or delete", e.Op)
+		}
+	}
+	return nil
+}
+
+// MatchRepo tells if the repo matches the name patterns, the exclude patterns and the owners
+// of the automation, the empty patterns match all the repos when the automation has filters
+func (a *Automation) MatchRepo(nameWithOwner, repoOwner string) bool {
+	matchPattern := strings.Trim(a.Pattern, " ,") == "" && len(a.Filters) > 0
+	for _, p := range strings.Split(a.Pattern, ",") {
+		p := strings.Trim(p, " ")
+		if len(p) == 0 {
+			continue
+		}
+		if wildcard.Match(p, nameWithOwner) {
+			matchPattern = true
+			break
+		}
+	}
+	if !matchPattern {
+		return false
+	}
+
+	for _, e := range strings.Split(a.Exclude, ",") {
+		e := strings.Trim(e, " ")
+		if len(e) == 0 {
+			continue
+		}
+		if wildcard.Match(e, nameWithOwner) {
+			return false
+		}
+	}
+
+	// last check on owner
+	if strings.Trim(a.Owner, " ") != "" {
+		for _, o := range strings.Split(a.Owner, ",") {
+			o := strings.Trim(o, " ")
+			if len(o) == 0 {
+				continue
+			}
+			if wildcard.Match(o, repoOwner) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
 }
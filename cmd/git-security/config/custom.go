@@ -1,10 +1,28 @@
 package config
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/IGLOU-EU/go-wildcard/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CustomValueTypes are the types of the custom fields
+var CustomValueTypes = []string{"string", "number", "boolean", "array"}
+
+// EnvKeyValue is an env of a hook, its value is encrypted in the DB or it's the reference of
+// a secret kept elsewhere and resolved at run time. The values are write only, the APIs
+// return them masked with Set telling if the env has one.
 type EnvKeyValue struct {
-	Key   string `bson:"key" json:"key"`
-	Value string `bson:"value" json:"value"`
+	Key       string     `bson:"key" json:"key"`
+	Value     string     `bson:"value" json:"value"`
+	Ref       string     `bson:"ref,omitempty" json:"ref,omitempty"`
+	Set       bool       `bson:"-" json:"set,omitempty"`
+	UpdatedAt *time.Time `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
 }
 
 type Custom struct {
@@ -17,6 +35,111 @@ type Custom struct {
 	Field        string             `bson:"field" json:"field"`
 	DefaultValue interface{}        `bson:"default_value" json:"default_value"`
 	ErrorValue   interface{}        `bson:"error_value" json:"error_value"`
+	Outputs      []CustomOutput     `bson:"outputs" json:"outputs"`
+	Filters      []Filter           `bson:"filters" json:"filters"`
 	Enabled      bool               `bson:"enabled" json:"enabled"`
 	BatchMode    bool               `bson:"batch_mode" json:"batch_mode"`
+	Executor     string             `bson:"executor" json:"executor"`
+	Schedule     string             `bson:"schedule" json:"schedule"`
+	DependsOn    []string           `bson:"depends_on" json:"depends_on"`
+	RepoJSON     bool               `bson:"repo_json" json:"repo_json"`
+	CacheTTL     int                `bson:"cache_ttl" json:"cache_ttl"`
+	OnlyChanged  bool               `bson:"only_changed" json:"only_changed"`
+	HookLimits   `bson:",inline"`
+	HookImage    `bson:",inline"`
+}
+
+// CustomOutput maps a key of the JSON object printed by a structured custom hook to its
+// own custom field
+type CustomOutput struct {
+	Key          string      `bson:"key" json:"key"`
+	Field        string      `bson:"field" json:"field"`
+	ValueType    string      `bson:"value_type" json:"value_type"`
+	DefaultValue interface{} `bson:"default_value" json:"default_value"`
+	ErrorValue   interface{} `bson:"error_value" json:"error_value"`
+}
+
+// Cached tells if the runs of the hook for a repo are reused, for the TTL (seconds) and/or
+// while the repo doesn't change. The batch mode hooks are never cached.
+func (c *Custom) Cached() bool {
+	return !c.BatchMode && (c.CacheTTL > 0 || c.OnlyChanged)
+}
+
+func (c *Custom) ValidateCache() error {
+	if c.CacheTTL < 0 {
+		return errors.New("the cache TTL can't be negative")
+	}
+	return nil
+}
+
+// Structured tells if the hook prints a JSON object mapped to the outputs instead of a
+// single value for the field
+func (c *Custom) Structured() bool {
+	return len(c.Outputs) > 0
+}
+
+// HasTarget tells if the hook selects repos, by the name patterns or the filters
+func (c *Custom) HasTarget() bool {
+	return strings.Trim(c.Pattern, " ,") != "" || len(c.Filters) > 0
+}
+
+// MatchPattern tells if the repo matches one of the name patterns, the empty patterns match
+// all the repos when the hook has filters
+func (c *Custom) MatchPattern(nameWithOwner string) bool {
+	if strings.Trim(c.Pattern, " ,") == "" {
+		return len(c.Filters) > 0
+	}
+	for _, p := range strings.Split(c.Pattern, ",") {
+		p := strings.Trim(p, " ")
+		if len(p) == 0 {
+			continue
+		}
+		if wildcard.Match(p, nameWithOwner) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fields returns the custom fields written by the hook, the single field is returned as an
+// output without a key
+func (c *Custom) Fields() []CustomOutput {
+	if c.Structured() {
+		return c.Outputs
+	}
+	if c.Field == "" {
+		return nil
+	}
+	return []CustomOutput{{
+		Field:        c.Field,
+		ValueType:    c.ValueType,
+		DefaultValue: c.DefaultValue,
+		ErrorValue:   c.ErrorValue,
+	}}
+}
+
+// ValidateOutputs checks the keys, the field names and the value types of the outputs
+func (c *Custom) ValidateOutputs() error {
+	keys := make(map[string]bool)
+	fields := make(map[string]bool)
+	for _, o := range c.Outputs {
+		if o.Key == "" || o.Field == "" {
+			return errors.New("the outputs need a key and a field")
+		}
+		if strings.ContainsAny(o.Field, ".$") {
+			return fmt.Errorf("invalid output field %q", o.Field)
+		}
+		if !slices.Contains(CustomValueTypes, o.ValueType) {
+			return fmt.Errorf("invalid value type %q of the output field %q", o.ValueType, o.Field)
+		}
+		if keys[o.Key] {
+			return fmt.Errorf("duplicated output key %q", o.Key)
+		}
+		if fields[o.Field] {
+			return fmt.Errorf("duplicated output field %q", o.Field)
+		}
+		keys[o.Key] = true
+		fields[o.Field] = true
+	}
+	return nil
 }
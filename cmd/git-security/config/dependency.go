@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+var nonEnvNameChars = regexp.MustCompile("[^A-Z0-9_]")
+
+// CustomEnvName is the env giving the value of a custom field to the hooks depending on it
+func CustomEnvName(field string) string {
+	return "GIT_CUSTOM_" + nonEnvNameChars.ReplaceAllString(strings.ToUpper(field), "_")
+}
+
+// OrderCustoms orders the hooks so that each one comes after the hooks writing the fields it
+// depends on, keeping the given order otherwise. The dependencies on the fields no hook
+// writes are ignored. The hooks in a dependency cycle, and the ones depending on them, are
+// left out and returned in the error.
+func OrderCustoms(customs []Custom) ([]Custom, error) {
+	writers := make(map[string]int)
+	for i := range customs {
+		for _, output := range customs[i].Fields() {
+			writers[output.Field] = i
+		}
+	}
+
+	// the hooks each hook waits for
+	waits := make([]map[int]struct{}, len(customs))
+	for i := range customs {
+		waits[i] = make(map[int]struct{})
+		for _, field := range customs[i].DependsOn {
+			if j, ok := writers[field]; ok {
+				waits[i][j] = struct{}{}
+			}
+		}
+	}
+
+	ordered := make([]Custom, 0, len(customs))
+	done := make([]bool, len(customs))
+	for len(ordered) < len(customs) {
+		progress := false
+		for i := range customs {
+			if done[i] {
+				continue
+			}
+			ready := true
+			for j := range waits[i] {
+				if !done[j] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				done[i] = true
+				ordered = append(ordered, customs[i])
+				progress = true
+			}
+		}
+		if !progress {
+			break
+		}
+	}
+
+	if len(ordered) < len(customs) {
+		var fields []string
+		for i := range customs {
+			if !done[i] {
+				for _, output := range customs[i].Fields() {
+					fields = append(fields, output.Field)
+				}
+			}
+		}
+		sort.Strings(fields)
+		return ordered, fmt.Errorf("dependency cycle between the custom fields %s", strings.Join(fields, ", "))
+	}
+	return ordered, nil
+}
+
+// ValidateDependencies checks that the hook depends on the fields written by the other hooks,
+// and that it isn't in a cycle with them nor depends on one
+func (c *Custom) ValidateDependencies(others []Custom) error {
+	fields := make([]string, 0)
+	for _, other := range others {
+		if other.ID == c.ID {
+			continue
+		}
+		for _, output := range other.Fields() {
+			fields = append(fields, output.Field)
+		}
+	}
+	for _, field := range c.DependsOn {
+		if !slices.Contains(fields, field) {
+			return fmt.Errorf("the custom field %q isn't written by another hook", field)
+		}
+	}
+
+	customs := []Custom{*c}
+	for _, other := range others {
+		if other.ID != c.ID {
+			customs = append(customs, other)
+		}
+	}
+	// the cycles between the other hooks alone don't stop this one
+	ordered, err := OrderCustoms(customs)
+	for _, o := range ordered {
+		if o.ID == c.ID {
+			return nil
+		}
+	}
+	return err
+}
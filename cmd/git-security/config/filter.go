@@ -0,0 +1,108 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Filter is a filter of the repo table, also used to target the repos of the custom hooks
+// and automations
+type Filter struct {
+	Type            string        `bson:"type" json:"type"`
+	Field           string        `bson:"field" json:"field"`
+	Values          []interface{} `bson:"values" json:"values"`
+	Negate          bool          `bson:"negate" json:"negate"`
+	IncludeZeroTime bool          `bson:"include_zero_time" json:"include_zero_time"`
+}
+
+// AppendFilters appends the mongo filters of the repo filters, the array values match any
+// element and the date values are the days from now. The fields are paths of the repos,
+// not operators.
+func AppendFilters(filters bson.D, repoFilters []Filter) (bson.D, error) {
+	for _, filter := range repoFilters {
+		if !ValidFilterField(filter.Field) {
+			return nil, fmt.Errorf("invalid filter field %q", filter.Field)
+		}
+		if filter.Type == "array" {
+			values := bson.A{}
+			for _, v := range filter.Values {
+				values = append(values, bson.M{filter.Field: v})
+			}
+			if filter.Negate {
+				filters = append(filters, bson.E{Key: "$nor", Value: values})
+			} else {
+				filters = append(filters, bson.E{Key: "$or", Value: values})
+			}
+		} else if filter.Type == "date" {
+			if len(filter.Values) != 2 {
+				return nil, errors.New("datefilter value size has to be 2")
+			}
+			start := time.Now().AddDate(0, 0, cast.ToInt(filter.Values[0]))
+			end := time.Now().AddDate(0, 0, cast.ToInt(filter.Values[1]))
+
+			if filter.IncludeZeroTime {
+				filters = append(filters, bson.E{Key: "$or", Value: []bson.D{
+					{
+						{
+							Key:   filter.Field,
+							Value: bson.M{"$gte": start, "$lte": end},
+						},
+					},
+					{
+						{
+							Key:   filter.Field,
+							Value: bson.M{"$eq": time.Time{}},
+						},
+					},
+				}})
+			} else {
+				filters = append(filters, bson.E{Key: filter.Field, Value: bson.M{"$gte": start, "$lte": end}})
+			}
+		} else {
+			if filter.Negate {
+				filters = append(filters, bson.E{Key: filter.Field, Value: bson.M{"$nin": filter.Values}})
+			} else {
+				filters = append(filters, bson.E{Key: filter.Field, Value: bson.M{"$in": filter.Values}})
+			}
+		}
+	}
+	return filters, nil
+}
+
+// ValidFilterField tells if the field is a path of the documents, without the segments that
+// mongo would read as operators
+func ValidFilterField(field string) bool {
+	if field == "" {
+		return false
+	}
+	for _, segment := range strings.Split(field, ".") {
+		if segment == "" || strings.HasPrefix(segment, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// HookFilters returns the filters of the repos a custom hook or an automation runs for, all
+// of them if repoNames is empty. The archived repos are skipped unless a filter selects them.
+func HookFilters(repoNames []string, repoFilters []Filter) (bson.D, error) {
+	filters := bson.D{}
+	archived := false
+	for _, filter := range repoFilters {
+		if filter.Field == "is_archived" {
+			archived = true
+		}
+	}
+	if !archived {
+		filters = append(filters, bson.E{Key: "is_archived", Value: false})
+	}
+	if len(repoNames) > 0 {
+		filters = append(filters, bson.E{Key: "full_name", Value: bson.M{"$in": repoNames}})
+	}
+	return AppendFilters(filters, repoFilters)
+}
@@ -0,0 +1,16 @@
+package config
+
+// HookImage pins the image of a custom hook or an automation to the digest its tag pointed
+// to when the hook was saved, the runs are refused once the tag points to another digest
+type HookImage struct {
+	PinDigest   bool   `bson:"pin_digest" json:"pin_digest"`
+	ImageDigest string `bson:"image_digest" json:"image_digest"`
+}
+
+// PinnedDigest returns the digest the runs have to use, empty if the image isn't pinned
+func (i *HookImage) PinnedDigest() string {
+	if !i.PinDigest {
+		return ""
+	}
+	return i.ImageDigest
+}
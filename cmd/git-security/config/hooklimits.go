@@ -0,0 +1,34 @@
+package config
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// networkModeRegex allows none, bridge and the user defined networks
+var networkModeRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// HookLimits are the run limits of a custom hook or an automation, the timeout is in seconds
+// and 0 means the global default (timeout, parallelism) or no limit (cpus, memory)
+type HookLimits struct {
+	Timeout     int     `bson:"timeout" json:"timeout"`
+	CPUs        float64 `bson:"cpus" json:"cpus"`
+	MemoryMB    int64   `bson:"memory_mb" json:"memory_mb"`
+	NetworkMode string  `bson:"network_mode" json:"network_mode"`
+	Parallelism int     `bson:"parallelism" json:"parallelism"`
+}
+
+func (l *HookLimits) Validate() error {
+	if l.Timeout < 0 || l.CPUs < 0 || l.MemoryMB < 0 || l.Parallelism < 0 {
+		return errors.New("the limits can't be negative")
+	}
+	// the network of the host or of another container would give the hooks its access
+	if strings.EqualFold(l.NetworkMode, "host") || strings.HasPrefix(strings.ToLower(l.NetworkMode), "container:") {
+		return errors.New("the host and container network modes are not allowed")
+	}
+	if l.NetworkMode != "" && !networkModeRegex.MatchString(l.NetworkMode) {
+		return errors.New("invalid network mode")
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package config
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// LocalUser is a basic auth user when Okta is not enabled
+type LocalUser struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Username     string             `bson:"username" json:"username"`
+	PasswordHash string             `bson:"password_hash" json:"-"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
+}
@@ -0,0 +1,11 @@
+package config
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+type Role struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Name        string             `bson:"name" json:"name"`
+	Description string             `bson:"description" json:"description"`
+	Permissions []string           `bson:"permissions" json:"permissions"`
+	BuiltIn     bool               `bson:"-" json:"built_in"`
+}
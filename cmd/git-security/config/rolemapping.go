@@ -0,0 +1,24 @@
+package config
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type RoleMapping struct {
+	ID    primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Group string             `bson:"group" json:"group"`
+	Roles []string           `bson:"roles" json:"roles"`
+}
+
+// GroupRoles keeps track of the roles that were granted to a user through
+// the identity provider group mappings, so they can be revoked on the next
+// login once the user leaves the group.
+type GroupRoles struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Username string             `bson:"username" json:"username"`
+	Groups   []string           `bson:"groups" json:"groups"`
+	Roles    []string           `bson:"roles" json:"roles"`
+	SyncedAt time.Time          `bson:"synced_at" json:"synced_at"`
+}
@@ -0,0 +1,18 @@
+package config
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// RoleScope restricts a role assignment of a user to a set of GitHub orgs,
+// repo owners or repo name patterns (wildcards on the full name)
+type RoleScope struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Username   string             `bson:"username" json:"username"`
+	Role       string             `bson:"role" json:"role"`
+	Orgs       []string           `bson:"orgs" json:"orgs"`
+	RepoOwners []string           `bson:"repo_owners" json:"repo_owners"`
+	Patterns   []string           `bson:"patterns" json:"patterns"`
+}
+
+func (rs *RoleScope) IsEmpty() bool {
+	return len(rs.Orgs) == 0 && len(rs.RepoOwners) == 0 && len(rs.Patterns) == 0
+}
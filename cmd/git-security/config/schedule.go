@@ -0,0 +1,15 @@
+package config
+
+import "github.com/robfig/cron/v3"
+
+// DefaultSchedule is used by the custom hooks and automations without a cron expression
+const DefaultSchedule = "@every 5m"
+
+// ParseSchedule parses the cron expression of a hook, the standard 5 fields and the
+// descriptors (@hourly, @daily, @every 1h...) are supported
+func ParseSchedule(schedule string) (cron.Schedule, error) {
+	if schedule == "" {
+		schedule = DefaultSchedule
+	}
+	return cron.ParseStandard(schedule)
+}
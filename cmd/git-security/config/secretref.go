@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// the kinds of secret references: a file like a mounted Kubernetes secret, an env of the
+// server, or a key of a secret in a Vault KV engine
+const (
+	SecretRefFile  = "file"
+	SecretRefEnv   = "env"
+	SecretRefVault = "vault"
+)
+
+// SecretRef is a parsed reference: file:/run/secrets/token, env:HOOK_TOKEN or
+// vault:secret/data/hooks#token
+type SecretRef struct {
+	Kind string
+	Path string
+	Key  string
+}
+
+func ParseSecretRef(ref string) (*SecretRef, error) {
+	kind, path, ok := strings.Cut(strings.TrimSpace(ref), ":")
+	if !ok || path == "" {
+		return nil, fmt.Errorf("invalid secret reference %q", ref)
+	}
+	switch kind {
+	case SecretRefFile:
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("the secret file of %q isn't an absolute path", ref)
+		}
+		return &SecretRef{Kind: kind, Path: filepath.Clean(path)}, nil
+	case SecretRefEnv:
+		return &SecretRef{Kind: kind, Path: path}, nil
+	case SecretRefVault:
+		path, key, _ := strings.Cut(path, "#")
+		path = strings.Trim(path, "/")
+		if path == "" || key == "" {
+			return nil, fmt.Errorf("the vault reference %q needs a path and a #key", ref)
+		}
+		return &SecretRef{Kind: kind, Path: path, Key: key}, nil
+	}
+	return nil, fmt.Errorf("unknown kind of secret reference %q", ref)
+}
+
+// ValidateSecretRefs checks the references of the envs, their values are ignored
+func ValidateSecretRefs(envs []EnvKeyValue) error {
+	for _, env := range envs {
+		if env.Ref == "" {
+			continue
+		}
+		if _, err := ParseSecretRef(env.Ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package config
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type APIToken struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Username   string             `bson:"username" json:"username"`
+	Name       string             `bson:"name" json:"name"`
+	Hash       string             `bson:"hash" json:"-"`
+	Prefix     string             `bson:"prefix" json:"prefix"`
+	Roles      []string           `bson:"roles" json:"roles"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt  time.Time          `bson:"expires_at" json:"expires_at"`
+	LastUsedAt time.Time          `bson:"last_used_at" json:"last_used_at"`
+}
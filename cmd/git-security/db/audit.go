@@ -0,0 +1,163 @@
+package db
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/r3labs/diff/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	auditLogTableName = "auditlog"
+
+	AuditActionCreate = "create"
+	AuditActionUpdate = "update"
+	AuditActionDelete = "delete"
+	AuditActionReveal = "reveal"
+)
+
+// AuditChange is a single changed value, the path is the dotted json path of the entity
+type AuditChange struct {
+	Path string      `bson:"path" json:"path"`
+	From interface{} `bson:"from" json:"from"`
+	To   interface{} `bson:"to" json:"to"`
+}
+
+// AuditLog is a configuration change (columns, customs, automations, owners, settings, roles...)
+type AuditLog struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Actor      string             `bson:"actor" json:"actor"`
+	EntityType string             `bson:"entity_type" json:"entity_type"`
+	EntityID   string             `bson:"entity_id" json:"entity_id"`
+	Action     string             `bson:"action" json:"action"`
+	Changes    []AuditChange      `bson:"changes" json:"changes"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func (dbi *DatabaseImpl) CreateAuditLogIndices() error {
+	for _, idxToCreate := range []string{"actor", "entity_type", "entity_id", "action"} {
+		if _, err := dbi.db.Collection(auditLogTableName).Indexes().CreateOne(dbi.ctx, mongo.IndexModel{
+			Keys: bson.M{idxToCreate: 1},
+		}); err != nil {
+			return err
+		}
+	}
+	for _, idxToCreate := range []string{"created_at"} {
+		if _, err := dbi.db.Collection(auditLogTableName).Indexes().CreateOne(dbi.ctx, mongo.IndexModel{
+			Keys: bson.M{idxToCreate: -1},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dbi *DatabaseImpl) ReadAuditLog(filters interface{}) ([]*AuditLog, error) {
+	cursor, err := dbi.db.Collection(auditLogTableName).Find(
+		dbi.ctx,
+		filters,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(dbi.ctx)
+
+	log := []*AuditLog{}
+	if err := cursor.All(dbi.ctx, &log); err != nil {
+		return nil, err
+	}
+
+	return log, nil
+}
+
+// CreateAuditLog records the diff between before and after, a nil before (after) means the
+// entity is created (deleted). The secrets must be redacted by the caller. Nothing is recorded
+// for an update without any change.
+func (dbi *DatabaseImpl) CreateAuditLog(actor, entityType, entityID string, before, after interface{}) error {
+	action := AuditActionUpdate
+	if before == nil {
+		action = AuditActionCreate
+	} else if after == nil {
+		action = AuditActionDelete
+	}
+
+	changes, err := createAuditChanges(before, after)
+	if err != nil {
+		return err
+	}
+	if action == AuditActionUpdate && len(changes) == 0 {
+		return nil
+	}
+	return dbi.CreateAuditLogAction(actor, entityType, entityID, action, changes)
+}
+
+// CreateAuditLogAction records an action with its changes as they are, for the actions that
+// aren't a diff of the entity such as the reveal of the secrets
+func (dbi *DatabaseImpl) CreateAuditLogAction(actor, entityType, entityID, action string, changes []AuditChange) error {
+	if _, err := dbi.db.Collection(auditLogTableName).InsertOne(
+		dbi.ctx,
+		AuditLog{
+			Actor:      actor,
+			EntityType: entityType,
+			EntityID:   entityID,
+			Action:     action,
+			Changes:    changes,
+			CreatedAt:  time.Now(),
+		},
+	); err != nil {
+		slog.Error("error in inserting an audit log entry", slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// createAuditChanges compares the json representations so the paths match the API payloads
+func createAuditChanges(before, after interface{}) ([]AuditChange, error) {
+	b, err := toJsonMap(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := toJsonMap(after)
+	if err != nil {
+		return nil, err
+	}
+	changelog, err := diff.Diff(b, a)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]AuditChange, 0, len(changelog))
+	for _, cl := range changelog {
+		changes = append(changes, AuditChange{
+			Path: strings.Join(cl.Path, "."),
+			From: cl.From,
+			To:   cl.To,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func toJsonMap(v interface{}) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	if v == nil {
+		return m, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
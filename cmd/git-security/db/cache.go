@@ -0,0 +1,86 @@
+package db
+
+import (
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const hookCacheTableName = "hookcache"
+
+// HookCacheEntry is the last successful run of a custom hook for a repo, the values it wrote
+// are reused until the TTL of the hook is over or the repo changes. The repo key is the head
+// commit of the default branch at the time of the run.
+type HookCacheEntry struct {
+	HookID  primitive.ObjectID `bson:"hook_id" json:"hook_id"`
+	Repo    string             `bson:"repo" json:"repo"`
+	RepoKey string             `bson:"repo_key" json:"repo_key"`
+	RanAt   time.Time          `bson:"ran_at" json:"ran_at"`
+}
+
+func (dbi *DatabaseImpl) CreateHookCacheIndices() error {
+	if _, err := dbi.db.Collection(hookCacheTableName).Indexes().CreateOne(dbi.ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hook_id", Value: 1}, {Key: "repo", Value: 1}},
+		Options: &options.IndexOptions{Unique: func(b bool) *bool { return &b }(true)},
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadHookCache returns the cached runs of the hook by repo name
+func (dbi *DatabaseImpl) ReadHookCache(hookID primitive.ObjectID) (map[string]*HookCacheEntry, error) {
+	cursor, err := dbi.db.Collection(hookCacheTableName).Find(dbi.ctx, bson.D{{Key: "hook_id", Value: hookID}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(dbi.ctx)
+
+	entries := []*HookCacheEntry{}
+	if err := cursor.All(dbi.ctx, &entries); err != nil {
+		return nil, err
+	}
+	cache := make(map[string]*HookCacheEntry, len(entries))
+	for _, e := range entries {
+		cache[e.Repo] = e
+	}
+	return cache, nil
+}
+
+// UpdateHookCache records a successful run of the hook for the repo
+func (dbi *DatabaseImpl) UpdateHookCache(entry *HookCacheEntry) error {
+	if _, err := dbi.db.Collection(hookCacheTableName).UpdateOne(
+		dbi.ctx,
+		bson.D{
+			{Key: "hook_id", Value: entry.HookID},
+			{Key: "repo", Value: entry.Repo},
+		},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "repo_key", Value: entry.RepoKey},
+			{Key: "ran_at", Value: entry.RanAt},
+		}}},
+		options.Update().SetUpsert(true),
+	); err != nil {
+		slog.Error("error in updating the hook cache", slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// DeleteHookCache invalidates the cached runs of the hook for the repos, all of them if the
+// repos are empty
+func (dbi *DatabaseImpl) DeleteHookCache(hookID primitive.ObjectID, repos []string) error {
+	filter := bson.D{{Key: "hook_id", Value: hookID}}
+	if len(repos) > 0 {
+		filter = append(filter, bson.E{Key: "repo", Value: bson.M{"$in": repos}})
+	}
+	if _, err := dbi.db.Collection(hookCacheTableName).DeleteMany(dbi.ctx, filter); err != nil {
+		slog.Error("error in deleting the hook cache", slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
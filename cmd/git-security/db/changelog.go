@@ -1,9 +1,14 @@
 package db
 
 import (
+	"encoding/json"
+	"fmt"
 	"log/slog"
+	"reflect"
 	"time"
 
+	"github.com/spf13/cast"
+
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -13,13 +18,22 @@ import (
 
 const (
 	changeLogTableName = "changelog"
+
+	ChangelogNewRepo    = "New Repo"
+	ChangelogDeleteRepo = "Delete Repo"
+	ChangelogNote       = "Note"
+
+	ChangelogOpCreate = "create"
+	ChangelogOpUpdate = "update"
+	ChangelogOpDelete = "delete"
 )
 
 type ChangeLog struct {
-	RepoID        string `bson:"repo_id" json:"repo_id"`
-	GitHubHost    string `bson:"github_host" json:"github_host"`
-	Name          string `bson:"name" json:"name"`
-	NameWithOwner string `bson:"full_name" json:"full_name"`
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	RepoID        string             `bson:"repo_id" json:"repo_id"`
+	GitHubHost    string             `bson:"github_host" json:"github_host"`
+	Name          string             `bson:"name" json:"name"`
+	NameWithOwner string             `bson:"full_name" json:"full_name"`
 	Owner         struct {
 		Login string `bson:"login" json:"login"`
 	} `bson:"owner" json:"owner"`
@@ -27,17 +41,31 @@ type ChangeLog struct {
 	RepoOwner        string             `bson:"repo_owner,omitempty" json:"repo_owner,omitempty"`
 	RepoOwnerContact string             `bson:"repo_owner_contact,omitempty" json:"repo_owner_contact,omitempty"`
 	Field            string             `bson:"field" json:"field"`
+	Op               string             `bson:"op,omitempty" json:"op,omitempty"`
 	From             string             `bson:"from" json:"from"`
 	To               string             `bson:"to" json:"to"`
+	FromValue        interface{}        `bson:"from_value,omitempty" json:"from_value,omitempty"`
+	ToValue          interface{}        `bson:"to_value,omitempty" json:"to_value,omitempty"`
+	Actor            string             `bson:"actor,omitempty" json:"actor,omitempty"`
 	CreatedAt        time.Time          `bson:"created_at" json:"created_at"`
 }
 
+// ChangelogChange is a change of a field of a repo. The values keep their types, an element
+// added to (removed from) an array is a create (delete) with the element in To (From).
+type ChangelogChange struct {
+	Field string
+	Op    string
+	From  interface{}
+	To    interface{}
+}
+
 func (dbi *DatabaseImpl) CreateChangelogIndices() error {
 	for _, idxToCreate := range []string{
 		"owner.login",
 		"name",
 		"repo_owner",
 		"field",
+		"op",
 		"from",
 		"to",
 	} {
@@ -73,29 +101,72 @@ func (dbi *DatabaseImpl) ReadChangelog(filters interface{}) ([]*ChangeLog, error
 }
 
 func (dbi *DatabaseImpl) CreateChangelog(repo *gh.Repository, field, from, to string) error {
-	if _, err := dbi.db.Collection(changeLogTableName).InsertOne(
-		dbi.ctx,
-		ChangeLog{
-			RepoID:        repo.ID,
-			GitHubHost:    repo.GitHubHost,
-			Name:          repo.Name,
-			NameWithOwner: repo.NameWithOwner,
-			Owner: struct {
-				Login string `bson:"login" json:"login"`
-			}{
-				Login: repo.Owner.Login,
-			},
-			RepoOwnerID:      repo.RepoOwnerID,
-			RepoOwner:        repo.RepoOwner,
-			RepoOwnerContact: repo.RepoOwnerContact,
-			Field:            field,
-			From:             from,
-			To:               to,
-			CreatedAt:        time.Now(),
+	return dbi.CreateChangelogBy("", repo, field, from, to)
+}
+
+// CreateChangelogBy records a change of the repo made by the actor, the app itself when empty
+func (dbi *DatabaseImpl) CreateChangelogBy(actor string, repo *gh.Repository, field, from, to string) error {
+	change := ChangelogChange{Field: field, Op: ChangelogOpUpdate}
+	switch field {
+	case ChangelogNewRepo, ChangelogNote:
+		change.Op = ChangelogOpCreate
+	case ChangelogDeleteRepo:
+		change.Op = ChangelogOpDelete
+	}
+	if from != "" {
+		change.From = from
+	}
+	if to != "" {
+		change.To = to
+	}
+	return dbi.createChangelogChange(actor, repo, change)
+}
+
+func (dbi *DatabaseImpl) createChangelogChange(actor string, repo *gh.Repository, change ChangelogChange) error {
+	entry := ChangeLog{
+		// the ID is the order in which the entries are read by the event-driven automations
+		ID:            primitive.NewObjectID(),
+		RepoID:        repo.ID,
+		GitHubHost:    repo.GitHubHost,
+		Name:          repo.Name,
+		NameWithOwner: repo.NameWithOwner,
+		Owner: struct {
+			Login string `bson:"login" json:"login"`
+		}{
+			Login: repo.Owner.Login,
 		},
-	); err != nil {
+		RepoOwnerID:      repo.RepoOwnerID,
+		RepoOwner:        repo.RepoOwner,
+		RepoOwnerContact: repo.RepoOwnerContact,
+		Field:            change.Field,
+		Op:               change.Op,
+		From:             changelogString(change.From),
+		To:               changelogString(change.To),
+		FromValue:        change.From,
+		ToValue:          change.To,
+		Actor:            actor,
+		CreatedAt:        time.Now(),
+	}
+	if _, err := dbi.db.Collection(changeLogTableName).InsertOne(dbi.ctx, entry); err != nil {
 		slog.Error("error in inserting a changelog entry", slog.String("error", err.Error()))
 		return err
 	}
 	return nil
 }
+
+// changelogString is the text of a value for the from and to of the entries, the matching of
+// the events and the CSVs. The arrays, the maps and the structs are in JSON.
+func changelogString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	if _, ok := v.(fmt.Stringer); !ok {
+		switch reflect.ValueOf(v).Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
+			if b, err := json.Marshal(v); err == nil {
+				return string(b)
+			}
+		}
+	}
+	return cast.ToString(v)
+}
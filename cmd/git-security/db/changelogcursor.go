@@ -0,0 +1,97 @@
+package db
+
+import (
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const changelogCursorsTableName = "changelogcursors"
+
+// ChangelogCursor is the last changelog entry handled by a reader of the changelog, the
+// entries are read in the order of their IDs
+type ChangelogCursor struct {
+	Name      string             `bson:"_id" json:"name"`
+	LastID    primitive.ObjectID `bson:"last_id" json:"last_id"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// CreateChangelogCursor creates the cursor at the time if it doesn't exist yet, the
+// entries recorded before aren't read
+func (dbi *DatabaseImpl) CreateChangelogCursor(name string, at time.Time) error {
+	if _, err := dbi.db.Collection(changelogCursorsTableName).UpdateOne(
+		dbi.ctx,
+		bson.D{{Key: "_id", Value: name}},
+		bson.D{{Key: "$setOnInsert", Value: bson.D{
+			{Key: "last_id", Value: primitive.NewObjectIDFromTimestamp(at)},
+			{Key: "updated_at", Value: time.Now()},
+		}}},
+		options.Update().SetUpsert(true),
+	); err != nil {
+		slog.Error("error in creating the changelog cursor", slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// ClaimChangelogAfter returns the entries after the cursor recorded before the time, in
+// order, and moves the cursor after them. The time leaves the entries being recorded the time
+// to be inserted, their IDs are taken before. The cursor is only moved from the entry it was
+// read at, so that a batch is claimed by a single replica, the others get no entries.
+func (dbi *DatabaseImpl) ClaimChangelogAfter(name string, before time.Time, limit int64) ([]*ChangeLog, error) {
+	var cursor ChangelogCursor
+	if err := dbi.db.Collection(changelogCursorsTableName).FindOne(
+		dbi.ctx,
+		bson.D{{Key: "_id", Value: name}},
+	).Decode(&cursor); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return []*ChangeLog{}, nil
+		}
+		return nil, err
+	}
+
+	entries, err := dbi.db.Collection(changeLogTableName).Find(
+		dbi.ctx,
+		bson.D{{Key: "_id", Value: bson.M{
+			"$gt": cursor.LastID,
+			"$lt": primitive.NewObjectIDFromTimestamp(before),
+		}}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer entries.Close(dbi.ctx)
+
+	log := []*ChangeLog{}
+	if err := entries.All(dbi.ctx, &log); err != nil {
+		return nil, err
+	}
+	if len(log) == 0 {
+		return log, nil
+	}
+
+	// the update is atomic on MongoDB, the embedded FerretDB needs the lock
+	dbi.mu.Lock()
+	defer dbi.mu.Unlock()
+	res, err := dbi.db.Collection(changelogCursorsTableName).UpdateOne(
+		dbi.ctx,
+		bson.D{{Key: "_id", Value: name}, {Key: "last_id", Value: cursor.LastID}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "last_id", Value: log[len(log)-1].ID},
+			{Key: "updated_at", Value: time.Now()},
+		}}},
+	)
+	if err != nil {
+		slog.Error("error in claiming the changelog entries", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return []*ChangeLog{}, nil
+	}
+	return log, nil
+}
@@ -9,6 +9,8 @@ import (
 	"testing"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -18,14 +20,44 @@ import (
 )
 
 type Database interface {
+	ClaimChangelogAfter(name string, before time.Time, limit int64) ([]*ChangeLog, error)
+	ClaimHookScheduleRun(hookType string, hookID primitive.ObjectID, dueAt, nextRunAt time.Time) (bool, error)
+	CreateAuditLog(actor, entityType, entityID string, before, after interface{}) error
+	CreateAuditLogAction(actor, entityType, entityID, action string, changes []AuditChange) error
+	CreateAuditLogIndices() error
 	CreateChangelog(repo *gh.Repository, field, from, to string) error
+	CreateChangelogBy(actor string, repo *gh.Repository, field, from, to string) error
+	CreateChangelogCursor(name string, at time.Time) error
 	CreateChangelogIndices() error
+	CreateHookCacheIndices() error
+	CreateHookRun(run *HookRun) error
+	CreateHookRunIndices() error
+	CreateHookScheduleIndices() error
+	CreateMissingRepoSnapshots() error
+	CreateRepoSnapshotIndices() error
+	DeleteHookCache(hookID primitive.ObjectID, repos []string) error
+	DeleteHookRuns(before time.Time) error
+	DeleteHookSchedule(hookType string, hookID primitive.ObjectID) error
+	DeleteRepoSnapshotQueries() error
+	DeleteRepoSnapshots(before time.Time) error
 	DeleteRepositories(before time.Time) error
+	ReadAuditLog(filters interface{}) ([]*AuditLog, error)
 	ReadChangelog(filters interface{}) ([]*ChangeLog, error)
+	ReadHookCache(hookID primitive.ObjectID) (map[string]*HookCacheEntry, error)
+	ReadHookRun(id primitive.ObjectID) (*HookRun, error)
+	ReadHookRuns(filters interface{}, limit int64) ([]*HookRun, error)
+	ReadHookSchedules(filters interface{}) ([]*HookSchedule, error)
 	ReadRepositories(filters interface{}) ([]*gh.Repository, error)
+	ReadRepositoriesAsOf(asOf time.Time, snapshotFilters, filters bson.D) ([]*gh.Repository, error)
+	TakeHookTrigger(hookType string, hookID primitive.ObjectID) (*HookTrigger, error)
+	TriggerHook(hookType string, hookID primitive.ObjectID, repos []string, requestedBy string) error
+	UpdateHookCache(entry *HookCacheEntry) error
+	UpdateHookSchedule(hookType string, hookID primitive.ObjectID, schedule string, prevNextRunAt, nextRunAt time.Time) (bool, error)
+	UpdateHookScheduleRun(hookType string, hookID primitive.ObjectID, lastRunAt time.Time, runErr error) error
 	UpdateRepositories(filters interface{}, update interface{}) ([]*gh.Repository, error)
 	UpdateRepositoriesByIDs(repoIDs []string, update interface{}) ([]*gh.Repository, error)
 	UpdateRepository(repoID string, update interface{}, upsert bool) (*gh.Repository, error)
+	UpdateRepositoryBy(actor, repoID string, update interface{}) (*gh.Repository, error)
 }
 
 type DatabaseImpl struct {
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"log/slog"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	hookRunsTableName = "hookruns"
+
+	// MaxHookRunLogSize is the size of the stdout and stderr kept for a run, the end of the
+	// logs is kept as the result of the custom hooks is the last line
+	MaxHookRunLogSize = 64 * 1024
+)
+
+// HookRun is an execution of a custom hook or an automation, the repo is empty for the
+// batch mode custom hooks. Error is the failure to run the hook, not a non zero exit code.
+// The webhooks record the status and the body of their last response as stdout, and their
+// attempts as stderr.
+type HookRun struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	HookType        string             `bson:"hook_type" json:"hook_type"`
+	HookID          primitive.ObjectID `bson:"hook_id" json:"hook_id"`
+	Repo            string             `bson:"repo" json:"repo"`
+	Executor        string             `bson:"executor" json:"executor"`
+	Image           string             `bson:"image" json:"image"`
+	ImageDigest     string             `bson:"image_digest" json:"image_digest"`
+	StartedAt       time.Time          `bson:"started_at" json:"started_at"`
+	EndedAt         time.Time          `bson:"ended_at" json:"ended_at"`
+	ExitCode        int                `bson:"exit_code" json:"exit_code"`
+	Error           string             `bson:"error" json:"error"`
+	TimedOut        bool               `bson:"timed_out" json:"timed_out"`
+	Stdout          string             `bson:"stdout,omitempty" json:"stdout,omitempty"`
+	Stderr          string             `bson:"stderr,omitempty" json:"stderr,omitempty"`
+	StdoutTruncated bool               `bson:"stdout_truncated" json:"stdout_truncated"`
+	StderrTruncated bool               `bson:"stderr_truncated" json:"stderr_truncated"`
+	ResponseStatus  int                `bson:"response_status,omitempty" json:"response_status,omitempty"`
+	Attempts        int                `bson:"attempts,omitempty" json:"attempts,omitempty"`
+}
+
+func (dbi *DatabaseImpl) CreateHookRunIndices() error {
+	for _, idxToCreate := range []string{"hook_type", "hook_id", "repo"} {
+		if _, err := dbi.db.Collection(hookRunsTableName).Indexes().CreateOne(dbi.ctx, mongo.IndexModel{
+			Keys: bson.M{idxToCreate: 1},
+		}); err != nil {
+			return err
+		}
+	}
+	for _, idxToCreate := range []string{"started_at"} {
+		if _, err := dbi.db.Collection(hookRunsTableName).Indexes().CreateOne(dbi.ctx, mongo.IndexModel{
+			Keys: bson.M{idxToCreate: -1},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateHookRun records the run, the logs are truncated to MaxHookRunLogSize. The secrets
+// must be redacted by the caller.
+func (dbi *DatabaseImpl) CreateHookRun(run *HookRun) error {
+	run.Stdout, run.StdoutTruncated = truncateLog(run.Stdout)
+	run.Stderr, run.StderrTruncated = truncateLog(run.Stderr)
+	if _, err := dbi.db.Collection(hookRunsTableName).InsertOne(dbi.ctx, run); err != nil {
+		slog.Error("error in inserting a hook run", slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// ReadHookRuns returns the latest runs first, without their logs
+func (dbi *DatabaseImpl) ReadHookRuns(filters interface{}, limit int64) ([]*HookRun, error) {
+	cursor, err := dbi.db.Collection(hookRunsTableName).Find(
+		dbi.ctx,
+		filters,
+		options.Find().
+			SetSort(bson.D{{Key: "started_at", Value: -1}}).
+			SetProjection(bson.D{{Key: "stdout", Value: 0}, {Key: "stderr", Value: 0}}).
+			SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(dbi.ctx)
+
+	runs := []*HookRun{}
+	if err := cursor.All(dbi.ctx, &runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// ReadHookRun returns the run with its logs, nil if it doesn't exist
+func (dbi *DatabaseImpl) ReadHookRun(id primitive.ObjectID) (*HookRun, error) {
+	var run HookRun
+	if err := dbi.db.Collection(hookRunsTableName).FindOne(
+		dbi.ctx,
+		bson.D{{Key: "_id", Value: id}},
+	).Decode(&run); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &run, nil
+}
+
+// DeleteHookRuns removes the runs started before the time, for the retention policy
+func (dbi *DatabaseImpl) DeleteHookRuns(before time.Time) error {
+	res, err := dbi.db.Collection(hookRunsTableName).DeleteMany(
+		dbi.ctx,
+		bson.D{{Key: "started_at", Value: bson.M{"$lt": before}}},
+	)
+	if err != nil {
+		return err
+	}
+	slog.Info("deleted old hook runs", slog.Int64("count", res.DeletedCount))
+	return nil
+}
+
+// truncateLog keeps the end of the log, from the start of a rune
+func truncateLog(log string) (string, bool) {
+	if len(log) <= MaxHookRunLogSize {
+		return log, false
+	}
+	start := len(log) - MaxHookRunLogSize
+	for start < len(log) && !utf8.RuneStart(log[start]) {
+		start++
+	}
+	return log[start:], true
+}
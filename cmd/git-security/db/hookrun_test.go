@@ -0,0 +1,67 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestHookRuns(t *testing.T) {
+	teardown, dbw, _ := SetupDBForTest(t)
+	defer teardown()
+
+	require.Nil(t, dbw.CreateHookRunIndices())
+	hookID := primitive.NewObjectID()
+	now := time.Now()
+
+	old := &HookRun{HookType: HookTypeCustom, HookID: hookID, Repo: "org/a", StartedAt: now.Add(-48 * time.Hour)}
+	require.Nil(t, dbw.CreateHookRun(old))
+	run := &HookRun{
+		HookType:  HookTypeCustom,
+		HookID:    hookID,
+		Repo:      "org/b",
+		StartedAt: now,
+		Stdout:    strings.Repeat("é", MaxHookRunLogSize) + "\nlast",
+		Stderr:    "warning",
+		ExitCode:  1,
+	}
+	require.Nil(t, dbw.CreateHookRun(run))
+	require.Nil(t, dbw.CreateHookRun(&HookRun{HookType: HookTypeAutomation, HookID: primitive.NewObjectID(), Repo: "org/b", StartedAt: now}))
+
+	// the end of the logs is kept
+	assert.True(t, run.StdoutTruncated)
+	assert.LessOrEqual(t, len(run.Stdout), MaxHookRunLogSize)
+	assert.True(t, strings.HasSuffix(run.Stdout, "é\nlast"))
+	assert.False(t, run.StderrTruncated)
+
+	// the runs are listed without the logs, the latest first
+	runs, err := dbw.ReadHookRuns(bson.D{{Key: "hook_id", Value: hookID}}, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(runs))
+	assert.Equal(t, "org/b", runs[0].Repo)
+	assert.Equal(t, 1, runs[0].ExitCode)
+	assert.Empty(t, runs[0].Stdout)
+	runs, err = dbw.ReadHookRuns(bson.D{{Key: "repo", Value: "org/b"}}, 1)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(runs))
+
+	// a single run has its logs
+	r, err := dbw.ReadHookRun(runs[0].ID)
+	require.Nil(t, err)
+	require.NotNil(t, r)
+	assert.NotEmpty(t, r.Stdout)
+	r, err = dbw.ReadHookRun(primitive.NewObjectID())
+	require.Nil(t, err)
+	assert.Nil(t, r)
+
+	// retention
+	require.Nil(t, dbw.DeleteHookRuns(now.Add(-24*time.Hour)))
+	runs, err = dbw.ReadHookRuns(bson.D{}, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(runs))
+}
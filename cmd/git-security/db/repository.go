@@ -3,10 +3,11 @@ package db
 import (
 	"fmt"
 	"log/slog"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/r3labs/diff/v3"
-	"github.com/spf13/cast"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -88,8 +89,12 @@ func (dbi *DatabaseImpl) UpdateRepositories(
 			return nil, err
 		}
 		if ok {
-			for field, change := range createDiffLog(r, *repo) {
-				dbi.CreateChangelog(repo, field, change[0], change[1])
+			changes := createDiffLog(r, *repo)
+			for _, change := range changes {
+				dbi.createChangelogChange("", repo, change)
+			}
+			if len(changes) > 0 {
+				dbi.createRepoSnapshot(repo, false)
 			}
 			dbi.repos[repo.ID] = *repo
 		}
@@ -123,8 +128,12 @@ func (dbi *DatabaseImpl) UpdateRepositoriesByIDs(
 			return nil, err
 		}
 		if ok {
-			for field, change := range createDiffLog(r, *repo) {
-				dbi.CreateChangelog(repo, field, change[0], change[1])
+			changes := createDiffLog(r, *repo)
+			for _, change := range changes {
+				dbi.createChangelogChange("", repo, change)
+			}
+			if len(changes) > 0 {
+				dbi.createRepoSnapshot(repo, false)
 			}
 			dbi.repos[repo.ID] = *repo
 		}
@@ -158,6 +167,20 @@ func (dbi *DatabaseImpl) UpdateRepository(
 	repoID string,
 	update interface{},
 	upsert bool,
+) (*gh.Repository, error) {
+	return dbi.updateRepository("", repoID, update, upsert)
+}
+
+// UpdateRepositoryBy updates an existing repo and records the changes made by the actor
+func (dbi *DatabaseImpl) UpdateRepositoryBy(actor, repoID string, update interface{}) (*gh.Repository, error) {
+	return dbi.updateRepository(actor, repoID, update, false)
+}
+
+func (dbi *DatabaseImpl) updateRepository(
+	actor string,
+	repoID string,
+	update interface{},
+	upsert bool,
 ) (*gh.Repository, error) {
 	dbi.mu.Lock()
 	defer dbi.mu.Unlock()
@@ -196,12 +219,17 @@ func (dbi *DatabaseImpl) UpdateRepository(
 	if newRecord != nil {
 		if ok {
 			// update
-			for field, change := range createDiffLog(r, *newRecord) {
-				dbi.CreateChangelog(newRecord, field, change[0], change[1])
+			changes := createDiffLog(r, *newRecord)
+			for _, change := range changes {
+				dbi.createChangelogChange(actor, newRecord, change)
+			}
+			if len(changes) > 0 {
+				dbi.createRepoSnapshot(newRecord, false)
 			}
 		} else if newRecord.GqlRepository != nil && newRecord.ID != "" {
 			// create
-			dbi.CreateChangelog(newRecord, "New Repo", "", "")
+			dbi.CreateChangelogBy(actor, newRecord, ChangelogNewRepo, "", "")
+			dbi.createRepoSnapshot(newRecord, false)
 		}
 
 		// put the latest version back to cache
@@ -238,27 +266,39 @@ func (dbi *DatabaseImpl) DeleteRepositories(before time.Time) error {
 
 	for _, repo := range repos {
 		delete(dbi.repos, repo.ID)
-		dbi.CreateChangelog(repo, "Delete Repo", "", "")
+		dbi.CreateChangelog(repo, ChangelogDeleteRepo, "", "")
+		dbi.createRepoSnapshot(repo, true)
 	}
 
 	return nil
 }
 
-func createDiffLog(before, after gh.Repository) map[string][2]string {
-	results := make(map[string][2]string)
+// createDiffLog returns the changes between the versions of the repo, sorted by field. The
+// elements added to and removed from the arrays are changes of their own, the field of an
+// element is the field of its array.
+func createDiffLog(before, after gh.Repository) []ChangelogChange {
+	results := make([]ChangelogChange, 0)
 	changelog, _ := diff.Diff(before, after)
 	for _, cl := range changelog {
+		var field string
 		if cl.Path[0] == "Customs" {
-			field := fmt.Sprintf("Customs.%s", cl.Path[1])
-			results[field] = [...]string{cast.ToString(cl.From), cast.ToString(cl.To)}
+			field = fmt.Sprintf("Customs.%s", cl.Path[1])
 		} else {
-			if cl.Type == diff.UPDATE {
-				field := cl.Path[len(cl.Path)-1]
-				if _, ok := ignoredChangelogFields[field]; !ok {
-					results[field] = [...]string{cast.ToString(cl.From), cast.ToString(cl.To)}
+			field = cl.Path[len(cl.Path)-1]
+			for idx, p := range cl.Path {
+				if _, err := strconv.Atoi(p); err == nil && idx > 0 {
+					field = cl.Path[idx-1]
+					break
 				}
 			}
+			if _, ok := ignoredChangelogFields[field]; ok {
+				continue
+			}
 		}
+		results = append(results, ChangelogChange{Field: field, Op: cl.Type, From: cl.From, To: cl.To})
 	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Field < results[j].Field
+	})
 	return results
 }
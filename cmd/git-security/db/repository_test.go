@@ -49,6 +49,8 @@ func TestUpdateRepositorySimple(t *testing.T) {
 	assert.Equal(t, "IsArchived", log[1].Field)
 	assert.Equal(t, "false", log[1].From)
 	assert.Equal(t, "true", log[1].To)
+	assert.Equal(t, ChangelogOpUpdate, log[1].Op)
+	assert.Equal(t, true, log[1].ToValue)
 }
 
 func TestCreateDiffLog(t *testing.T) {
@@ -69,11 +71,10 @@ func TestCreateDiffLog(t *testing.T) {
 				IsArchived: true,
 			},
 		})
-	assert.Equal(t, 2, len(results))
-	assert.Equal(t, "123", results["RepoOwner"][0])
-	assert.Equal(t, "1234", results["RepoOwner"][1])
-	assert.Equal(t, "false", results["IsArchived"][0])
-	assert.Equal(t, "true", results["IsArchived"][1])
+	assert.Equal(t, []ChangelogChange{
+		{Field: "IsArchived", Op: ChangelogOpUpdate, From: false, To: true},
+		{Field: "RepoOwner", Op: ChangelogOpUpdate, From: "123", To: "1234"},
+	}, results)
 }
 
 func TestCreateDiffLogMapAndAddToArray(t *testing.T) {
@@ -88,15 +89,15 @@ func TestCreateDiffLogMapAndAddToArray(t *testing.T) {
 			RepoOwner: "123",
 			Customs: map[string]interface{}{
 				"new-custom":        123,
-				"pre-receive-hooks": []string{"ggshield", "newhook"},
+				"pre-receive-hooks": []string{"ggshield", "newhook", "otherhook"},
 			},
 		},
 	)
-	assert.Equal(t, 2, len(results))
-	assert.Equal(t, "", results["Customs.pre-receive-hooks"][0])
-	assert.Equal(t, "newhook", results["Customs.pre-receive-hooks"][1])
-	assert.Equal(t, "", results["Customs.new-custom"][0])
-	assert.Equal(t, "123", results["Customs.new-custom"][1])
+	assert.Equal(t, []ChangelogChange{
+		{Field: "Customs.new-custom", Op: ChangelogOpCreate, To: 123},
+		{Field: "Customs.pre-receive-hooks", Op: ChangelogOpCreate, To: "newhook"},
+		{Field: "Customs.pre-receive-hooks", Op: ChangelogOpCreate, To: "otherhook"},
+	}, results)
 }
 
 func TestCreateDiffLogMapAndAddRemoved(t *testing.T) {
@@ -114,9 +115,82 @@ func TestCreateDiffLogMapAndAddRemoved(t *testing.T) {
 			},
 		},
 	)
-	assert.Equal(t, 1, len(results))
-	assert.Equal(t, "ggshield", results["Customs.pre-receive-hooks"][0])
-	assert.Equal(t, "", results["Customs.pre-receive-hooks"][1])
+	assert.Equal(t, []ChangelogChange{
+		{Field: "Customs.pre-receive-hooks", Op: ChangelogOpDelete, From: "ggshield"},
+	}, results)
+}
+
+func TestCreateDiffLogArrays(t *testing.T) {
+	before := gh.Repository{
+		GqlRepository:      &gh.GqlRepository{ID: "foobar"},
+		PushAllowanceUsers: []string{"alice", "bob"},
+	}
+	before.DefaultBranchRef.BranchProtectionRule.RequiredStatusChecks = []struct {
+		Context string `bson:"context" json:"context"`
+	}{{Context: "ci"}}
+	after := gh.Repository{
+		GqlRepository:          &gh.GqlRepository{ID: "foobar"},
+		PushAllowanceUsers:     []string{"bob", "carol"},
+		BypassPullRequestUsers: []string{"dave"},
+	}
+	after.DefaultBranchRef.BranchProtectionRule.RequiredStatusChecks = []struct {
+		Context string `bson:"context" json:"context"`
+	}{{Context: "ci"}, {Context: "lint"}}
+
+	assert.Equal(t, []ChangelogChange{
+		{Field: "BypassPullRequestUsers", Op: ChangelogOpCreate, To: "dave"},
+		{Field: "PushAllowanceUsers", Op: ChangelogOpDelete, From: "alice"},
+		{Field: "PushAllowanceUsers", Op: ChangelogOpCreate, To: "carol"},
+		{Field: "RequiredStatusChecks", Op: ChangelogOpCreate, To: "lint"},
+	}, createDiffLog(before, after))
+}
+
+func TestChangelogValues(t *testing.T) {
+	teardown, db, _ := SetupDBForTest(t)
+	defer teardown()
+
+	repo := gh.Repository{
+		GqlRepository:      &gh.GqlRepository{ID: "foobar"},
+		PushAllowanceUsers: []string{"alice"},
+		Customs:            map[string]interface{}{"score": 1},
+	}
+	_, err := db.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+	require.Nil(t, err)
+	repo.PushAllowanceUsers = []string{"alice", "bob"}
+	repo.Customs = map[string]interface{}{"score": 2, "labels": []string{"pci"}}
+	_, err = db.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+	require.Nil(t, err)
+
+	// the users added to the push allowances
+	log, err := db.ReadChangelog(bson.D{
+		{Key: "field", Value: "PushAllowanceUsers"},
+		{Key: "op", Value: ChangelogOpCreate},
+		{Key: "to", Value: "bob"},
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(log))
+	assert.Equal(t, "bob", log[0].ToValue)
+	assert.Nil(t, log[0].FromValue)
+
+	log, err = db.ReadChangelog(bson.D{{Key: "field", Value: "Customs.score"}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(log))
+	assert.Equal(t, ChangelogOpUpdate, log[0].Op)
+	assert.Equal(t, "1", log[0].From)
+	assert.EqualValues(t, 1, log[0].FromValue)
+	assert.EqualValues(t, 2, log[0].ToValue)
+
+	// the new arrays are recorded as a whole
+	log, err = db.ReadChangelog(bson.D{{Key: "field", Value: "Customs.labels"}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(log))
+	assert.Equal(t, ChangelogOpCreate, log[0].Op)
+	assert.Equal(t, `["pci"]`, log[0].To)
+
+	log, err = db.ReadChangelog(bson.D{{Key: "field", Value: ChangelogNewRepo}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(log))
+	assert.Equal(t, ChangelogOpCreate, log[0].Op)
 }
 
 func TestUpdateRepositoriesByIDs(t *testing.T) {
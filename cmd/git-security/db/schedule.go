@@ -0,0 +1,232 @@
+package db
+
+import (
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	hookSchedulesTableName = "hookschedules"
+
+	HookTypeCustom     = "custom"
+	HookTypeAutomation = "automation"
+)
+
+// HookSchedule is the scheduler state of a custom hook or an automation, the next run is
+// computed from the cron expression of the hook
+type HookSchedule struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	HookType  string             `bson:"hook_type" json:"hook_type"`
+	HookID    primitive.ObjectID `bson:"hook_id" json:"hook_id"`
+	Schedule  string             `bson:"schedule" json:"schedule"`
+	LastRunAt time.Time          `bson:"last_run_at" json:"last_run_at"`
+	NextRunAt time.Time          `bson:"next_run_at" json:"next_run_at"`
+	LastError string             `bson:"last_error" json:"last_error"`
+	Trigger   *HookTrigger       `bson:"trigger,omitempty" json:"trigger,omitempty"`
+}
+
+// HookTrigger is a run requested through the API, no repos means all of them
+type HookTrigger struct {
+	Repos       []string  `bson:"repos" json:"repos"`
+	RequestedBy string    `bson:"requested_by" json:"requested_by"`
+	RequestedAt time.Time `bson:"requested_at" json:"requested_at"`
+}
+
+func hookScheduleFilter(hookType string, hookID primitive.ObjectID) bson.D {
+	return bson.D{
+		{Key: "hook_type", Value: hookType},
+		{Key: "hook_id", Value: hookID},
+	}
+}
+
+func (dbi *DatabaseImpl) CreateHookScheduleIndices() error {
+	if _, err := dbi.db.Collection(hookSchedulesTableName).Indexes().CreateOne(dbi.ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hook_type", Value: 1}, {Key: "hook_id", Value: 1}},
+		Options: &options.IndexOptions{Unique: func(b bool) *bool { return &b }(true)},
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dbi *DatabaseImpl) ReadHookSchedules(filters interface{}) ([]*HookSchedule, error) {
+	cursor, err := dbi.db.Collection(hookSchedulesTableName).Find(
+		dbi.ctx,
+		filters,
+		options.Find().SetSort(bson.D{{Key: "next_run_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(dbi.ctx)
+
+	schedules := []*HookSchedule{}
+	if err := cursor.All(dbi.ctx, &schedules); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// UpdateHookSchedule records the schedule of the hook and when it runs next, if the next run
+// is still the one read before, zero when the schedule doesn't exist yet. It tells if the
+// schedule was updated, another replica may have updated it first.
+func (dbi *DatabaseImpl) UpdateHookSchedule(
+	hookType string,
+	hookID primitive.ObjectID,
+	schedule string,
+	prevNextRunAt, nextRunAt time.Time,
+) (bool, error) {
+	// the update is atomic on MongoDB, the embedded FerretDB needs the lock
+	dbi.mu.Lock()
+	defer dbi.mu.Unlock()
+
+	filters := hookScheduleFilter(hookType, hookID)
+	if prevNextRunAt.IsZero() {
+		// the schedules created by a trigger have no next run yet
+		filters = append(filters, bson.E{Key: "next_run_at", Value: bson.M{"$in": bson.A{nil, time.Time{}}}})
+	} else {
+		filters = append(filters, bson.E{Key: "next_run_at", Value: prevNextRunAt})
+	}
+	res, err := dbi.db.Collection(hookSchedulesTableName).UpdateOne(
+		dbi.ctx,
+		filters,
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "schedule", Value: schedule},
+			{Key: "next_run_at", Value: nextRunAt},
+		}}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		// the upsert of a schedule that moved on
+		return false, nil
+	}
+	if err != nil {
+		slog.Error("error in updating the hook schedule", slog.String("error", err.Error()))
+		return false, err
+	}
+	return res.MatchedCount > 0 || res.UpsertedCount > 0, nil
+}
+
+// ClaimHookScheduleRun moves the next run of the hook from the one due to the following one,
+// it tells if the due run was claimed so that a single replica runs it
+func (dbi *DatabaseImpl) ClaimHookScheduleRun(hookType string, hookID primitive.ObjectID, dueAt, nextRunAt time.Time) (bool, error) {
+	// the update is atomic on MongoDB, the embedded FerretDB needs the lock
+	dbi.mu.Lock()
+	defer dbi.mu.Unlock()
+
+	filters := hookScheduleFilter(hookType, hookID)
+	filters = append(filters, bson.E{Key: "next_run_at", Value: dueAt})
+	res, err := dbi.db.Collection(hookSchedulesTableName).UpdateOne(
+		dbi.ctx,
+		filters,
+		bson.D{{Key: "$set", Value: bson.D{{Key: "next_run_at", Value: nextRunAt}}}},
+	)
+	if err != nil {
+		slog.Error("error in claiming the hook schedule run", slog.String("error", err.Error()))
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// UpdateHookScheduleRun records the run of the hook, runErr is nil if the run succeeded. The
+// next run was moved when the run was claimed.
+func (dbi *DatabaseImpl) UpdateHookScheduleRun(hookType string, hookID primitive.ObjectID, lastRunAt time.Time, runErr error) error {
+	lastError := ""
+	if runErr != nil {
+		lastError = runErr.Error()
+	}
+	if _, err := dbi.db.Collection(hookSchedulesTableName).UpdateOne(
+		dbi.ctx,
+		hookScheduleFilter(hookType, hookID),
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "last_run_at", Value: lastRunAt},
+			{Key: "last_error", Value: lastError},
+		}}},
+		options.Update().SetUpsert(true),
+	); err != nil {
+		slog.Error("error in updating the hook schedule run", slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// TriggerHook requests a run of the hook at the next scheduler tick, the repos are added
+// to the ones of a pending trigger. No repos means all of them.
+func (dbi *DatabaseImpl) TriggerHook(hookType string, hookID primitive.ObjectID, repos []string, requestedBy string) error {
+	// the update is atomic on MongoDB, the embedded FerretDB needs the lock
+	dbi.mu.Lock()
+	defer dbi.mu.Unlock()
+
+	filters := hookScheduleFilter(hookType, hookID)
+	var update bson.D
+	if len(repos) == 0 {
+		update = bson.D{{Key: "$set", Value: bson.D{{Key: "trigger", Value: HookTrigger{
+			Repos:       []string{},
+			RequestedBy: requestedBy,
+			RequestedAt: time.Now(),
+		}}}}}
+	} else {
+		// a pending trigger of all the repos is left as is, the upsert then fails on the
+		// unique index of the schedules. It fails too when a concurrent trigger creates the
+		// schedule first, so it's tried again once.
+		filters = append(filters, bson.E{Key: "trigger.repos", Value: bson.M{"$ne": bson.A{}}})
+		update = bson.D{
+			{Key: "$addToSet", Value: bson.D{{Key: "trigger.repos", Value: bson.M{"$each": repos}}}},
+			{Key: "$set", Value: bson.D{
+				{Key: "trigger.requested_by", Value: requestedBy},
+				{Key: "trigger.requested_at", Value: time.Now()},
+			}},
+		}
+	}
+
+	var err error
+	for range 2 {
+		if _, err = dbi.db.Collection(hookSchedulesTableName).UpdateOne(
+			dbi.ctx,
+			filters,
+			update,
+			options.Update().SetUpsert(true),
+		); !mongo.IsDuplicateKeyError(err) || len(repos) == 0 {
+			break
+		}
+	}
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		slog.Error("error in triggering the hook", slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// TakeHookTrigger removes the pending trigger of the hook and returns it, nil if there's none
+func (dbi *DatabaseImpl) TakeHookTrigger(hookType string, hookID primitive.ObjectID) (*HookTrigger, error) {
+	filters := hookScheduleFilter(hookType, hookID)
+	filters = append(filters, bson.E{Key: "trigger", Value: bson.M{"$ne": nil}})
+	var schedule HookSchedule
+	if err := dbi.db.Collection(hookSchedulesTableName).FindOneAndUpdate(
+		dbi.ctx,
+		filters,
+		bson.D{{Key: "$unset", Value: bson.D{{Key: "trigger", Value: ""}}}},
+	).Decode(&schedule); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return schedule.Trigger, nil
+}
+
+// DeleteHookSchedule removes the scheduler state of a deleted hook
+func (dbi *DatabaseImpl) DeleteHookSchedule(hookType string, hookID primitive.ObjectID) error {
+	if _, err := dbi.db.Collection(hookSchedulesTableName).DeleteOne(
+		dbi.ctx,
+		hookScheduleFilter(hookType, hookID),
+	); err != nil {
+		return err
+	}
+	return nil
+}
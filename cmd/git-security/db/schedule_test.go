@@ -0,0 +1,104 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestHookSchedules(t *testing.T) {
+	teardown, dbw, _ := SetupDBForTest(t)
+	defer teardown()
+
+	require.Nil(t, dbw.CreateHookScheduleIndices())
+	id := primitive.NewObjectID()
+
+	trigger, err := dbw.TakeHookTrigger(HookTypeCustom, id)
+	require.Nil(t, err)
+	assert.Nil(t, trigger)
+
+	// the repos of the pending triggers are merged
+	require.Nil(t, dbw.TriggerHook(HookTypeCustom, id, []string{"org/a"}, "alice"))
+	require.Nil(t, dbw.TriggerHook(HookTypeCustom, id, []string{"org/b", "org/a"}, "bob"))
+	trigger, err = dbw.TakeHookTrigger(HookTypeCustom, id)
+	require.Nil(t, err)
+	require.NotNil(t, trigger)
+	assert.Equal(t, []string{"org/a", "org/b"}, trigger.Repos)
+	assert.Equal(t, "bob", trigger.RequestedBy)
+
+	// the trigger is taken once
+	trigger, err = dbw.TakeHookTrigger(HookTypeCustom, id)
+	require.Nil(t, err)
+	assert.Nil(t, trigger)
+
+	// a trigger for all the repos wins
+	require.Nil(t, dbw.TriggerHook(HookTypeCustom, id, []string{"org/a"}, "alice"))
+	require.Nil(t, dbw.TriggerHook(HookTypeCustom, id, nil, "bob"))
+	require.Nil(t, dbw.TriggerHook(HookTypeCustom, id, []string{"org/b"}, "alice"))
+	trigger, err = dbw.TakeHookTrigger(HookTypeCustom, id)
+	require.Nil(t, err)
+	require.NotNil(t, trigger)
+	assert.Empty(t, trigger.Repos)
+
+	// the concurrent triggers aren't lost, even when they create the schedule
+	concurrentID := primitive.NewObjectID()
+	var wg sync.WaitGroup
+	repos := make([]string, 0)
+	for i := range 10 {
+		repo := fmt.Sprintf("org/repo%d", i)
+		repos = append(repos, repo)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, dbw.TriggerHook(HookTypeCustom, concurrentID, []string{repo}, "alice"))
+		}()
+	}
+	wg.Wait()
+	trigger, err = dbw.TakeHookTrigger(HookTypeCustom, concurrentID)
+	require.Nil(t, err)
+	require.NotNil(t, trigger)
+	assert.ElementsMatch(t, repos, trigger.Repos)
+	require.Nil(t, dbw.DeleteHookSchedule(HookTypeCustom, concurrentID))
+
+	// the runs are recorded per hook type
+	next := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	updated, err := dbw.UpdateHookSchedule(HookTypeCustom, id, "@hourly", time.Time{}, next)
+	require.Nil(t, err)
+	assert.True(t, updated)
+	require.Nil(t, dbw.UpdateHookScheduleRun(HookTypeAutomation, id, time.Now(), assert.AnError))
+	schedules, err := dbw.ReadHookSchedules(bson.D{{Key: "hook_type", Value: HookTypeCustom}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(schedules))
+	assert.Equal(t, "@hourly", schedules[0].Schedule)
+	assert.True(t, next.Equal(schedules[0].NextRunAt))
+	schedules, err = dbw.ReadHookSchedules(bson.D{{Key: "hook_type", Value: HookTypeAutomation}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(schedules))
+	assert.Equal(t, assert.AnError.Error(), schedules[0].LastError)
+
+	// the schedule and the due runs are only updated from the next run read
+	updated, err = dbw.UpdateHookSchedule(HookTypeCustom, id, "@daily", time.Time{}, next)
+	require.Nil(t, err)
+	assert.False(t, updated)
+	later := next.Add(time.Hour)
+	claimed, err := dbw.ClaimHookScheduleRun(HookTypeCustom, id, next, later)
+	require.Nil(t, err)
+	assert.True(t, claimed)
+	claimed, err = dbw.ClaimHookScheduleRun(HookTypeCustom, id, next, later)
+	require.Nil(t, err)
+	assert.False(t, claimed)
+	updated, err = dbw.UpdateHookSchedule(HookTypeCustom, id, "@daily", later, next)
+	require.Nil(t, err)
+	assert.True(t, updated)
+
+	require.Nil(t, dbw.DeleteHookSchedule(HookTypeCustom, id))
+	schedules, err = dbw.ReadHookSchedules(bson.D{})
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(schedules))
+}
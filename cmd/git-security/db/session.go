@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
+)
+
+const (
+	sessionsTableName = "sessions"
+)
+
+// Session is the persisted fiber session, the session ID itself is never stored,
+// only its hash is used as the document ID
+type Session struct {
+	ID             string    `bson:"_id" json:"id"`
+	Data           []byte    `bson:"data" json:"-"`
+	Username       string    `bson:"username,omitempty" json:"username"`
+	CreatedAt      time.Time `bson:"created_at" json:"created_at"`
+	LastActivityAt time.Time `bson:"last_activity_at" json:"last_activity_at"`
+	ExpiresAt      time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// SessionStorage implements fiber.Storage on top of the database so the sessions
+// survive restarts and are shared across replicas
+type SessionStorage struct {
+	ctx context.Context
+	db  *mongo.Database
+}
+
+func NewSessionStorage(ctx context.Context, db *mongo.Database) *SessionStorage {
+	return &SessionStorage{
+		ctx: ctx,
+		db:  db,
+	}
+}
+
+func (s *SessionStorage) CreateIndices() error {
+	// FerretDB doesn't implement TTL indexes, the expired sessions are deleted by DeleteExpiredSessions
+	for _, idxToCreate := range []string{"username", "expires_at"} {
+		if _, err := s.db.Collection(sessionsTableName).Indexes().CreateOne(s.ctx, mongo.IndexModel{
+			Keys: bson.M{idxToCreate: 1},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SessionStorage) Get(key string) ([]byte, error) {
+	if key == "" {
+		return nil, nil
+	}
+	var sess Session
+	if err := s.db.Collection(sessionsTableName).FindOne(
+		s.ctx,
+		bson.D{
+			{Key: "_id", Value: security.HashToken(key)},
+			{Key: "expires_at", Value: bson.M{"$gt": time.Now()}},
+		},
+	).Decode(&sess); err != nil {
+		if err != mongo.ErrNoDocuments {
+			slog.Error("error in finding the session", slog.String("error", err.Error()))
+			return nil, err
+		}
+		return nil, nil
+	}
+	return sess.Data, nil
+}
+
+func (s *SessionStorage) Set(key string, val []byte, exp time.Duration) error {
+	if key == "" || len(val) == 0 {
+		return nil
+	}
+	now := time.Now()
+	expiresAt := now.Add(exp)
+	if exp == 0 {
+		// no expiration
+		expiresAt = now.AddDate(100, 0, 0)
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.M{
+			"data":             val,
+			"expires_at":       expiresAt,
+			"last_activity_at": now,
+		}},
+		{Key: "$setOnInsert", Value: bson.M{
+			"created_at": now,
+		}},
+	}
+	if _, err := s.db.Collection(sessionsTableName).UpdateByID(
+		s.ctx, security.HashToken(key), update, options.Update().SetUpsert(true)); err != nil {
+		slog.Error("error in saving the session", slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (s *SessionStorage) Delete(key string) error {
+	if key == "" {
+		return nil
+	}
+	_, err := s.db.Collection(sessionsTableName).DeleteOne(s.ctx, bson.D{{Key: "_id", Value: security.HashToken(key)}})
+	return err
+}
+
+func (s *SessionStorage) Reset() error {
+	_, err := s.db.Collection(sessionsTableName).DeleteMany(s.ctx, bson.D{})
+	return err
+}
+
+func (s *SessionStorage) Close() error {
+	return nil
+}
+
+// SetUsername tags the session with the logged in user
+func (s *SessionStorage) SetUsername(key, username string) error {
+	update := bson.D{{Key: "$set", Value: bson.M{"username": username}}}
+	_, err := s.db.Collection(sessionsTableName).UpdateByID(s.ctx, security.HashToken(key), update)
+	return err
+}
+
+// Touch updates the last activity of the session
+func (s *SessionStorage) Touch(key string) error {
+	update := bson.D{{Key: "$set", Value: bson.M{"last_activity_at": time.Now()}}}
+	_, err := s.db.Collection(sessionsTableName).UpdateByID(s.ctx, security.HashToken(key), update)
+	return err
+}
+
+// ReadSessions returns the active sessions matching the filters
+func (s *SessionStorage) ReadSessions(filters bson.D) ([]*Session, error) {
+	filters = append(filters, bson.E{Key: "expires_at", Value: bson.M{"$gt": time.Now()}})
+	cursor, err := s.db.Collection(sessionsTableName).Find(
+		s.ctx,
+		filters,
+		options.Find().SetSort(bson.D{{Key: "last_activity_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(s.ctx)
+
+	sessions := []*Session{}
+	if err := cursor.All(s.ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RevokeSessions deletes the sessions matching the filters, the filters must not be empty
+func (s *SessionStorage) RevokeSessions(filters bson.D) (int64, error) {
+	if len(filters) == 0 {
+		return 0, nil
+	}
+	result, err := s.db.Collection(sessionsTableName).DeleteMany(s.ctx, filters)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// DeleteExpiredSessions cleans up the expired sessions
+func (s *SessionStorage) DeleteExpiredSessions() error {
+	_, err := s.db.Collection(sessionsTableName).DeleteMany(
+		s.ctx,
+		bson.D{{Key: "expires_at", Value: bson.M{"$lte": time.Now()}}},
+	)
+	return err
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
+)
+
+func TestSessionStorage(t *testing.T) {
+	teardown, _, mdb := SetupDBForTest(t)
+	defer teardown()
+
+	s := NewSessionStorage(context.Background(), mdb)
+	require.Nil(t, s.CreateIndices())
+
+	val, err := s.Get("missing")
+	require.Nil(t, err)
+	assert.Nil(t, val)
+
+	require.Nil(t, s.Set("foo", []byte("data"), time.Hour))
+	require.Nil(t, s.SetUsername("foo", "foo@bar.com"))
+	require.Nil(t, s.Set("bar", []byte("data"), time.Hour))
+	require.Nil(t, s.SetUsername("bar", "foo@bar.com"))
+	require.Nil(t, s.Set("expired", []byte("data"), -time.Minute))
+
+	val, err = s.Get("foo")
+	require.Nil(t, err)
+	assert.Equal(t, []byte("data"), val)
+
+	// the raw session ID is never stored
+	sessions, err := s.ReadSessions(bson.D{{Key: "username", Value: "foo@bar.com"}})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(sessions))
+	for _, sess := range sessions {
+		assert.NotEqual(t, "foo", sess.ID)
+		assert.NotEqual(t, "bar", sess.ID)
+	}
+
+	// saving the session again keeps the username
+	require.Nil(t, s.Set("foo", []byte("data2"), time.Hour))
+	sessions, err = s.ReadSessions(bson.D{{Key: "_id", Value: security.HashToken("foo")}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sessions))
+	assert.Equal(t, "foo@bar.com", sessions[0].Username)
+
+	// expired sessions are not returned
+	val, err = s.Get("expired")
+	require.Nil(t, err)
+	assert.Nil(t, val)
+	require.Nil(t, s.DeleteExpiredSessions())
+	count, err := mdb.Collection(sessionsTableName).CountDocuments(context.Background(), bson.D{})
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+
+	// revoke a single session, then all the sessions of the user
+	n, err := s.RevokeSessions(bson.D{{Key: "_id", Value: security.HashToken("foo")}})
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	val, err = s.Get("foo")
+	require.Nil(t, err)
+	assert.Nil(t, val)
+
+	n, err = s.RevokeSessions(bson.D{{Key: "username", Value: "foo@bar.com"}})
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	val, err = s.Get("bar")
+	require.Nil(t, err)
+	assert.Nil(t, val)
+}
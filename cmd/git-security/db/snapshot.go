@@ -0,0 +1,305 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+const (
+	repoSnapshotsTableName = "reposnapshots"
+	// repoSnapshotQueryPrefix prefixes the temporary collections of the point-in-time queries
+	repoSnapshotQueryPrefix = repoSnapshotsTableName + "_"
+	// repoSnapshotQueryTTL is the age after which a temporary collection is surely left over
+	repoSnapshotQueryTTL = time.Hour
+)
+
+// repoSnapshotFields are the fields of the repo kept along its snapshot, named as in the
+// repositories so that the same filters match the snapshots
+var repoSnapshotFields = []string{"full_name", "owner.login", "repo_owner", "is_archived"}
+
+// RepoSnapshot is the full state of a repo after a change, the document of the repo is kept
+// gzipped in data. A deleted snapshot records the deletion of the repo.
+type RepoSnapshot struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	RepoID   string             `bson:"repo_id" json:"repo_id"`
+	FullName string             `bson:"full_name" json:"full_name"`
+	Owner    struct {
+		Login string `bson:"login" json:"login"`
+	} `bson:"owner" json:"owner"`
+	RepoOwner  string    `bson:"repo_owner,omitempty" json:"repo_owner,omitempty"`
+	IsArchived bool      `bson:"is_archived" json:"is_archived"`
+	Deleted    bool      `bson:"deleted" json:"deleted"`
+	Data       []byte    `bson:"data,omitempty" json:"-"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+}
+
+// IsRepoSnapshotField tells if the filters on the field can be matched on the snapshots
+func IsRepoSnapshotField(field string) bool {
+	return slices.Contains(repoSnapshotFields, field)
+}
+
+func (dbi *DatabaseImpl) CreateRepoSnapshotIndices() error {
+	for _, idxToCreate := range []string{"repo_id", "full_name"} {
+		if _, err := dbi.db.Collection(repoSnapshotsTableName).Indexes().CreateOne(dbi.ctx, mongo.IndexModel{
+			Keys: bson.M{idxToCreate: 1},
+		}); err != nil {
+			return err
+		}
+	}
+	if _, err := dbi.db.Collection(repoSnapshotsTableName).Indexes().CreateOne(dbi.ctx, mongo.IndexModel{
+		Keys: bson.M{"created_at": -1},
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// createRepoSnapshot records the state of the repo, or its deletion
+func (dbi *DatabaseImpl) createRepoSnapshot(repo *gh.Repository, deleted bool) error {
+	snapshot := RepoSnapshot{
+		RepoID:     repo.ID,
+		FullName:   repo.NameWithOwner,
+		Owner:      repo.Owner,
+		RepoOwner:  repo.RepoOwner,
+		IsArchived: repo.IsArchived,
+		Deleted:    deleted,
+		CreatedAt:  time.Now(),
+	}
+	if !deleted {
+		data, err := compressRepo(repo)
+		if err != nil {
+			return err
+		}
+		snapshot.Data = data
+	}
+	if _, err := dbi.db.Collection(repoSnapshotsTableName).InsertOne(dbi.ctx, snapshot); err != nil {
+		slog.Error("error in inserting a repo snapshot", slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// CreateMissingRepoSnapshots records the state of the repos without any snapshot, like the
+// repos fetched before the snapshots existed, so that they can be found by the point-in-time
+// queries even if they never change
+func (dbi *DatabaseImpl) CreateMissingRepoSnapshots() error {
+	dbi.mu.Lock()
+	defer dbi.mu.Unlock()
+
+	ids, err := dbi.db.Collection(repoSnapshotsTableName).Distinct(dbi.ctx, "repo_id", bson.D{})
+	if err != nil {
+		return err
+	}
+	repos, err := dbi.ReadRepositories(bson.D{{Key: "id", Value: bson.M{"$nin": ids}}})
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		if err := dbi.createRepoSnapshot(repo, false); err != nil {
+			return err
+		}
+	}
+	if len(repos) > 0 {
+		slog.Info("created the missing repo snapshots", slog.Int("count", len(repos)))
+	}
+	return nil
+}
+
+// ReadRepositoriesAsOf rebuilds the repos as they stood at the time from their latest snapshot
+// before it, and returns the ones matching the filters. The snapshot filters are matched on
+// the fields kept along the snapshots, only the repos passing them are decompressed. The
+// other filters are queried in a temporary collection of these repos so that they work as
+// they do on the repositories.
+func (dbi *DatabaseImpl) ReadRepositoriesAsOf(asOf time.Time, snapshotFilters, filters bson.D) ([]*gh.Repository, error) {
+	latest, err := dbi.latestRepoSnapshots(bson.D{{Key: "created_at", Value: bson.M{"$lte": asOf}}})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(latest))
+	for _, snapshot := range latest {
+		if !snapshot.Deleted {
+			ids = append(ids, snapshot.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return []*gh.Repository{}, nil
+	}
+	snapshotCursor, err := dbi.db.Collection(repoSnapshotsTableName).Find(
+		dbi.ctx,
+		append(bson.D{{Key: "_id", Value: bson.M{"$in": ids}}}, snapshotFilters...),
+	)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []*RepoSnapshot{}
+	if err := snapshotCursor.All(dbi.ctx, &snapshots); err != nil {
+		return nil, err
+	}
+
+	docs := make([]interface{}, 0, len(snapshots))
+	repos := make([]*gh.Repository, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		doc, err := decompressRepo(snapshot.Data)
+		if err != nil {
+			slog.Error(
+				"error in reading the repo snapshot",
+				slog.String("id", snapshot.ID.Hex()),
+				slog.String("error", err.Error()),
+			)
+			return nil, err
+		}
+		if len(filters) > 0 {
+			docs = append(docs, doc)
+			continue
+		}
+		var repo gh.Repository
+		if err := bson.Unmarshal(doc, &repo); err != nil {
+			return nil, err
+		}
+		repos = append(repos, &repo)
+	}
+	if len(filters) == 0 || len(docs) == 0 {
+		return repos, nil
+	}
+
+	collection := dbi.db.Collection(repoSnapshotQueryPrefix + primitive.NewObjectID().Hex())
+	defer func() {
+		if err := collection.Drop(dbi.ctx); err != nil {
+			slog.Error("error in dropping the repo snapshots query", slog.String("error", err.Error()))
+		}
+	}()
+	if _, err := collection.InsertMany(dbi.ctx, docs); err != nil {
+		return nil, err
+	}
+	cursor, err := collection.Find(dbi.ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(dbi.ctx)
+
+	if err := cursor.All(dbi.ctx, &repos); err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+// DeleteRepoSnapshotQueries drops the temporary collections of the point-in-time queries left
+// over by a crash, the recent ones may still be used by the queries of another replica
+func (dbi *DatabaseImpl) DeleteRepoSnapshotQueries() error {
+	names, err := dbi.db.ListCollectionNames(dbi.ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		id, err := primitive.ObjectIDFromHex(strings.TrimPrefix(name, repoSnapshotQueryPrefix))
+		if !strings.HasPrefix(name, repoSnapshotQueryPrefix) || err != nil {
+			continue
+		}
+		if time.Since(id.Timestamp()) < repoSnapshotQueryTTL {
+			continue
+		}
+		if err := dbi.db.Collection(name).Drop(dbi.ctx); err != nil {
+			return err
+		}
+		slog.Info("dropped a left over repo snapshots query", slog.String("collection", name))
+	}
+	return nil
+}
+
+// DeleteRepoSnapshots removes the snapshots taken before the time, for the retention policy.
+// The latest snapshot of each repo before the time is kept, it's still the state of the repo
+// at the time unless the repo was deleted then.
+func (dbi *DatabaseImpl) DeleteRepoSnapshots(before time.Time) error {
+	filter := bson.D{{Key: "created_at", Value: bson.M{"$lt": before}}}
+	latest, err := dbi.latestRepoSnapshots(filter)
+	if err != nil {
+		return err
+	}
+	kept := make([]primitive.ObjectID, 0, len(latest))
+	for _, snapshot := range latest {
+		if !snapshot.Deleted {
+			kept = append(kept, snapshot.ID)
+		}
+	}
+	res, err := dbi.db.Collection(repoSnapshotsTableName).DeleteMany(
+		dbi.ctx,
+		append(filter, bson.E{Key: "_id", Value: bson.M{"$nin": kept}}),
+	)
+	if err != nil {
+		return err
+	}
+	slog.Info("deleted old repo snapshots", slog.Int64("count", res.DeletedCount))
+	return nil
+}
+
+// latestRepoSnapshots returns the latest snapshot of each repo among the ones matching the
+// filters, without their data
+func (dbi *DatabaseImpl) latestRepoSnapshots(filters bson.D) ([]*RepoSnapshot, error) {
+	cursor, err := dbi.db.Collection(repoSnapshotsTableName).Find(
+		dbi.ctx,
+		filters,
+		options.Find().
+			SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+			SetProjection(bson.D{{Key: "data", Value: 0}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(dbi.ctx)
+
+	seen := make(map[string]bool)
+	snapshots := make([]*RepoSnapshot, 0)
+	for cursor.Next(dbi.ctx) {
+		var snapshot RepoSnapshot
+		if err := cursor.Decode(&snapshot); err != nil {
+			return nil, err
+		}
+		if seen[snapshot.RepoID] {
+			continue
+		}
+		seen[snapshot.RepoID] = true
+		snapshots = append(snapshots, &snapshot)
+	}
+	return snapshots, cursor.Err()
+}
+
+func compressRepo(repo *gh.Repository) ([]byte, error) {
+	doc, err := bson.Marshal(repo)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(doc); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressRepo(data []byte) (bson.Raw, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	doc, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw(doc), bson.Raw(doc).Validate()
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRepoSnapshots(t *testing.T) {
+	teardown, db, mdb := SetupDBForTest(t)
+	defer teardown()
+
+	tick := func() time.Time {
+		time.Sleep(10 * time.Millisecond)
+		now := time.Now()
+		time.Sleep(10 * time.Millisecond)
+		return now
+	}
+	update := func(repo gh.Repository) {
+		_, err := db.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+		require.Nil(t, err)
+	}
+	names := func(repos []*gh.Repository) []string {
+		names := make([]string, 0, len(repos))
+		for _, repo := range repos {
+			names = append(names, repo.NameWithOwner)
+		}
+		return names
+	}
+
+	// the repos fetched before the snapshots existed
+	_, err := mdb.Collection(repositoriesTableName).InsertOne(context.Background(), gh.Repository{
+		GqlRepository: &gh.GqlRepository{ID: "old", NameWithOwner: "org/old"},
+	})
+	require.Nil(t, err)
+	require.Nil(t, db.CreateMissingRepoSnapshots())
+	require.Nil(t, db.CreateMissingRepoSnapshots())
+	beforeAll := tick()
+
+	api := gh.Repository{GqlRepository: &gh.GqlRepository{ID: "api", NameWithOwner: "payments/api"}}
+	api.Owner.Login = "payments"
+	update(api)
+	created := tick()
+
+	api.IsArchived = true
+	update(api)
+	// the ignored fields aren't a change
+	api.FetchedAt = time.Now()
+	update(api)
+	archived := tick()
+
+	require.Nil(t, db.DeleteRepositories(time.Now().Add(time.Hour)))
+	deleted := tick()
+
+	count, err := mdb.Collection(repoSnapshotsTableName).CountDocuments(context.Background(), bson.D{})
+	require.Nil(t, err)
+	// old, created, archived, and the deletions of old and api
+	assert.Equal(t, int64(5), count)
+
+	repos, err := db.ReadRepositoriesAsOf(beforeAll, bson.D{}, bson.D{})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"org/old"}, names(repos))
+
+	repos, err = db.ReadRepositoriesAsOf(created, bson.D{{Key: "is_archived", Value: false}}, bson.D{})
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{"org/old", "payments/api"}, names(repos))
+
+	repos, err = db.ReadRepositoriesAsOf(archived, bson.D{}, bson.D{{Key: "full_name", Value: "payments/api"}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(repos))
+	assert.True(t, repos[0].IsArchived)
+	repos, err = db.ReadRepositoriesAsOf(archived, bson.D{{Key: "owner.login", Value: "payments"}}, bson.D{})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"payments/api"}, names(repos))
+	repos, err = db.ReadRepositoriesAsOf(archived, bson.D{{Key: "is_archived", Value: false}}, bson.D{})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"org/old"}, names(repos))
+
+	repos, err = db.ReadRepositoriesAsOf(deleted, bson.D{}, bson.D{})
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(repos))
+
+	// the latest snapshots before the retention still give the state at the time
+	update(api)
+	require.Nil(t, db.DeleteRepoSnapshots(archived))
+	count, err = mdb.Collection(repoSnapshotsTableName).CountDocuments(context.Background(), bson.D{})
+	require.Nil(t, err)
+	assert.Equal(t, int64(5), count)
+	require.Nil(t, db.DeleteRepoSnapshots(time.Now()))
+	count, err = mdb.Collection(repoSnapshotsTableName).CountDocuments(context.Background(), bson.D{})
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+	repos, err = db.ReadRepositoriesAsOf(time.Now(), bson.D{}, bson.D{})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"payments/api"}, names(repos))
+}
+
+func TestDeleteRepoSnapshotQueries(t *testing.T) {
+	teardown, db, mdb := SetupDBForTest(t)
+	defer teardown()
+
+	old := repoSnapshotQueryPrefix + primitive.NewObjectIDFromTimestamp(time.Now().Add(-2*time.Hour)).Hex()
+	recent := repoSnapshotQueryPrefix + primitive.NewObjectID().Hex()
+	for _, name := range []string{old, recent, repoSnapshotsTableName} {
+		_, err := mdb.Collection(name).InsertOne(context.Background(), bson.D{{Key: "id", Value: "repo"}})
+		require.Nil(t, err)
+	}
+
+	require.Nil(t, db.DeleteRepoSnapshotQueries())
+	names, err := mdb.ListCollectionNames(context.Background(), bson.D{})
+	require.Nil(t, err)
+	assert.NotContains(t, names, old)
+	assert.Contains(t, names, recent)
+	assert.Contains(t, names, repoSnapshotsTableName)
+}
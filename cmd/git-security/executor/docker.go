@@ -0,0 +1,146 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/kballard/go-shellquote"
+)
+
+// DockerExecutor runs the jobs as containers on the Docker daemon configured by the DOCKER_* envs
+type DockerExecutor struct{}
+
+func NewDockerExecutor() *DockerExecutor {
+	return &DockerExecutor{}
+}
+
+func (d *DockerExecutor) Run(ctx context.Context, job *Job) (*Result, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		slog.Error("error in NewClientWithOpts()", slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer cli.Close()
+
+	c, err := shellquote.Split(job.Command)
+	if err != nil {
+		slog.Error("error in shellquote.Split()", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	e, masked := job.env()
+	slog.Debug("docker: create container",
+		slog.String("image", job.Image),
+		slog.Any("Cmd", c),
+		slog.Any("Env", masked),
+	)
+	containerConfig := &container.Config{
+		Image: job.Image,
+		Cmd:   c,
+		Env:   e,
+	}
+	hostConfig := &container.HostConfig{
+		NetworkMode: container.NetworkMode(job.NetworkMode),
+		Resources: container.Resources{
+			NanoCPUs: int64(job.CPUs * 1e9),
+			Memory:   job.MemoryMB * 1024 * 1024,
+		},
+	}
+	resp, err := cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, "")
+	if err != nil {
+		if strings.Contains(err.Error(), "No such image") {
+			// pull the image
+			slog.Debug("docker: pull image", slog.String("image", job.Image))
+			pullOptions := image.PullOptions{}
+			if job.RegistryAuth != nil {
+				if pullOptions.RegistryAuth, err = registry.EncodeAuthConfig(registry.AuthConfig{
+					ServerAddress: job.RegistryAuth.Server,
+					Username:      job.RegistryAuth.Username,
+					Password:      job.RegistryAuth.Password,
+				}); err != nil {
+					return nil, err
+				}
+			}
+			reader, err := cli.ImagePull(ctx, job.Image, pullOptions)
+			if err != nil {
+				slog.Error("error in ImagePull()", slog.String("error", err.Error()))
+				return nil, err
+			}
+			defer reader.Close()
+			io.Copy(io.Discard, reader)
+
+			resp, err = cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, "")
+			if err != nil {
+				slog.Error("error in ContainerCreate()", slog.String("error", err.Error()))
+				return nil, err
+			}
+		} else {
+			slog.Error("error in ContainerCreate()", slog.String("error", err.Error()))
+			return nil, err
+		}
+	}
+	defer func() {
+		// the job context could be done already (timeout), still kill and remove the container
+		if err := cli.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{
+			RemoveVolumes: true,
+			RemoveLinks:   false,
+			Force:         true,
+		}); err != nil {
+			slog.Error("error in ContainerRemove()", slog.String("ID", resp.ID), slog.String("error", err.Error()))
+		}
+	}()
+
+	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		slog.Error("error in ContainerStart()", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	result := &Result{ImageDigest: d.imageDigest(ctx, cli, job.Image)}
+	statusCh, errCh := cli.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			slog.Error("error in ContainerWait()", slog.String("error", err.Error()))
+			return nil, err
+		}
+	case status := <-statusCh:
+		result.ExitCode = int(status.StatusCode)
+	}
+
+	out, err := cli.ContainerLogs(ctx, resp.ID, container.LogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		slog.Error("error in ContainerLogs()", slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer out.Close()
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	if _, err := stdcopy.StdCopy(stdout, stderr, out); err != nil {
+		slog.Error("error in StdCopy()", slog.String("error", err.Error()))
+		return nil, err
+	}
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	return result, nil
+}
+
+// imageDigest returns the repo digest of the image, or its ID for the local images
+func (d *DockerExecutor) imageDigest(ctx context.Context, cli *client.Client, imageName string) string {
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+	if err != nil {
+		slog.Error("error in ImageInspectWithRaw()", slog.String("error", err.Error()))
+		return ""
+	}
+	if len(inspect.RepoDigests) > 0 {
+		return inspect.RepoDigests[0]
+	}
+	return inspect.ID
+}
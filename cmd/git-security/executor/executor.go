@@ -0,0 +1,73 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+)
+
+const (
+	Docker     = "docker"
+	Subprocess = "subprocess"
+	Kubernetes = "kubernetes"
+)
+
+// Job is a single run of a custom hook or an automation, the timeout is the deadline of
+// the context given to Run. The limits are ignored by the executors not supporting them.
+type Job struct {
+	Image   string
+	Command string
+	Envs    []config.EnvKeyValue
+	// PlainEnvs are the env keys that are not secrets and can be logged as is
+	PlainEnvs []string
+	// CPUs and MemoryMB limit the resources of the job, 0 means no limit
+	CPUs     float64
+	MemoryMB int64
+	// NetworkMode is the network of the container (none, bridge...), the default if empty
+	NetworkMode string
+	// RegistryAuth is the credential the image is pulled with, if any
+	RegistryAuth *RegistryAuth
+}
+
+// Result is the output of the job, the executors that can't tell stdout and stderr apart
+// return both in Stdout. ImageDigest is the digest of the image that was run, if any.
+type Result struct {
+	Stdout      string
+	Stderr      string
+	ExitCode    int
+	ImageDigest string
+}
+
+// Executor runs the jobs, a non zero exit code is not an error, only the failure to run the job is
+type Executor interface {
+	Run(ctx context.Context, job *Job) (*Result, error)
+}
+
+// Names returns the supported executors
+func Names() []string {
+	return []string{Docker, Subprocess, Kubernetes}
+}
+
+// env returns the KEY=VALUE pairs and their masked version for the logs
+func (j *Job) env() ([]string, []string) {
+	e := make([]string, 0)
+	masked := make([]string, 0)
+	for _, ekv := range j.Envs {
+		k := strings.TrimSpace(ekv.Key)
+		if k == "" {
+			continue
+		}
+		e = append(e, fmt.Sprintf("%s=%s", k, ekv.Value))
+		if slices.Contains(j.PlainEnvs, k) {
+			masked = append(masked, fmt.Sprintf("%s=%s", k, ekv.Value))
+		} else {
+			masked = append(masked,
+				fmt.Sprintf("%s=%s", k, strings.Repeat("*", utf8.RuneCountInString(ekv.Value))))
+		}
+	}
+	return e, masked
+}
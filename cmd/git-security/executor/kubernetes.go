@@ -0,0 +1,319 @@
+package executor
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/kballard/go-shellquote"
+)
+
+const (
+	serviceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+	jobNameLabel       = "job-name"
+)
+
+var (
+	// pod waiting reasons that won't recover by themselves
+	failedWaitingReasons = []string{
+		"ErrImagePull",
+		"ImagePullBackOff",
+		"InvalidImageName",
+		"CreateContainerConfigError",
+		"CreateContainerError",
+	}
+)
+
+// KubernetesExecutor runs the jobs as Kubernetes Jobs in the namespace, the envs are passed
+// through a Secret created for the run. It talks to the API server with the service account
+// of the pod, the role needs to manage jobs and secrets, and read pods and pods/log.
+type KubernetesExecutor struct {
+	client       *resty.Client
+	namespace    string
+	pollInterval time.Duration
+}
+
+// NewKubernetesExecutor uses the in-cluster configuration, the namespace defaults to the one of the pod
+func NewKubernetesExecutor(namespace string) (*KubernetesExecutor, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	token, err := os.ReadFile(serviceAccountPath + "/token")
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := os.ReadFile(serviceAccountPath + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountPath + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(caCert)
+	client := resty.New().
+		SetBaseURL("https://" + net.JoinHostPort(host, port)).
+		SetTLSClientConfig(&tls.Config{RootCAs: caCertPool}).
+		SetAuthToken(strings.TrimSpace(string(token)))
+	return newKubernetesExecutor(client, namespace), nil
+}
+
+func newKubernetesExecutor(client *resty.Client, namespace string) *KubernetesExecutor {
+	client.
+		SetTimeout(30 * time.Second).
+		OnAfterResponse(func(c *resty.Client, resp *resty.Response) error {
+			if resp.IsError() {
+				return fmt.Errorf("status code: %d, response: %s", resp.StatusCode(), resp.String())
+			}
+			return nil
+		})
+	return &KubernetesExecutor{
+		client:       client,
+		namespace:    namespace,
+		pollInterval: 2 * time.Second,
+	}
+}
+
+type k8sMetadata struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type k8sJobStatus struct {
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+type k8sPod struct {
+	Metadata k8sMetadata `json:"metadata"`
+	Status   struct {
+		ContainerStatuses []struct {
+			State struct {
+				Waiting *struct {
+					Reason  string `json:"reason"`
+					Message string `json:"message"`
+				} `json:"waiting"`
+				Terminated *struct {
+					ExitCode int `json:"exitCode"`
+				} `json:"terminated"`
+			} `json:"state"`
+			ImageID string `json:"imageID"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+func (k *KubernetesExecutor) Run(ctx context.Context, job *Job) (*Result, error) {
+	c, err := shellquote.Split(job.Command)
+	if err != nil {
+		slog.Error("error in shellquote.Split()", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	name := "git-security-" + hex.EncodeToString(b)
+	labels := map[string]string{"app.kubernetes.io/managed-by": "git-security"}
+
+	_, masked := job.env()
+	slog.Debug("kubernetes: create job",
+		slog.String("name", name),
+		slog.String("image", job.Image),
+		slog.Any("Cmd", c),
+		slog.Any("Env", masked),
+	)
+
+	// the envs are in a secret so they don't show up in the job spec
+	stringData := make(map[string]string)
+	for _, ekv := range job.Envs {
+		if k := strings.TrimSpace(ekv.Key); k != "" {
+			stringData[k] = ekv.Value
+		}
+	}
+	if _, err := k.client.R().
+		SetContext(ctx).
+		SetBody(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   k8sMetadata{Name: name, Labels: labels},
+			"type":       "Opaque",
+			"stringData": stringData,
+		}).
+		Post(fmt.Sprintf("/api/v1/namespaces/%s/secrets", k.namespace)); err != nil {
+		slog.Error("error in creating the secret", slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer k.delete(fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", k.namespace, name))
+
+	// the image pull secret of the run, with the credential of the registry of the image
+	var imagePullSecrets []map[string]string
+	if job.RegistryAuth != nil {
+		dockerConfig, err := json.Marshal(map[string]interface{}{
+			"auths": map[string]interface{}{
+				job.RegistryAuth.Server: map[string]string{
+					"username": job.RegistryAuth.Username,
+					"password": job.RegistryAuth.Password,
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		pullSecret := name + "-pull"
+		if _, err := k.client.R().
+			SetContext(ctx).
+			SetBody(map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Secret",
+				"metadata":   k8sMetadata{Name: pullSecret, Labels: labels},
+				"type":       "kubernetes.io/dockerconfigjson",
+				"stringData": map[string]string{".dockerconfigjson": string(dockerConfig)},
+			}).
+			Post(fmt.Sprintf("/api/v1/namespaces/%s/secrets", k.namespace)); err != nil {
+			slog.Error("error in creating the image pull secret", slog.String("error", err.Error()))
+			return nil, err
+		}
+		defer k.delete(fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", k.namespace, pullSecret))
+		imagePullSecrets = append(imagePullSecrets, map[string]string{"name": pullSecret})
+	}
+
+	// the network mode has no equivalent, the network policies of the namespace apply
+	limits := make(map[string]string)
+	if job.CPUs > 0 {
+		limits["cpu"] = fmt.Sprintf("%dm", int64(job.CPUs*1000))
+	}
+	if job.MemoryMB > 0 {
+		limits["memory"] = fmt.Sprintf("%dMi", job.MemoryMB)
+	}
+	spec := map[string]interface{}{
+		"backoffLimit": 0,
+		"template": map[string]interface{}{
+			"metadata": k8sMetadata{Labels: labels},
+			"spec": map[string]interface{}{
+				"restartPolicy":                "Never",
+				"automountServiceAccountToken": false,
+				"imagePullSecrets":             imagePullSecrets,
+				"containers": []map[string]interface{}{
+					{
+						"name":      "hook",
+						"image":     job.Image,
+						"args":      c,
+						"envFrom":   []map[string]interface{}{{"secretRef": map[string]string{"name": name}}},
+						"resources": map[string]interface{}{"limits": limits},
+					},
+				},
+			},
+		},
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		spec["activeDeadlineSeconds"] = max(int64(math.Ceil(time.Until(deadline).Seconds())), 1)
+	}
+	if _, err := k.client.R().
+		SetContext(ctx).
+		SetBody(map[string]interface{}{
+			"apiVersion": "batch/v1",
+			"kind":       "Job",
+			"metadata":   k8sMetadata{Name: name, Labels: labels},
+			"spec":       spec,
+		}).
+		Post(fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs", k.namespace)); err != nil {
+		slog.Error("error in creating the job", slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer k.delete(fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s?propagationPolicy=Background", k.namespace, name))
+
+	pod, err := k.wait(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Terminated != nil {
+			result.ExitCode = cs.State.Terminated.ExitCode
+		}
+		result.ImageDigest = cs.ImageID
+	}
+	resp, err := k.client.R().
+		SetContext(ctx).
+		Get(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log", k.namespace, pod.Metadata.Name))
+	if err != nil {
+		slog.Error("error in getting the pod logs", slog.String("error", err.Error()))
+		return nil, err
+	}
+	// the pod log has stdout and stderr combined
+	result.Stdout = string(resp.Body())
+	return result, nil
+}
+
+// wait polls the job until it's done and returns its pod
+func (k *KubernetesExecutor) wait(ctx context.Context, name string) (*k8sPod, error) {
+	for {
+		var job struct {
+			Status k8sJobStatus `json:"status"`
+		}
+		if _, err := k.client.R().
+			SetContext(ctx).
+			SetResult(&job).
+			Get(fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", k.namespace, name)); err != nil {
+			slog.Error("error in getting the job", slog.String("error", err.Error()))
+			return nil, err
+		}
+
+		var pods struct {
+			Items []k8sPod `json:"items"`
+		}
+		if _, err := k.client.R().
+			SetContext(ctx).
+			SetQueryParam("labelSelector", jobNameLabel+"="+name).
+			SetResult(&pods).
+			Get(fmt.Sprintf("/api/v1/namespaces/%s/pods", k.namespace)); err != nil {
+			slog.Error("error in listing the pods", slog.String("error", err.Error()))
+			return nil, err
+		}
+
+		if len(pods.Items) > 0 {
+			pod := pods.Items[0]
+			if job.Status.Succeeded > 0 || job.Status.Failed > 0 {
+				return &pod, nil
+			}
+			for _, cs := range pod.Status.ContainerStatuses {
+				if cs.State.Waiting != nil && slices.Contains(failedWaitingReasons, cs.State.Waiting.Reason) {
+					return nil, fmt.Errorf("%s: %s", cs.State.Waiting.Reason, cs.State.Waiting.Message)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(k.pollInterval):
+		}
+	}
+}
+
+// delete cleans up the resources of the run, even if the context of the run is done
+func (k *KubernetesExecutor) delete(path string) {
+	if _, err := k.client.R().Delete(path); err != nil {
+		slog.Error("error in deleting the kubernetes resource", slog.String("path", path), slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,83 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+)
+
+func TestKubernetesExecutor(t *testing.T) {
+	var mu sync.Mutex
+	requests := []string{}
+	var secret map[string]interface{}
+	waitingReason := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/secrets"):
+			json.NewDecoder(r.Body).Decode(&secret)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/log"):
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("line 1\nline 2\n"))
+		case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/jobs/"):
+			if waitingReason != "" {
+				w.Write([]byte(`{"status": {}}`))
+			} else {
+				w.Write([]byte(`{"status": {"failed": 1}}`))
+			}
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/pods"):
+			if waitingReason != "" {
+				w.Write([]byte(`{"items": [{"metadata": {"name": "pod"}, "status": {"containerStatuses": [
+					{"state": {"waiting": {"reason": "` + waitingReason + `", "message": "failed"}}}]}}]}`))
+			} else {
+				w.Write([]byte(`{"items": [{"metadata": {"name": "pod"}, "status": {"containerStatuses": [
+					{"state": {"terminated": {"exitCode": 2}}, "imageID": "alpine@sha256:1234"}]}}]}`))
+			}
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	k := newKubernetesExecutor(resty.New().SetBaseURL(server.URL), "ns")
+	result, err := k.Run(context.Background(), &Job{
+		Image:   "alpine",
+		Command: "sh -c 'exit 2'",
+		Envs:    []config.EnvKeyValue{{Key: "TOKEN", Value: "abc"}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, 2, result.ExitCode)
+	assert.Equal(t, "line 1\nline 2\n", result.Stdout)
+	assert.Equal(t, "alpine@sha256:1234", result.ImageDigest)
+	assert.Equal(t, map[string]interface{}{"TOKEN": "abc"}, secret["stringData"])
+
+	// the job and the secret are cleaned up
+	mu.Lock()
+	assert.Contains(t, requests, "POST /apis/batch/v1/namespaces/ns/jobs")
+	assert.Contains(t, requests[len(requests)-2], "DELETE /apis/batch/v1/namespaces/ns/jobs/git-security-")
+	assert.Contains(t, requests[len(requests)-1], "DELETE /api/v1/namespaces/ns/secrets/git-security-")
+	waitingReason = "ImagePullBackOff"
+	mu.Unlock()
+
+	// the image pull failures don't wait forever
+	_, err = k.Run(context.Background(), &Job{Image: "missing", Command: "true"})
+	assert.NotNil(t, err)
+}
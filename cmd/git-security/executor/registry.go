@@ -0,0 +1,291 @@
+package executor
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IGLOU-EU/go-wildcard/v2"
+	"github.com/distribution/reference"
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	dockerHubRegistry = "docker.io"
+	// digestCacheTTL is how long the digests resolved for the runs are reused
+	digestCacheTTL = time.Minute
+)
+
+// manifestMediaTypes are the manifests the digest of an image tag is resolved from, the
+// multi-platform indexes first like the Docker daemon does
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// RegistryAuth is the credential the images of a registry are pulled with
+type RegistryAuth struct {
+	Server   string
+	Username string
+	Password string
+}
+
+// Registries holds the images the hooks may run and the credentials of their registries. An
+// allowlist entry is a registry (ghcr.io), or a repository matched with wildcards
+// (ghcr.io/org/*, docker.io/library/alpine), an empty allowlist allows all the images.
+type Registries struct {
+	allowlist []string
+	auths     map[string]RegistryAuth
+	client    *resty.Client
+	scheme    string
+
+	mu      sync.Mutex
+	digests map[string]resolvedDigest
+}
+
+type resolvedDigest struct {
+	digest     string
+	resolvedAt time.Time
+}
+
+// NewRegistries reads the credentials from a Docker config.json file, if any
+func NewRegistries(allowlist []string, authFile string) (*Registries, error) {
+	auths := make(map[string]RegistryAuth)
+	if authFile != "" {
+		b, err := os.ReadFile(authFile)
+		if err != nil {
+			return nil, err
+		}
+		if auths, err = parseDockerConfig(b); err != nil {
+			return nil, fmt.Errorf("error in the registry auth file: %w", err)
+		}
+	}
+	return newRegistries(allowlist, auths, resty.New(), "https"), nil
+}
+
+func newRegistries(allowlist []string, auths map[string]RegistryAuth, client *resty.Client, scheme string) *Registries {
+	list := make([]string, 0, len(allowlist))
+	for _, entry := range allowlist {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	client.SetTimeout(30 * time.Second)
+	return &Registries{
+		allowlist: list,
+		auths:     auths,
+		client:    client,
+		scheme:    scheme,
+		digests:   make(map[string]resolvedDigest),
+	}
+}
+
+// parseDockerConfig returns the credentials by registry, given as base64 user:password in
+// auth or as username and password
+func parseDockerConfig(b []byte) (map[string]RegistryAuth, error) {
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+	auths := make(map[string]RegistryAuth)
+	for server, a := range config.Auths {
+		auth := RegistryAuth{Server: server, Username: a.Username, Password: a.Password}
+		if a.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth of %s", server)
+			}
+			auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		auths[registryDomain(server)] = auth
+	}
+	return auths, nil
+}
+
+// registryDomain normalizes the server of a credential, Docker Hub is known by many names
+func registryDomain(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	server, _, _ = strings.Cut(server, "/")
+	switch server {
+	case "index.docker.io", "registry-1.docker.io":
+		return dockerHubRegistry
+	}
+	return server
+}
+
+// Allowed checks the image against the allowlist
+func (r *Registries) Allowed(image string) error {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return fmt.Errorf("invalid image %q: %w", image, err)
+	}
+	if len(r.allowlist) == 0 {
+		return nil
+	}
+	domain, name := reference.Domain(named), named.Name()
+	for _, entry := range r.allowlist {
+		if entry == domain || wildcard.Match(entry, name) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the image %s isn't in the allowlist", name)
+}
+
+// Auth returns the credential of the registry of the image, nil if there is none
+func (r *Registries) Auth(image string) *RegistryAuth {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil
+	}
+	if auth, ok := r.auths[reference.Domain(named)]; ok {
+		return &auth
+	}
+	return nil
+}
+
+// ResolveDigest returns the digest the tag of the image points to in its registry, or the
+// digest of the image if it has one already
+func (r *Registries) ResolveDigest(ctx context.Context, image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image %q: %w", image, err)
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		return digested.Digest().String(), nil
+	}
+	tagged := reference.TagNameOnly(named).(reference.Tagged)
+
+	host := reference.Domain(named)
+	if host == dockerHubRegistry {
+		host = "registry-1.docker.io"
+	}
+	url := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", r.scheme, host, reference.Path(named), tagged.Tag())
+	auth := r.Auth(image)
+
+	manifest := func() *resty.Request {
+		return r.client.R().
+			SetContext(ctx).
+			SetHeader("Accept", strings.Join(manifestMediaTypes, ", "))
+	}
+	resp, err := manifest().Head(url)
+	if err != nil {
+		slog.Error("error in resolving the image digest", slog.String("image", image), slog.String("error", err.Error()))
+		return "", err
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		// the registries ask for a token of the repository, or for basic auth
+		challenge := resp.Header().Get("WWW-Authenticate")
+		req := manifest()
+		if strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			token, err := r.token(ctx, challenge, auth)
+			if err != nil {
+				return "", err
+			}
+			req.SetAuthToken(token)
+		} else if auth != nil {
+			req.SetBasicAuth(auth.Username, auth.Password)
+		}
+		if resp, err = req.Head(url); err != nil {
+			slog.Error("error in resolving the image digest", slog.String("image", image), slog.String("error", err.Error()))
+			return "", err
+		}
+	}
+	if resp.IsError() {
+		return "", fmt.Errorf("error in resolving the digest of %s: status code %d", image, resp.StatusCode())
+	}
+	digest := resp.Header().Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("the registry of %s returned no digest", image)
+	}
+	return digest, nil
+}
+
+// CheckDigest refuses the image once its tag points to another digest than the pinned one,
+// the digests resolved in the last minute are reused so that the runs of a hook for many
+// repos don't query the registry each time
+func (r *Registries) CheckDigest(ctx context.Context, image, digest string) error {
+	r.mu.Lock()
+	resolved, ok := r.digests[image]
+	r.mu.Unlock()
+	if !ok || time.Since(resolved.resolvedAt) >= digestCacheTTL {
+		current, err := r.ResolveDigest(ctx, image)
+		if err != nil {
+			return err
+		}
+		resolved = resolvedDigest{digest: current, resolvedAt: time.Now()}
+		r.mu.Lock()
+		r.digests[image] = resolved
+		r.mu.Unlock()
+	}
+	if resolved.digest != digest {
+		return fmt.Errorf("the digest of the image %s drifted from %s to %s", image, digest, resolved.digest)
+	}
+	return nil
+}
+
+// token gets a bearer token from the realm of the challenge, with the credential if any
+func (r *Registries) token(ctx context.Context, challenge string, auth *RegistryAuth) (string, error) {
+	params := make(map[string]string)
+	for _, param := range strings.Split(challenge[len("bearer "):], ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok {
+			params[k] = strings.Trim(v, `"`)
+		}
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("invalid registry challenge: %s", challenge)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	req := r.client.R().SetContext(ctx).SetResult(&token).ForceContentType("application/json")
+	for _, k := range []string{"service", "scope"} {
+		if params[k] != "" {
+			req.SetQueryParam(k, params[k])
+		}
+	}
+	if auth != nil {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := req.Get(params["realm"])
+	if err != nil {
+		slog.Error("error in getting the registry token", slog.String("error", err.Error()))
+		return "", err
+	}
+	if resp.IsError() {
+		return "", fmt.Errorf("error in getting the registry token: status code %d", resp.StatusCode())
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+// PinnedImage returns the image reference of the digest, without its tag
+func PinnedImage(image, digest string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image %q: %w", image, err)
+	}
+	pinned := named.Name() + "@" + digest
+	if _, err := reference.ParseNormalizedNamed(pinned); err != nil {
+		return "", fmt.Errorf("invalid digest %q: %w", digest, err)
+	}
+	return pinned, nil
+}
@@ -0,0 +1,108 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistries(t *testing.T) {
+	auths, err := parseDockerConfig([]byte(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": "dXNlcjpwYXNz"},
+		"ghcr.io": {"username": "bot", "password": "token"}
+	}}`))
+	require.Nil(t, err)
+	r := newRegistries([]string{"ghcr.io/org/*", "docker.io/library/alpine", " quay.io "}, auths, resty.New(), "http")
+
+	assert.Nil(t, r.Allowed("alpine:3"))
+	assert.Nil(t, r.Allowed("ghcr.io/org/hook@sha256:"+strings.Repeat("a", 64)))
+	assert.Nil(t, r.Allowed("quay.io/any/image"))
+	assert.NotNil(t, r.Allowed("ghcr.io/other/hook"))
+	assert.NotNil(t, r.Allowed("ubuntu"))
+	assert.NotNil(t, r.Allowed("Invalid Image"))
+	assert.Nil(t, newRegistries(nil, nil, resty.New(), "http").Allowed("ubuntu"))
+
+	assert.Equal(t, &RegistryAuth{Server: "https://index.docker.io/v1/", Username: "user", Password: "pass"}, r.Auth("alpine"))
+	assert.Equal(t, "bot", r.Auth("ghcr.io/org/hook").Username)
+	assert.Nil(t, r.Auth("quay.io/any/image"))
+
+	pinned, err := PinnedImage("alpine:3", "sha256:"+strings.Repeat("a", 64))
+	require.Nil(t, err)
+	assert.Equal(t, "docker.io/library/alpine@sha256:"+strings.Repeat("a", 64), pinned)
+	_, err = PinnedImage("alpine:3", "invalid")
+	assert.NotNil(t, err)
+}
+
+func TestResolveDigest(t *testing.T) {
+	var mu sync.Mutex
+	digest, manifests := "sha256:"+strings.Repeat("1", 64), 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/token":
+			// the token of the repo needs the credential
+			if user, pass, ok := r.BasicAuth(); !ok || user != "bot" || pass != "token" ||
+				r.URL.Query().Get("scope") != "repository:org/hook:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token": "abc"}`))
+		case r.URL.Path == "/v2/org/hook/manifests/v1" && r.Header.Get("Authorization") == "Bearer abc":
+			manifests++
+			w.Header().Set("Docker-Content-Digest", digest)
+		case r.URL.Path == "/v2/org/hook/manifests/v1":
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:org/hook:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	image := host + "/org/hook:v1"
+	r := newRegistries(nil, map[string]RegistryAuth{host: {Server: host, Username: "bot", Password: "token"}}, resty.New(), "http")
+
+	resolved, err := r.ResolveDigest(context.Background(), image)
+	require.Nil(t, err)
+	assert.Equal(t, digest, resolved)
+	resolved, err = r.ResolveDigest(context.Background(), host+"/org/hook@"+digest)
+	require.Nil(t, err)
+	assert.Equal(t, digest, resolved)
+	_, err = r.ResolveDigest(context.Background(), host+"/org/missing:v1")
+	assert.NotNil(t, err)
+
+	// the digests resolved for the runs are reused for a while
+	mu.Lock()
+	manifests = 0
+	mu.Unlock()
+	assert.Nil(t, r.CheckDigest(context.Background(), image, digest))
+	assert.Nil(t, r.CheckDigest(context.Background(), image, digest))
+	mu.Lock()
+	assert.Equal(t, 1, manifests)
+	mu.Unlock()
+
+	// the tag moved to another digest
+	r.digests = make(map[string]resolvedDigest)
+	mu.Lock()
+	digest = "sha256:" + strings.Repeat("2", 64)
+	mu.Unlock()
+	err = r.CheckDigest(context.Background(), image, "sha256:"+strings.Repeat("1", 64))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "drifted")
+
+	// no credential, no token
+	_, err = newRegistries(nil, nil, resty.New(), "http").ResolveDigest(context.Background(), image)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,68 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// SubprocessExecutor runs the command as a local process, the image, the resource limits and
+// the network mode are ignored. The process only gets PATH and HOME from the server
+// environment, never its secrets.
+type SubprocessExecutor struct{}
+
+func NewSubprocessExecutor() *SubprocessExecutor {
+	return &SubprocessExecutor{}
+}
+
+func (s *SubprocessExecutor) Run(ctx context.Context, job *Job) (*Result, error) {
+	c, err := shellquote.Split(job.Command)
+	if err != nil {
+		slog.Error("error in shellquote.Split()", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if len(c) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	dir, err := os.MkdirTemp("", "git-security-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	e, masked := job.env()
+	slog.Debug("subprocess: run command",
+		slog.Any("Cmd", c),
+		slog.Any("Env", masked),
+	)
+
+	cmd := exec.CommandContext(ctx, c[0], c[1:]...)
+	cmd.Dir = dir
+	// the children of a killed process could keep the pipes open
+	killProcessGroup(cmd)
+	cmd.WaitDelay = 5 * time.Second
+	cmd.Env = append([]string{"PATH=" + os.Getenv("PATH"), "HOME=" + dir}, e...)
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	result := &Result{}
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || ctx.Err() != nil {
+			slog.Error("error in running the command", slog.String("error", err.Error()))
+			return nil, err
+		}
+		result.ExitCode = exitErr.ExitCode()
+	}
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	return result, nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package executor
+
+import "os/exec"
+
+// killProcessGroup is not supported, only the command is killed on cancellation
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,62 @@
+package executor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+)
+
+func TestSubprocessExecutor(t *testing.T) {
+	t.Setenv("GIT_SECURITY_KEY", "secret")
+	e := NewSubprocessExecutor()
+	ctx := context.Background()
+
+	// only the job envs are passed
+	result, err := e.Run(ctx, &Job{
+		Command: `sh -c 'echo "$GIT_REPO" && echo "key=$GIT_SECURITY_KEY" >&2'`,
+		Envs: []config.EnvKeyValue{
+			{Key: "GIT_REPO", Value: "org/repo"},
+			{Key: " ", Value: "ignored"},
+		},
+		PlainEnvs: []string{"GIT_REPO"},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "org/repo\n", result.Stdout)
+	assert.Equal(t, "key=\n", result.Stderr)
+	assert.Equal(t, 0, result.ExitCode)
+
+	// a non zero exit code is not an error
+	result, err = e.Run(ctx, &Job{Command: `sh -c 'echo failed; exit 3'`})
+	require.Nil(t, err)
+	assert.Equal(t, "failed\n", result.Stdout)
+	assert.Equal(t, 3, result.ExitCode)
+
+	// the failures to run the command are
+	_, err = e.Run(ctx, &Job{Command: "git-security-missing-command"})
+	assert.NotNil(t, err)
+	_, err = e.Run(ctx, &Job{Command: `sh -c 'unterminated`})
+	assert.NotNil(t, err)
+
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = e.Run(ctx, &Job{Command: "sleep 5"})
+	assert.NotNil(t, err)
+}
+
+func TestJobEnv(t *testing.T) {
+	j := &Job{
+		Envs: []config.EnvKeyValue{
+			{Key: "GIT_REPO", Value: "org/repo"},
+			{Key: "TOKEN", Value: "abc"},
+		},
+		PlainEnvs: []string{"GIT_REPO"},
+	}
+	e, masked := j.env()
+	assert.Equal(t, []string{"GIT_REPO=org/repo", "TOKEN=abc"}, e)
+	assert.Equal(t, []string{"GIT_REPO=org/repo", "TOKEN=***"}, masked)
+}
@@ -138,6 +138,7 @@ type Target struct {
 }
 
 type CommitFragment struct {
+	Oid     string  `bson:"oid" json:"oid" diff:"-"`
 	History History `bson:"history" json:"history" graphql:"history(first: 10)"`
 }
 
@@ -266,6 +267,21 @@ func (ghi *GitHubImpl) CreateBranchProtectionRule(repoID, pattern string) error
 	return ghi.gqlClient.Mutate(ghi.ctx, &m, input, nil)
 }
 
+// BranchProtectionRuleFields are the fields UpdateBranchProtectionRule can change
+var BranchProtectionRuleFields = []string{
+	"RequiresApprovingReviews",
+	"RequiredApprovingReviewCount",
+	"DismissesStaleReviews",
+	"RequiresCodeOwnerReviews",
+	"RequiresStatusChecks",
+	"RequiresStrictStatusChecks",
+	"RequiresConversationResolution",
+	"RequiresCommitSignatures",
+	"IsAdminEnforced",
+	"AllowsForcePushes",
+	"AllowsDeletions",
+}
+
 func (ghi *GitHubImpl) UpdateBranchProtectionRule(branchProtectionRuleID, field string, value interface{}) error {
 	var m struct {
 		UpdateBranchProtectionRule struct {
@@ -331,14 +347,44 @@ func (ghi *GitHubImpl) UpdateBranchProtectionRule(branchProtectionRuleID, field
 	return ghi.gqlClient.Mutate(ghi.ctx, &m, input, nil)
 }
 
+// ScoreHit is a score weight and if the repo hits it
+type ScoreHit struct {
+	config.ScoreWeight `bson:",inline"`
+	Hit                bool `bson:"hit" json:"hit"`
+}
+
 func (repo *Repository) UpdateRepoScoreAndColor(gs *config.GlobalSettings) error {
-	b, err := json.Marshal(*repo)
+	hits, err := repo.ScoreBreakdown(gs)
 	if err != nil {
-		slog.Error("error in json.Marshal()", slog.String("error", err.Error()))
 		return err
 	}
 
 	score := 0
+	for _, h := range hits {
+		if h.Hit {
+			score += h.Weight
+		}
+	}
+	repo.Score = &score
+	for _, sc := range gs.ScoreColors {
+		if score >= sc.Range[0] &&
+			(score < sc.Range[1] || score == 100 && sc.Range[1] == 100) {
+			repo.ScoreColor = &sc.Color
+			break
+		}
+	}
+	return nil
+}
+
+// ScoreBreakdown returns the score weights the repo hits or not
+func (repo *Repository) ScoreBreakdown(gs *config.GlobalSettings) ([]ScoreHit, error) {
+	b, err := json.Marshal(*repo)
+	if err != nil {
+		slog.Error("error in json.Marshal()", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	hits := make([]ScoreHit, 0, len(gs.ScoreWeights))
 	for _, weight := range gs.ScoreWeights {
 		hit := false
 		fieldValue := gjson.GetBytes(b, weight.Field)
@@ -411,19 +457,9 @@ func (repo *Repository) UpdateRepoScoreAndColor(gs *config.GlobalSettings) error
 		} else {
 			hit = weight.Arg == ""
 		}
-		if hit {
-			score += weight.Weight
-		}
+		hits = append(hits, ScoreHit{ScoreWeight: weight, Hit: hit})
 	}
-	repo.Score = &score
-	for _, sc := range gs.ScoreColors {
-		if score >= sc.Range[0] &&
-			(score < sc.Range[1] || score == 100 && sc.Range[1] == 100) {
-			repo.ScoreColor = &sc.Color
-			break
-		}
-	}
-	return nil
+	return hits, nil
 }
 
 func (ghi *GitHubImpl) ArchiveRepository(repoID string, archive bool) error {
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"time"
 
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/executor"
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/service"
 	flag "github.com/eekwong/go-common-flags"
 	"github.com/eekwong/go-interruptible-service"
@@ -35,6 +37,12 @@ func main() {
 		Usage:   "key for encrypting the env variable values in DB",
 		EnvVars: []string{"GIT_SECURITY_KEY"},
 	})
+	flags = append(flags, &cli.StringSliceFlag{
+		Name:    "keyring",
+		Usage:   "encryption keys as id:base64 key, the first one encrypts and all of them decrypt with the key of GIT_SECURITY_KEY",
+		Value:   cli.NewStringSlice(),
+		EnvVars: []string{"GIT_SECURITY_KEYRING"},
+	})
 
 	flags = append(flags, &cli.StringFlag{
 		Name:    "cacert",
@@ -56,6 +64,12 @@ func main() {
 		EnvVars: []string{"GIT_SECURITY_ADMIN_PASSWORDS"},
 	})
 
+	flags = append(flags, &cli.StringFlag{
+		Name:    "okta-groups-claim",
+		Usage:   "claim holding the Okta groups, enables the group to role mappings and disables the default user role",
+		EnvVars: []string{"GIT_SECURITY_OKTA_GROUPS_CLAIM"},
+	})
+
 	flags = append(flags, &cli.StringFlag{
 		Name:    "db",
 		Usage:   "Sqlite (sqlite), PostgreSQL (pg) or Mongo (mongo) as database backend",
@@ -70,6 +84,86 @@ func main() {
 		EnvVars: []string{"GIT_SECURITY_IGNORED_COMMITTERS"},
 	})
 
+	flags = append(flags, &cli.StringFlag{
+		Name:    "executor",
+		Usage:   "default executor of the custom hooks and automations: docker, subprocess or kubernetes",
+		Value:   executor.Docker,
+		EnvVars: []string{"GIT_SECURITY_EXECUTOR"},
+	})
+
+	flags = append(flags, &cli.BoolFlag{
+		Name:    "allow-subprocess-executor",
+		Usage:   "let the hooks choose the subprocess executor, which runs their commands on the host with the access of the server",
+		EnvVars: []string{"GIT_SECURITY_ALLOW_SUBPROCESS_EXECUTOR"},
+	})
+
+	flags = append(flags, &cli.StringFlag{
+		Name:    "kubernetes-namespace",
+		Usage:   "namespace of the jobs created by the kubernetes executor, defaults to the namespace of the pod",
+		EnvVars: []string{"GIT_SECURITY_KUBERNETES_NAMESPACE"},
+	})
+
+	flags = append(flags, &cli.DurationFlag{
+		Name:    "hook-run-retention",
+		Usage:   "how long the runs and logs of the custom hooks and automations are kept, 0 to keep them forever",
+		Value:   30 * 24 * time.Hour,
+		EnvVars: []string{"GIT_SECURITY_HOOK_RUN_RETENTION"},
+	})
+
+	flags = append(flags, &cli.DurationFlag{
+		Name:    "snapshot-retention",
+		Usage:   "how long the snapshots of the repos are kept for the point-in-time queries, 0 to keep them forever",
+		Value:   365 * 24 * time.Hour,
+		EnvVars: []string{"GIT_SECURITY_SNAPSHOT_RETENTION"},
+	})
+
+	flags = append(flags, &cli.DurationFlag{
+		Name:    "hook-timeout",
+		Usage:   "default timeout of the custom hook and automation runs, 0 for none",
+		Value:   30 * time.Minute,
+		EnvVars: []string{"GIT_SECURITY_HOOK_TIMEOUT"},
+	})
+
+	flags = append(flags, &cli.IntFlag{
+		Name:    "hook-parallelism",
+		Usage:   "default number of repos a custom hook or automation runs for at once",
+		Value:   1,
+		EnvVars: []string{"GIT_SECURITY_HOOK_PARALLELISM"},
+	})
+	flags = append(flags, &cli.StringSliceFlag{
+		Name:    "image-allowlist",
+		Usage:   "registries (ghcr.io) or repositories (ghcr.io/org/*) the images of the hooks can come from, all if empty",
+		Value:   cli.NewStringSlice(),
+		EnvVars: []string{"GIT_SECURITY_IMAGE_ALLOWLIST"},
+	})
+	flags = append(flags, &cli.StringFlag{
+		Name:    "registry-auth-file",
+		Usage:   "Docker config.json with the credentials the images of the hooks are pulled and resolved with",
+		EnvVars: []string{"GIT_SECURITY_REGISTRY_AUTH_FILE"},
+	})
+	flags = append(flags, &cli.StringSliceFlag{
+		Name:    "secret-dirs",
+		Usage:   "directories the file secret references of the hook envs can read, like mounted secrets",
+		Value:   cli.NewStringSlice(),
+		EnvVars: []string{"GIT_SECURITY_SECRET_DIRS"},
+	})
+	flags = append(flags, &cli.StringSliceFlag{
+		Name:    "secret-envs",
+		Usage:   "envs of the server (wildcards) the env secret references of the hook envs can read",
+		Value:   cli.NewStringSlice(),
+		EnvVars: []string{"GIT_SECURITY_SECRET_ENVS"},
+	})
+	flags = append(flags, &cli.StringFlag{
+		Name:    "vault-addr",
+		Usage:   "address of the Vault server of the vault secret references of the hook envs",
+		EnvVars: []string{"GIT_SECURITY_VAULT_ADDR"},
+	})
+	flags = append(flags, &cli.StringFlag{
+		Name:    "vault-token",
+		Usage:   "token reading the vault secret references of the hook envs",
+		EnvVars: []string{"GIT_SECURITY_VAULT_TOKEN"},
+	})
+
 	app := &cli.App{
 		Name:    "github-security",
 		Version: "v0.1.0",
@@ -84,22 +178,7 @@ func main() {
 			logger := slog.New(slog.NewJSONHandler(os.Stdout, opts))
 			slog.SetDefault(logger)
 
-			return interruptible.Run(service.New(
-				&service.Opts{
-					GitHub:            flag.GetGitHubOpts(c),
-					Http:              flag.GetHttpOpts(c),
-					Https:             flag.GetHttpsOpts(c),
-					Postgres:          flag.GetPostgresOpts(c),
-					Mongo:             flag.GetMongoOpts(c),
-					Okta:              flag.GetOktaOpts(c),
-					Key:               c.String("key"),
-					CACert:            c.String("cacert"),
-					DB:                c.String("db"),
-					AdminUsernames:    c.StringSlice("admin-usernames"),
-					AdminPasswords:    c.StringSlice("admin-passwords"),
-					IgnoredCommitters: c.StringSlice("ignored-committers"),
-				},
-			))
+			return interruptible.Run(service.New(getOpts(c)))
 		},
 		Commands: []*cli.Command{
 			{
@@ -115,6 +194,58 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:  "rotate-key",
+				Usage: "re-encrypt the stored hook envs with the first key of GIT_SECURITY_KEYRING",
+				Action: func(c *cli.Context) error {
+					rotated, err := service.RotateKey(getOpts(c))
+					failed := 0
+					for _, r := range rotated {
+						if r.Error != "" {
+							failed++
+							fmt.Printf("%s %s %s: failed from key %s: %s\n", r.Collection, r.HookID.Hex(), r.Key, r.FromKeyID, r.Error)
+						} else {
+							fmt.Printf("%s %s %s: re-encrypted from key %s\n", r.Collection, r.HookID.Hex(), r.Key, r.FromKeyID)
+						}
+					}
+					fmt.Printf("%d values re-encrypted, %d failed\n", len(rotated)-failed, failed)
+					if err != nil {
+						return err
+					}
+					if failed > 0 {
+						return fmt.Errorf("%d values couldn't be re-encrypted", failed)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "create-user",
+				Usage: "create a basic auth user in the local user store",
+				Flags: userFlags(&cli.StringSliceFlag{
+					Name:  "role",
+					Usage: "role assigned to the user, can be repeated",
+					Value: cli.NewStringSlice("user"),
+				}),
+				Action: func(c *cli.Context) error {
+					password, err := getPassword(c)
+					if err != nil {
+						return err
+					}
+					return service.CreateLocalUser(getOpts(c), c.String("username"), password, c.StringSlice("role"))
+				},
+			},
+			{
+				Name:  "reset-password",
+				Usage: "reset the password of a basic auth user in the local user store",
+				Flags: userFlags(),
+				Action: func(c *cli.Context) error {
+					password, err := getPassword(c)
+					if err != nil {
+						return err
+					}
+					return service.ResetLocalUserPassword(getOpts(c), c.String("username"), password)
+				},
+			},
 		},
 	}
 
@@ -122,3 +253,65 @@ func main() {
 		slog.Error("error in app.Run()", slog.String("error", err.Error()))
 	}
 }
+
+func getOpts(c *cli.Context) *service.Opts {
+	return &service.Opts{
+		GitHub:              flag.GetGitHubOpts(c),
+		Http:                flag.GetHttpOpts(c),
+		Https:               flag.GetHttpsOpts(c),
+		Postgres:            flag.GetPostgresOpts(c),
+		Mongo:               flag.GetMongoOpts(c),
+		Okta:                flag.GetOktaOpts(c),
+		OktaGroupsClaim:     c.String("okta-groups-claim"),
+		Key:                 c.String("key"),
+		Keyring:             c.StringSlice("keyring"),
+		CACert:              c.String("cacert"),
+		DB:                  c.String("db"),
+		AdminUsernames:      c.StringSlice("admin-usernames"),
+		AdminPasswords:      c.StringSlice("admin-passwords"),
+		IgnoredCommitters:   c.StringSlice("ignored-committers"),
+		Debug:               c.Bool("debug"),
+		Executor:            c.String("executor"),
+		AllowSubprocess:     c.Bool("allow-subprocess-executor"),
+		KubernetesNamespace: c.String("kubernetes-namespace"),
+		HookRunRetention:    c.Duration("hook-run-retention"),
+		SnapshotRetention:   c.Duration("snapshot-retention"),
+		HookTimeout:         c.Duration("hook-timeout"),
+		HookParallelism:     c.Int("hook-parallelism"),
+		ImageAllowlist:      c.StringSlice("image-allowlist"),
+		RegistryAuthFile:    c.String("registry-auth-file"),
+		SecretDirs:          c.StringSlice("secret-dirs"),
+		SecretEnvs:          c.StringSlice("secret-envs"),
+		VaultAddr:           c.String("vault-addr"),
+		VaultToken:          c.String("vault-token"),
+	}
+}
+
+// userFlags are the flags of the local user subcommands, with the embedded FerretDB
+// they have to run while the server is stopped
+func userFlags(extra ...cli.Flag) []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "username",
+			Usage:    "username of the basic auth user",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "password",
+			Usage: "password (or bcrypt hash) of the basic auth user, a random one is generated and printed if not set",
+		},
+	}, extra...)
+}
+
+func getPassword(c *cli.Context) (string, error) {
+	if password := c.String("password"); password != "" {
+		return password, nil
+	}
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	password := base64.RawURLEncoding.EncodeToString(b)
+	fmt.Println(password)
+	return password, nil
+}
@@ -0,0 +1,127 @@
+package security
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// ciphertextPrefix tags the ciphertexts with the ID of their key: gs1:<key id>:<base64>,
+	// the ciphertexts without it were encrypted by the single key of GIT_SECURITY_KEY
+	ciphertextPrefix = "gs1:"
+	// LegacyKeyID is the ID of the key given by GIT_SECURITY_KEY
+	LegacyKeyID = "default"
+)
+
+var keyIDRegex = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Key is an encryption key of the keyring
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring encrypts with its primary key, the first one, and decrypts with any of its keys
+// so that the values encrypted by the old keys can still be read while they are rotated
+type Keyring struct {
+	keys []Key
+}
+
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	ids := make(map[string]bool)
+	for _, key := range keys {
+		if !keyIDRegex.MatchString(key.ID) {
+			return nil, fmt.Errorf("invalid key ID %q", key.ID)
+		}
+		if ids[key.ID] {
+			return nil, fmt.Errorf("duplicate key ID %q", key.ID)
+		}
+		ids[key.ID] = true
+		switch len(key.Secret) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("the key %s must be 16, 24 or 32 bytes", key.ID)
+		}
+	}
+	return &Keyring{keys: keys}, nil
+}
+
+// ParseKeyring returns the keyring of the id:base64 entries, the first one is the primary
+// key. The legacy key of GIT_SECURITY_KEY is added last as the default key, the primary one
+// when there are no entries.
+func ParseKeyring(legacyKey string, entries []string) (*Keyring, error) {
+	keys := make([]Key, 0, len(entries)+1)
+	for _, entry := range entries {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid keyring entry, expected id:base64 key")
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+		keys = append(keys, Key{ID: id, Secret: secret})
+	}
+	if legacyKey != "" {
+		secret, err := base64.StdEncoding.DecodeString(legacyKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, Key{ID: LegacyKeyID, Secret: secret})
+	}
+	return NewKeyring(keys...)
+}
+
+// PrimaryID returns the ID of the key the values are encrypted with
+func (k *Keyring) PrimaryID() string {
+	if len(k.keys) == 0 {
+		return ""
+	}
+	return k.keys[0].ID
+}
+
+// Encrypt encrypts with the primary key and tags the ciphertext with its ID
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	if len(k.keys) == 0 {
+		return "", errors.New("no encryption key is configured")
+	}
+	ciphertext, err := Encrypt(plaintext, k.keys[0].Secret)
+	if err != nil {
+		return "", err
+	}
+	return ciphertextPrefix + k.keys[0].ID + ":" + ciphertext, nil
+}
+
+// Decrypt decrypts with the key the ciphertext is tagged with, the untagged ciphertexts with
+// the legacy key
+func (k *Keyring) Decrypt(ciphertext string) (string, error) {
+	id, ciphertext := KeyID(ciphertext), strings.TrimPrefix(ciphertext, ciphertextPrefix)
+	if id == "" {
+		id = LegacyKeyID
+	} else {
+		ciphertext = strings.TrimPrefix(ciphertext, id+":")
+	}
+	for _, key := range k.keys {
+		if key.ID == id {
+			return Decrypt(ciphertext, key.Secret)
+		}
+	}
+	return "", fmt.Errorf("the key %s isn't in the keyring", id)
+}
+
+// Current tells if the ciphertext is encrypted with the primary key
+func (k *Keyring) Current(ciphertext string) bool {
+	return KeyID(ciphertext) == k.PrimaryID()
+}
+
+// KeyID returns the ID of the key of the ciphertext, empty for the untagged ones
+func KeyID(ciphertext string) string {
+	if !strings.HasPrefix(ciphertext, ciphertextPrefix) {
+		return ""
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(ciphertext, ciphertextPrefix), ":")
+	return id
+}
@@ -0,0 +1,35 @@
+package security
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	DefaultPassword = "changeme"
+)
+
+// HashPassword returns the bcrypt hash of the password
+func HashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// CheckPassword compares the bcrypt hash with the plaintext password
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// IsPasswordHash tells if the value is already a bcrypt hash, so the passwords
+// can be given hashed in the flags
+func IsPasswordHash(value string) bool {
+	if !strings.HasPrefix(value, "$2") {
+		return false
+	}
+	_, err := bcrypt.Cost([]byte(value))
+	return err == nil
+}
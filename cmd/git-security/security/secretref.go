@@ -0,0 +1,126 @@
+package security
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/IGLOU-EU/go-wildcard/v2"
+	"github.com/go-resty/resty/v2"
+	"github.com/tidwall/gjson"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+)
+
+// SecretResolver resolves the secret references of the hook envs at run time. The files are
+// only read in the allowed directories and the envs of the server only by the allowed names
+// (wildcards), so that the hooks can't read the secrets of the server itself. The Vault
+// references need the address of the server.
+type SecretResolver struct {
+	dirs  []string
+	envs  []string
+	vault *resty.Client
+}
+
+func NewSecretResolver(dirs, envs []string, vaultAddr, vaultToken string) *SecretResolver {
+	r := &SecretResolver{envs: envs}
+	for _, dir := range dirs {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			r.dirs = append(r.dirs, filepath.Clean(dir))
+		}
+	}
+	if vaultAddr != "" {
+		r.vault = resty.New().
+			SetBaseURL(strings.TrimRight(vaultAddr, "/")).
+			SetHeader("X-Vault-Token", vaultToken).
+			SetTimeout(30 * time.Second)
+	}
+	return r
+}
+
+// Resolve returns the secret of the reference
+func (r *SecretResolver) Resolve(ctx context.Context, ref string) (string, error) {
+	secretRef, err := config.ParseSecretRef(ref)
+	if err != nil {
+		return "", err
+	}
+	switch secretRef.Kind {
+	case config.SecretRefFile:
+		return r.resolveFile(secretRef.Path)
+	case config.SecretRefEnv:
+		return r.resolveEnv(secretRef.Path)
+	default:
+		return r.resolveVault(ctx, secretRef.Path, secretRef.Key)
+	}
+}
+
+// resolveFile reads the file within the allowed directories, after following the symlinks
+// of the mounted secrets. The trailing new line is dropped.
+func (r *SecretResolver) resolveFile(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("error in reading the secret file %s: %w", path, err)
+	}
+	allowed := false
+	for _, dir := range r.dirs {
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(realDir, resolved); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", fmt.Errorf("the secret file %s isn't in an allowed directory", path)
+	}
+	b, err := os.ReadFile(resolved)
+	if err != nil {
+		return "", fmt.Errorf("error in reading the secret file %s: %w", path, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func (r *SecretResolver) resolveEnv(name string) (string, error) {
+	allowed := false
+	for _, pattern := range r.envs {
+		if wildcard.Match(strings.TrimSpace(pattern), name) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", fmt.Errorf("the env %s isn't allowed as a secret", name)
+	}
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("the env %s isn't set", name)
+	}
+	return value, nil
+}
+
+// resolveVault reads the key of the secret, from a KV engine of version 2 (data.data) or 1 (data)
+func (r *SecretResolver) resolveVault(ctx context.Context, path, key string) (string, error) {
+	if r.vault == nil {
+		return "", fmt.Errorf("no vault is configured for the secret %s", path)
+	}
+	resp, err := r.vault.R().SetContext(ctx).Get("/v1/" + path)
+	if err != nil {
+		slog.Error("error in reading the vault secret", slog.String("path", path), slog.String("error", err.Error()))
+		return "", err
+	}
+	if resp.IsError() {
+		return "", fmt.Errorf("error in reading the vault secret %s: status code %d", path, resp.StatusCode())
+	}
+	for _, prefix := range []string{"data.data.", "data."} {
+		if value := gjson.GetBytes(resp.Body(), prefix+gjson.Escape(key)); value.Type == gjson.String {
+			return value.String(), nil
+		}
+	}
+	return "", fmt.Errorf("the vault secret %s has no key %s", path, key)
+}
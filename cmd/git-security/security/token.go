@@ -0,0 +1,28 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	TokenPrefix = "gs_"
+)
+
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return TokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded sha256 of the token, tokens are random
+// and long enough so there is no need for a slow hash
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return hex.EncodeToString(h[:])
+}
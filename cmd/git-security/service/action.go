@@ -0,0 +1,159 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+// automationActor attributes the changes applied for the automation in the changelog
+func automationActor(automation config.Automation) string {
+	return "automation:" + automation.ID.Hex()
+}
+
+// applyAutomationActions applies the actions printed on stdout by the automation to the repo,
+// the actions not allowed by the permissions of the automation are refused. It returns the
+// errors of the actions not applied.
+func (app *GitSecurityApp) applyAutomationActions(
+	automation config.Automation,
+	repo *gh.Repository,
+	stdout string,
+) error {
+	actions, errs := parseAutomationActions(stdout)
+	for _, action := range actions {
+		if !automation.Allows(action) {
+			errs = append(errs, fmt.Errorf("the %s action is not permitted", action.Action))
+			continue
+		}
+		if err := app.applyAutomationAction(automationActor(automation), repo, action); err != nil {
+			errs = append(errs, fmt.Errorf("error in the %s action: %w", action.Action, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseAutomationActions returns the actions printed on stdout, and the errors of the lines
+// with the prefix that aren't valid actions
+func parseAutomationActions(stdout string) ([]config.AutomationAction, []error) {
+	var actions []config.AutomationAction
+	var errs []error
+	for _, line := range strings.Split(stdout, "\n") {
+		s, ok := strings.CutPrefix(strings.TrimSpace(line), config.AutomationActionPrefix)
+		if !ok {
+			continue
+		}
+		var action config.AutomationAction
+		if err := json.Unmarshal([]byte(s), &action); err != nil {
+			errs = append(errs, fmt.Errorf("invalid action %s: %w", s, err))
+			continue
+		}
+		actions = append(actions, action)
+	}
+	return actions, errs
+}
+
+func (app *GitSecurityApp) applyAutomationAction(actor string, repo *gh.Repository, action config.AutomationAction) error {
+	switch action.Action {
+	case config.ActionSetCustom:
+		return app.setCustomAction(actor, repo, action.Field, action.Value)
+	case config.ActionAssignOwner:
+		return app.assignOwnerAction(actor, repo, action.Owner)
+	case config.ActionAddNote:
+		if strings.TrimSpace(action.Note) == "" {
+			return errors.New("the note is empty")
+		}
+		return app.dbw.CreateChangelogBy(actor, repo, db.ChangelogNote, "", action.Note)
+	case config.ActionRequestProtection:
+		return app.requestProtectionAction(actor, repo, action.Field, action.Value)
+	default:
+		return fmt.Errorf("unknown action %q", action.Action)
+	}
+}
+
+// setCustomAction sets a field of a custom hook, the value is cast to the type of the field
+func (app *GitSecurityApp) setCustomAction(actor string, repo *gh.Repository, field string, value interface{}) error {
+	cursor, err := app.db.Collection("customs").Find(app.ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(app.ctx)
+	var customs []config.Custom
+	if err := cursor.All(app.ctx, &customs); err != nil {
+		return err
+	}
+
+	for _, custom := range customs {
+		for _, output := range custom.Fields() {
+			if output.Field != field {
+				continue
+			}
+			values := make(map[string]interface{})
+			setCustomValue(values, field, output.ValueType, value)
+			update := bson.D{{Key: "$set", Value: bson.D{
+				{Key: "customs." + field, Value: values[field]},
+			}}}
+			_, err := app.dbw.UpdateRepositoryBy(actor, repo.ID, update)
+			return err
+		}
+	}
+	return fmt.Errorf("unknown custom field %q", field)
+}
+
+// assignOwnerAction assigns the owner with the name to the repo
+func (app *GitSecurityApp) assignOwnerAction(actor string, repo *gh.Repository, name string) error {
+	var owner config.Owner
+	if err := app.db.Collection("owners").FindOne(
+		app.ctx,
+		bson.D{{Key: "name", Value: name}},
+	).Decode(&owner); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("unknown owner %q", name)
+		}
+		return err
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "repo_owner_id", Value: owner.ID},
+		{Key: "repo_owner", Value: owner.Name},
+		{Key: "repo_owner_contact", Value: owner.Contact},
+	}}}
+	_, err := app.dbw.UpdateRepositoryBy(actor, repo.ID, update)
+	return err
+}
+
+// requestProtectionAction changes a field of the branch protection rule of the default
+// branch on GitHub, and updates the repo with the rule changed
+func (app *GitSecurityApp) requestProtectionAction(actor string, repo *gh.Repository, field string, value interface{}) error {
+	if !slices.Contains(gh.BranchProtectionRuleFields, field) {
+		return fmt.Errorf("unknown branch protection field %q", field)
+	}
+	if repo.GqlRepository == nil || repo.DefaultBranchRef.BranchProtectionRule.ID == "" {
+		return errors.New("the repo has no branch protection rule")
+	}
+	if v, ok := value.(float64); ok {
+		value = int(v)
+	}
+
+	if err := app.g.UpdateBranchProtectionRule(
+		repo.DefaultBranchRef.BranchProtectionRule.ID,
+		field,
+		value,
+	); err != nil {
+		return err
+	}
+	updatedRepo, err := app.g.GetRepo(repo.Owner.Login, repo.Name)
+	if err != nil {
+		return err
+	}
+	_, err = app.dbw.UpdateRepositoryBy(actor, repo.ID, bson.D{{Key: "$set", Value: updatedRepo}})
+	return err
+}
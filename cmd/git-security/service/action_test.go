@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/executor"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+// fakeGitHub records the branch protection updates
+type fakeGitHub struct {
+	gh.GitHub
+	updates map[string]interface{}
+	repo    *gh.Repository
+}
+
+func (f *fakeGitHub) UpdateBranchProtectionRule(branchProtectionRuleID, field string, value interface{}) error {
+	f.updates[field] = value
+	return nil
+}
+
+func (f *fakeGitHub) GetRepo(orgName, repoName string) (*gh.Repository, error) {
+	return f.repo, nil
+}
+
+func TestApplyAutomationActions(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	repo := gh.Repository{GqlRepository: &gh.GqlRepository{ID: "repo", Name: "repo", NameWithOwner: "org/repo"}}
+	repo.DefaultBranchRef.BranchProtectionRule.ID = "rule"
+	updatedRepo := repo
+	updatedRepo.GqlRepository = &gh.GqlRepository{ID: "repo", Name: "repo", NameWithOwner: "org/repo"}
+	updatedRepo.DefaultBranchRef.BranchProtectionRule.ID = "rule"
+	updatedRepo.DefaultBranchRef.BranchProtectionRule.RequiredApprovingReviewCount = 2
+
+	g := &fakeGitHub{updates: make(map[string]interface{}), repo: &updatedRepo}
+	app := &GitSecurityApp{
+		ctx:       context.Background(),
+		opts:      &Opts{Executor: executor.Subprocess, HookTimeout: time.Minute, HookParallelism: 1},
+		db:        mdb,
+		dbw:       dbw,
+		g:         g,
+		executors: map[string]executor.Executor{executor.Subprocess: executor.NewSubprocessExecutor()},
+	}
+
+	_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+	require.Nil(t, err)
+	_, err = mdb.Collection("customs").InsertOne(app.ctx, config.Custom{Field: "team", ValueType: "string"})
+	require.Nil(t, err)
+	_, err = mdb.Collection("owners").InsertOne(app.ctx, config.Owner{Name: "team-a", Contact: "a@example.com"})
+	require.Nil(t, err)
+
+	automation := config.Automation{
+		ID: primitive.NewObjectID(),
+		Command: `sh -c 'echo "::git-security:: {\"action\": \"set_custom\", \"field\": \"team\", \"value\": \"a\"}"
+echo "::git-security:: {\"action\": \"assign_owner\", \"owner\": \"team-a\"}"
+echo "::git-security:: {\"action\": \"add_note\", \"note\": \"owner from CODEOWNERS\"}"
+echo "::git-security:: {\"action\": \"request_protection\", \"field\": \"RequiredApprovingReviewCount\", \"value\": 2}"
+echo "::git-security:: {\"action\": \"request_protection\", \"field\": \"AllowsForcePushes\", \"value\": true}"
+echo "::git-security:: {\"action\": \"assign_owner\", \"owner\": \"team-b\"}"
+echo done'`,
+		Enabled: true,
+		Permissions: []config.AutomationPermission{
+			{Action: config.ActionSetCustom, Fields: []string{"team"}},
+			{Action: config.ActionAssignOwner},
+			{Action: config.ActionAddNote},
+			{Action: config.ActionRequestProtection, Fields: []string{"Required*"}},
+		},
+	}
+	require.Nil(t, automation.ValidatePermissions())
+
+	stdout, err := app.runSingleAutomation(automation, repo.NameWithOwner, nil)
+	require.Nil(t, err)
+	err = app.applyAutomationActions(automation, &repo, stdout)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "the request_protection action is not permitted")
+	assert.Contains(t, err.Error(), `unknown owner "team-b"`)
+
+	repos, err := dbw.ReadRepositories(bson.D{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(repos))
+	assert.Equal(t, "a", repos[0].Customs["team"])
+	assert.Equal(t, "team-a", repos[0].RepoOwner)
+	assert.Equal(t, "a@example.com", repos[0].RepoOwnerContact)
+	assert.Equal(t, 2, repos[0].DefaultBranchRef.BranchProtectionRule.RequiredApprovingReviewCount)
+	assert.Equal(t, map[string]interface{}{"RequiredApprovingReviewCount": 2}, g.updates)
+
+	// the changes are attributed to the automation
+	changelog, err := dbw.ReadChangelog(bson.D{{Key: "actor", Value: automationActor(automation)}})
+	require.Nil(t, err)
+	fields := make(map[string]string)
+	for _, c := range changelog {
+		fields[c.Field] = c.To
+	}
+	assert.Equal(t, "a", fields["Customs.team"])
+	assert.Equal(t, "team-a", fields["RepoOwner"])
+	assert.Equal(t, "owner from CODEOWNERS", fields[db.ChangelogNote])
+	assert.Equal(t, "2", fields["RequiredApprovingReviewCount"])
+}
+
+func TestAutomationAllows(t *testing.T) {
+	automation := config.Automation{
+		Permissions: []config.AutomationPermission{
+			{Action: config.ActionSetCustom, Fields: []string{"team", "score_*"}},
+			{Action: config.ActionAddNote},
+		},
+	}
+	assert.True(t, automation.Allows(config.AutomationAction{Action: config.ActionSetCustom, Field: "team"}))
+	assert.True(t, automation.Allows(config.AutomationAction{Action: config.ActionSetCustom, Field: "score_x"}))
+	assert.False(t, automation.Allows(config.AutomationAction{Action: config.ActionSetCustom, Field: "owner"}))
+	assert.True(t, automation.Allows(config.AutomationAction{Action: config.ActionAddNote}))
+	assert.False(t, automation.Allows(config.AutomationAction{Action: config.ActionAssignOwner, Owner: "a"}))
+
+	automation.Permissions = append(automation.Permissions, config.AutomationPermission{Action: config.ActionRequestProtection})
+	assert.NotNil(t, automation.ValidatePermissions())
+}
@@ -1,262 +1,163 @@
 package service
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/json"
-	"fmt"
-	"io"
 	"log/slog"
-	"strings"
-	"unicode/utf8"
 
-	"github.com/IGLOU-EU/go-wildcard/v2"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/image"
-	"github.com/docker/docker/client"
-	"github.com/kballard/go-shellquote"
-	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/executor"
 	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
-	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
 )
 
-func (app *GitSecurityApp) runAutomation() error {
-	slog.Info(("start runAutomation()"))
-	filters := bson.D{
-		{
-			Key:   "is_archived",
-			Value: false,
-		},
+// runAutomation runs the automation against the repos, all of them if repoNames is empty
+func (app *GitSecurityApp) runAutomation(automation config.Automation, repoNames []string) error {
+	slog.Info("start runAutomation()", slog.String("id", automation.ID.Hex()))
+
+	// prereq check
+	if !automation.Enabled || !app.automationRunnable(automation) {
+		return nil
+	}
+
+	filters, err := config.HookFilters(repoNames, automation.Filters)
+	if err != nil {
+		return err
 	}
 	repos, err := app.dbw.ReadRepositories(filters)
 	if err != nil {
 		return err
 	}
 
+	envs, err := app.decryptEnvs(automation.Envs)
+	if err != nil {
+		return err
+	}
+
+	g := new(errgroup.Group)
+	g.SetLimit(app.hookParallelism(automation.HookLimits))
 	for _, repo := range repos {
-		cursorAutomation, err := app.db.Collection("automations").Find(app.ctx, bson.D{})
-		if err != nil {
-			return err
-		}
-		var automations []config.Automation
-		if err := cursorAutomation.All(app.ctx, &automations); err != nil {
-			cursorAutomation.Close(app.ctx)
-			return err
+		if !proceedWithRightCondition(repo, automation) {
+			continue
 		}
-		cursorAutomation.Close(app.ctx)
-
-		for _, automation := range automations {
-			// prereq check
-			if !automation.Enabled || len(automation.Image) == 0 || len(automation.Command) == 0 {
-				continue
-			}
-
-			if proceedWithRightCondition(repo, automation) {
-				// repo struct to json
-				b, err := json.Marshal(repo)
-				if err != nil {
-					slog.Error(
-						"error in json.Marshal the repo",
-						slog.String("error", err.Error()),
-						slog.String("repo", repo.NameWithOwner),
-					)
-					continue
-				}
-
-				// do automation logic
-				// add envs + decrypt
-				envs := []config.EnvKeyValue{
-					{
-						Key:   "GIT_REPO_JSON",
-						Value: string(b),
-					},
-				}
-				for _, e := range automation.Envs {
-					v, err := security.Decrypt(e.Value, app.key)
-					if err != nil {
-						slog.Error(
-							"error in security.Decrypt()",
-							slog.String("error", err.Error()),
-							slog.String("encrypted", e.Value),
-						)
-						return err
-					}
-					envs = append(envs, config.EnvKeyValue{
-						Key:   e.Key,
-						Value: v,
-					})
-				}
 
-				if err := app.runSingleAutomation(automation.Image, automation.Command, envs); err != nil {
-					slog.Error("error in runSingleAutomation()", slog.String("error", err.Error()))
-				}
+		g.Go(func() error {
+			if app.ctx.Err() == nil {
+				app.runAutomationForRepo(automation, repo, nil, envs)
 			}
-		}
+			return nil
+		})
 	}
+	g.Wait()
 
 	return nil
 }
 
-func proceedWithRightCondition(repo *gh.Repository, automation config.Automation) bool {
-	matchPattern := false
-	for _, p := range strings.Split(automation.Pattern, ",") {
-		p := strings.Trim(p, " ")
-		if len(p) == 0 {
-			continue
-		}
-		if wildcard.Match(p, repo.NameWithOwner) {
-			matchPattern = true
-			break
-		}
-	}
-	if !matchPattern {
-		return false
-	}
-
-	for _, e := range strings.Split(automation.Exclude, ",") {
-		e := strings.Trim(e, " ")
-		if len(e) == 0 {
-			continue
-		}
-		if wildcard.Match(e, repo.NameWithOwner) {
-			return false
-		}
+// automationRunnable tells if the automation has what it needs to run
+func (app *GitSecurityApp) automationRunnable(automation config.Automation) bool {
+	if automation.IsWebhook() {
+		return len(automation.Webhook.URL) > 0
 	}
+	return len(automation.Command) > 0 &&
+		(!app.requiresImage(automation.Executor) || len(automation.Image) > 0)
+}
 
-	// last check on owner
-	if strings.Trim(automation.Owner, " ") != "" {
-		for _, o := range strings.Split(automation.Owner, ",") {
-			o := strings.Trim(o, " ")
-			if len(o) == 0 {
-				continue
-			}
-			if wildcard.Match(o, repo.RepoOwner) {
-				return true
-			}
+// runAutomationForRepo runs the automation with the repo in GIT_REPO_JSON, and the change in
+// GIT_CHANGE_* for the event-driven automations. The webhooks are run by the app.
+func (app *GitSecurityApp) runAutomationForRepo(
+	automation config.Automation,
+	repo *gh.Repository,
+	change *db.ChangeLog,
+	envs []config.EnvKeyValue,
+) {
+	if automation.IsWebhook() {
+		if err := app.runWebhook(automation, repo, change, envs); err != nil {
+			slog.Error("error in runWebhook()", slog.String("error", err.Error()))
 		}
-		return false
+		return
 	}
-	return true
-}
 
-func (app *GitSecurityApp) runSingleAutomation(imageName, command string, envs []config.EnvKeyValue) error {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	repoEnvs, err := automationEnvs(repo, change, envs)
 	if err != nil {
-		slog.Error("error in NewClientWithOpts()", slog.String("error", err.Error()))
-		return err
+		slog.Error(
+			"error in json.Marshal the repo",
+			slog.String("error", err.Error()),
+			slog.String("repo", repo.NameWithOwner),
+		)
+		return
 	}
-
-	c, err := shellquote.Split(command)
+	stdout, err := app.runSingleAutomation(automation, repo.NameWithOwner, repoEnvs)
 	if err != nil {
-		slog.Error("error in shellquote.Split()", slog.String("error", err.Error()))
-		return err
+		slog.Error("error in runSingleAutomation()", slog.String("error", err.Error()))
+		return
+	}
+	if err := app.applyAutomationActions(automation, repo, stdout); err != nil {
+		slog.Error(
+			"error in applyAutomationActions()",
+			slog.String("error", err.Error()),
+			slog.String("repo", repo.NameWithOwner),
+		)
 	}
+}
 
-	e := make([]string, 0)
-	masked := make([]string, 0)
-	for _, ekv := range envs {
-		k := strings.TrimSpace(ekv.Key)
-		if k != "" {
-			e = append(e, fmt.Sprintf("%s=%s", k, ekv.Value))
-			if k != "GIT_REPO_JSON" {
-				masked = append(masked,
-					fmt.Sprintf("%s=%s", k, strings.Repeat("*", utf8.RuneCountInString(ekv.Value))))
-			} else {
-				masked = append(masked, fmt.Sprintf("%s=%s", k, ekv.Value))
-			}
-		}
+// automationEnvs returns the envs of the automation with the repo in GIT_REPO_JSON and the
+// change in GIT_CHANGE_*
+func automationEnvs(repo *gh.Repository, change *db.ChangeLog, envs []config.EnvKeyValue) ([]config.EnvKeyValue, error) {
+	if change != nil {
+		envs = append([]config.EnvKeyValue{
+			{Key: "GIT_CHANGE_FIELD", Value: change.Field},
+			{Key: "GIT_CHANGE_OP", Value: change.Op},
+			{Key: "GIT_CHANGE_FROM", Value: change.From},
+			{Key: "GIT_CHANGE_TO", Value: change.To},
+		}, envs...)
 	}
 
-	slog.Debug("automation: create container",
-		slog.String("image", imageName),
-		slog.Any("Cmd", c),
-		slog.Any("Env", masked),
-	)
-	resp, err := cli.ContainerCreate(app.ctx, &container.Config{
-		Image: imageName,
-		Cmd:   c,
-		Tty:   true,
-		Env:   e,
-	}, nil, nil, nil, "")
+	// repo struct to json
+	b, err := json.Marshal(repo)
 	if err != nil {
-		if strings.Contains(err.Error(), "No such image") {
-			// pull the image
-			slog.Debug("automation: pull image", slog.String("image", imageName))
-			reader, err := cli.ImagePull(app.ctx, imageName, image.PullOptions{})
-			if err != nil {
-				slog.Error("error in ImagePull()", slog.String("error", err.Error()))
-				return err
-			}
-			defer reader.Close()
-			io.Copy(io.Discard, reader)
-
-			resp, err = cli.ContainerCreate(app.ctx, &container.Config{
-				Image: imageName,
-				Cmd:   c,
-				Tty:   true,
-				Env:   e,
-			}, nil, nil, nil, "")
-			if err != nil {
-				slog.Error("error in ContainerCreate()", slog.String("error", err.Error()))
-				return err
-			}
-		} else {
-			slog.Error("error in ContainerCreate()", slog.String("error", err.Error()))
-			return err
-		}
-	}
-	defer func() {
-		if err := cli.ContainerRemove(app.ctx, resp.ID, container.RemoveOptions{
-			RemoveVolumes: true,
-			RemoveLinks:   false,
-			Force:         true,
-		}); err != nil {
-			slog.Error("error in ContainerRemove()", slog.String("ID", resp.ID), slog.String("error", err.Error()))
-		}
-		cli.Close()
-	}()
-
-	if err := cli.ContainerStart(app.ctx, resp.ID, container.StartOptions{}); err != nil {
-		slog.Error("error in ContainerStart()", slog.String("error", err.Error()))
-		return err
+		return nil, err
 	}
+	return append([]config.EnvKeyValue{
+		{
+			Key:   "GIT_REPO_JSON",
+			Value: string(b),
+		},
+	}, envs...), nil
+}
 
-	statusCh, errCh := cli.ContainerWait(app.ctx, resp.ID, container.WaitConditionNotRunning)
-	select {
-	case err := <-errCh:
-		if err != nil {
-			slog.Error("error in ContainerWait()", slog.String("error", err.Error()))
-			return err
-		}
-	case <-statusCh:
-	}
+func proceedWithRightCondition(repo *gh.Repository, automation config.Automation) bool {
+	return automation.MatchRepo(repo.NameWithOwner, repo.RepoOwner)
+}
 
-	out, err := cli.ContainerLogs(app.ctx, resp.ID, container.LogsOptions{ShowStdout: true})
+// runSingleAutomation runs the automation for the repo and returns its stdout
+func (app *GitSecurityApp) runSingleAutomation(automation config.Automation, repo string, envs []config.EnvKeyValue) (string, error) {
+	run, job := automationJob(automation, repo, envs)
+	result, err := app.runHook(run, job, automation.HookLimits, automation.HookImage)
 	if err != nil {
-		slog.Error("error in ContainerLogs()", slog.String("error", err.Error()))
-		return err
+		return "", err
 	}
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(out)
-
-	sc := bufio.NewScanner(buf)
-	b := make([]byte, 0, 1024*1024)
-	sc.Buffer(b, 102400*1024)
-	var line string
-	for sc.Scan() {
-		line = sc.Text()
-		slog.Debug("container output",
-			slog.String("output", buf.String()),
-			slog.String("line", line),
-		)
-	}
-	if err := sc.Err(); err != nil {
-		slog.Error("error in Scan()", slog.String("error", err.Error()))
-		return err
-	}
+	slog.Debug("automation output",
+		slog.String("stdout", result.Stdout),
+		slog.String("stderr", result.Stderr),
+		slog.Int("exit code", result.ExitCode),
+	)
+	return result.Stdout, nil
+}
 
-	return nil
+// automationJob returns the run and the job of the automation for the repo
+func automationJob(automation config.Automation, repo string, envs []config.EnvKeyValue) (*db.HookRun, *executor.Job) {
+	return &db.HookRun{
+			HookType: db.HookTypeAutomation,
+			HookID:   automation.ID,
+			Repo:     repo,
+			Executor: automation.Executor,
+		},
+		&executor.Job{
+			Image:     automation.Image,
+			Command:   automation.Command,
+			Envs:      envs,
+			PlainEnvs: []string{"GIT_REPO_JSON", "GIT_CHANGE_FIELD", "GIT_CHANGE_OP", "GIT_CHANGE_FROM", "GIT_CHANGE_TO"},
+		}
 }
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+// customRepoKey identifies the state of the repo a run of the hook depends on: the head
+// commit of its default branch, or its last update when it has no commit, and the values of
+// the custom fields the hook depends on
+func customRepoKey(custom config.Custom, repo *gh.Repository) string {
+	var key strings.Builder
+	if repo.GqlRepository != nil && repo.DefaultBranchRef.Target.Commit.Oid != "" {
+		key.WriteString(repo.DefaultBranchRef.Target.Commit.Oid)
+	} else if repo.GqlRepository != nil {
+		key.WriteString(repo.UpdatedAt.UTC().Format(time.RFC3339))
+	}
+	for _, field := range custom.DependsOn {
+		value, _ := customEnvValue(repo.Customs[field])
+		key.WriteString("\n" + field + "=" + value)
+	}
+	return key.String()
+}
+
+// cachedRun tells if the cached run of the hook for the repo is still valid, within the TTL
+// and with the repo unchanged when the hook asks for both
+func cachedRun(custom config.Custom, entry *db.HookCacheEntry, repo *gh.Repository, now time.Time) bool {
+	if entry == nil || !custom.Cached() {
+		return false
+	}
+	if custom.CacheTTL > 0 && now.Sub(entry.RanAt) >= time.Duration(custom.CacheTTL)*time.Second {
+		return false
+	}
+	if custom.OnlyChanged && entry.RepoKey != customRepoKey(custom, repo) {
+		return false
+	}
+	return true
+}
@@ -1,324 +1,360 @@
 package service
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
-	"strings"
 	"time"
-	"unicode/utf8"
 
-	"github.com/IGLOU-EU/go-wildcard/v2"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/image"
-	"github.com/docker/docker/client"
-	"github.com/kballard/go-shellquote"
 	"github.com/spf13/cast"
 	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
-	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/executor"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
 )
 
-func (app *GitSecurityApp) runCustom() error {
-	slog.Info(("start runCustom()"))
-	filters := bson.D{
-		{
-			Key:   "is_archived",
-			Value: false,
-		},
+// runCustom runs the custom hook against the repos, all of them if repoNames is empty
+func (app *GitSecurityApp) runCustom(custom config.Custom, repoNames []string) error {
+	slog.Info("start runCustom()", slog.String("field", custom.Field), slog.Int("outputs", len(custom.Outputs)))
+
+	// prereq check
+	if !custom.Enabled || len(custom.Command) == 0 || len(custom.Fields()) == 0 || !custom.HasTarget() {
+		return nil
+	}
+	if app.requiresImage(custom.Executor) && len(custom.Image) == 0 {
+		return nil
+	}
+
+	// the repos not targeted by the hook get the default values
+	filters, err := config.HookFilters(repoNames, nil)
+	if err != nil {
+		return err
 	}
 	repos, err := app.dbw.ReadRepositories(filters)
 	if err != nil {
 		return err
 	}
+	targeted, err := app.targetedRepos(repoNames, custom.Filters)
+	if err != nil {
+		return err
+	}
+	repos = mergeRepos(repos, targeted)
 
-	// need a map of results for batch mode custom hooks
-	batchedResults := make(map[string]map[string]interface{})
-	for _, repo := range repos {
-		cursorCustom, err := app.db.Collection("customs").Find(app.ctx, bson.D{})
+	envs, err := app.decryptEnvs(custom.Envs)
+	if err != nil {
+		return err
+	}
+
+	// if custom is batch mode, we need to fetch the result only once, the repos get the
+	// error value if it fails
+	var batchErr error
+	batchedResults := make(map[string]interface{})
+	if custom.BatchMode {
+		resultJSON, err := app.runSingleCustom(custom, "", envs)
 		if err != nil {
-			return err
+			slog.Error("error in runSingleCustom()", slog.String("error", err.Error()))
+			batchErr = err
+		} else if err := json.Unmarshal([]byte(resultJSON), &batchedResults); err != nil {
+			slog.Error("error in json.Unmarshal()", slog.String("error", err.Error()))
+			batchErr = err
 		}
-		var customs []config.Custom
-		if err := cursorCustom.All(app.ctx, &customs); err != nil {
-			cursorCustom.Close(app.ctx)
+		slog.Info(
+			"batched custom hook repo count",
+			slog.Int("count", len(batchedResults)),
+			slog.String("field", custom.Field),
+		)
+	}
+
+	// the repos with a valid cached run keep their values
+	var cache map[string]*db.HookCacheEntry
+	if custom.Cached() {
+		if cache, err = app.dbw.ReadHookCache(custom.ID); err != nil {
 			return err
 		}
-		cursorCustom.Close(app.ctx)
-
-		for _, custom := range customs {
-			// prereq check
-			if !custom.Enabled || len(custom.Image) == 0 || len(custom.Command) == 0 || len(custom.Field) == 0 {
-				continue
-			}
-
-			// if custom is batch mode, and we need to fetch the result only once
-			customHookID := getCustomHookID(&custom)
-			if custom.BatchMode {
-				if _, ok := batchedResults[customHookID]; !ok {
-					batchedResults[customHookID] = make(map[string]interface{})
-
-					envs := make([]config.EnvKeyValue, 0)
-					for _, e := range custom.Envs {
-						v, err := security.Decrypt(e.Value, app.key)
-						if err != nil {
-							slog.Error(
-								"error in security.Decrypt()",
-								slog.String("error", err.Error()),
-								slog.String("encrypted", e.Value),
-							)
-							return err
-						}
-						envs = append(envs, config.EnvKeyValue{
-							Key:   e.Key,
-							Value: v,
-						})
-					}
+	}
 
-					resultJSON, err := app.runSingleCustom(custom.Image, custom.Command, envs)
-					if err != nil {
-						slog.Error("error in runSingleCustom()", slog.String("error", err.Error()))
-						continue
-					}
+	now := time.Now()
+	skipped := 0
+	g := new(errgroup.Group)
+	g.SetLimit(app.hookParallelism(custom.HookLimits))
+	for _, repo := range repos {
+		_, ok := targeted[repo.ID]
+		filtered := targeted == nil || ok
+		if filtered && custom.MatchPattern(repo.NameWithOwner) && cachedRun(custom, cache[repo.NameWithOwner], repo, now) {
+			skipped++
+			continue
+		}
 
-					var result map[string]interface{}
-					err = json.Unmarshal([]byte(resultJSON), &result)
-					if err != nil {
-						slog.Error("error in json.Unmarshal()", slog.String("error", err.Error()))
-						continue
-					}
-					batchedResults[customHookID] = result
-					slog.Info(
-						"batched custom hook repo count",
-						slog.Int("count", len(result)),
-						slog.String("field", custom.Field),
-					)
-				}
+		g.Go(func() error {
+			if app.ctx.Err() != nil {
+				return nil
 			}
+			if app.runCustomForRepo(custom, repo, filtered, envs, batchedResults, batchErr != nil) && custom.Cached() {
+				app.dbw.UpdateHookCache(&db.HookCacheEntry{
+					HookID:  custom.ID,
+					Repo:    repo.NameWithOwner,
+					RepoKey: customRepoKey(custom, repo),
+					RanAt:   time.Now(),
+				})
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	if skipped > 0 {
+		slog.Info("custom hook cached repo count", slog.Int("count", skipped), slog.String("field", custom.Field))
+	}
 
-			for _, p := range strings.Split(custom.Pattern, ",") {
-				p := strings.Trim(p, " ")
-				if len(p) == 0 {
-					break
-				}
-
-				var result interface{}
-				if wildcard.Match(p, repo.NameWithOwner) {
-					if custom.BatchMode {
-						if v, ok := batchedResults[customHookID][repo.NameWithOwner]; ok {
-							result = v
-						} else {
-							result = custom.DefaultValue
-						}
-					} else {
-						// do custom logic
-						// add envs + decrypt
-						envs := []config.EnvKeyValue{
-							{
-								Key:   "GIT_REPO",
-								Value: repo.NameWithOwner,
-							},
-						}
-						for _, e := range custom.Envs {
-							v, err := security.Decrypt(e.Value, app.key)
-							if err != nil {
-								slog.Error(
-									"error in security.Decrypt()",
-									slog.String("error", err.Error()),
-									slog.String("encrypted", e.Value),
-								)
-								return err
-							}
-							envs = append(envs, config.EnvKeyValue{
-								Key:   e.Key,
-								Value: v,
-							})
-						}
-
-						result, err = app.runSingleCustom(custom.Image, custom.Command, envs)
-						if err != nil {
-							slog.Error("error in runSingleCustom()", slog.String("error", err.Error()))
-							result = custom.ErrorValue
-						}
-					}
-				} else {
-					result = custom.DefaultValue
-				}
-
-				hasUpdate := false
-				if repo.Customs == nil {
-					repo.Customs = make(map[string]interface{})
-				}
-
-				switch custom.ValueType {
-				case "string":
-					r := cast.ToString(result)
-					if v, ok := repo.Customs[custom.Field]; !ok || v != r {
-						hasUpdate = true
-						repo.Customs[custom.Field] = r
-					}
-				case "number":
-					r := cast.ToFloat64(result)
-					if v, ok := repo.Customs[custom.Field]; !ok || v != r {
-						hasUpdate = true
-						repo.Customs[custom.Field] = r
-					}
-				case "boolean":
-					r := cast.ToBool(result)
-					if v, ok := repo.Customs[custom.Field]; !ok || v != r {
-						hasUpdate = true
-						repo.Customs[custom.Field] = r
-					}
-				case "array":
-					var arr []string
-					json.Unmarshal([]byte(cast.ToString(result)), &arr)
-					if v, ok := repo.Customs[custom.Field]; !ok || v != &arr {
-						hasUpdate = true
-						repo.Customs[custom.Field] = arr
-					}
-				}
+	return batchErr
+}
 
-				if hasUpdate {
-					update := bson.D{{Key: "$set", Value: bson.D{
-						{Key: "customs", Value: repo.Customs},
-						{Key: "custom_run_at", Value: time.Now()},
-					}}}
-					if _, err := app.dbw.UpdateRepository(repo.ID, update, false); err != nil {
-						slog.Error("error in Update()", slog.String("error", err.Error()))
-						break
-					}
-				}
+// runCustomForRepo updates the custom fields of the repo with the result of the hook, the
+// repos not matched by the filters or the patterns get the default values. It returns true
+// if the hook ran and succeeded for the repo.
+func (app *GitSecurityApp) runCustomForRepo(
+	custom config.Custom,
+	repo *gh.Repository,
+	filtered bool,
+	envs []config.EnvKeyValue,
+	batchedResults map[string]interface{},
+	batchFailed bool,
+) bool {
+	var result interface{}
+	failed, matched := false, filtered && custom.MatchPattern(repo.NameWithOwner)
+	if matched {
+		if custom.BatchMode {
+			if v, ok := batchedResults[repo.NameWithOwner]; ok {
+				result = v
+			} else if batchFailed {
+				failed = true
+			} else {
+				matched = false
+			}
+		} else {
+			// do custom logic
+			repoEnvs, err := customRepoEnvs(custom, repo, envs)
+			if err == nil {
+				result, err = app.runSingleCustom(custom, repo.NameWithOwner, repoEnvs)
+			}
+			if err != nil {
+				slog.Error("error in runSingleCustom()", slog.String("error", err.Error()))
+				failed = true
 			}
 		}
 	}
 
-	return nil
-}
-
-func (app *GitSecurityApp) runSingleCustom(imageName, command string, envs []config.EnvKeyValue) (string, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	values, err := customFieldValues(custom, result, failed, matched)
 	if err != nil {
-		slog.Error("error in NewClientWithOpts()", slog.String("error", err.Error()))
-		return "", err
+		failed = true
+		slog.Error(
+			"error in the structured custom output",
+			slog.String("repo", repo.NameWithOwner),
+			slog.String("error", err.Error()),
+		)
 	}
 
-	c, err := shellquote.Split(command)
-	if err != nil {
-		slog.Error("error in shellquote.Split()", slog.String("error", err.Error()))
-		return "", err
+	if repo.Customs == nil {
+		repo.Customs = make(map[string]interface{})
+	}
+	// only the fields of the hook are set, the other fields may have changed since the repo
+	// was read
+	fields := bson.D{}
+	for _, output := range custom.Fields() {
+		if setCustomValue(repo.Customs, output.Field, output.ValueType, values[output.Field]) {
+			fields = append(fields, bson.E{Key: "customs." + output.Field, Value: repo.Customs[output.Field]})
+		}
 	}
 
-	e := make([]string, 0)
-	masked := make([]string, 0)
-	for _, ekv := range envs {
-		k := strings.TrimSpace(ekv.Key)
-		if k != "" {
-			e = append(e, fmt.Sprintf("%s=%s", k, ekv.Value))
-			if k != "GIT_REPO" {
-				masked = append(masked,
-					fmt.Sprintf("%s=%s", k, strings.Repeat("*", utf8.RuneCountInString(ekv.Value))))
-			} else {
-				masked = append(masked, fmt.Sprintf("%s=%s", k, ekv.Value))
-			}
+	if len(fields) > 0 {
+		update := bson.D{{Key: "$set", Value: append(fields, bson.E{Key: "custom_run_at", Value: time.Now()})}}
+		if _, err := app.dbw.UpdateRepository(repo.ID, update, false); err != nil {
+			slog.Error("error in Update()", slog.String("error", err.Error()))
+			return false
 		}
 	}
+	return matched && !failed
+}
 
-	slog.Debug("custom: create container",
-		slog.String("image", imageName),
-		slog.Any("Cmd", c),
-		slog.Any("Env", masked),
-	)
-	resp, err := cli.ContainerCreate(app.ctx, &container.Config{
-		Image: imageName,
-		Cmd:   c,
-		Tty:   true,
-		Env:   e,
-	}, nil, nil, nil, "")
-	if err != nil {
-		if strings.Contains(err.Error(), "No such image") {
-			// pull the image
-			slog.Debug("custom: pull image", slog.String("image", imageName))
-			reader, err := cli.ImagePull(app.ctx, imageName, image.PullOptions{})
-			if err != nil {
-				slog.Error("error in ImagePull()", slog.String("error", err.Error()))
-				return "", err
-			}
-			defer reader.Close()
-			io.Copy(io.Discard, reader)
+// customFieldValues returns the value of each field of the custom hook for its result, the
+// error values when it failed and the default values when the repo isn't matched. The
+// structured hooks not giving a JSON object fail.
+func customFieldValues(custom config.Custom, result interface{}, failed, matched bool) (map[string]interface{}, error) {
+	// the structured hooks print a JSON object, or give one per repo in batch mode
+	var object map[string]interface{}
+	var err error
+	if matched && !failed && custom.Structured() {
+		if object, err = customObject(result); err != nil {
+			failed = true
+		}
+	}
 
-			resp, err = cli.ContainerCreate(app.ctx, &container.Config{
-				Image: imageName,
-				Cmd:   c,
-				Tty:   true,
-				Env:   e,
-			}, nil, nil, nil, "")
-			if err != nil {
-				slog.Error("error in ContainerCreate()", slog.String("error", err.Error()))
-				return "", err
+	values := make(map[string]interface{})
+	for _, output := range custom.Fields() {
+		var value interface{}
+		switch {
+		case failed:
+			value = output.ErrorValue
+		case !matched:
+			value = output.DefaultValue
+		case custom.Structured():
+			v, ok := object[output.Key]
+			if !ok {
+				v = output.DefaultValue
 			}
-		} else {
-			slog.Error("error in ContainerCreate()", slog.String("error", err.Error()))
-			return "", err
+			value = v
+		default:
+			value = result
 		}
+		values[output.Field] = value
 	}
-	defer func() {
-		if err := cli.ContainerRemove(app.ctx, resp.ID, container.RemoveOptions{
-			RemoveVolumes: true,
-			RemoveLinks:   false,
-			Force:         true,
-		}); err != nil {
-			slog.Error("error in ContainerRemove()", slog.String("ID", resp.ID), slog.String("error", err.Error()))
-		}
-		cli.Close()
-	}()
+	return values, err
+}
 
-	if err := cli.ContainerStart(app.ctx, resp.ID, container.StartOptions{}); err != nil {
-		slog.Error("error in ContainerStart()", slog.String("error", err.Error()))
-		return "", err
+// customObject returns the JSON object of a structured hook, printed as the last line or
+// already decoded from the batch results
+func customObject(result interface{}) (map[string]interface{}, error) {
+	switch r := result.(type) {
+	case map[string]interface{}:
+		return r, nil
+	case string:
+		object := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(r), &object); err != nil {
+			return nil, err
+		}
+		return object, nil
+	default:
+		return nil, fmt.Errorf("expected a JSON object, got %T", result)
 	}
+}
 
-	statusCh, errCh := cli.ContainerWait(app.ctx, resp.ID, container.WaitConditionNotRunning)
-	select {
-	case err := <-errCh:
-		if err != nil {
-			slog.Error("error in ContainerWait()", slog.String("error", err.Error()))
-			return "", err
+// setCustomValue casts the value to the type of the field and sets it, it returns true if
+// the field has changed
+func setCustomValue(customs map[string]interface{}, field, valueType string, value interface{}) bool {
+	hasUpdate := false
+	switch valueType {
+	case "string":
+		r := cast.ToString(value)
+		if v, ok := customs[field]; !ok || v != r {
+			hasUpdate = true
+			customs[field] = r
+		}
+	case "number":
+		r := cast.ToFloat64(value)
+		if v, ok := customs[field]; !ok || v != r {
+			hasUpdate = true
+			customs[field] = r
+		}
+	case "boolean":
+		r := cast.ToBool(value)
+		if v, ok := customs[field]; !ok || v != r {
+			hasUpdate = true
+			customs[field] = r
+		}
+	case "array":
+		var arr []string
+		if a, ok := value.([]interface{}); ok {
+			arr = cast.ToStringSlice(a)
+		} else {
+			json.Unmarshal([]byte(cast.ToString(value)), &arr)
+		}
+		if v, ok := customs[field]; !ok || v != &arr {
+			hasUpdate = true
+			customs[field] = arr
 		}
-	case <-statusCh:
 	}
+	return hasUpdate
+}
 
-	out, err := cli.ContainerLogs(app.ctx, resp.ID, container.LogsOptions{ShowStdout: true})
+// runSingleCustom runs the custom hook for the repo, or all of them in batch mode, and
+// returns the last line of stdout
+func (app *GitSecurityApp) runSingleCustom(custom config.Custom, repo string, envs []config.EnvKeyValue) (string, error) {
+	run, job := customJob(custom, repo, envs)
+	result, err := app.runHook(run, job, custom.HookLimits, custom.HookImage)
 	if err != nil {
-		slog.Error("error in ContainerLogs()", slog.String("error", err.Error()))
 		return "", err
 	}
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(out)
-
-	sc := bufio.NewScanner(buf)
-	b := make([]byte, 0, 1024*1024)
-	sc.Buffer(b, 102400*1024)
-	var line string
-	for sc.Scan() {
-		line = sc.Text()
-	}
-	if err := sc.Err(); err != nil {
-		slog.Error("error in Scan()", slog.String("error", err.Error()))
+	line, err := lastLine(result.Stdout)
+	if err != nil {
 		return "", err
 	}
-
-	slog.Debug("container output",
-		slog.String("output", buf.String()),
+	slog.Debug("custom output",
+		slog.String("stdout", result.Stdout),
+		slog.String("stderr", result.Stderr),
 		slog.String("last line", line),
+		slog.Int("exit code", result.ExitCode),
 	)
 	return line, nil
 }
 
-func getCustomHookID(c *config.Custom) string {
-	return fmt.Sprintf("%s:%s:%s:%s", c.Field, c.Image, c.Command, c.Pattern)
+// customJob returns the run and the job of the custom hook for the repo
+func customJob(custom config.Custom, repo string, envs []config.EnvKeyValue) (*db.HookRun, *executor.Job) {
+	return &db.HookRun{
+			HookType: db.HookTypeCustom,
+			HookID:   custom.ID,
+			Repo:     repo,
+			Executor: custom.Executor,
+		},
+		&executor.Job{
+			Image:     custom.Image,
+			Command:   custom.Command,
+			Envs:      envs,
+			PlainEnvs: customPlainEnvs(custom),
+		}
+}
+
+// customRepoEnvs returns the envs of the hook for the repo, with the values of the custom
+// fields it depends on and the repo in GIT_REPO_JSON if the hook asks for it
+func customRepoEnvs(custom config.Custom, repo *gh.Repository, envs []config.EnvKeyValue) ([]config.EnvKeyValue, error) {
+	repoEnvs := []config.EnvKeyValue{
+		{
+			Key:   "GIT_REPO",
+			Value: repo.NameWithOwner,
+		},
+	}
+	for _, field := range custom.DependsOn {
+		var value string
+		if v, ok := repo.Customs[field]; ok {
+			var err error
+			if value, err = customEnvValue(v); err != nil {
+				return nil, err
+			}
+		}
+		repoEnvs = append(repoEnvs, config.EnvKeyValue{
+			Key:   config.CustomEnvName(field),
+			Value: value,
+		})
+	}
+	if custom.RepoJSON {
+		b, err := json.Marshal(repo)
+		if err != nil {
+			return nil, err
+		}
+		repoEnvs = append(repoEnvs, config.EnvKeyValue{
+			Key:   "GIT_REPO_JSON",
+			Value: string(b),
+		})
+	}
+	return append(repoEnvs, envs...), nil
+}
+
+// customEnvValue returns the strings as they are and the other values in JSON
+func customEnvValue(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// customPlainEnvs are the envs of the hook that aren't secrets
+func customPlainEnvs(custom config.Custom) []string {
+	plainEnvs := []string{"GIT_REPO", "GIT_REPO_JSON"}
+	for _, field := range custom.DependsOn {
+		plainEnvs = append(plainEnvs, config.CustomEnvName(field))
+	}
+	return plainEnvs
 }
@@ -0,0 +1,281 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/executor"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+func TestRunCustom(t *testing.T) {
+	teardown, dbw, _ := db.SetupDBForTest(t)
+	defer teardown()
+
+	app := &GitSecurityApp{
+		ctx:       context.Background(),
+		opts:      &Opts{Executor: executor.Subprocess, HookTimeout: time.Minute, HookParallelism: 1},
+		dbw:       dbw,
+		executors: map[string]executor.Executor{executor.Subprocess: executor.NewSubprocessExecutor()},
+	}
+	for i := 0; i < 4; i++ {
+		repo := gh.Repository{GqlRepository: &gh.GqlRepository{
+			ID:            fmt.Sprintf("repo%d", i),
+			NameWithOwner: fmt.Sprintf("org/repo%d", i),
+		}}
+		_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+		require.Nil(t, err)
+	}
+
+	// the repos run in parallel, the timed out ones get the error value
+	custom := config.Custom{
+		ID:         primitive.NewObjectID(),
+		Pattern:    "org/*",
+		Command:    `sh -c 'if [ "$GIT_REPO" = org/repo3 ]; then sleep 5; fi; echo ok'`,
+		ValueType:  "string",
+		Field:      "status",
+		ErrorValue: "error",
+		Enabled:    true,
+		HookLimits: config.HookLimits{Timeout: 1, Parallelism: 4},
+	}
+	start := time.Now()
+	require.Nil(t, app.runCustom(custom, nil))
+	assert.Less(t, time.Since(start), 4*time.Second)
+
+	repos, err := dbw.ReadRepositories(bson.D{})
+	require.Nil(t, err)
+	require.Equal(t, 4, len(repos))
+	for _, repo := range repos {
+		if repo.NameWithOwner == "org/repo3" {
+			assert.Equal(t, "error", repo.Customs["status"])
+		} else {
+			assert.Equal(t, "ok", repo.Customs["status"])
+		}
+	}
+
+	runs, err := dbw.ReadHookRuns(bson.D{{Key: "timed_out", Value: true}}, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(runs))
+	assert.Equal(t, "org/repo3", runs[0].Repo)
+	assert.Equal(t, "timed out after 1s", runs[0].Error)
+
+	// only the repos given run
+	custom.Command = "echo updated"
+	require.Nil(t, app.runCustom(custom, []string{"org/repo1"}))
+	repos, err = dbw.ReadRepositories(bson.D{{Key: "full_name", Value: "org/repo1"}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(repos))
+	assert.Equal(t, "updated", repos[0].Customs["status"])
+	repos, err = dbw.ReadRepositories(bson.D{{Key: "full_name", Value: "org/repo0"}})
+	require.Nil(t, err)
+	assert.Equal(t, "ok", repos[0].Customs["status"])
+
+	// the repos not matched by the filters get the default value
+	custom.Pattern = ""
+	custom.Filters = []config.Filter{{Field: "full_name", Values: []interface{}{"org/repo2"}}}
+	custom.DefaultValue = "skipped"
+	custom.Command = "echo filtered"
+	require.Nil(t, app.runCustom(custom, nil))
+	customs := readCustoms(t, dbw)
+	assert.Equal(t, "filtered", customs["org/repo2"].(map[string]interface{})["status"])
+	assert.Equal(t, "skipped", customs["org/repo0"].(map[string]interface{})["status"])
+
+	// the custom fields set while the hook runs aren't reverted
+	repos, err = dbw.ReadRepositories(bson.D{{Key: "full_name", Value: "org/repo2"}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(repos))
+	_, err = dbw.UpdateRepository(repos[0].ID, bson.D{{Key: "$set", Value: bson.D{{Key: "customs.team", Value: "payments"}}}}, false)
+	require.Nil(t, err)
+	custom.Command = "echo refreshed"
+	assert.True(t, app.runCustomForRepo(custom, repos[0], true, nil, nil, false))
+	customs = readCustoms(t, dbw)
+	assert.Equal(t, "refreshed", customs["org/repo2"].(map[string]interface{})["status"])
+	assert.Equal(t, "payments", customs["org/repo2"].(map[string]interface{})["team"])
+}
+
+func TestRunCustomStructured(t *testing.T) {
+	teardown, dbw, _ := db.SetupDBForTest(t)
+	defer teardown()
+
+	app := &GitSecurityApp{
+		ctx:       context.Background(),
+		opts:      &Opts{Executor: executor.Subprocess, HookTimeout: time.Minute, HookParallelism: 1},
+		dbw:       dbw,
+		executors: map[string]executor.Executor{executor.Subprocess: executor.NewSubprocessExecutor()},
+	}
+	for i := 0; i < 3; i++ {
+		repo := gh.Repository{GqlRepository: &gh.GqlRepository{
+			ID:            fmt.Sprintf("repo%d", i),
+			NameWithOwner: fmt.Sprintf("org/repo%d", i),
+		}}
+		_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+		require.Nil(t, err)
+	}
+	outputs := []config.CustomOutput{
+		{Key: "lang", Field: "language", ValueType: "string", DefaultValue: "none", ErrorValue: "error"},
+		{Key: "vulns", Field: "vulnerabilities", ValueType: "number", DefaultValue: 0, ErrorValue: -1},
+		{Key: "tags", Field: "tags", ValueType: "array", DefaultValue: "[]", ErrorValue: "[]"},
+	}
+
+	// every key is written to its own field, the missing keys get the default value and the
+	// invalid objects the error values
+	custom := config.Custom{
+		ID:      primitive.NewObjectID(),
+		Pattern: "org/*",
+		Command: `sh -c 'if [ "$GIT_REPO" = org/repo2 ]; then echo oops; else echo "{\"lang\": \"go\", \"vulns\": 3}"; fi'`,
+		Outputs: outputs,
+		Enabled: true,
+	}
+	require.Nil(t, app.runCustom(custom, nil))
+	customs := readCustoms(t, dbw)
+	assert.Equal(t, map[string]interface{}{"language": "go", "vulnerabilities": 3.0, "tags": bson.A{}}, customs["org/repo0"])
+	assert.Equal(t, map[string]interface{}{"language": "error", "vulnerabilities": -1.0, "tags": bson.A{}}, customs["org/repo2"])
+
+	// in batch mode the hook prints an object per repo
+	custom.BatchMode = true
+	custom.Command = `echo '{"org/repo0": {"lang": "rust", "tags": ["a", "b"]}, "org/repo1": "oops"}'`
+	require.Nil(t, app.runCustom(custom, nil))
+	customs = readCustoms(t, dbw)
+	assert.Equal(t, map[string]interface{}{"language": "rust", "vulnerabilities": 0.0, "tags": bson.A{"a", "b"}}, customs["org/repo0"])
+	assert.Equal(t, map[string]interface{}{"language": "error", "vulnerabilities": -1.0, "tags": bson.A{}}, customs["org/repo1"])
+	assert.Equal(t, map[string]interface{}{"language": "none", "vulnerabilities": 0.0, "tags": bson.A{}}, customs["org/repo2"])
+}
+
+func readCustoms(t *testing.T, dbw db.Database) map[string]interface{} {
+	repos, err := dbw.ReadRepositories(bson.D{})
+	require.Nil(t, err)
+	customs := make(map[string]interface{})
+	for _, repo := range repos {
+		customs[repo.NameWithOwner] = repo.Customs
+	}
+	return customs
+}
+
+func TestRunCustomDependencies(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	app := &GitSecurityApp{
+		ctx:       context.Background(),
+		opts:      &Opts{Executor: executor.Subprocess, HookTimeout: time.Minute, HookParallelism: 1},
+		db:        mdb,
+		dbw:       dbw,
+		executors: map[string]executor.Executor{executor.Subprocess: executor.NewSubprocessExecutor()},
+	}
+	repo := gh.Repository{GqlRepository: &gh.GqlRepository{ID: "repo", NameWithOwner: "org/repo"}}
+	_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+	require.Nil(t, err)
+
+	// the hooks are read in the reverse order of their dependencies, the cycle is left out
+	customs := []interface{}{
+		config.Custom{
+			Pattern:   "org/*",
+			Command:   `sh -c 'if [ "$GIT_CUSTOM_IS_PRODUCTION" = true ] && [ -n "$GIT_REPO_JSON" ]; then echo yes; else echo no; fi'`,
+			ValueType: "string",
+			Field:     "needs_pentest",
+			DependsOn: []string{"is_production"},
+			RepoJSON:  true,
+			Enabled:   true,
+		},
+		config.Custom{
+			Pattern:   "org/*",
+			Command:   "echo true",
+			ValueType: "boolean",
+			Field:     "is_production",
+			Enabled:   true,
+		},
+		config.Custom{Field: "a", DependsOn: []string{"b"}, Enabled: true},
+		config.Custom{Field: "b", DependsOn: []string{"a"}, Enabled: true},
+	}
+	_, err = mdb.Collection("customs").InsertMany(app.ctx, customs)
+	require.Nil(t, err)
+
+	hooks, err := app.readScheduledCustoms()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(hooks))
+	require.Nil(t, app.runScheduledHooks(db.HookTypeCustom, hooks))
+
+	repos, err := dbw.ReadRepositories(bson.D{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(repos))
+	assert.Equal(t, true, repos[0].Customs["is_production"])
+	assert.Equal(t, "yes", repos[0].Customs["needs_pentest"])
+
+	// the cycles are refused
+	var saved []config.Custom
+	cursor, err := mdb.Collection("customs").Find(app.ctx, bson.D{})
+	require.Nil(t, err)
+	require.Nil(t, cursor.All(app.ctx, &saved))
+	production := saved[1]
+	production.DependsOn = []string{"needs_pentest"}
+	assert.ErrorContains(t, production.ValidateDependencies(saved), "dependency cycle")
+	production.DependsOn = []string{"unknown"}
+	assert.ErrorContains(t, production.ValidateDependencies(saved), "isn't written by another hook")
+	production.DependsOn = nil
+	assert.Nil(t, production.ValidateDependencies(saved))
+}
+
+func TestRunCustomCache(t *testing.T) {
+	teardown, dbw, _ := db.SetupDBForTest(t)
+	defer teardown()
+
+	app := &GitSecurityApp{
+		ctx:       context.Background(),
+		opts:      &Opts{Executor: executor.Subprocess, HookTimeout: time.Minute, HookParallelism: 1},
+		dbw:       dbw,
+		executors: map[string]executor.Executor{executor.Subprocess: executor.NewSubprocessExecutor()},
+	}
+	repo := gh.Repository{GqlRepository: &gh.GqlRepository{ID: "repo", NameWithOwner: "org/repo"}}
+	repo.DefaultBranchRef.Target.Commit.Oid = "a"
+	_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+	require.Nil(t, err)
+
+	// the hook prints how many times it ran
+	count := fmt.Sprintf("%s/count", t.TempDir())
+	custom := config.Custom{
+		ID:          primitive.NewObjectID(),
+		Pattern:     "org/*",
+		Command:     fmt.Sprintf(`sh -c 'echo >> %s; wc -l < %s'`, count, count),
+		ValueType:   "number",
+		Field:       "runs",
+		Enabled:     true,
+		OnlyChanged: true,
+	}
+	runs := func() interface{} {
+		require.Nil(t, app.runCustom(custom, nil))
+		repos, err := dbw.ReadRepositories(bson.D{})
+		require.Nil(t, err)
+		return repos[0].Customs["runs"]
+	}
+	assert.Equal(t, 1.0, runs())
+	assert.Equal(t, 1.0, runs())
+
+	// a new head commit runs it again
+	_, err = dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: bson.M{"default_branch.target.commit.oid": "b"}}}, false)
+	require.Nil(t, err)
+	assert.Equal(t, 2.0, runs())
+	assert.Equal(t, 2.0, runs())
+
+	// the invalidation forces a run
+	require.Nil(t, dbw.DeleteHookCache(custom.ID, []string{"org/repo"}))
+	assert.Equal(t, 3.0, runs())
+
+	// with a TTL, the changes don't run it until the TTL is over
+	custom.OnlyChanged = false
+	custom.CacheTTL = 3600
+	_, err = dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: bson.M{"default_branch.target.commit.oid": "c"}}}, false)
+	require.Nil(t, err)
+	assert.Equal(t, 3.0, runs())
+	custom.CacheTTL = 1
+	time.Sleep(time.Second)
+	assert.Equal(t, 4.0, runs())
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+const (
+	// eventAutomationsCursor is the changelog cursor of the event-driven automations
+	eventAutomationsCursor = "automations"
+	// changelogEventsBatch is the number of changes read from the changelog at once
+	changelogEventsBatch = 1000
+	// changelogEventsLag leaves the changes being recorded the time to be inserted
+	changelogEventsLag = 5 * time.Second
+	// changelogEventsInterval is the wait between the reads of the changelog
+	changelogEventsInterval = 5 * time.Second
+)
+
+// changelogEvent is a change recorded in the changelog with the repo after the change
+type changelogEvent struct {
+	repo  gh.Repository
+	entry db.ChangeLog
+}
+
+// runEventAutomations runs the event-driven automations on the changes recorded in the
+// changelog after their cursor. The cursor is kept in the database so that the changes
+// recorded while the app was down are run at the next start, it starts from now the first
+// time. Each batch is claimed by a single replica before it runs, the changes of a batch
+// aren't run if the app stops while running them.
+func (app *GitSecurityApp) runEventAutomations() {
+	if err := app.dbw.CreateChangelogCursor(eventAutomationsCursor, time.Now()); err != nil {
+		slog.Error("error in app.dbw.CreateChangelogCursor()", slog.String("error", err.Error()))
+	}
+	for {
+		n, err := app.runChangelogEvents(time.Now().Add(-changelogEventsLag))
+		if err != nil {
+			slog.Error("error in app.runChangelogEvents()", slog.String("error", err.Error()))
+		}
+		if app.ctx.Err() != nil {
+			return
+		}
+		// the next batch is read right away
+		if err == nil && n == changelogEventsBatch {
+			continue
+		}
+
+		select {
+		case <-app.ctx.Done():
+			return
+		case <-time.After(changelogEventsInterval):
+		}
+	}
+}
+
+// runChangelogEvents claims the next batch of changes recorded before the time and runs the
+// automations on them. It returns the number of changes claimed.
+func (app *GitSecurityApp) runChangelogEvents(before time.Time) (int, error) {
+	entries, err := app.dbw.ClaimChangelogAfter(eventAutomationsCursor, before, changelogEventsBatch)
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+	events, err := app.changelogEvents(entries)
+	if err != nil {
+		return len(entries), err
+	}
+	// the failed runs are recorded
+	if err := app.runAutomationsForEvents(events); err != nil {
+		slog.Error("error in app.runAutomationsForEvents()", slog.String("error", err.Error()))
+	}
+	return len(entries), nil
+}
+
+// changelogEvents returns the changes with their repo as it is now, the deleted repos are
+// rebuilt from their changes
+func (app *GitSecurityApp) changelogEvents(entries []*db.ChangeLog) ([]changelogEvent, error) {
+	repoIDs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		repoIDs = append(repoIDs, entry.RepoID)
+	}
+	repos, err := app.dbw.ReadRepositories(bson.D{{Key: "id", Value: bson.M{"$in": repoIDs}}})
+	if err != nil {
+		return nil, err
+	}
+	reposByID := make(map[string]*gh.Repository, len(repos))
+	for _, repo := range repos {
+		reposByID[repo.ID] = repo
+	}
+
+	events := make([]changelogEvent, 0, len(entries))
+	for _, entry := range entries {
+		repo, ok := reposByID[entry.RepoID]
+		if !ok {
+			repo = &gh.Repository{
+				GqlRepository: &gh.GqlRepository{
+					ID:            entry.RepoID,
+					Name:          entry.Name,
+					NameWithOwner: entry.NameWithOwner,
+				},
+				GitHubHost:       entry.GitHubHost,
+				RepoOwnerID:      entry.RepoOwnerID,
+				RepoOwner:        entry.RepoOwner,
+				RepoOwnerContact: entry.RepoOwnerContact,
+			}
+			repo.Owner.Login = entry.Owner.Login
+		}
+		events = append(events, changelogEvent{repo: *repo, entry: *entry})
+	}
+	return events, nil
+}
+
+func (app *GitSecurityApp) runAutomationsForEvents(events []changelogEvent) error {
+	cursor, err := app.db.Collection("automations").Find(app.ctx, bson.D{{Key: "enabled", Value: true}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(app.ctx)
+	var automations []config.Automation
+	if err := cursor.All(app.ctx, &automations); err != nil {
+		return err
+	}
+
+	for _, automation := range automations {
+		if !automation.EventDriven() || !app.automationRunnable(automation) {
+			continue
+		}
+
+		// the changes applied by the actions of the automation don't run it again
+		var matched []changelogEvent
+		for _, event := range events {
+			if event.entry.Actor != automationActor(automation) &&
+				automation.MatchEvent(event.entry.Field, event.entry.Op, event.entry.From, event.entry.To) &&
+				proceedWithRightCondition(&event.repo, automation) {
+				matched = append(matched, event)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		// the filters are checked on the current repos, the deleted ones don't match
+		if len(automation.Filters) > 0 {
+			repoNames := make([]string, 0, len(matched))
+			for _, event := range matched {
+				repoNames = append(repoNames, event.repo.NameWithOwner)
+			}
+			targeted, err := app.targetedRepos(repoNames, automation.Filters)
+			if err != nil {
+				return err
+			}
+			matched = slices.DeleteFunc(matched, func(event changelogEvent) bool {
+				_, ok := targeted[event.repo.ID]
+				return !ok
+			})
+			if len(matched) == 0 {
+				continue
+			}
+		}
+		slog.Info("start event-driven automation",
+			slog.String("id", automation.ID.Hex()),
+			slog.Int("events", len(matched)),
+		)
+
+		envs, err := app.decryptEnvs(automation.Envs)
+		if err != nil {
+			return err
+		}
+
+		g := new(errgroup.Group)
+		g.SetLimit(app.hookParallelism(automation.HookLimits))
+		for _, event := range matched {
+			g.Go(func() error {
+				if app.ctx.Err() != nil {
+					return nil
+				}
+				app.runAutomationForRepo(automation, &event.repo, &event.entry, envs)
+				return nil
+			})
+		}
+		g.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/executor"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+func TestRunAutomationsForEvents(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	app := &GitSecurityApp{
+		ctx:       context.Background(),
+		opts:      &Opts{Executor: executor.Subprocess, HookTimeout: time.Minute, HookParallelism: 1},
+		db:        mdb,
+		dbw:       dbw,
+		executors: map[string]executor.Executor{executor.Subprocess: executor.NewSubprocessExecutor()},
+	}
+	require.Nil(t, dbw.CreateChangelogCursor(eventAutomationsCursor, time.Now().Add(-time.Minute)))
+
+	automations := []interface{}{
+		config.Automation{
+			Pattern: "org/*",
+			Command: `sh -c 'echo "$GIT_CHANGE_FIELD:$GIT_CHANGE_OP:$GIT_CHANGE_FROM:$GIT_CHANGE_TO"'`,
+			Enabled: true,
+			Events:  []config.AutomationEvent{{Field: "RepoOwner", To: "team-*"}},
+		},
+		config.Automation{
+			Pattern: "org/*",
+			Command: "echo new",
+			Enabled: true,
+			Events:  []config.AutomationEvent{{Field: db.ChangelogNewRepo}},
+		},
+		config.Automation{
+			Pattern: "org/*",
+			Command: "echo created",
+			Enabled: true,
+			// the owner changes are updates
+			Events: []config.AutomationEvent{{Field: "RepoOwner", Op: db.ChangelogOpCreate}},
+		},
+		config.Automation{
+			Pattern: "org/*",
+			Command: "echo scheduled",
+			Enabled: true,
+		},
+	}
+	_, err := mdb.Collection("automations").InsertMany(app.ctx, automations)
+	require.Nil(t, err)
+
+	repo := gh.Repository{GqlRepository: &gh.GqlRepository{ID: "repo", NameWithOwner: "org/repo"}}
+	_, err = dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+	require.Nil(t, err)
+	for _, owner := range []string{"alice", "team-a"} {
+		_, err = dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: bson.M{"repo_owner": owner}}}, false)
+		require.Nil(t, err)
+	}
+
+	// the repo creation and the 2 owner changes are read once
+	n, err := app.runChangelogEvents(time.Now().Add(time.Second))
+	require.Nil(t, err)
+	assert.Equal(t, 3, n)
+	n, err = app.runChangelogEvents(time.Now().Add(time.Second))
+	require.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	runs, err := dbw.ReadHookRuns(bson.D{}, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(runs))
+	var outputs []string
+	for _, r := range runs {
+		run, err := dbw.ReadHookRun(r.ID)
+		require.Nil(t, err)
+		assert.Equal(t, "org/repo", run.Repo)
+		outputs = append(outputs, run.Stdout)
+	}
+	assert.ElementsMatch(t, []string{"new\n", "RepoOwner:update:alice:team-a\n"}, outputs)
+}
+
+func TestChangelogEvents(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	app := &GitSecurityApp{
+		ctx:  context.Background(),
+		opts: &Opts{},
+		db:   mdb,
+		dbw:  dbw,
+	}
+	repo := gh.Repository{GqlRepository: &gh.GqlRepository{ID: "repo", NameWithOwner: "org/repo"}}
+	_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+	require.Nil(t, err)
+
+	// the changes before the cursor was created aren't read
+	require.Nil(t, dbw.CreateChangelogCursor(eventAutomationsCursor, time.Now().Add(time.Second)))
+	time.Sleep(time.Second)
+	_, err = dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: bson.M{"repo_owner": "alice"}}}, false)
+	require.Nil(t, err)
+	require.Nil(t, dbw.DeleteRepositories(time.Now().Add(time.Hour)))
+
+	// the recent changes wait for the lag
+	entries, err := dbw.ClaimChangelogAfter(eventAutomationsCursor, time.Now().Add(-time.Minute), changelogEventsBatch)
+	require.Nil(t, err)
+	assert.Empty(t, entries)
+
+	owner, err := dbw.ClaimChangelogAfter(eventAutomationsCursor, time.Now().Add(time.Second), 1)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(owner))
+	assert.Equal(t, "RepoOwner", owner[0].Field)
+
+	// the cursor is kept across the restarts
+	require.Nil(t, dbw.CreateChangelogCursor(eventAutomationsCursor, time.Now()))
+	deleted, err := dbw.ClaimChangelogAfter(eventAutomationsCursor, time.Now().Add(time.Second), changelogEventsBatch)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(deleted))
+	assert.Equal(t, db.ChangelogDeleteRepo, deleted[0].Field)
+
+	// the deleted repos are rebuilt from their changes
+	events, err := app.changelogEvents(append(owner, deleted...))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(events))
+	assert.Equal(t, "org/repo", events[1].repo.NameWithOwner)
+	assert.Equal(t, "alice", events[1].repo.RepoOwner)
+
+	// the replicas claim each change once
+	for i := range 5 {
+		_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: bson.M{"repo_owner": fmt.Sprintf("team-%d", i)}}}, true)
+		require.Nil(t, err)
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	claimed := []primitive.ObjectID{}
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entries, err := dbw.ClaimChangelogAfter(eventAutomationsCursor, time.Now().Add(time.Second), 2)
+			assert.Nil(t, err)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, entry := range entries {
+				claimed = append(claimed, entry.ID)
+			}
+		}()
+	}
+	wg.Wait()
+	for {
+		entries, err := dbw.ClaimChangelogAfter(eventAutomationsCursor, time.Now().Add(time.Second), 2)
+		require.Nil(t, err)
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			claimed = append(claimed, entry.ID)
+		}
+	}
+	log, err := dbw.ReadChangelog(bson.D{{Key: "_id", Value: bson.M{"$gt": deleted[0].ID}}})
+	require.Nil(t, err)
+	assert.Equal(t, len(log), len(claimed))
+	unique := make(map[primitive.ObjectID]bool)
+	for _, id := range claimed {
+		unique[id] = true
+	}
+	assert.Equal(t, len(claimed), len(unique))
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/executor"
+)
+
+// setupExecutors creates the executors the hooks can choose from, the Kubernetes one is only
+// available when running in a cluster. The subprocess one runs the commands on the host with
+// the access of the server, without the image allowlist, so it's only available when it's
+// the default executor or explicitly allowed.
+func (app *GitSecurityApp) setupExecutors() error {
+	registries, err := executor.NewRegistries(app.opts.ImageAllowlist, app.opts.RegistryAuthFile)
+	if err != nil {
+		return err
+	}
+	app.registries = registries
+	app.executors = map[string]executor.Executor{
+		executor.Docker: executor.NewDockerExecutor(),
+	}
+	if app.opts.Executor == executor.Subprocess || app.opts.AllowSubprocess {
+		app.executors[executor.Subprocess] = executor.NewSubprocessExecutor()
+	}
+	k, err := executor.NewKubernetesExecutor(app.opts.KubernetesNamespace)
+	if err != nil {
+		if app.opts.Executor == executor.Kubernetes {
+			return err
+		}
+		slog.Debug("kubernetes executor not available", slog.String("error", err.Error()))
+	} else {
+		app.executors[executor.Kubernetes] = k
+	}
+	if _, ok := app.executors[app.opts.Executor]; !ok {
+		return fmt.Errorf("error in the executor argument: %s", app.opts.Executor)
+	}
+	return nil
+}
+
+// executorNames returns the executors the hooks can choose from
+func (app *GitSecurityApp) executorNames() []string {
+	names := make([]string, 0, len(app.executors))
+	for _, name := range executor.Names() {
+		if _, ok := app.executors[name]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// executorName returns the executor chosen by the hook, or the global one
+func (app *GitSecurityApp) executorName(name string) string {
+	if name == "" {
+		return app.opts.Executor
+	}
+	return name
+}
+
+// getExecutor returns the executor chosen by the hook, or the global one
+func (app *GitSecurityApp) getExecutor(name string) (executor.Executor, error) {
+	name = app.executorName(name)
+	e, ok := app.executors[name]
+	if !ok {
+		return nil, fmt.Errorf("executor %s is not available", name)
+	}
+	return e, nil
+}
+
+// checkImage refuses the images out of the allowlist, and the pinned images whose tag points
+// to another digest now. The job runs the pinned digest, pulled with the credential of its
+// registry.
+func (app *GitSecurityApp) checkImage(ctx context.Context, job *executor.Job, image config.HookImage) error {
+	if err := app.registries.Allowed(job.Image); err != nil {
+		return err
+	}
+	if digest := image.PinnedDigest(); digest != "" {
+		if err := app.registries.CheckDigest(ctx, job.Image, digest); err != nil {
+			return err
+		}
+		pinned, err := executor.PinnedImage(job.Image, digest)
+		if err != nil {
+			return err
+		}
+		job.Image = pinned
+	}
+	job.RegistryAuth = app.registries.Auth(job.Image)
+	return nil
+}
+
+// requiresImage tells if the executor runs the command in a container image
+func (app *GitSecurityApp) requiresImage(name string) bool {
+	return app.executorName(name) != executor.Subprocess
+}
+
+// lastLine returns the last line of the output, it's the result of the custom hooks
+func lastLine(output string) (string, error) {
+	sc := bufio.NewScanner(strings.NewReader(output))
+	b := make([]byte, 0, 1024*1024)
+	sc.Buffer(b, 102400*1024)
+	var line string
+	for sc.Scan() {
+		line = sc.Text()
+	}
+	if err := sc.Err(); err != nil {
+		slog.Error("error in Scan()", slog.String("error", err.Error()))
+		return "", err
+	}
+	return line, nil
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/executor"
+)
+
+const (
+	redactedSecret = "[REDACTED]"
+	// minRedactedLength avoids redacting every occurrence of the very short env values
+	minRedactedLength = 4
+)
+
+// runHook runs the job with the executor of the hook and records the run in the history,
+// the env values that are secrets are redacted from the recorded logs. The job is killed
+// when the timeout of the hook is reached.
+func (app *GitSecurityApp) runHook(run *db.HookRun, job *executor.Job, limits config.HookLimits, image config.HookImage) (*executor.Result, error) {
+	result, err := app.executeHook(run, job, limits, image)
+	app.recordHookRun(run, job.Envs, job.PlainEnvs)
+	return result, err
+}
+
+// executeHook runs the job with the executor of the hook and fills the run, without
+// recording it. The images not allowed or whose pinned digest drifted aren't run, nor are
+// the invalid limits.
+func (app *GitSecurityApp) executeHook(run *db.HookRun, job *executor.Job, limits config.HookLimits, image config.HookImage) (*executor.Result, error) {
+	run.Executor = app.executorName(run.Executor)
+	run.Image = job.Image
+	job.CPUs = limits.CPUs
+	job.MemoryMB = limits.MemoryMB
+	job.NetworkMode = limits.NetworkMode
+
+	ctx := app.ctx
+	timeout := app.hookTimeout(limits)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(app.ctx, timeout)
+		defer cancel()
+	}
+
+	run.StartedAt = time.Now()
+	var result *executor.Result
+	// the hooks saved before the limits were validated
+	err := limits.Validate()
+	if err == nil && app.requiresImage(run.Executor) {
+		err = app.checkImage(ctx, job, image)
+	}
+	if err == nil {
+		result, err = app.runJob(ctx, run.Executor, job)
+	}
+	run.EndedAt = time.Now()
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", timeout)
+		run.TimedOut = true
+	}
+	if err != nil {
+		run.Error = err.Error()
+	} else {
+		run.Stdout = result.Stdout
+		run.Stderr = result.Stderr
+		run.ExitCode = result.ExitCode
+		run.ImageDigest = result.ImageDigest
+	}
+	return result, err
+}
+
+// recordHookRun redacts the env values that are secrets from the logs and records the run
+func (app *GitSecurityApp) recordHookRun(run *db.HookRun, envs []config.EnvKeyValue, plainEnvs []string) {
+	redactHookRun(run, envs, plainEnvs)
+	if err := app.dbw.CreateHookRun(run); err != nil {
+		slog.Error("error in app.dbw.CreateHookRun()", slog.String("error", err.Error()))
+	}
+}
+
+func (app *GitSecurityApp) runJob(ctx context.Context, executorName string, job *executor.Job) (*executor.Result, error) {
+	e, err := app.getExecutor(executorName)
+	if err != nil {
+		return nil, err
+	}
+	return e.Run(ctx, job)
+}
+
+// hookTimeout returns the timeout of the hook, or the global one
+func (app *GitSecurityApp) hookTimeout(limits config.HookLimits) time.Duration {
+	if limits.Timeout > 0 {
+		return time.Duration(limits.Timeout) * time.Second
+	}
+	return app.opts.HookTimeout
+}
+
+// hookParallelism returns how many runs of the hook can be done at once
+func (app *GitSecurityApp) hookParallelism(limits config.HookLimits) int {
+	if limits.Parallelism > 0 {
+		return limits.Parallelism
+	}
+	return max(app.opts.HookParallelism, 1)
+}
+
+// redactHookRun redacts the env values that are secrets from the logs of the run
+func redactHookRun(run *db.HookRun, envs []config.EnvKeyValue, plainEnvs []string) {
+	secrets := make([]string, 0)
+	for _, e := range envs {
+		if !slices.Contains(plainEnvs, strings.TrimSpace(e.Key)) && len(e.Value) >= minRedactedLength {
+			secrets = append(secrets, e.Value)
+		}
+	}
+	run.Stdout = redactSecrets(run.Stdout, secrets)
+	run.Stderr = redactSecrets(run.Stderr, secrets)
+	run.Error = redactSecrets(run.Error, secrets)
+}
+
+// redactSecrets replaces the secrets in the log, the longest ones first in case they overlap
+func redactSecrets(log string, secrets []string) string {
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+	for _, secret := range secrets {
+		log = strings.ReplaceAll(log, secret, redactedSecret)
+	}
+	return log
+}
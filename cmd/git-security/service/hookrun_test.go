@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/executor"
+)
+
+func TestRunSingleCustom(t *testing.T) {
+	teardown, dbw, _ := db.SetupDBForTest(t)
+	defer teardown()
+
+	app := &GitSecurityApp{
+		ctx:       context.Background(),
+		opts:      &Opts{Executor: executor.Subprocess},
+		dbw:       dbw,
+		executors: map[string]executor.Executor{executor.Subprocess: executor.NewSubprocessExecutor()},
+	}
+	custom := config.Custom{
+		ID:      primitive.NewObjectID(),
+		Command: `sh -c 'echo "token is $TOKEN" >&2; echo "$GIT_REPO"; echo 42'`,
+	}
+
+	// the result is the last line of stdout
+	result, err := app.runSingleCustom(custom, "org/repo", []config.EnvKeyValue{
+		{Key: "GIT_REPO", Value: "org/repo"},
+		{Key: "TOKEN", Value: "s3cr3t"},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "42", result)
+
+	// the run is recorded with the secrets redacted
+	runs, err := dbw.ReadHookRuns(bson.D{{Key: "hook_id", Value: custom.ID}}, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(runs))
+	assert.Equal(t, "org/repo", runs[0].Repo)
+	assert.Equal(t, executor.Subprocess, runs[0].Executor)
+	assert.False(t, runs[0].EndedAt.Before(runs[0].StartedAt))
+	run, err := dbw.ReadHookRun(runs[0].ID)
+	require.Nil(t, err)
+	assert.Equal(t, "org/repo\n42\n", run.Stdout)
+	assert.Equal(t, "token is [REDACTED]\n", run.Stderr)
+
+	// the failures to run are recorded too
+	custom.Command = "git-security-missing-command"
+	_, err = app.runSingleCustom(custom, "org/repo", nil)
+	assert.NotNil(t, err)
+	runs, err = dbw.ReadHookRuns(bson.D{{Key: "hook_id", Value: custom.ID}}, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(runs))
+	assert.NotEmpty(t, runs[0].Error)
+}
+
+type fakeExecutor struct {
+	jobs []*executor.Job
+}
+
+func (f *fakeExecutor) Run(ctx context.Context, job *executor.Job) (*executor.Result, error) {
+	f.jobs = append(f.jobs, job)
+	return &executor.Result{}, nil
+}
+
+func TestCheckImage(t *testing.T) {
+	registries, err := executor.NewRegistries([]string{"docker.io/library/alpine"}, "")
+	require.Nil(t, err)
+	fake := &fakeExecutor{}
+	app := &GitSecurityApp{
+		ctx:        context.Background(),
+		opts:       &Opts{Executor: executor.Docker},
+		executors:  map[string]executor.Executor{executor.Docker: fake},
+		registries: registries,
+	}
+	digest1, digest2 := "sha256:"+strings.Repeat("1", 64), "sha256:"+strings.Repeat("2", 64)
+	execute := func(image string, hookImage config.HookImage) (*db.HookRun, error) {
+		run := &db.HookRun{}
+		_, err := app.executeHook(run, &executor.Job{Image: image, Command: "true"}, config.HookLimits{}, hookImage)
+		return run, err
+	}
+
+	// the images out of the allowlist aren't run
+	run, err := execute("ubuntu", config.HookImage{})
+	assert.NotNil(t, err)
+	assert.Contains(t, run.Error, "allowlist")
+	assert.Empty(t, fake.jobs)
+
+	_, err = execute("alpine:3", config.HookImage{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(fake.jobs))
+	assert.Equal(t, "alpine:3", fake.jobs[0].Image)
+
+	// the pinned images run their digest, and not once it drifted
+	_, err = execute("alpine@"+digest1, config.HookImage{PinDigest: true, ImageDigest: digest1})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(fake.jobs))
+	assert.Equal(t, "docker.io/library/alpine@"+digest1, fake.jobs[1].Image)
+
+	run, err = execute("alpine@"+digest2, config.HookImage{PinDigest: true, ImageDigest: digest1})
+	assert.NotNil(t, err)
+	assert.Contains(t, run.Error, "drifted")
+	assert.Equal(t, 2, len(fake.jobs))
+
+	// nor are the hooks saved with the network of the host
+	run = &db.HookRun{}
+	_, err = app.executeHook(run, &executor.Job{Image: "alpine:3", Command: "true"}, config.HookLimits{NetworkMode: "host"}, config.HookImage{})
+	assert.NotNil(t, err)
+	assert.Contains(t, run.Error, "network")
+	assert.Equal(t, 2, len(fake.jobs))
+}
+
+func TestSetupExecutors(t *testing.T) {
+	// the subprocess executor runs on the host, it's only there when chosen
+	app := &GitSecurityApp{opts: &Opts{Executor: executor.Docker}}
+	require.Nil(t, app.setupExecutors())
+	assert.NotContains(t, app.executorNames(), executor.Subprocess)
+	_, err := app.getExecutor(executor.Subprocess)
+	assert.NotNil(t, err)
+
+	app = &GitSecurityApp{opts: &Opts{Executor: executor.Docker, AllowSubprocess: true}}
+	require.Nil(t, app.setupExecutors())
+	assert.Contains(t, app.executorNames(), executor.Subprocess)
+
+	app = &GitSecurityApp{opts: &Opts{Executor: executor.Subprocess}}
+	require.Nil(t, app.setupExecutors())
+	assert.Contains(t, app.executorNames(), executor.Subprocess)
+}
+
+func TestDeleteOldHookRuns(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	app := &GitSecurityApp{ctx: context.Background(), opts: &Opts{}, db: mdb, dbw: dbw}
+	require.Nil(t, dbw.CreateHookRun(&db.HookRun{
+		HookType:  "custom",
+		HookID:    primitive.NewObjectID(),
+		StartedAt: time.Now().Add(-time.Hour),
+	}))
+
+	// a retention of 0 keeps the runs forever
+	app.deleteOldData()
+	runs, err := dbw.ReadHookRuns(bson.D{}, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(runs))
+
+	app.opts.HookRunRetention = time.Minute
+	app.deleteOldData()
+	runs, err = dbw.ReadHookRuns(bson.D{}, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(runs))
+}
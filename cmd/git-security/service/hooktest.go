@@ -0,0 +1,176 @@
+package service
+
+import (
+	"encoding/json"
+	"maps"
+	"time"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/api"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+// TestCustom runs the custom hook for the repo, even if the hook doesn't target it, and
+// returns the values of the custom fields it would write. Nothing is recorded.
+func (app *GitSecurityApp) TestCustom(custom config.Custom, repo *gh.Repository) (*api.HookTestResult, error) {
+	targeted, err := app.testTargeted(repo, custom.Filters, custom.HasTarget() && custom.MatchPattern(repo.NameWithOwner))
+	if err != nil {
+		return nil, err
+	}
+	if custom.Envs, err = app.resolveSecretRefs(custom.Envs); err != nil {
+		return nil, err
+	}
+
+	// the batch mode hooks run for all the repos and give the result of each one
+	runRepo, envs := "", custom.Envs
+	if !custom.BatchMode {
+		runRepo = repo.NameWithOwner
+		if envs, err = customRepoEnvs(custom, repo, envs); err != nil {
+			return nil, err
+		}
+	}
+	run, job := customJob(custom, runRepo, envs)
+	test := &api.HookTestResult{Targeted: targeted}
+	result, err := app.executeHook(run, job, custom.HookLimits, custom.HookImage)
+
+	var value interface{}
+	failed, matched := err != nil, true
+	if !failed {
+		var line string
+		if line, err = lastLine(result.Stdout); err != nil {
+			failed = true
+			test.Errors = append(test.Errors, err.Error())
+		} else if custom.BatchMode {
+			test.Result = line
+			batchedResults := make(map[string]interface{})
+			if err := json.Unmarshal([]byte(line), &batchedResults); err != nil {
+				failed = true
+				test.Errors = append(test.Errors, err.Error())
+			}
+			value, matched = batchedResults[repo.NameWithOwner]
+		} else {
+			test.Result = line
+			value = line
+		}
+	}
+
+	values, err := customFieldValues(custom, value, failed, matched)
+	if err != nil {
+		test.Errors = append(test.Errors, err.Error())
+	}
+	customs := maps.Clone(repo.Customs)
+	if customs == nil {
+		customs = make(map[string]interface{})
+	}
+	test.Values = make(map[string]interface{})
+	for _, output := range custom.Fields() {
+		if setCustomValue(customs, output.Field, output.ValueType, values[output.Field]) {
+			test.Changed = append(test.Changed, output.Field)
+		}
+		test.Values[output.Field] = customs[output.Field]
+	}
+
+	redactHookRun(run, job.Envs, job.PlainEnvs)
+	test.HookRun = *run
+	return test, nil
+}
+
+// TestAutomation runs the automation for the repo, even if the automation doesn't target it,
+// and returns the actions it printed without applying them. The webhooks are only sent with
+// send, otherwise the request they would send is returned. Nothing is recorded.
+func (app *GitSecurityApp) TestAutomation(automation config.Automation, repo *gh.Repository, send bool) (*api.HookTestResult, error) {
+	targeted, err := app.testTargeted(repo, automation.Filters, automation.MatchRepo(repo.NameWithOwner, repo.RepoOwner))
+	if err != nil {
+		return nil, err
+	}
+	if automation.Envs, err = app.resolveSecretRefs(automation.Envs); err != nil {
+		return nil, err
+	}
+	test := &api.HookTestResult{Targeted: targeted}
+
+	if automation.IsWebhook() {
+		run := &db.HookRun{
+			HookType:  db.HookTypeAutomation,
+			HookID:    automation.ID,
+			Repo:      repo.NameWithOwner,
+			Executor:  webhookExecutor,
+			StartedAt: time.Now(),
+		}
+		if send {
+			err = app.postWebhook(run, automation, repo, nil, automation.Envs)
+		} else {
+			err = app.testWebhookRequest(test, automation, repo)
+		}
+		run.EndedAt = time.Now()
+		if err != nil {
+			run.Error = err.Error()
+		}
+		redactHookRun(run, automation.Envs, nil)
+		test.HookRun = *run
+		return test, nil
+	}
+
+	envs, err := automationEnvs(repo, nil, automation.Envs)
+	if err != nil {
+		return nil, err
+	}
+	run, job := automationJob(automation, repo.NameWithOwner, envs)
+	if result, err := app.executeHook(run, job, automation.HookLimits, automation.HookImage); err == nil {
+		actions, errs := parseAutomationActions(result.Stdout)
+		for _, action := range actions {
+			test.Actions = append(test.Actions, api.HookTestAction{
+				AutomationAction: action,
+				Permitted:        automation.Allows(action),
+			})
+		}
+		for _, err := range errs {
+			test.Errors = append(test.Errors, err.Error())
+		}
+	}
+
+	redactHookRun(run, job.Envs, job.PlainEnvs)
+	test.HookRun = *run
+	return test, nil
+}
+
+// testWebhookRequest renders the request of the webhook into the test without sending it,
+// the secrets of the envs are redacted
+func (app *GitSecurityApp) testWebhookRequest(test *api.HookTestResult, automation config.Automation, repo *gh.Repository) error {
+	req, err := app.renderWebhook(automation.Webhook, repo, nil, automation.Envs)
+	if err != nil {
+		return err
+	}
+	secrets := make([]string, 0)
+	for _, e := range automation.Envs {
+		if len(e.Value) >= minRedactedLength {
+			secrets = append(secrets, e.Value)
+		}
+	}
+	test.Request = &api.HookTestRequest{
+		URL:     redactSecrets(req.URL, secrets),
+		Headers: make(map[string]string, len(req.Headers)),
+		Payload: redactSecrets(req.Payload, secrets),
+	}
+	for k, v := range req.Headers {
+		test.Request.Headers[k] = redactSecrets(v, secrets)
+	}
+	return nil
+}
+
+// testTargeted tells if the scheduled runs of a hook matching the repo target it, the
+// archived repos are only targeted by the filters on is_archived
+func (app *GitSecurityApp) testTargeted(repo *gh.Repository, repoFilters []config.Filter, matched bool) (bool, error) {
+	if !matched {
+		return false, nil
+	}
+	filters, err := config.HookFilters([]string{repo.NameWithOwner}, repoFilters)
+	if err != nil {
+		return false, err
+	}
+	repos, err := app.dbw.ReadRepositories(filters)
+	if err != nil {
+		return false, err
+	}
+	return len(repos) > 0, nil
+}
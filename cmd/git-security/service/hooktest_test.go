@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/executor"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+func TestTestHooks(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	app := &GitSecurityApp{
+		ctx:       context.Background(),
+		opts:      &Opts{Executor: executor.Subprocess, HookTimeout: time.Minute, HookParallelism: 1},
+		db:        mdb,
+		dbw:       dbw,
+		executors: map[string]executor.Executor{executor.Subprocess: executor.NewSubprocessExecutor()},
+	}
+	repo := gh.Repository{
+		GqlRepository: &gh.GqlRepository{ID: "repo", NameWithOwner: "org/repo"},
+		Customs:       map[string]interface{}{"lang": "go"},
+	}
+	_, err := dbw.UpdateRepository(repo.ID, bson.D{{Key: "$set", Value: repo}}, true)
+	require.Nil(t, err)
+
+	custom := config.Custom{
+		Pattern: "other/*",
+		Command: `sh -c 'echo "checking $GIT_REPO with $TOKEN" >&2; echo "{\"lang\": \"go\", \"stars\": \"12\"}"'`,
+		Envs:    []config.EnvKeyValue{{Key: "TOKEN", Value: "secret-token"}},
+		Outputs: []config.CustomOutput{
+			{Key: "lang", Field: "lang", ValueType: "string"},
+			{Key: "stars", Field: "stars", ValueType: "number"},
+			{Key: "license", Field: "license", ValueType: "string", DefaultValue: "none"},
+		},
+	}
+	result, err := app.TestCustom(custom, &repo)
+	require.Nil(t, err)
+	assert.False(t, result.Targeted)
+	assert.Empty(t, result.Errors)
+	assert.Equal(t, "checking org/repo with [REDACTED]\n", result.Stderr)
+	assert.Equal(t, `{"lang": "go", "stars": "12"}`, result.Result)
+	assert.Equal(t, map[string]interface{}{"lang": "go", "stars": 12.0, "license": "none"}, result.Values)
+	assert.ElementsMatch(t, []string{"stars", "license"}, result.Changed)
+
+	automation := config.Automation{
+		Pattern: "org/*",
+		Command: `sh -c 'echo "::git-security:: {\"action\": \"add_note\", \"note\": \"hi\"}"; echo "::git-security:: {\"action\": \"assign_owner\", \"owner\": \"a\"}"; echo "::git-security:: oops"'`,
+		Permissions: []config.AutomationPermission{
+			{Action: config.ActionAddNote},
+		},
+	}
+	result, err = app.TestAutomation(automation, &repo, false)
+	require.Nil(t, err)
+	assert.True(t, result.Targeted)
+	require.Equal(t, 2, len(result.Actions))
+	assert.Equal(t, "hi", result.Actions[0].Note)
+	assert.True(t, result.Actions[0].Permitted)
+	assert.Equal(t, "a", result.Actions[1].Owner)
+	assert.False(t, result.Actions[1].Permitted)
+	assert.Equal(t, 1, len(result.Errors))
+
+	// the webhooks are rendered, and only sent with send
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	webhook := config.Automation{
+		Kind: config.AutomationKindWebhook,
+		Envs: []config.EnvKeyValue{{Key: "TOKEN", Value: "secret-token"}},
+		Webhook: config.AutomationWebhook{
+			URL:     server.URL,
+			Payload: `{"repo": "{{ .Repo.full_name }}"}`,
+			Headers: []config.EnvKeyValue{{Key: "Authorization", Value: "Bearer {{ .Env.TOKEN }}"}},
+		},
+	}
+	result, err = app.TestAutomation(webhook, &repo, false)
+	require.Nil(t, err)
+	assert.Equal(t, 0, calls)
+	assert.Empty(t, result.Error)
+	require.NotNil(t, result.Request)
+	assert.Equal(t, server.URL, result.Request.URL)
+	assert.Equal(t, `{"repo": "org/repo"}`, result.Request.Payload)
+	assert.Equal(t, "Bearer [REDACTED]", result.Request.Headers["Authorization"])
+
+	result, err = app.TestAutomation(webhook, &repo, true)
+	require.Nil(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Nil(t, result.Request)
+	assert.Equal(t, 200, result.ResponseStatus)
+
+	// nothing is recorded
+	runs, err := dbw.ReadHookRuns(bson.D{}, 10)
+	require.Nil(t, err)
+	assert.Empty(t, runs)
+	repos, err := dbw.ReadRepositories(bson.D{})
+	require.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"lang": "go"}, repos[0].Customs)
+	changelog, err := dbw.ReadChangelog(bson.D{{Key: "field", Value: db.ChangelogNote}})
+	require.Nil(t, err)
+	assert.Empty(t, changelog)
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/api"
+)
+
+// CreateLocalUser creates a basic auth user with the roles from the CLI
+func CreateLocalUser(opts *Opts, username, password string, roles []string) error {
+	return runWithDB(opts, func(app *GitSecurityApp) error {
+		return api.CreateLocalUser(app.ctx, app.db, username, password, roles)
+	})
+}
+
+// ResetLocalUserPassword resets the password of a basic auth user from the CLI
+func ResetLocalUserPassword(opts *Opts, username, password string) error {
+	return runWithDB(opts, func(app *GitSecurityApp) error {
+		return api.ResetLocalUserPassword(app.ctx, app.db, username, password)
+	})
+}
+
+// runWithDB connects to the database (starting the embedded FerretDB if needed),
+// runs the function and tears everything down
+func runWithDB(opts *Opts, fn func(app *GitSecurityApp) error) error {
+	if opts.DB != "sqlite" && opts.DB != "pg" && opts.DB != "mongo" {
+		return fmt.Errorf("error in the db argument: %s", opts.DB)
+	}
+	app := New(opts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app.ctx = ctx
+
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	if err := app.connect(ctx, &wg); err != nil {
+		return err
+	}
+	return fn(app)
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
+)
+
+// encryptedCollections are the collections of the hooks with encrypted envs
+var encryptedCollections = []string{"customs", "automations"}
+
+// rotateKeyAttempts is the number of times the envs of a hook edited during the rotation are
+// read again
+const rotateKeyAttempts = 5
+
+// encryptedHook is a hook with its envs as stored, to only replace the envs still the same
+type encryptedHook struct {
+	ID   primitive.ObjectID `bson:"_id"`
+	Envs bson.RawValue      `bson:"envs"`
+}
+
+// RotatedEnv is an env value re-encrypted by the key rotation, or that failed to be
+type RotatedEnv struct {
+	Collection string
+	HookID     primitive.ObjectID
+	Key        string
+	FromKeyID  string
+	Error      string
+}
+
+// RotateKey re-encrypts with the primary key of the keyring the stored env values encrypted
+// by the other keys, from the CLI
+func RotateKey(opts *Opts) ([]RotatedEnv, error) {
+	var rotated []RotatedEnv
+	err := runWithDB(opts, func(app *GitSecurityApp) error {
+		var err error
+		if app.key, err = security.ParseKeyring(opts.Key, opts.Keyring); err != nil {
+			return err
+		}
+		rotated, err = app.rotateKey()
+		return err
+	})
+	return rotated, err
+}
+
+// rotateKey re-encrypts the env values in place, the values that can't be decrypted are
+// reported and left as they are
+func (app *GitSecurityApp) rotateKey() ([]RotatedEnv, error) {
+	rotated := make([]RotatedEnv, 0)
+	for _, collection := range encryptedCollections {
+		cursor, err := app.db.Collection(collection).Find(app.ctx, bson.D{})
+		if err != nil {
+			return rotated, err
+		}
+		var hooks []encryptedHook
+		if err := cursor.All(app.ctx, &hooks); err != nil {
+			return rotated, err
+		}
+
+		for _, hook := range hooks {
+			r, err := app.rotateHook(collection, hook)
+			rotated = append(rotated, r...)
+			if err != nil {
+				return rotated, err
+			}
+		}
+	}
+	return rotated, nil
+}
+
+// rotateHook re-encrypts the envs of the hook. The envs are only replaced if they are still the
+// ones read, the envs edited meanwhile from the API are read again and rotated anew.
+func (app *GitSecurityApp) rotateHook(collection string, hook encryptedHook) ([]RotatedEnv, error) {
+	id := hook.ID
+	for range rotateKeyAttempts {
+		if hook.Envs.Type != bson.TypeArray {
+			return nil, nil
+		}
+		var envs []config.EnvKeyValue
+		if err := hook.Envs.Unmarshal(&envs); err != nil {
+			return nil, err
+		}
+		rotated, changed := app.rotateEnvs(collection, id, envs)
+		if !changed {
+			return rotated, nil
+		}
+		res, err := app.db.Collection(collection).UpdateOne(
+			app.ctx,
+			bson.D{{Key: "_id", Value: id}, {Key: "envs", Value: hook.Envs}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "envs", Value: envs}}}},
+		)
+		if err != nil {
+			return nil, err
+		}
+		if res.MatchedCount > 0 {
+			return rotated, nil
+		}
+
+		hook = encryptedHook{}
+		if err := app.db.Collection(collection).FindOne(
+			app.ctx,
+			bson.D{{Key: "_id", Value: id}},
+		).Decode(&hook); err != nil {
+			// the hook was deleted meanwhile
+			if err == mongo.ErrNoDocuments {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("the envs of the hook %s in %s kept changing, rotate the key again", id.Hex(), collection)
+}
+
+// rotateEnvs re-encrypts in the envs the values encrypted by the other keys, and tells if any
+// of them changed
+func (app *GitSecurityApp) rotateEnvs(collection string, id primitive.ObjectID, envs []config.EnvKeyValue) ([]RotatedEnv, bool) {
+	rotated := make([]RotatedEnv, 0)
+	changed := false
+	for idx, env := range envs {
+		if env.Ref != "" || env.Value == "" || app.key.Current(env.Value) {
+			continue
+		}
+		r := RotatedEnv{
+			Collection: collection,
+			HookID:     id,
+			Key:        env.Key,
+			FromKeyID:  security.KeyID(env.Value),
+		}
+		if r.FromKeyID == "" {
+			r.FromKeyID = security.LegacyKeyID
+		}
+		plaintext, err := app.key.Decrypt(env.Value)
+		if err == nil {
+			envs[idx].Value, err = app.key.Encrypt(plaintext)
+		}
+		if err != nil {
+			r.Error = err.Error()
+		} else {
+			changed = true
+		}
+		rotated = append(rotated, r)
+	}
+	return rotated, changed
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
+)
+
+func TestRotateKey(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	legacy := []byte("0123456789abcdef0123456789abcdef")
+	oldKey := security.Key{ID: "old", Secret: []byte("abcdef0123456789abcdef0123456789")}
+	newKey := security.Key{ID: "new", Secret: []byte("456789abcdef0123456789abcdef0123")}
+	old, err := security.NewKeyring(oldKey)
+	require.Nil(t, err)
+	gone, err := security.NewKeyring(security.Key{ID: "gone", Secret: legacy})
+	require.Nil(t, err)
+
+	// the values of the single key, of the old key of the keyring, of a lost key
+	fromLegacy, err := security.Encrypt("legacy", legacy)
+	require.Nil(t, err)
+	fromOld, err := old.Encrypt("old")
+	require.Nil(t, err)
+	fromGone, err := gone.Encrypt("gone")
+	require.Nil(t, err)
+	customID, automationID := primitive.NewObjectID(), primitive.NewObjectID()
+	_, err = mdb.Collection("customs").InsertOne(context.Background(), config.Custom{
+		ID: customID,
+		Envs: []config.EnvKeyValue{
+			{Key: "LEGACY", Value: fromLegacy},
+			{Key: "REF", Ref: "env:HOOK_TOKEN"},
+			{Key: "EMPTY"},
+		},
+	})
+	require.Nil(t, err)
+	_, err = mdb.Collection("automations").InsertOne(context.Background(), config.Automation{
+		ID: automationID,
+		Envs: []config.EnvKeyValue{
+			{Key: "OLD", Value: fromOld},
+			{Key: "GONE", Value: fromGone},
+		},
+	})
+	require.Nil(t, err)
+
+	keyring, err := security.NewKeyring(newKey, oldKey, security.Key{ID: security.LegacyKeyID, Secret: legacy})
+	require.Nil(t, err)
+	app := &GitSecurityApp{ctx: context.Background(), db: mdb, dbw: dbw, key: keyring}
+	rotated, err := app.rotateKey()
+	require.Nil(t, err)
+	require.Equal(t, 3, len(rotated))
+	assert.Equal(t, RotatedEnv{Collection: "customs", HookID: customID, Key: "LEGACY", FromKeyID: security.LegacyKeyID}, rotated[0])
+	assert.Equal(t, RotatedEnv{Collection: "automations", HookID: automationID, Key: "OLD", FromKeyID: "old"}, rotated[1])
+	assert.Equal(t, "GONE", rotated[2].Key)
+	assert.NotEmpty(t, rotated[2].Error)
+
+	// the values are encrypted by the new key, the ones that failed are left as they are
+	var custom config.Custom
+	require.Nil(t, mdb.Collection("customs").FindOne(context.Background(), bson.D{{Key: "_id", Value: customID}}).Decode(&custom))
+	assert.Equal(t, "new", security.KeyID(custom.Envs[0].Value))
+	assert.Equal(t, config.EnvKeyValue{Key: "REF", Ref: "env:HOOK_TOKEN"}, custom.Envs[1])
+	assert.Equal(t, config.EnvKeyValue{Key: "EMPTY"}, custom.Envs[2])
+	var automation config.Automation
+	require.Nil(t, mdb.Collection("automations").FindOne(context.Background(), bson.D{{Key: "_id", Value: automationID}}).Decode(&automation))
+	assert.Equal(t, fromGone, automation.Envs[1].Value)
+
+	onlyNew, err := security.NewKeyring(newKey)
+	require.Nil(t, err)
+	for env, plaintext := range map[string]string{custom.Envs[0].Value: "legacy", automation.Envs[0].Value: "old"} {
+		value, err := onlyNew.Decrypt(env)
+		require.Nil(t, err)
+		assert.Equal(t, plaintext, value)
+	}
+
+	// the rotated values are left alone
+	rotated, err = app.rotateKey()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(rotated))
+	assert.Equal(t, "GONE", rotated[0].Key)
+}
+
+func TestRotateHookEdited(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	oldKey := security.Key{ID: "old", Secret: []byte("abcdef0123456789abcdef0123456789")}
+	newKey := security.Key{ID: "new", Secret: []byte("456789abcdef0123456789abcdef0123")}
+	old, err := security.NewKeyring(oldKey)
+	require.Nil(t, err)
+	keyring, err := security.NewKeyring(newKey, oldKey)
+	require.Nil(t, err)
+	app := &GitSecurityApp{ctx: context.Background(), db: mdb, dbw: dbw, key: keyring}
+
+	fromOld, err := old.Encrypt("old")
+	require.Nil(t, err)
+	id := primitive.NewObjectID()
+	_, err = mdb.Collection("customs").InsertOne(context.Background(), config.Custom{
+		ID:   id,
+		Envs: []config.EnvKeyValue{{Key: "OLD", Value: fromOld}},
+	})
+	require.Nil(t, err)
+	var hook encryptedHook
+	require.Nil(t, mdb.Collection("customs").FindOne(context.Background(), bson.D{{Key: "_id", Value: id}}).Decode(&hook))
+
+	// an env is added from the API after the hook was read by the rotation
+	fromOther, err := old.Encrypt("other")
+	require.Nil(t, err)
+	_, err = mdb.Collection("customs").UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: id}},
+		bson.D{{Key: "$push", Value: bson.D{{Key: "envs", Value: config.EnvKeyValue{Key: "OTHER", Value: fromOther}}}}},
+	)
+	require.Nil(t, err)
+
+	rotated, err := app.rotateHook("customs", hook)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(rotated))
+	var custom config.Custom
+	require.Nil(t, mdb.Collection("customs").FindOne(context.Background(), bson.D{{Key: "_id", Value: id}}).Decode(&custom))
+	require.Equal(t, 2, len(custom.Envs))
+	onlyNew, err := security.NewKeyring(newKey)
+	require.Nil(t, err)
+	for idx, plaintext := range []string{"old", "other"} {
+		value, err := onlyNew.Decrypt(custom.Envs[idx].Value)
+		require.Nil(t, err)
+		assert.Equal(t, plaintext, value)
+	}
+
+	// the hook deleted meanwhile is skipped
+	_, err = mdb.Collection("customs").DeleteOne(context.Background(), bson.D{{Key: "_id", Value: id}})
+	require.Nil(t, err)
+	rotated, err = app.rotateHook("customs", hook)
+	require.Nil(t, err)
+	assert.Empty(t, rotated)
+}
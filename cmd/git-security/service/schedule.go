@@ -0,0 +1,236 @@
+package service
+
+import (
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+)
+
+// schedulerInterval is how often the scheduler looks for the hooks due or triggered
+const schedulerInterval = 15 * time.Second
+
+// scheduledHook is a custom hook or an automation the scheduler runs
+type scheduledHook struct {
+	id       primitive.ObjectID
+	schedule string
+	run      func(repoNames []string) error
+}
+
+// runScheduler runs the hooks of the type when they are due or triggered through the API
+func (app *GitSecurityApp) runScheduler(hookType string, readHooks func() ([]scheduledHook, error)) {
+loop:
+	for {
+		hooks, err := readHooks()
+		if err != nil {
+			slog.Error("error in reading the scheduled hooks", slog.String("hook_type", hookType), slog.String("error", err.Error()))
+		} else if err := app.runScheduledHooks(hookType, hooks); err != nil {
+			slog.Error("error in app.runScheduledHooks()", slog.String("hook_type", hookType), slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-app.ctx.Done():
+			break loop
+		case <-time.After(schedulerInterval):
+		}
+	}
+}
+
+func (app *GitSecurityApp) runScheduledHooks(hookType string, hooks []scheduledHook) error {
+	schedules, err := app.dbw.ReadHookSchedules(bson.D{{Key: "hook_type", Value: hookType}})
+	if err != nil {
+		return err
+	}
+	schedulesByHookID := make(map[primitive.ObjectID]*db.HookSchedule)
+	for _, s := range schedules {
+		schedulesByHookID[s.HookID] = s
+	}
+
+	for _, hook := range hooks {
+		if app.ctx.Err() != nil {
+			return nil
+		}
+
+		cronSchedule, err := config.ParseSchedule(hook.schedule)
+		if err != nil {
+			slog.Error("error in the hook schedule",
+				slog.String("hook_type", hookType),
+				slog.String("hook_id", hook.id.Hex()),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+
+		// a new hook runs right away, a changed schedule is applied from the last run
+		now := time.Now()
+		s, ok := schedulesByHookID[hook.id]
+		if !ok || s.Schedule != hook.schedule || s.NextRunAt.IsZero() {
+			nextRunAt := now
+			if ok && !s.LastRunAt.IsZero() {
+				nextRunAt = cronSchedule.Next(s.LastRunAt)
+			}
+			var prevNextRunAt time.Time
+			if ok {
+				prevNextRunAt = s.NextRunAt
+			}
+			updated, err := app.dbw.UpdateHookSchedule(hookType, hook.id, hook.schedule, prevNextRunAt, nextRunAt)
+			if err != nil {
+				return err
+			}
+			// another replica updated the schedule first, it's read again at the next tick
+			if !updated {
+				continue
+			}
+			s = &db.HookSchedule{Schedule: hook.schedule, NextRunAt: nextRunAt}
+		}
+
+		// the due run is claimed by moving the next run, the replicas that read the same
+		// schedule skip it
+		due := !s.NextRunAt.After(now)
+		if due {
+			claimed, err := app.dbw.ClaimHookScheduleRun(hookType, hook.id, s.NextRunAt, cronSchedule.Next(now))
+			if err != nil {
+				return err
+			}
+			due = claimed
+		}
+		trigger, err := app.dbw.TakeHookTrigger(hookType, hook.id)
+		if err != nil {
+			return err
+		}
+		if !due && trigger == nil {
+			continue
+		}
+
+		// the scheduled run covers all the repos, a trigger only runs the ones requested
+		var repoNames []string
+		if !due {
+			repoNames = trigger.Repos
+		}
+		slog.Info("run scheduled hook",
+			slog.String("hook_type", hookType),
+			slog.String("hook_id", hook.id.Hex()),
+			slog.Bool("triggered", trigger != nil),
+			slog.Any("repos", repoNames),
+		)
+		runErr := hook.run(repoNames)
+		if runErr != nil {
+			slog.Error("error in running the scheduled hook",
+				slog.String("hook_type", hookType),
+				slog.String("hook_id", hook.id.Hex()),
+				slog.String("error", runErr.Error()),
+			)
+		}
+
+		if err := app.dbw.UpdateHookScheduleRun(hookType, hook.id, now, runErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *GitSecurityApp) readScheduledCustoms() ([]scheduledHook, error) {
+	cursor, err := app.db.Collection("customs").Find(app.ctx, bson.D{{Key: "enabled", Value: true}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(app.ctx)
+	var customs []config.Custom
+	if err := cursor.All(app.ctx, &customs); err != nil {
+		return nil, err
+	}
+
+	// the hooks run after the ones writing the fields they depend on
+	customs, err = config.OrderCustoms(customs)
+	if err != nil {
+		slog.Error("error in config.OrderCustoms()", slog.String("error", err.Error()))
+	}
+
+	hooks := make([]scheduledHook, 0, len(customs))
+	for _, custom := range customs {
+		hooks = append(hooks, scheduledHook{
+			id:       custom.ID,
+			schedule: custom.Schedule,
+			run: func(repoNames []string) error {
+				return app.runCustom(custom, repoNames)
+			},
+		})
+	}
+	return hooks, nil
+}
+
+func (app *GitSecurityApp) readScheduledAutomations() ([]scheduledHook, error) {
+	cursor, err := app.db.Collection("automations").Find(app.ctx, bson.D{{Key: "enabled", Value: true}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(app.ctx)
+	var automations []config.Automation
+	if err := cursor.All(app.ctx, &automations); err != nil {
+		return nil, err
+	}
+
+	hooks := make([]scheduledHook, 0, len(automations))
+	for _, automation := range automations {
+		// the event-driven automations run on the repo changes only
+		if automation.EventDriven() {
+			continue
+		}
+		hooks = append(hooks, scheduledHook{
+			id:       automation.ID,
+			schedule: automation.Schedule,
+			run: func(repoNames []string) error {
+				return app.runAutomation(automation, repoNames)
+			},
+		})
+	}
+	return hooks, nil
+}
+
+// decryptEnvs returns the envs of the hook with the values decrypted and the secret
+// references resolved
+func (app *GitSecurityApp) decryptEnvs(encrypted []config.EnvKeyValue) ([]config.EnvKeyValue, error) {
+	envs := make([]config.EnvKeyValue, 0, len(encrypted))
+	for _, e := range encrypted {
+		if e.Ref != "" || e.Value == "" {
+			envs = append(envs, config.EnvKeyValue{Key: e.Key, Ref: e.Ref})
+			continue
+		}
+		v, err := app.key.Decrypt(e.Value)
+		if err != nil {
+			slog.Error(
+				"error in app.key.Decrypt()",
+				slog.String("error", err.Error()),
+				slog.String("encrypted", e.Value),
+			)
+			return nil, err
+		}
+		envs = append(envs, config.EnvKeyValue{
+			Key:   e.Key,
+			Value: v,
+		})
+	}
+	return app.resolveSecretRefs(envs)
+}
+
+// resolveSecretRefs returns the envs with the secret references resolved, only at run time
+// so that the secrets never leave the server otherwise
+func (app *GitSecurityApp) resolveSecretRefs(decrypted []config.EnvKeyValue) ([]config.EnvKeyValue, error) {
+	envs := make([]config.EnvKeyValue, 0, len(decrypted))
+	for _, e := range decrypted {
+		if e.Ref != "" {
+			v, err := app.secrets.Resolve(app.ctx, e.Ref)
+			if err != nil {
+				slog.Error("error in resolving the secret", slog.String("ref", e.Ref), slog.String("error", err.Error()))
+				return nil, err
+			}
+			e = config.EnvKeyValue{Key: e.Key, Value: v}
+		}
+		envs = append(envs, e)
+	}
+	return envs, nil
+}
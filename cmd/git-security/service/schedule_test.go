@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
+)
+
+func TestRunScheduledHooks(t *testing.T) {
+	teardown, dbw, _ := db.SetupDBForTest(t)
+	defer teardown()
+
+	require.Nil(t, dbw.CreateHookScheduleIndices())
+	app := &GitSecurityApp{ctx: context.Background(), dbw: dbw}
+	id := primitive.NewObjectID()
+	runs := [][]string{}
+	hooks := []scheduledHook{{
+		id:       id,
+		schedule: "@daily",
+		run: func(repoNames []string) error {
+			runs = append(runs, repoNames)
+			return nil
+		},
+	}}
+
+	// a new hook runs right away, then at the next schedule
+	require.Nil(t, app.runScheduledHooks(db.HookTypeCustom, hooks))
+	require.Nil(t, app.runScheduledHooks(db.HookTypeCustom, hooks))
+	assert.Equal(t, [][]string{nil}, runs)
+	schedules, err := dbw.ReadHookSchedules(bson.D{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(schedules))
+	nextRunAt := schedules[0].NextRunAt
+	assert.True(t, nextRunAt.After(time.Now()))
+	assert.False(t, schedules[0].LastRunAt.IsZero())
+
+	// a trigger runs the requested repos without moving the next run
+	require.Nil(t, dbw.TriggerHook(db.HookTypeCustom, id, []string{"org/repo"}, "alice"))
+	require.Nil(t, app.runScheduledHooks(db.HookTypeCustom, hooks))
+	require.Nil(t, app.runScheduledHooks(db.HookTypeCustom, hooks))
+	assert.Equal(t, [][]string{nil, {"org/repo"}}, runs)
+	schedules, err = dbw.ReadHookSchedules(bson.D{})
+	require.Nil(t, err)
+	assert.True(t, nextRunAt.Equal(schedules[0].NextRunAt))
+
+	// a changed schedule is applied from the last run
+	hooks[0].schedule = "@every 1s"
+	time.Sleep(1100 * time.Millisecond)
+	require.Nil(t, app.runScheduledHooks(db.HookTypeCustom, hooks))
+	assert.Equal(t, 3, len(runs))
+
+	// an invalid schedule is skipped
+	hooks[0].schedule = "invalid"
+	require.Nil(t, app.runScheduledHooks(db.HookTypeCustom, hooks))
+	assert.Equal(t, 3, len(runs))
+
+	// the replicas run a due hook once
+	var replicaRuns atomic.Int32
+	replicaHooks := []scheduledHook{{
+		id:       primitive.NewObjectID(),
+		schedule: "@daily",
+		run: func(repoNames []string) error {
+			replicaRuns.Add(1)
+			return nil
+		},
+	}}
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, app.runScheduledHooks(db.HookTypeAutomation, replicaHooks))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), replicaRuns.Load())
+}
+
+func TestDecryptEnvs(t *testing.T) {
+	// a stand-in for a Vault KV engine of version 2
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/hooks":
+			w.Write([]byte(`{"data": {"data": {"token": "from-vault"}, "metadata": {"version": 1}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+
+	dir, other := t.TempDir(), t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "token"), []byte("from-file\n"), 0600))
+	require.Nil(t, os.WriteFile(filepath.Join(other, "token"), []byte("outside"), 0600))
+	require.Nil(t, os.Symlink(filepath.Join(other, "token"), filepath.Join(dir, "link")))
+	t.Setenv("HOOK_TOKEN", "from-env")
+	t.Setenv("GIT_SECURITY_KEY", "server-secret")
+
+	key, err := security.NewKeyring(security.Key{ID: "test", Secret: []byte("0123456789abcdef0123456789abcdef")})
+	require.Nil(t, err)
+	app := &GitSecurityApp{
+		ctx:     context.Background(),
+		key:     key,
+		secrets: security.NewSecretResolver([]string{dir}, []string{"HOOK_*"}, vault.URL, "vault-token"),
+	}
+	encrypted, err := key.Encrypt("plain")
+	require.Nil(t, err)
+
+	envs, err := app.decryptEnvs([]config.EnvKeyValue{
+		{Key: "PLAIN", Value: encrypted},
+		{Key: "FILE", Ref: "file:" + filepath.Join(dir, "token")},
+		{Key: "ENV", Ref: "env:HOOK_TOKEN"},
+		{Key: "VAULT", Ref: "vault:secret/data/hooks#token"},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []config.EnvKeyValue{
+		{Key: "PLAIN", Value: "plain"},
+		{Key: "FILE", Value: "from-file"},
+		{Key: "ENV", Value: "from-env"},
+		{Key: "VAULT", Value: "from-vault"},
+	}, envs)
+
+	// the secrets of the server and the files out of the allowed directories can't be read
+	for _, ref := range []string{
+		"env:GIT_SECURITY_KEY",
+		"env:HOOK_MISSING",
+		"file:" + filepath.Join(other, "token"),
+		"file:" + filepath.Join(dir, "link"),
+		"file:" + filepath.Join(dir, "..", filepath.Base(other), "token"),
+		"vault:secret/data/hooks#missing",
+		"vault:secret/data/missing#token",
+		"unknown:ref",
+	} {
+		_, err := app.decryptEnvs([]config.EnvKeyValue{{Key: "SECRET", Ref: ref}})
+		assert.NotNil(t, err, ref)
+	}
+}
@@ -3,7 +3,6 @@ package service
 import (
 	"context"
 	"crypto/tls"
-	"encoding/base64"
 	"fmt"
 	"log/slog"
 	"os"
@@ -21,7 +20,9 @@ import (
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/api"
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
 	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/executor"
 	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/security"
 )
 
 const (
@@ -30,28 +31,50 @@ const (
 )
 
 type Opts struct {
-	GitHub            *flag.GitHubOpts
-	Http              *flag.HttpOpts
-	Https             *flag.HttpsOpts
-	Postgres          *flag.PostgresOpts
-	Mongo             *flag.MongoOpts
-	Okta              *flag.OktaOpts
-	Key               string
-	CACert            string
-	DB                string
-	AdminUsernames    []string
-	AdminPasswords    []string
-	IgnoredCommitters []string
+	GitHub              *flag.GitHubOpts
+	Http                *flag.HttpOpts
+	Https               *flag.HttpsOpts
+	Postgres            *flag.PostgresOpts
+	Mongo               *flag.MongoOpts
+	Okta                *flag.OktaOpts
+	OktaGroupsClaim     string
+	Key                 string
+	Keyring             []string
+	CACert              string
+	DB                  string
+	AdminUsernames      []string
+	AdminPasswords      []string
+	IgnoredCommitters   []string
+	Debug               bool
+	Executor            string
+	AllowSubprocess     bool
+	KubernetesNamespace string
+	HookRunRetention    time.Duration
+	SnapshotRetention   time.Duration
+	HookTimeout         time.Duration
+	HookParallelism     int
+	ImageAllowlist      []string
+	RegistryAuthFile    string
+	SecretDirs          []string
+	SecretEnvs          []string
+	VaultAddr           string
+	VaultToken          string
 }
 
 type GitSecurityApp struct {
 	interruptible.Service
-	ctx  context.Context
-	opts *Opts
-	db   *mongo.Database
-	dbw  db.Database
-	g    gh.GitHub
-	key  []byte
+	ctx       context.Context
+	opts      *Opts
+	db        *mongo.Database
+	dbw       db.Database
+	sessions  *db.SessionStorage
+	g         gh.GitHub
+	key       *security.Keyring
+	executors map[string]executor.Executor
+	// registries checks the images of the hooks and holds the credentials of their registries
+	registries *executor.Registries
+	// secrets resolves the secret references of the hook envs
+	secrets *security.SecretResolver
 }
 
 func New(opts *Opts) *GitSecurityApp {
@@ -71,76 +94,56 @@ func (app *GitSecurityApp) Run() (interruptible.Stop, error) {
 
 	var wg sync.WaitGroup
 
-	uri := app.opts.Mongo.GetURI()
+	if err := app.connect(ctx, &wg); err != nil {
+		cancel()
+		return nil, err
+	}
 
-	if app.opts.DB != "mongo" {
-		os.Mkdir(app.opts.DB, os.ModePerm)
-		f, err := ferretdb.New(&ferretdb.Config{
-			Listener: ferretdb.ListenerConfig{
-				TCP: "127.0.0.1:27017",
-			},
-			Handler:   app.opts.DB,
-			SQLiteURL: "file:sqlite/",
-			PostgreSQLURL: fmt.Sprintf(
-				"postgres://%s:%s@%s:%d/%s",
-				app.opts.Postgres.PostgresUsername,
-				app.opts.Postgres.PostgresPassword,
-				app.opts.Postgres.PostgresHost,
-				app.opts.Postgres.PostgresPort,
-				app.opts.Postgres.PostgresDBName,
-			),
-			Logger: slog.New(slog.NewJSONHandler(os.Stdout, nil)),
-		})
-		if err != nil {
+	// local users for the basic auth
+	if !app.opts.Okta.IsEnabled() {
+		if err := api.SeedLocalUsers(
+			ctx, app.db, app.opts.AdminUsernames, app.opts.AdminPasswords, app.opts.Debug); err != nil {
 			cancel()
 			return nil, err
 		}
+	}
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if err := f.Run(ctx); err != nil {
-				slog.Error("error in running FerretDB", slog.String("error", err.Error()))
-			}
-		}()
+	// create default columns
+	app.createDefaultColumns()
 
-		uri = f.MongoDBURI()
+	// the repos fetched before the snapshots existed
+	if err := app.dbw.CreateMissingRepoSnapshots(); err != nil {
+		slog.Error("error in app.dbw.CreateMissingRepoSnapshots()", slog.String("error", err.Error()))
 	}
-
-	m, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
-	if err != nil {
-		cancel()
-		return nil, err
+	if err := app.dbw.DeleteRepoSnapshotQueries(); err != nil {
+		slog.Error("error in app.dbw.DeleteRepoSnapshotQueries()", slog.String("error", err.Error()))
 	}
 
-	app.db = m.Database("public")
-	app.dbw = db.New(app.ctx, app.db)
-
-	// create indices
-	if err := app.createIndices(ctx); err != nil {
+	// setup github clients
+	var err error
+	app.g, err = gh.New(ctx, app.opts.GitHub.Host, app.opts.GitHub.PAT, app.opts.CACert, app.opts.IgnoredCommitters)
+	if err != nil {
 		cancel()
 		return nil, err
 	}
 
-	// create default columns
-	app.createDefaultColumns()
-
-	// setup github clients
-	app.g, err = gh.New(ctx, app.opts.GitHub.Host, app.opts.GitHub.PAT, app.opts.CACert, app.opts.IgnoredCommitters)
+	app.key, err = security.ParseKeyring(app.opts.Key, app.opts.Keyring)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
+	app.secrets = security.NewSecretResolver(app.opts.SecretDirs, app.opts.SecretEnvs, app.opts.VaultAddr, app.opts.VaultToken)
 
-	app.key, err = base64.StdEncoding.DecodeString(app.opts.Key)
-	if err != nil {
+	// executors of the custom hooks and automations
+	if err := app.setupExecutors(); err != nil {
 		cancel()
 		return nil, err
 	}
 
 	// web server
 	fiberApp := api.NewFiberApp(
-		ctx, app.db, app.dbw, app.g, app.key, app.opts.AdminUsernames, app.opts.AdminPasswords, app.opts.Okta)
+		ctx, app.db, app.dbw, app.g, app.key, app.sessions, app.opts.AdminUsernames,
+		app.opts.Okta, app.opts.OktaGroupsClaim, app, app.registries, app.executorNames())
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -199,62 +202,53 @@ func (app *GitSecurityApp) Run() (interruptible.Stop, error) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		app.runScheduler(db.HookTypeCustom, app.readScheduledCustoms)
+	}()
 
-		if err := app.runCustom(); err != nil {
-			slog.Error("error in app.runCustom()", slog.String("error", err.Error()))
-		}
+	// run automation logics
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.runScheduler(db.HookTypeAutomation, app.readScheduledAutomations)
+	}()
 
-	loop:
-		for {
-			select {
-			case <-app.ctx.Done():
-				break loop
-			case <-time.After(5 * time.Minute):
-				if err := app.runCustom(); err != nil {
-					slog.Error("error in app.runCustom()", slog.String("error", err.Error()))
-				}
-			}
-		}
+	// run event-driven automations
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.runEventAutomations()
 	}()
 
-	// run automation logics
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
-		if err := app.runAutomation(); err != nil {
-			slog.Error("error in app.runAutomation()", slog.String("error", err.Error()))
-		}
+		app.deleteOldData()
 
 	loop:
 		for {
 			select {
 			case <-app.ctx.Done():
 				break loop
-			case <-time.After(5 * time.Minute):
-				if err := app.runAutomation(); err != nil {
-					slog.Error("error in app.runAutomation()", slog.String("error", err.Error()))
-				}
+			case <-time.After(deleteOldDataInterval):
+				app.deleteOldData()
 			}
 		}
 	}()
 
+	// clean up the expired sessions
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
-		if err := app.deleteOldRepos(oldRepos); err != nil {
-			slog.Error("error in app.runCustom()", slog.String("error", err.Error()))
-		}
-
 	loop:
 		for {
 			select {
 			case <-app.ctx.Done():
 				break loop
-			case <-time.After(deleteOldDataInterval):
-				if err := app.deleteOldRepos(oldRepos); err != nil {
-					slog.Error("error in app.runCustom()", slog.String("error", err.Error()))
+			case <-time.After(time.Hour):
+				if err := app.sessions.DeleteExpiredSessions(); err != nil {
+					slog.Error("error in app.sessions.DeleteExpiredSessions()", slog.String("error", err.Error()))
 				}
 			}
 		}
@@ -272,6 +266,56 @@ func (app *GitSecurityApp) Run() (interruptible.Stop, error) {
 	}, nil
 }
 
+// connect starts the embedded FerretDB if needed and connects to the database
+func (app *GitSecurityApp) connect(ctx context.Context, wg *sync.WaitGroup) error {
+	uri := app.opts.Mongo.GetURI()
+
+	if app.opts.DB != "mongo" {
+		os.Mkdir(app.opts.DB, os.ModePerm)
+		f, err := ferretdb.New(&ferretdb.Config{
+			Listener: ferretdb.ListenerConfig{
+				TCP: "127.0.0.1:27017",
+			},
+			Handler:   app.opts.DB,
+			SQLiteURL: "file:sqlite/",
+			PostgreSQLURL: fmt.Sprintf(
+				"postgres://%s:%s@%s:%d/%s",
+				app.opts.Postgres.PostgresUsername,
+				app.opts.Postgres.PostgresPassword,
+				app.opts.Postgres.PostgresHost,
+				app.opts.Postgres.PostgresPort,
+				app.opts.Postgres.PostgresDBName,
+			),
+			Logger: slog.New(slog.NewJSONHandler(os.Stdout, nil)),
+		})
+		if err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f.Run(ctx); err != nil {
+				slog.Error("error in running FerretDB", slog.String("error", err.Error()))
+			}
+		}()
+
+		uri = f.MongoDBURI()
+	}
+
+	m, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return err
+	}
+
+	app.db = m.Database("public")
+	app.dbw = db.New(app.ctx, app.db)
+	app.sessions = db.NewSessionStorage(app.ctx, app.db)
+
+	// create indices
+	return app.createIndices(ctx)
+}
+
 func (app *GitSecurityApp) createIndices(ctx context.Context) error {
 	for _, idxToCreate := range []string{"id", "is_archived", "owner.login", "primary_language.name"} {
 		slog.Info(
@@ -308,6 +352,38 @@ func (app *GitSecurityApp) createIndices(ctx context.Context) error {
 			return err
 		}
 	}
+	for _, idxToCreate := range []string{"username"} {
+		if _, err := app.db.Collection("grouproles").Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.M{idxToCreate: 1},
+			Options: &options.IndexOptions{Unique: func(b bool) *bool { return &b }(true)},
+		}); err != nil {
+			return err
+		}
+	}
+	for _, idxToCreate := range []string{"name"} {
+		if _, err := app.db.Collection("roles").Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.M{idxToCreate: 1},
+			Options: &options.IndexOptions{Unique: func(b bool) *bool { return &b }(true)},
+		}); err != nil {
+			return err
+		}
+	}
+	for _, idxToCreate := range []string{"username"} {
+		if _, err := app.db.Collection("localusers").Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.M{idxToCreate: 1},
+			Options: &options.IndexOptions{Unique: func(b bool) *bool { return &b }(true)},
+		}); err != nil {
+			return err
+		}
+	}
+	for _, idxToCreate := range []string{"hash"} {
+		if _, err := app.db.Collection("tokens").Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.M{idxToCreate: 1},
+			Options: &options.IndexOptions{Unique: func(b bool) *bool { return &b }(true)},
+		}); err != nil {
+			return err
+		}
+	}
 	for _, idxToCreate := range []string{"username", "start", "end"} {
 		if _, err := app.db.Collection("logged").Indexes().CreateOne(ctx, mongo.IndexModel{
 			Keys: bson.M{idxToCreate: -1},
@@ -320,6 +396,30 @@ func (app *GitSecurityApp) createIndices(ctx context.Context) error {
 		return err
 	}
 
+	if err := app.dbw.CreateAuditLogIndices(); err != nil {
+		return err
+	}
+
+	if err := app.dbw.CreateHookScheduleIndices(); err != nil {
+		return err
+	}
+
+	if err := app.dbw.CreateHookRunIndices(); err != nil {
+		return err
+	}
+
+	if err := app.dbw.CreateHookCacheIndices(); err != nil {
+		return err
+	}
+
+	if err := app.dbw.CreateRepoSnapshotIndices(); err != nil {
+		return err
+	}
+
+	if err := app.sessions.CreateIndices(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -578,8 +678,7 @@ func (app *GitSecurityApp) fetch() error {
 			for _, automation := range automations {
 				if proceedWithRightCondition(repo, automation) &&
 					automation.Enabled &&
-					len(automation.Image) > 0 &&
-					len(automation.Command) > 0 {
+					app.automationRunnable(automation) {
 					automationsCount += 1
 				}
 			}
@@ -595,6 +694,24 @@ func (app *GitSecurityApp) fetch() error {
 	return nil
 }
 
+// deleteOldData removes the repos gone from GitHub, and the hook runs and the repo snapshots
+// past their retention, a retention of 0 keeps them forever
+func (app *GitSecurityApp) deleteOldData() {
+	if err := app.deleteOldRepos(oldRepos); err != nil {
+		slog.Error("error in app.runCustom()", slog.String("error", err.Error()))
+	}
+	if app.opts.HookRunRetention > 0 {
+		if err := app.dbw.DeleteHookRuns(time.Now().Add(-app.opts.HookRunRetention)); err != nil {
+			slog.Error("error in app.dbw.DeleteHookRuns()", slog.String("error", err.Error()))
+		}
+	}
+	if app.opts.SnapshotRetention > 0 {
+		if err := app.dbw.DeleteRepoSnapshots(time.Now().Add(-app.opts.SnapshotRetention)); err != nil {
+			slog.Error("error in app.dbw.DeleteRepoSnapshots()", slog.String("error", err.Error()))
+		}
+	}
+}
+
 func (app *GitSecurityApp) deleteOldRepos(oldRepos int) error {
 	return app.dbw.DeleteRepositories(time.Now().AddDate(0, 0, oldRepos))
 }
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+// targetedRepos returns the repos matched by the filters of a hook by ID, among the named ones
+// if any. It is nil when the hook has no filters and targets all the repos.
+func (app *GitSecurityApp) targetedRepos(repoNames []string, repoFilters []config.Filter) (map[string]*gh.Repository, error) {
+	if len(repoFilters) == 0 {
+		return nil, nil
+	}
+	filters, err := config.HookFilters(repoNames, repoFilters)
+	if err != nil {
+		return nil, err
+	}
+	repos, err := app.dbw.ReadRepositories(filters)
+	if err != nil {
+		return nil, err
+	}
+	targeted := make(map[string]*gh.Repository, len(repos))
+	for _, repo := range repos {
+		targeted[repo.ID] = repo
+	}
+	return targeted, nil
+}
+
+// mergeRepos adds the targeted repos missing from the repos, like the archived ones selected
+// by a filter
+func mergeRepos(repos []*gh.Repository, targeted map[string]*gh.Repository) []*gh.Repository {
+	ids := make(map[string]bool, len(repos))
+	for _, repo := range repos {
+		ids[repo.ID] = true
+	}
+	for id, repo := range targeted {
+		if !ids[id] {
+			repos = append(repos, repo)
+		}
+	}
+	return repos
+}
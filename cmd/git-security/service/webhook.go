@@ -0,0 +1,232 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+const (
+	webhookExecutor = "webhook"
+	// maxWebhookBackoff caps the wait between the retries of a webhook
+	maxWebhookBackoff = time.Minute
+)
+
+// webhookBackoff is the wait before the first retry of a webhook, doubled at each retry
+var webhookBackoff = time.Second
+
+// webhookData is given to the payload and header templates of a webhook, the change is nil
+// for the scheduled runs
+type webhookData struct {
+	Repo   map[string]interface{}
+	Change *db.ChangeLog
+	Score  []gh.ScoreHit
+	Env    map[string]string
+}
+
+// runWebhook POSTs the payload of the webhook automation for the repo, the failed requests
+// are retried with an exponential backoff. The run is recorded with the last response.
+func (app *GitSecurityApp) runWebhook(
+	automation config.Automation,
+	repo *gh.Repository,
+	change *db.ChangeLog,
+	envs []config.EnvKeyValue,
+) error {
+	run := &db.HookRun{
+		HookType:  db.HookTypeAutomation,
+		HookID:    automation.ID,
+		Repo:      repo.NameWithOwner,
+		Executor:  webhookExecutor,
+		StartedAt: time.Now(),
+	}
+	err := app.postWebhook(run, automation, repo, change, envs)
+	run.EndedAt = time.Now()
+	if err != nil {
+		run.Error = err.Error()
+	}
+	app.recordHookRun(run, envs, nil)
+	return err
+}
+
+// webhookRequest is the request of a webhook with its rendered payload and headers
+type webhookRequest struct {
+	URL     string
+	Headers map[string]string
+	Payload string
+}
+
+func (app *GitSecurityApp) postWebhook(
+	run *db.HookRun,
+	automation config.Automation,
+	repo *gh.Repository,
+	change *db.ChangeLog,
+	envs []config.EnvKeyValue,
+) error {
+	webhook := automation.Webhook
+	req, err := app.renderWebhook(webhook, repo, change, envs)
+	if err != nil {
+		return err
+	}
+
+	ctx := app.ctx
+	timeout := app.hookTimeout(automation.HookLimits)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(app.ctx, timeout)
+		defer cancel()
+	}
+
+	var attempts strings.Builder
+	defer func() {
+		run.Stderr = attempts.String()
+	}()
+	client := resty.New()
+	backoff := webhookBackoff
+	for {
+		run.Attempts++
+		resp, err := client.R().
+			SetContext(ctx).
+			SetHeaders(req.Headers).
+			SetBody(req.Payload).
+			Post(req.URL)
+		retry := false
+		if err != nil {
+			fmt.Fprintf(&attempts, "attempt %d: %s\n", run.Attempts, err.Error())
+			retry = ctx.Err() == nil
+		} else {
+			fmt.Fprintf(&attempts, "attempt %d: %s\n", run.Attempts, resp.Status())
+			run.ResponseStatus = resp.StatusCode()
+			run.Stdout = string(resp.Body())
+			if resp.IsSuccess() {
+				return nil
+			}
+			retry = resp.StatusCode() == 429 || resp.StatusCode() >= 500
+			err = fmt.Errorf("the webhook responded %s", resp.Status())
+		}
+
+		if !retry || run.Attempts > webhook.Retries {
+			return webhookError(ctx, run, timeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return webhookError(ctx, run, timeout, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxWebhookBackoff)
+	}
+}
+
+// renderWebhook renders the payload and the headers of the webhook for the repo, the payload
+// is signed with the HMAC env if any
+func (app *GitSecurityApp) renderWebhook(
+	webhook config.AutomationWebhook,
+	repo *gh.Repository,
+	change *db.ChangeLog,
+	envs []config.EnvKeyValue,
+) (*webhookRequest, error) {
+	data, err := app.webhookData(repo, change, envs)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadTemplate := webhook.Payload
+	if payloadTemplate == "" {
+		payloadTemplate = config.DefaultWebhookPayload
+	}
+	payload, err := renderWebhookTemplate("payload", payloadTemplate, data)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	for _, h := range webhook.Headers {
+		if headers[h.Key], err = renderWebhookTemplate(h.Key, h.Value, data); err != nil {
+			return nil, err
+		}
+	}
+	if webhook.HMACEnv != "" {
+		secret, ok := data.Env[webhook.HMACEnv]
+		if !ok {
+			return nil, fmt.Errorf("the HMAC env %s is not set", webhook.HMACEnv)
+		}
+		header := webhook.HMACHeader
+		if header == "" {
+			header = config.DefaultWebhookHMACHeader
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(payload))
+		headers[header] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return &webhookRequest{URL: webhook.URL, Headers: headers, Payload: payload}, nil
+}
+
+// webhookError returns the error of the last attempt, or the timeout of the hook
+func webhookError(ctx context.Context, run *db.HookRun, timeout time.Duration, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		run.TimedOut = true
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
+
+// webhookData returns the data of the templates, the repo as in GIT_REPO_JSON and its score
+func (app *GitSecurityApp) webhookData(repo *gh.Repository, change *db.ChangeLog, envs []config.EnvKeyValue) (*webhookData, error) {
+	b, err := json.Marshal(repo)
+	if err != nil {
+		return nil, err
+	}
+	data := &webhookData{
+		Change: change,
+		Env:    make(map[string]string, len(envs)),
+	}
+	if err := json.Unmarshal(b, &data.Repo); err != nil {
+		return nil, err
+	}
+	for _, e := range envs {
+		data.Env[e.Key] = e.Value
+	}
+
+	gs := config.GlobalSettings{
+		ScoreColors:  make([]config.ScoreColor, 0),
+		ScoreWeights: make([]config.ScoreWeight, 0),
+	}
+	if err := app.db.Collection("globalSettings").FindOne(
+		app.ctx,
+		bson.D{},
+	).Decode(&gs); err != nil {
+		if err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+	}
+	if data.Score, err = repo.ScoreBreakdown(&gs); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func renderWebhookTemplate(name, text string, data *webhookData) (string, error) {
+	t, err := template.New(name).Funcs(config.WebhookTemplateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
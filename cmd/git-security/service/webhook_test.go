@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/config"
+	"github.com/PaloAltoNetworks/git-security/cmd/git-security/db"
+	gh "github.com/PaloAltoNetworks/git-security/cmd/git-security/github"
+)
+
+func TestRunWebhook(t *testing.T) {
+	teardown, dbw, mdb := db.SetupDBForTest(t)
+	defer teardown()
+
+	webhookBackoff = 10 * time.Millisecond
+	app := &GitSecurityApp{
+		ctx:  context.Background(),
+		opts: &Opts{HookTimeout: time.Minute},
+		db:   mdb,
+		dbw:  dbw,
+	}
+	_, err := mdb.Collection("globalSettings").InsertOne(app.ctx, config.GlobalSettings{
+		ScoreWeights: []config.ScoreWeight{{Weight: 10, Field: "is_archived", Comparator: "==", Arg: "false"}},
+	})
+	require.Nil(t, err)
+
+	// the first attempt fails
+	var calls int
+	var body []byte
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ = io.ReadAll(r.Body)
+		headers = r.Header
+		w.Write([]byte("received by secret-token"))
+	}))
+	defer server.Close()
+
+	automation := config.Automation{
+		ID:   primitive.NewObjectID(),
+		Kind: config.AutomationKindWebhook,
+		Webhook: config.AutomationWebhook{
+			URL:     server.URL,
+			Payload: `{"repo": "{{ .Repo.full_name }}", "to": "{{ .Change.To }}", "score": {{ json .Score }}}`,
+			Headers: []config.EnvKeyValue{{Key: "Authorization", Value: "Bearer {{ .Env.TOKEN }}"}},
+			HMACEnv: "HMAC_SECRET",
+			Retries: 2,
+		},
+	}
+	envs := []config.EnvKeyValue{{Key: "TOKEN", Value: "secret-token"}, {Key: "HMAC_SECRET", Value: "hmac-secret"}}
+	repo := &gh.Repository{GqlRepository: &gh.GqlRepository{NameWithOwner: "org/repo"}}
+	change := &db.ChangeLog{Field: "AllowsForcePushes", From: "false", To: "true"}
+	require.Nil(t, app.runWebhook(automation, repo, change, envs))
+
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, `{"repo": "org/repo", "to": "true", "score": [{"weight":10,"field":"is_archived","comparator":"==","arg":"false","hit":true}]}`, string(body))
+	assert.Equal(t, "Bearer secret-token", headers.Get("Authorization"))
+	mac := hmac.New(sha256.New, []byte("hmac-secret"))
+	mac.Write(body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), headers.Get(config.DefaultWebhookHMACHeader))
+
+	runs, err := dbw.ReadHookRuns(bson.D{}, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(runs))
+	run, err := dbw.ReadHookRun(runs[0].ID)
+	require.Nil(t, err)
+	assert.Equal(t, "webhook", run.Executor)
+	assert.Equal(t, 2, run.Attempts)
+	assert.Equal(t, 200, run.ResponseStatus)
+	assert.Equal(t, "received by [REDACTED]", run.Stdout)
+	assert.Equal(t, "attempt 1: 503 Service Unavailable\nattempt 2: 200 OK\n", run.Stderr)
+
+	// the client errors aren't retried
+	calls = 0
+	automation.Webhook.URL = server.URL + "/missing"
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNotFound)
+	})
+	assert.EqualError(t, app.runWebhook(automation, repo, change, envs), "the webhook responded 404 Not Found")
+	assert.Equal(t, 1, calls)
+}
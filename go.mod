@@ -7,6 +7,7 @@ require (
 	github.com/IGLOU-EU/go-wildcard/v2 v2.0.2
 	github.com/casbin/casbin/v2 v2.99.0
 	github.com/casbin/mongodb-adapter/v3 v3.7.0
+	github.com/distribution/reference v0.6.0
 	github.com/docker/docker v27.2.1+incompatible
 	github.com/eekwong/go-common-flags v0.0.0-20240315040634-2ecee3d5a43f
 	github.com/eekwong/go-interruptible-service v0.1.0
@@ -20,6 +21,7 @@ require (
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51
 	github.com/okta/okta-jwt-verifier-golang v1.3.1
 	github.com/r3labs/diff/v3 v3.0.1
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/shurcooL/githubv4 v0.0.0-20240727222349-48295856cce7
 	github.com/spf13/cast v1.7.0
 	github.com/stretchr/testify v1.9.0
@@ -27,6 +29,7 @@ require (
 	github.com/urfave/cli/v2 v2.27.4
 	github.com/xissy/lexorank v0.0.1
 	go.mongodb.org/mongo-driver v1.16.1
+	golang.org/x/crypto v0.27.0
 	golang.org/x/oauth2 v0.23.0
 	golang.org/x/sync v0.8.0
 )
@@ -47,7 +50,6 @@ require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.4 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.3.0 // indirect
-	github.com/distribution/reference v0.6.0 // indirect
 	github.com/docker/go-connections v0.5.0 // indirect
 	github.com/docker/go-units v0.5.0 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
@@ -117,7 +119,6 @@ require (
 	go.opentelemetry.io/otel/sdk v1.29.0 // indirect
 	go.opentelemetry.io/otel/trace v1.29.0 // indirect
 	go.opentelemetry.io/proto/otlp v1.3.1 // indirect
-	golang.org/x/crypto v0.27.0 // indirect
 	golang.org/x/exp v0.0.0-20240909161429-701f63a606c0 // indirect
 	golang.org/x/net v0.29.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect